@@ -6,6 +6,8 @@ type IModel interface {
 	Configure(rasterBuffer IRasterBuffer)
 	Reset()
 	Step() bool
-	SendEvent(string)
+	// SendEvent passes a model command, returning an error if the model
+	// rejects it.
+	SendEvent(string) error
 	Name() string
 }
@@ -0,0 +1,10 @@
+package api
+
+import "image/color"
+
+// IPalette is implemented by models that draw their cells in a fixed
+// set of state colors, so recordings can use those colors exactly.
+type IPalette interface {
+	// Palette returns the state colors.
+	Palette() color.Palette
+}
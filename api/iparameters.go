@@ -0,0 +1,7 @@
+package api
+
+// IParameters is implemented by models whose parameters can be set by
+// name with a SetCommand.
+type IParameters interface {
+	SetParameter(name string, value float64) error
+}
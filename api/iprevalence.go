@@ -0,0 +1,7 @@
+package api
+
+// IPrevalence is implemented by models that can report the fraction of
+// cells infected, so runs can stop on prevalence.
+type IPrevalence interface {
+	Prevalence() float64
+}
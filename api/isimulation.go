@@ -1,8 +1,13 @@
 package api
 
+import "context"
+
 // ISimulation is simulation host
 type ISimulation interface {
 	Initialize(rasterBuffer IRasterBuffer, surface ISurface)
 	Configure(model IModel)
-	Start(inChan chan string, outChan chan string)
+	// SetDataRoot sets the directory exports and recordings are
+	// written under.
+	SetDataRoot(root string)
+	Start(ctx context.Context, inChan <-chan Command, outChan chan<- Event)
 }
@@ -0,0 +1,10 @@
+package api
+
+// ISnapshot is implemented by models whose state can be saved and
+// restored, so a new run can branch from an earlier step.
+type ISnapshot interface {
+	// Snapshot returns the model's state.
+	Snapshot() []byte
+	// Restore sets the model's state from a snapshot and redraws it.
+	Restore(snapshot []byte) error
+}
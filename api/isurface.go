@@ -1,12 +1,16 @@
 package api
 
+import "context"
+
 // ISurface is the graph viewer
 type ISurface interface {
 	// Open(IHost)
 	Open(IModel)
 	Close()
 
-	Run(chToSim, chFromSim chan string)
+	// Run polls events and renders until ctx is cancelled or Quit is
+	// called.
+	Run(ctx context.Context, chToSim chan<- Command)
 	Quit()
 
 	SetFont(fontPath string, size int) error
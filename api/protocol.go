@@ -0,0 +1,267 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// CommandKind identifies what a Command asks the simulation to do.
+type CommandKind int
+
+const (
+	// RunCommand resets the model and runs it until it finishes or
+	// Until is met.
+	RunCommand CommandKind = iota
+	StepCommand
+	PauseCommand
+	ResumeCommand
+	ResetCommand
+	StopCommand
+	StatusCommand
+	ExitCommand
+	// SetCommand sets the model parameter Name to Value.
+	SetCommand
+	// AdjustCommand nudges the model parameter Name up (Value > 0) or
+	// down (Value < 0) by the model's step size.
+	AdjustCommand
+	// MouseCommand reports a mouse Action ("down", "up" or "drag") at
+	// cell Col,Row.
+	MouseCommand
+	// ModelCommand passes Args to the model as a model specific
+	// command, e.g. "kc add 100 100 2".
+	ModelCommand
+	// SpeedCommand sets the target rate to Value steps per second. 0
+	// runs as fast as possible.
+	SpeedCommand
+	// RenderCommand renders every Value-th step while running.
+	RenderCommand
+	// FrameCommand moves Value frames through the history, back if
+	// negative. It pauses a running simulation.
+	FrameCommand
+	// LiveCommand returns from the history to the newest frame.
+	LiveCommand
+	// BranchCommand restores the model to the frame shown and drops
+	// the later frames. Resuming starts a new run from there.
+	BranchCommand
+	// HistoryCommand keeps Value frames in memory and spills up to
+	// Spill older ones to disk.
+	HistoryCommand
+	// RecordCommand records every Value-th frame rendered in format
+	// Name, "png", "gif", "y4m" or "rgb", each frame shown for Delay
+	// 100ths of a second. Name "off" stops recording.
+	RecordCommand
+)
+
+var commandNames = []string{"run", "step", "pause", "resume", "reset", "stop", "status", "exit", "set", "adjust", "mouse", "model", "speed", "render", "frame", "live", "branch", "history", "record"}
+
+func (k CommandKind) String() string {
+	if int(k) < len(commandNames) {
+		return commandNames[k]
+	}
+	return fmt.Sprintf("command(%d)", int(k))
+}
+
+// Command is a request sent to the simulation. Every command is
+// answered by exactly one Event carrying the command's ID.
+type Command struct {
+	ID   int64
+	Kind CommandKind
+
+	// SetCommand, AdjustCommand and RecordCommand
+	Name  string
+	Value float64
+
+	// MouseCommand
+	Action   string
+	Button   int
+	Col, Row int
+
+	// ModelCommand
+	Args []string
+
+	// RunCommand
+	Until Until
+
+	// HistoryCommand
+	Spill int
+
+	// RecordCommand. 0 keeps the delay set before.
+	Delay int
+}
+
+// Until says when a run stops before the model finishes. Zero fields
+// are ignored.
+type Until struct {
+	// Steps stops the run after this many steps.
+	Steps int
+	// Prevalence stops the run once the infected fraction reaches it.
+	Prevalence float64
+	// Extinct stops the run once nothing is infected.
+	Extinct bool
+}
+
+// IsZero reports whether the run only stops when the model finishes.
+func (u Until) IsZero() bool {
+	return u == Until{}
+}
+
+func (u Until) String() string {
+	conditions := []string{}
+	if u.Steps > 0 {
+		conditions = append(conditions, fmt.Sprintf("%d steps", u.Steps))
+	}
+	if u.Prevalence > 0 {
+		conditions = append(conditions, fmt.Sprintf("prevalence %g", u.Prevalence))
+	}
+	if u.Extinct {
+		conditions = append(conditions, "extinction")
+	}
+	return strings.Join(conditions, " or ")
+}
+
+var lastCommandID int64
+
+// NewCommand returns a command with an ID unique to this process so
+// replies can be matched whichever client sent it.
+func NewCommand(kind CommandKind) Command {
+	return Command{ID: atomic.AddInt64(&lastCommandID, 1), Kind: kind}
+}
+
+func NewRunCommand(until Until) Command {
+	c := NewCommand(RunCommand)
+	c.Until = until
+	return c
+}
+
+func NewFrameCommand(frames int) Command {
+	c := NewCommand(FrameCommand)
+	c.Value = float64(frames)
+	return c
+}
+
+func NewHistoryCommand(memory, spill int) Command {
+	c := NewCommand(HistoryCommand)
+	c.Value = float64(memory)
+	c.Spill = spill
+	return c
+}
+
+func NewRecordCommand(format string, every, delay int) Command {
+	c := NewCommand(RecordCommand)
+	c.Name = format
+	c.Value = float64(every)
+	c.Delay = delay
+	return c
+}
+
+func NewSetCommand(name string, value float64) Command {
+	c := NewCommand(SetCommand)
+	c.Name = name
+	c.Value = value
+	return c
+}
+
+func NewAdjustCommand(name string, direction float64) Command {
+	c := NewCommand(AdjustCommand)
+	c.Name = name
+	c.Value = direction
+	return c
+}
+
+func NewMouseCommand(action string, button, col, row int) Command {
+	c := NewCommand(MouseCommand)
+	c.Action = action
+	c.Button = button
+	c.Col = col
+	c.Row = row
+	return c
+}
+
+func NewModelCommand(args []string) Command {
+	c := NewCommand(ModelCommand)
+	c.Args = args
+	return c
+}
+
+// ModelEvent returns the string form models receive through
+// IModel.SendEvent.
+func (c Command) ModelEvent() string {
+	switch c.Kind {
+	case SetCommand:
+		return fmt.Sprintf("%s %g", c.Name, c.Value)
+	case AdjustCommand:
+		if c.Value < 0 {
+			return "dec " + c.Name
+		}
+		return "inc " + c.Name
+	case MouseCommand:
+		if c.Action == "drag" {
+			return fmt.Sprintf("mouse drag %d %d", c.Col, c.Row)
+		}
+		return fmt.Sprintf("mouse %s %d %d %d", c.Action, c.Button, c.Col, c.Row)
+	case ModelCommand:
+		return strings.Join(c.Args, " ")
+	}
+	return c.Kind.String()
+}
+
+// EventKind identifies an Event sent by the simulation.
+type EventKind int
+
+const (
+	StartedEvent EventKind = iota
+	SteppedEvent
+	PausedEvent
+	ResumedEvent
+	ResetEvent
+	StoppedEvent
+	// CompletedEvent is sent when the model finishes on its own. It
+	// doesn't answer a command so its ID is 0.
+	CompletedEvent
+	TerminatedEvent
+	ExitedEvent
+	StatusEvent
+	// DoneEvent answers set, adjust, mouse and model commands.
+	DoneEvent
+	// ErrorEvent answers a command that couldn't be carried out.
+	// Message says why.
+	ErrorEvent
+	// ReportEvent carries the results of background work a model
+	// command started, e.g. a parameter sweep. Its ID is 0.
+	ReportEvent
+)
+
+var eventNames = []string{"Started", "Stepped", "Paused", "Resumed", "Reset", "Stopped", "Completed", "Terminated", "Exited", "Status", "Done", "Error", "Report"}
+
+func (k EventKind) String() string {
+	if int(k) < len(eventNames) {
+		return eventNames[k]
+	}
+	return fmt.Sprintf("event(%d)", int(k))
+}
+
+// Event is sent by the simulation, either in reply to the command with
+// the same ID or, with ID 0, on its own.
+type Event struct {
+	ID      int64
+	Kind    EventKind
+	Message string
+}
+
+// Reply returns an event answering the command.
+func (c Command) Reply(kind EventKind, message string) Event {
+	return Event{ID: c.ID, Kind: kind, Message: message}
+}
+
+// Error returns an error event answering the command.
+func (c Command) Error(format string, args ...interface{}) Event {
+	return c.Reply(ErrorEvent, fmt.Sprintf(format, args...))
+}
+
+func (e Event) String() string {
+	if e.Message == "" {
+		return e.Kind.String()
+	}
+	return e.Kind.String() + ": " + e.Message
+}
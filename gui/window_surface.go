@@ -2,15 +2,29 @@ package gui
 
 import (
 	"Netron1-Go/api"
+	"Netron1-Go/raster"
+	"context"
 	"fmt"
 	"image/color"
 	"log"
 	"math"
+	"sync"
 	"time"
 
 	"github.com/veandco/go-sdl2/sdl"
 )
 
+const (
+	// SurfaceScale scales the view
+	SurfaceScale = 300
+	width        = SurfaceScale
+	height       = SurfaceScale
+	windowPosX   = 1500
+	windowPosY   = 100
+	fps          = 30.0
+	framePeriod  = 1.0 / fps * 1000.0
+)
+
 // WindowSurface is the GUI and shows the plots and graphs.
 // It receives commands for graphing and viewing various graphs.
 type WindowSurface struct {
@@ -25,22 +39,29 @@ type WindowSurface struct {
 	// mouse
 	mx int32
 	my int32
+	// Last cell a drag was sent for
+	dragCol int32
+	dragRow int32
+
+	// quit is closed by Quit
+	quit     chan struct{}
+	quitOnce sync.Once
 
-	running bool
 	animate bool
 	step    bool
 
 	opened bool
 	ready  bool
 
-	chFromSim chan string
-	chToSim   chan string
+	ctx     context.Context
+	chToSim chan<- api.Command
 }
 
 // NewSurfaceBuffer creates a new viewer and initializes it.
 func NewSurfaceBuffer() api.ISurface {
 	o := new(WindowSurface)
 	o.opened = false
+	o.quit = make(chan struct{})
 	o.animate = true
 	o.step = false
 	return o
@@ -91,7 +112,7 @@ func (ws *WindowSurface) Open(model api.IModel) {
 		panic(err)
 	}
 
-	ws.rasterBuffer = NewRasterBuffer(int(w), int(h))
+	ws.rasterBuffer = raster.NewRasterBuffer(int(w), int(h))
 	ws.rasterBuffer.EnableAlphaBlending(true)
 
 	ws.opened = true
@@ -108,17 +129,33 @@ func (ws *WindowSurface) SetFont(fontPath string, size int) error {
 func (ws *WindowSurface) filterEvent(e sdl.Event, userdata interface{}) bool {
 	switch t := e.(type) {
 	case *sdl.QuitEvent:
-		ws.running = false
+		ws.send(api.NewCommand(api.ExitCommand))
 		return false // We handled it. Don't allow it to be added to the queue.
 	case *sdl.MouseMotionEvent:
 		ws.mx = t.X
 		ws.my = t.Y
+		if t.State&sdl.ButtonLMask() != 0 {
+			// Only send drags when the mouse enters a new cell
+			scale := int32(ws.model.Properties().Scale())
+			col, row := t.X/scale, t.Y/scale
+			if col != ws.dragCol || row != ws.dragRow {
+				ws.dragCol = col
+				ws.dragRow = row
+				ws.send(api.NewMouseCommand("drag", 0, int(col), int(row)))
+			}
+		}
 		// fmt.Printf("[%d ms] MouseMotion\ttype:%d\tid:%d\tx:%d\ty:%d\txrel:%d\tyrel:%d\n",
 		// 	t.Timestamp, t.Type, t.Which, t.X, t.Y, t.XRel, t.YRel)
 		return false // We handled it. Don't allow it to be added to the queue.
-		// case *sdl.MouseButtonEvent:
-		// 	fmt.Printf("[%d ms] MouseButton\ttype:%d\tid:%d\tx:%d\ty:%d\tbutton:%d\tstate:%d\n",
-		// 		t.Timestamp, t.Type, t.Which, t.X, t.Y, t.Button, t.State)
+	case *sdl.MouseButtonEvent:
+		// Mouse positions are sent to the model in cell coordinates
+		scale := int32(ws.model.Properties().Scale())
+		action := "up"
+		if t.State == sdl.PRESSED {
+			action = "down"
+		}
+		ws.send(api.NewMouseCommand(action, int(t.Button), int(t.X/scale), int(t.Y/scale)))
+		return false
 		// case *sdl.MouseWheelEvent:
 		// 	fmt.Printf("[%d ms] MouseWheel\ttype:%d\tid:%d\tx:%d\ty:%d\n",
 		// 		t.Timestamp, t.Type, t.Which, t.X, t.Y)
@@ -126,35 +163,50 @@ func (ws *WindowSurface) filterEvent(e sdl.Event, userdata interface{}) bool {
 		if t.State == sdl.PRESSED {
 			switch t.Keysym.Scancode {
 			case sdl.SCANCODE_ESCAPE:
-				ws.chFromSim <- "Exited"
-				ws.running = false
+				ws.send(api.NewCommand(api.ExitCommand))
 			case sdl.SCANCODE_R:
-				ws.chToSim <- "run"
+				ws.send(api.NewCommand(api.RunCommand))
 			case sdl.SCANCODE_E:
-				ws.chToSim <- "step"
+				ws.send(api.NewCommand(api.StepCommand))
 			case sdl.SCANCODE_P:
-				ws.chToSim <- "pause"
+				ws.send(api.NewCommand(api.PauseCommand))
 			case sdl.SCANCODE_U:
-				ws.chToSim <- "resume"
+				ws.send(api.NewCommand(api.ResumeCommand))
 			case sdl.SCANCODE_T:
-				ws.chToSim <- "stop"
+				ws.send(api.NewCommand(api.StopCommand))
 			case sdl.SCANCODE_A:
-				ws.chToSim <- "status"
+				ws.send(api.NewCommand(api.StatusCommand))
 			case sdl.SCANCODE_S:
-				ws.chToSim <- "reset"
+				ws.send(api.NewCommand(api.ResetCommand))
 				ws.step = true
 			case sdl.SCANCODE_K: // decrease acceptible rate
-				ws.chToSim <- "inc accept"
+				ws.send(api.NewAdjustCommand("accept", 1))
 			case sdl.SCANCODE_L: // increase accetable rate
-				ws.chToSim <- "dec accept"
+				ws.send(api.NewAdjustCommand("accept", -1))
 			case sdl.SCANCODE_N: // decrease drop rate
-				ws.chToSim <- "dec drop"
+				ws.send(api.NewAdjustCommand("drop", -1))
 			case sdl.SCANCODE_M: // increase drop rate
-				ws.chToSim <- "inc drop"
+				ws.send(api.NewAdjustCommand("drop", 1))
 			case sdl.SCANCODE_COMMA: // decrease step size
-				ws.chToSim <- "dec size"
+				ws.send(api.NewAdjustCommand("size", -1))
 			case sdl.SCANCODE_PERIOD: // increase step size
-				ws.chToSim <- "inc size"
+				ws.send(api.NewAdjustCommand("size", 1))
+			case sdl.SCANCODE_LEFT: // back through the frames
+				ws.send(api.NewFrameCommand(-1))
+			case sdl.SCANCODE_RIGHT: // forward through the frames
+				ws.send(api.NewFrameCommand(1))
+			case sdl.SCANCODE_END: // back to the live frame
+				ws.send(api.NewCommand(api.LiveCommand))
+			case sdl.SCANCODE_B: // branch a new run from the frame shown
+				ws.send(api.NewCommand(api.BranchCommand))
+			case sdl.SCANCODE_KP_8: // move selected city
+				ws.send(api.NewModelCommand([]string{"city", "move", "0", "-1"}))
+			case sdl.SCANCODE_KP_2:
+				ws.send(api.NewModelCommand([]string{"city", "move", "0", "1"}))
+			case sdl.SCANCODE_KP_4:
+				ws.send(api.NewModelCommand([]string{"city", "move", "-1", "0"}))
+			case sdl.SCANCODE_KP_6:
+				ws.send(api.NewModelCommand([]string{"city", "move", "1", "0"}))
 			}
 		}
 		// fmt.Printf("[%d ms] Keyboard\ttype:%d\tsym:%c\tmodifiers:%d\tstate:%d\trepeat:%d\n",
@@ -167,11 +219,10 @@ func (ws *WindowSurface) filterEvent(e sdl.Event, userdata interface{}) bool {
 
 // Run starts the polling event loop. This must run on
 // the main thread.
-func (ws *WindowSurface) Run(chToSim, chFromSim chan string) {
-	ws.chFromSim = chFromSim
+func (ws *WindowSurface) Run(ctx context.Context, chToSim chan<- api.Command) {
+	ws.ctx = ctx
 	ws.chToSim = chToSim
 
-	ws.running = true
 	var frameStart time.Time
 	var loopTime float64
 
@@ -191,7 +242,17 @@ func (ws *WindowSurface) Run(chToSim, chFromSim chan string) {
 	leftT := sdl.Rect{X: 0, Y: 0, W: int32(mp.Width() * mp.Scale()), H: int32(mp.Height() * mp.Scale())}
 	// rightT := sdl.Rect{X: int32(mp.Width() / 2), Y: 0, W: int32(mp.Width() / 2), H: int32(mp.Height())}
 
-	for ws.running {
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Println("Run exiting")
+			return
+		case <-ws.quit:
+			fmt.Println("Run exiting")
+			return
+		default:
+		}
+
 		frameStart = time.Now()
 
 		sdl.PumpEvents()
@@ -221,8 +282,16 @@ func (ws *WindowSurface) Run(chToSim, chFromSim chan string) {
 		} else {
 		}
 	}
+}
 
-	fmt.Println("Run exiting")
+// send sends cmd to the simulation unless the surface is shutting
+// down.
+func (ws *WindowSurface) send(cmd api.Command) {
+	select {
+	case ws.chToSim <- cmd:
+	case <-ws.ctx.Done():
+	case <-ws.quit:
+	}
 }
 
 // Update
@@ -232,7 +301,7 @@ func (ws *WindowSurface) Update(state bool) {
 
 // Quit stops the gui from running, effectively shutting it down.
 func (ws *WindowSurface) Quit() {
-	ws.running = false
+	ws.quitOnce.Do(func() { close(ws.quit) })
 }
 
 // Close closes the viewer.
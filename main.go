@@ -6,19 +6,18 @@ import (
 	"Netron1-Go/gui"
 	"Netron1-Go/simulation"
 	"bufio"
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
-	"time"
+	"sync"
 )
 
 const configFile = "config/config.json"
 
-var mainLoop = true
-var consoleLoop = true
-var simLoop = true
-
 func main() {
 	config, err := config.NewConfig(configFile)
 
@@ -26,9 +25,16 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// Cancelled when the simulation exits or on ctrl-c. Every
+	// coroutine returns once it's done.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+
 	// Our channels with the simulation coroutine
-	chToSim := make(chan string)
-	chFromSim := make(chan string)
+	chToSim := make(chan api.Command)
+	chFromSim := make(chan api.Event)
 
 	model := simulation.NewSISDynCorrModel()
 
@@ -39,7 +45,11 @@ func main() {
 
 	surface.Open(model)
 
-	go surface.Run(chToSim, chFromSim)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		surface.Run(ctx, chToSim)
+	}()
 
 	// -----------------------------------------------------
 	// Setup console
@@ -49,26 +59,40 @@ func main() {
 
 	printHelp()
 
-	go messageFromConsole(chToSim)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		messageFromConsole(ctx, chToSim)
+	}()
 
-	go messageFromSim(chFromSim, config, surface)
+	go func() {
+		defer wg.Done()
+		messageFromSim(ctx, cancel, chFromSim, config)
+	}()
 
 	// -----------------------------------------------------
 	// Setup simulation
 	// -----------------------------------------------------
 	sim := simulation.NewSimulation()
 	sim.Initialize(surface.Raster(), surface)
+	sim.SetDataRoot(config.DataRoot())
 
 	sim.Configure(model)
 
-	go sim.Start(chToSim, chFromSim)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sim.Start(ctx, chToSim, chFromSim)
+		// A cancelled context also ends the other coroutines
+		// if the simulation returned first.
+		cancel()
+	}()
 
 	// -----------------------------------------------------
 	// Stall until other coroutines finish
 	// -----------------------------------------------------
-	for mainLoop {
-		time.Sleep(100 * time.Millisecond)
-	}
+	<-ctx.Done()
+	wg.Wait()
 
 	fmt.Println("Closing channels...")
 	close(chFromSim)
@@ -80,94 +104,299 @@ func main() {
 	fmt.Println("Goodbye.")
 }
 
-func messageFromConsole(chToSim chan string) {
+// consoleCommands maps the console commands without arguments.
+var consoleCommands = map[string]api.CommandKind{
+	"r":      api.RunCommand,
+	"p":      api.PauseCommand,
+	"e":      api.StepCommand,
+	"u":      api.ResumeCommand,
+	"s":      api.ResetCommand,
+	"t":      api.StopCommand,
+	"a":      api.StatusCommand,
+	"live":   api.LiveCommand,
+	"branch": api.BranchCommand,
+}
+
+// readLines sends the lines typed on the console. It closes the
+// channel at end of input.
+func readLines(lines chan<- string) {
 	reader := bufio.NewReader(os.Stdin)
 
-	for consoleLoop {
-		text, _ := reader.ReadString('\n')
+	for {
+		text, err := reader.ReadString('\n')
+		if err != nil {
+			close(lines)
+			return
+		}
 		// convert CRLF to LF
-		text = strings.Replace(text, "\n", "", -1)
+		lines <- strings.TrimRight(text, "\r\n")
+	}
+}
+
+func messageFromConsole(ctx context.Context, chToSim chan<- api.Command) {
+	// The reader blocks on stdin so it's left behind at exit.
+	lines := make(chan string)
+	go readLines(lines)
+
+	send := func(cmd api.Command) {
+		select {
+		case chToSim <- cmd:
+		case <-ctx.Done():
+		}
+	}
+
+	for {
+		var text string
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return
+		case text, ok = <-lines:
+		}
+		if !ok {
+			// End of input
+			text = "q"
+		}
 
-		switch text {
-		case "q":
-			chToSim <- "exit"
+		if kind, ok := consoleCommands[text]; ok {
+			send(api.NewCommand(kind))
+			continue
+		}
+
+		fields := strings.Fields(text)
+
+		switch {
+		case text == "q":
+			send(api.NewCommand(api.ExitCommand))
 			fmt.Println("-------")
-			mainLoop = false
-			consoleLoop = false
-			simLoop = false
-		case "r":
-			chToSim <- "run"
-		case "p":
-			chToSim <- "pause"
-		case "e":
-			chToSim <- "step"
-		case "u":
-			chToSim <- "resume"
-		case "s":
-			chToSim <- "reset"
-		case "t":
-			chToSim <- "stop"
-		case "a":
-			chToSim <- "status"
+			return
+		case len(fields) > 0 && parsers[fields[0]] != nil:
+			cmd, err := parsers[fields[0]](fields)
+			if err != nil {
+				fmt.Println(err)
+				fmt.Print("> ")
+				continue
+			}
+			send(cmd)
+		case len(fields) > 1:
+			// Commands with arguments are passed on to the model.
+			send(api.NewModelCommand(fields))
 		default:
 			fmt.Println("*********************")
 			fmt.Println("** Unknown command **")
 			fmt.Println("*********************")
 		}
+	}
+}
+
+// parsers parse the console commands with arguments the simulation
+// handles. Other commands with arguments go to the model.
+var parsers = map[string]func(fields []string) (api.Command, error){
+	"set":     parseSet,
+	"run":     parseRun,
+	"speed":   parseSpeed,
+	"render":  parseRender,
+	"frame":   parseFrame,
+	"history": parseHistory,
+	"record":  parseRecord,
+}
 
-		if !mainLoop {
-			printHelp()
+// parseRun parses "run [<steps>] [prevalence <p>] [extinct]" into a
+// RunCommand that stops at whichever condition is met first.
+func parseRun(fields []string) (api.Command, error) {
+	until := api.Until{}
+	usage := fmt.Errorf("Usage: run [<steps>] [prevalence <0..1>] [extinct]")
+
+	for i := 1; i < len(fields); i++ {
+		switch fields[i] {
+		case "extinct":
+			until.Extinct = true
+		case "prevalence":
+			i++
+			if i == len(fields) {
+				return api.Command{}, usage
+			}
+			p, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				return api.Command{}, usage
+			}
+			until.Prevalence = p
+		default:
+			n, err := strconv.Atoi(fields[i])
+			if err != nil || n <= 0 {
+				return api.Command{}, usage
+			}
+			until.Steps = n
 		}
 	}
+	return api.NewRunCommand(until), nil
 }
 
-func messageFromSim(chFromSim chan string, config api.IConfig, surface api.ISurface) {
+// parseSpeed parses "speed <steps per second|max>".
+func parseSpeed(fields []string) (api.Command, error) {
+	if len(fields) != 2 {
+		return api.Command{}, fmt.Errorf("Usage: speed <steps per second|max>")
+	}
+	cmd := api.NewCommand(api.SpeedCommand)
+	if fields[1] == "max" {
+		return cmd, nil
+	}
+	rate, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return api.Command{}, fmt.Errorf("Bad speed: %s", fields[1])
+	}
+	cmd.Value = rate
+	return cmd, nil
+}
+
+// parseRender parses "render <k>".
+func parseRender(fields []string) (api.Command, error) {
+	if len(fields) != 2 {
+		return api.Command{}, fmt.Errorf("Usage: render <k>")
+	}
+	k, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return api.Command{}, fmt.Errorf("Bad render step: %s", fields[1])
+	}
+	cmd := api.NewCommand(api.RenderCommand)
+	cmd.Value = float64(k)
+	return cmd, nil
+}
+
+// parseFrame parses "frame <frames>", negative to move back.
+func parseFrame(fields []string) (api.Command, error) {
+	if len(fields) != 2 {
+		return api.Command{}, fmt.Errorf("Usage: frame <frames>")
+	}
+	n, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return api.Command{}, fmt.Errorf("Bad frames: %s", fields[1])
+	}
+	return api.NewFrameCommand(n), nil
+}
+
+// parseHistory parses "history <memory frames> [<disk frames>]".
+func parseHistory(fields []string) (api.Command, error) {
+	usage := fmt.Errorf("Usage: history <memory frames> [<disk frames>]")
+	if len(fields) < 2 || len(fields) > 3 {
+		return api.Command{}, usage
+	}
+	limits := []int{0, 0}
+	for i, f := range fields[1:] {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return api.Command{}, usage
+		}
+		limits[i] = n
+	}
+	return api.NewHistoryCommand(limits[0], limits[1]), nil
+}
+
+// parseRecord parses "record <png|gif|y4m|rgb> [<k>] [delay <1/100 s>]"
+// and "record off".
+func parseRecord(fields []string) (api.Command, error) {
+	usage := fmt.Errorf("Usage: record <png|gif|y4m|rgb> [<k>] [delay <1/100 s>] | record off")
+	if len(fields) < 2 || (fields[1] == "off" && len(fields) > 2) {
+		return api.Command{}, usage
+	}
+	every, delay := 1, 0
+	for i := 2; i < len(fields); i++ {
+		if fields[i] == "delay" {
+			i++
+			if i == len(fields) {
+				return api.Command{}, usage
+			}
+			d, err := strconv.Atoi(fields[i])
+			if err != nil || d <= 0 {
+				return api.Command{}, usage
+			}
+			delay = d
+			continue
+		}
+		k, err := strconv.Atoi(fields[i])
+		if err != nil {
+			return api.Command{}, usage
+		}
+		every = k
+	}
+	return api.NewRecordCommand(fields[1], every, delay), nil
+}
+
+// parseSet parses "set <name> <value>" into a SetCommand.
+func parseSet(fields []string) (api.Command, error) {
+	if len(fields) != 3 {
+		return api.Command{}, fmt.Errorf("Usage: set <name> <value>")
+	}
+	value, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		return api.Command{}, fmt.Errorf("Bad value: %s", fields[2])
+	}
+	return api.NewSetCommand(fields[1], value), nil
+}
 
-	for simLoop {
+// messageFromSim reports the simulation's events. It cancels ctx once
+// the simulation exits.
+func messageFromSim(ctx context.Context, cancel context.CancelFunc, chFromSim <-chan api.Event, config api.IConfig) {
+
+	for {
 		select {
-		case msg := <-chFromSim:
-			switch msg {
-			case "Exited":
+		case <-ctx.Done():
+			return
+		case ev := <-chFromSim:
+			switch ev.Kind {
+			case api.ExitedEvent:
 				fmt.Println("Simulation exited.")
 				config.SetExitState("Exited")
-				simLoop = false
-				mainLoop = false
-			case "Started":
-				fmt.Println("Simulation started.")
-			case "Stepped":
+				cancel()
+				return
+			case api.StartedEvent:
+				if ev.Message != "" {
+					fmt.Println("Simulation started " + ev.Message + ".")
+				} else {
+					fmt.Println("Simulation started.")
+				}
+			case api.SteppedEvent:
 				fmt.Println("Simulation stepped.")
-			case "Reset":
+			case api.ResetEvent:
 				fmt.Println("Simulation reset.")
-			case "Terminated":
+			case api.TerminatedEvent:
 				fmt.Println("Simulation terminated.")
 				config.SetExitState("Terminated")
-			case "Paused":
+				cancel()
+				return
+			case api.PausedEvent:
 				fmt.Println("Simulation paused.")
 				config.SetExitState("Paused")
-			case "Stopped":
+			case api.StoppedEvent:
 				fmt.Println("Simulation stopped.")
 				config.SetExitState("Stopped")
-			case "Complete":
-				fmt.Println("Simulation completed.")
+			case api.CompletedEvent:
+				if ev.Message != "" {
+					fmt.Println("Simulation completed: " + ev.Message + ".")
+				} else {
+					fmt.Println("Simulation completed.")
+				}
 				config.SetExitState("Completed")
-			case "Running":
-				fmt.Println("Simulation is ready running!")
-			case "Not Running":
-				fmt.Println("Simulation isn't running.")
-			case "Already Paused":
-				fmt.Println("Simulation is already paused.")
-			case "Not Paused":
-				fmt.Println("Simulation is not paused.")
-			case "Resumed":
+			case api.ResumedEvent:
 				fmt.Println("Simulation resumed.")
+			case api.StatusEvent:
+				fmt.Println("Status: " + ev.Message)
+			case api.DoneEvent:
+				// Mouse and key adjustments are answered silently
+				if ev.Message == "" {
+					continue
+				}
+				fmt.Println(ev.Message)
+			case api.ErrorEvent:
+				fmt.Println("Error: " + ev.Message)
+			case api.ReportEvent:
+				fmt.Println(ev.Message)
 			default:
-				fmt.Println(msg)
+				fmt.Println(ev)
 			}
 		}
 
-		if simLoop {
-			fmt.Print("> ")
-		}
+		fmt.Print("> ")
 	}
 }
 
@@ -182,6 +411,17 @@ func printHelp() {
 	fmt.Println("  t: stop simulation")
 	fmt.Println("  a: status of simulation")
 	fmt.Println("  h: this help menu")
+	fmt.Println("  run [<steps>] [prevalence <p>] [extinct]: run until a condition")
+	fmt.Println("  speed <steps/s|max>: target speed")
+	fmt.Println("  render <k>: render every k-th step while running")
+	fmt.Println("  frame <n>: move n frames through the history, back if negative")
+	fmt.Println("  live: back to the live frame")
+	fmt.Println("  branch: branch a new run from the frame shown")
+	fmt.Println("  history <memory frames> [<disk frames>]: frames kept")
+	fmt.Println("  record <png|gif|y4m|rgb> [<k>] [delay <1/100 s>]: record every k-th frame rendered")
+	fmt.Println("  record off: stop recording")
+	fmt.Println("  set <name> <value>: set a model parameter, e.g. \"set drop 0.2\"")
+	fmt.Println("  <cmd> <args...>: model command, e.g. \"kc add 100 100 2\"")
 	fmt.Println("-----------------------------")
 	fmt.Print("> ")
 }
@@ -1,18 +1,7 @@
-package gui
+package raster
 
 import "Netron1-Go/api"
 
-const (
-	// SurfaceScale scales the view
-	SurfaceScale = 300
-	width        = SurfaceScale
-	height       = SurfaceScale
-	windowPosX   = 1500
-	windowPosY   = 100
-	fps          = 30.0
-	framePeriod  = 1.0 / fps * 1000.0
-)
-
 type Properties struct {
 	width, height, windowPosX, windowPosY int
 	scale                                 int
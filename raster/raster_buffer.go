@@ -1,4 +1,4 @@
-package gui
+package raster
 
 import (
 	"Netron1-Go/api"
@@ -0,0 +1,305 @@
+package simulation
+
+import (
+	"Netron1-Go/api"
+	"Netron1-Go/raster"
+	"context"
+	"fmt"
+	"image/color"
+	"math/rand"
+	"strings"
+)
+
+// The bootstrap percolation model starts with a random fraction of
+// active cells. An inactive cell becomes active once at least m of its
+// neighbors are active and never deactivates. The run completes when
+// no cell changes.
+//   bootstrap density <p>      initial active fraction
+//   bootstrap m <m>
+//   bootstrap degree <4..8>
+//   bootstrap stats            final density and cluster geometry
+//   bootstrap sweep <from> <to> <step> <trials>
+//                              final density for a range of initial
+//                              densities, run in the background
+
+type BootstrapModel struct {
+	initialColor     color.RGBA
+	infectedColor    color.RGBA // cell type = 1
+	susceptibleColor color.RGBA // cell type = 2
+
+	raster api.IRasterBuffer
+	cells  *Grid
+
+	density float64
+	m       int
+	// degree goes from 4 to 8
+	degree int
+
+	steps int
+
+	jobs
+}
+
+func NewBootstrapModel() api.IModel {
+	o := new(BootstrapModel)
+	// Initially active = Dark blue
+	o.initialColor = color.RGBA{R: 0, G: 0, B: 140, A: 255}
+	// Active = Blue
+	o.infectedColor = color.RGBA{R: 80, G: 120, B: 255, A: 255}
+	// Inactive = Skin
+	o.susceptibleColor = color.RGBA{R: 255, G: 225, B: 200, A: 255}
+
+	return o
+}
+
+func (s *BootstrapModel) Name() string {
+	return "BootstrapModel"
+}
+
+// Palette returns the state colors.
+func (s *BootstrapModel) Palette() color.Palette {
+	return color.Palette{
+		s.initialColor,
+		s.infectedColor,
+		s.susceptibleColor,
+	}
+}
+
+func (s *BootstrapModel) Configure(rasterBuffer api.IRasterBuffer) {
+	s.raster = rasterBuffer
+	s.density = 0.06
+	s.m = 2
+	s.degree = 4
+
+	rand.Seed(13163)
+
+	s.cells = NewGrid(s.raster.Width(), s.raster.Height())
+}
+
+// SetParameter sets density, m or degree by name.
+func (s *BootstrapModel) SetParameter(name string, value float64) error {
+	switch name {
+	case "density":
+		if value < 0 || value > 1 {
+			return fmt.Errorf("density must be 0 to 1")
+		}
+		s.density = value
+	case "m":
+		if value < 1 {
+			return fmt.Errorf("m must be at least 1")
+		}
+		s.m = int(value)
+	case "degree":
+		if value < 4 || value > 8 {
+			return fmt.Errorf("degree must be 4 to 8")
+		}
+		s.degree = int(value)
+	default:
+		return fmt.Errorf("unknown parameter: %s", name)
+	}
+	return nil
+}
+
+// SendEvent receives an event from the host simulation
+func (s *BootstrapModel) SendEvent(event string) error {
+	fields := strings.Fields(event)
+	if len(fields) < 2 || fields[0] != "bootstrap" {
+		return unhandled(event)
+	}
+
+	args, err := parseFloats(fields[2:])
+	if err != nil {
+		return fmt.Errorf("bootstrap: %v", err)
+	}
+
+	switch {
+	case fields[1] == "density" && len(args) == 1:
+		if err := s.SetParameter("density", args[0]); err != nil {
+			return err
+		}
+		fmt.Println("initial density: ", s.density)
+	case fields[1] == "m" && len(args) == 1:
+		if err := s.SetParameter("m", args[0]); err != nil {
+			return err
+		}
+		fmt.Println("m: ", s.m)
+	case fields[1] == "degree" && len(args) == 1:
+		if err := s.SetParameter("degree", args[0]); err != nil {
+			return err
+		}
+		fmt.Println("degree: ", s.degree)
+	case fields[1] == "stats":
+		fmt.Printf("p: %.4f, m: %d, degree: %d, steps: %d\n", s.density, s.m, s.degree, s.steps)
+		fmt.Println(s.geometry().toString(s.raster.Width() * s.raster.Height()))
+	case fields[1] == "sweep" && len(args) == 4 && args[2] > 0 && args[3] >= 1:
+		s.start(s.sweep(args[0], args[1], args[2], int(args[3])))
+		fmt.Println("bootstrap sweep started")
+	default:
+		return fmt.Errorf("unknown bootstrap command: %s", event)
+	}
+	return nil
+}
+
+func (s *BootstrapModel) geometry() ClusterGeometry {
+	return measureClusters(s.raster.Width(), s.raster.Height(), s.degree, func(col, row int) bool {
+		return s.cells.at(col, row).state == 1
+	})
+}
+
+// sweep returns a job that runs trials to completion for each initial
+// density on a copy of the model and reports the mean final density
+// and how often the grid fills.
+func (s *BootstrapModel) sweep(from, to, step float64, trials int) job {
+	m := s.copy()
+	return func(ctx context.Context) (string, error) {
+		cells := float64(m.raster.Width() * m.raster.Height())
+		var report strings.Builder
+
+		fmt.Fprintln(&report, "p, final density, filled fraction")
+		for p := from; p <= to+step/2; p += step {
+			m.density = p
+			final, filled := 0.0, 0
+			for t := 0; t < trials; t++ {
+				m.populate()
+				for ctx.Err() == nil && m.Step() {
+				}
+				if err := ctx.Err(); err != nil {
+					return "", err
+				}
+				g := m.geometry()
+				final += float64(g.members) / cells
+				if g.members == int(cells) {
+					filled++
+				}
+			}
+			fmt.Fprintf(&report, "%.4f, %.4f, %.2f\n", p, final/float64(trials), float64(filled)/float64(trials))
+		}
+		return report.String(), nil
+	}
+}
+
+// copy returns a model with the same parameters, and cells and a
+// raster of its own.
+func (s *BootstrapModel) copy() *BootstrapModel {
+	c := *s
+	c.jobs = jobs{}
+	c.raster = raster.NewRasterBuffer(s.raster.Width(), s.raster.Height())
+	c.cells = NewGrid(s.raster.Width(), s.raster.Height())
+	return &c
+}
+
+// Snapshot returns the cells and the number of steps so far.
+func (s *BootstrapModel) Snapshot() []byte {
+	w := stateWriter{}
+	w.cells(s.cells)
+	w.int(s.steps)
+	return w.buf
+}
+
+// Restore sets the cells from a snapshot and redraws them. The cells
+// active from the start aren't told apart from the ones activated
+// since.
+func (s *BootstrapModel) Restore(snapshot []byte) error {
+	r := stateReader{buf: snapshot}
+	cells := r.cells(s.cells)
+	steps := r.int()
+	if err := r.done(); err != nil {
+		return err
+	}
+
+	copy(s.cells.cells, cells)
+	s.steps = steps
+
+	w := s.raster.Width()
+	h := s.raster.Height()
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			if s.cells.at(col, row).state == 1 {
+				s.raster.SetPixelColor(s.infectedColor)
+			} else {
+				s.raster.SetPixelColor(s.susceptibleColor)
+			}
+			s.raster.SetPixel(col, row)
+		}
+	}
+	return nil
+}
+
+func (s *BootstrapModel) Properties() api.IProperties {
+	return raster.NewProperties(300, 300, 1500, 100, 1)
+}
+
+func (s *BootstrapModel) Reset() {
+	fmt.Println(("--- bootstrap reset ---"))
+	s.raster.Clear()
+	s.populate()
+}
+
+// populate activates a random fraction of the cells.
+func (s *BootstrapModel) populate() {
+	w := s.raster.Width()
+	h := s.raster.Height()
+
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			c := s.cells.at(col, row)
+			if rand.Float64() < s.density {
+				c.state = 1 // Active
+				s.raster.SetPixelColor(s.initialColor)
+			} else {
+				c.state = 2 // Inactive
+				s.raster.SetPixelColor(s.susceptibleColor)
+			}
+			c.nextState = c.state
+			s.raster.SetPixel(col, row)
+		}
+	}
+
+	s.steps = 0
+}
+
+func (s *BootstrapModel) Step() bool {
+	w := s.raster.Width()
+	h := s.raster.Height()
+	activated := 0
+
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			if s.cells.at(col, row).state == 1 {
+				continue
+			}
+
+			active := 0
+			for _, n := range neighbors(s.degree) {
+				nc := col + n[0]
+				nr := row + n[1]
+				if nc >= 0 && nc < w && nr >= 0 && nr < h && s.cells.at(nc, nr).state == 1 {
+					active++
+				}
+			}
+			if active >= s.m {
+				s.cells.at(col, row).nextState = 1
+				activated++
+			}
+		}
+	}
+
+	// Copy next-state to current-state
+	s.raster.SetPixelColor(s.infectedColor)
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			c := s.cells.at(col, row)
+			if c.state != c.nextState {
+				c.state = c.nextState
+				s.raster.SetPixel(col, row)
+			}
+		}
+	}
+
+	if activated == 0 {
+		return false
+	}
+
+	s.steps++
+	return true
+}
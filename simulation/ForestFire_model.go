@@ -0,0 +1,389 @@
+package simulation
+
+import (
+	"Netron1-Go/api"
+	"Netron1-Go/raster"
+	"fmt"
+	"image/color"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// The forest fire model is the Drossel-Schwabl self-organized
+// criticality model. Empty cells grow a tree with probability p,
+// lightning ignites a tree with probability f, fire spreads to
+// neighboring trees and burnt trees leave an empty cell.
+// In instant mode a lightning strike burns its whole cluster of trees
+// in a single step, which is the limit of separated time scales.
+//   fire growth <p>
+//   fire lightning <f>
+//   fire instant <on|off>
+//   fire stats      tree density and fire size statistics
+//   fire export     fire sizes and their log-log distribution
+
+type ForestFireModel struct {
+	emptyColor   color.RGBA // cell type = 0
+	treeColor    color.RGBA // cell type = 1
+	burningColor color.RGBA // cell type = 2
+
+	raster api.IRasterBuffer
+	cells  *FGrid
+
+	growth    float64
+	lightning float64
+	instant   bool
+
+	// Burning cells and total size of each fire still burning
+	nextFire int
+	burning  map[int]int
+	burnt    map[int]int
+	fires    avalancheSizes
+
+	// Fraction of cells with a tree per step
+	density []float64
+}
+
+func NewForestFireModel() api.IModel {
+	o := new(ForestFireModel)
+	// Empty = Earth
+	o.emptyColor = color.RGBA{R: 90, G: 60, B: 30, A: 255}
+	// Tree = Green
+	o.treeColor = color.RGBA{R: 0, G: 150, B: 0, A: 255}
+	// Burning = Orange
+	o.burningColor = color.RGBA{R: 255, G: 140, B: 0, A: 255}
+
+	return o
+}
+
+func (s *ForestFireModel) Name() string {
+	return "ForestFireModel"
+}
+
+// Palette returns the state colors.
+func (s *ForestFireModel) Palette() color.Palette {
+	return color.Palette{
+		s.emptyColor,
+		s.treeColor,
+		s.burningColor,
+	}
+}
+
+func (s *ForestFireModel) Configure(rasterBuffer api.IRasterBuffer) {
+	s.raster = rasterBuffer
+	s.growth = 0.05
+	s.lightning = 0.00001
+	s.instant = false
+
+	rand.Seed(13163)
+
+	s.cells = NewFGrid(s.raster.Width(), s.raster.Height())
+}
+
+// SetParameter sets growth or lightning by name.
+func (s *ForestFireModel) SetParameter(name string, value float64) error {
+	if value < 0 || value > 1 {
+		return fmt.Errorf("%s must be 0 to 1", name)
+	}
+	switch name {
+	case "growth":
+		s.growth = value
+	case "lightning":
+		s.lightning = value
+	default:
+		return fmt.Errorf("unknown parameter: %s", name)
+	}
+	return nil
+}
+
+// SendEvent receives an event from the host simulation
+func (s *ForestFireModel) SendEvent(event string) error {
+	fields := strings.Fields(event)
+	if len(fields) < 2 || fields[0] != "fire" {
+		return unhandled(event)
+	}
+
+	if fields[1] == "instant" && len(fields) == 3 {
+		if fields[2] != "on" && fields[2] != "off" {
+			return fmt.Errorf("usage: fire instant <on|off>")
+		}
+		s.instant = fields[2] == "on"
+		fmt.Println("instant fires: ", s.instant)
+		return nil
+	}
+
+	args, err := parseFloats(fields[2:])
+	if err != nil {
+		return fmt.Errorf("fire: %v", err)
+	}
+
+	switch {
+	case fields[1] == "growth" && len(args) == 1:
+		if err := s.SetParameter("growth", args[0]); err != nil {
+			return err
+		}
+		fmt.Println("growth: ", s.growth)
+	case fields[1] == "lightning" && len(args) == 1:
+		if err := s.SetParameter("lightning", args[0]); err != nil {
+			return err
+		}
+		fmt.Println("lightning: ", s.lightning)
+	case fields[1] == "stats":
+		s.printStats()
+	case fields[1] == "export":
+		base := dataPath(s.Name() + "_fires")
+		if err := s.fires.export(base); err != nil {
+			return fmt.Errorf("export failed: %v", err)
+		}
+		fmt.Println("Exported fires to: " + base + "_*")
+	default:
+		return fmt.Errorf("unknown fire command: %s", event)
+	}
+	return nil
+}
+
+func (s *ForestFireModel) printStats() {
+	n := len(s.density)
+	if n == 0 {
+		return
+	}
+
+	// Skip the initial transient
+	mean := 0.0
+	for _, v := range s.density[n/4:] {
+		mean += v
+	}
+	mean /= float64(n - n/4)
+
+	fmt.Printf("step: %d, p: %g, f: %g, p/f: %.0f\n", n-1, s.growth, s.lightning, s.growth/s.lightning)
+	fmt.Printf("tree density: %.4f, mean: %.4f\n", s.density[n-1], mean)
+	fmt.Println(s.fires.toString(s.raster.Width() * s.raster.Height() / 100))
+}
+
+// ignite starts a new fire at col,row. In instant mode the whole
+// cluster burns at once and the fire is recorded.
+func (s *ForestFireModel) ignite(col, row int) {
+	s.nextFire++
+	fire := s.nextFire
+
+	if s.instant {
+		size := floodFill(s.raster.Width(), s.raster.Height(), 4, col, row,
+			func(c, r int) bool { return s.cells.at(c, r).state == 1 && s.cells.at(c, r).nextState == 1 },
+			func(c, r int) {
+				s.cells.at(c, r).nextState = 0
+				s.cells.at(c, r).fire = fire
+			})
+		s.fires.add(size)
+		return
+	}
+
+	s.cells.at(col, row).nextState = 2
+	s.cells.at(col, row).fire = fire
+	s.burnt[fire] = 1
+}
+
+func (s *ForestFireModel) record() {
+	w := s.raster.Width()
+	h := s.raster.Height()
+	trees := 0
+
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			if s.cells.at(col, row).state == 1 {
+				trees++
+			}
+		}
+	}
+
+	s.density = append(s.density, float64(trees)/float64(w*h))
+}
+
+// Snapshot returns the cells and the fires still burning.
+func (s *ForestFireModel) Snapshot() []byte {
+	w := stateWriter{}
+	w.int(len(s.cells.cells))
+	for _, c := range s.cells.cells {
+		w.int(c.state)
+		w.int(c.fire)
+	}
+	w.int(s.nextFire)
+
+	fires := []int{}
+	for k := range s.burnt {
+		fires = append(fires, k)
+	}
+	sort.Ints(fires)
+	w.int(len(fires))
+	for _, k := range fires {
+		w.int(k)
+		w.int(s.burnt[k])
+	}
+
+	w.int(len(s.fires.sizes))
+	w.int(len(s.density))
+	return w.buf
+}
+
+// Restore sets the cells and the burning fires from a snapshot, cuts
+// the fire sizes and the density back to its step and redraws the
+// cells.
+func (s *ForestFireModel) Restore(snapshot []byte) error {
+	r := stateReader{buf: snapshot}
+	if r.int() != len(s.cells.cells) {
+		return errBadSnapshot
+	}
+	cells := make([]FCell, len(s.cells.cells))
+	for i := range cells {
+		cells[i].state = r.int()
+		cells[i].fire = r.int()
+	}
+	nextFire := r.int()
+	burnt := map[int]int{}
+	for i, n := 0, r.count(); i < n; i++ {
+		k := r.int()
+		burnt[k] = r.int()
+	}
+	fires := r.length(len(s.fires.sizes))
+	density := r.length(len(s.density))
+	if err := r.done(); err != nil {
+		return err
+	}
+
+	copy(s.cells.cells, cells)
+	s.nextFire = nextFire
+	s.burnt = burnt
+	s.burning = map[int]int{}
+	s.fires.sizes = s.fires.sizes[:fires]
+	s.density = s.density[:density]
+
+	w := s.raster.Width()
+	h := s.raster.Height()
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			c := s.cells.at(col, row)
+			switch c.state {
+			case 1:
+				s.raster.SetPixelColor(s.treeColor)
+			case 2:
+				s.raster.SetPixelColor(s.burningColor)
+				s.burning[c.fire]++
+			default:
+				s.raster.SetPixelColor(s.emptyColor)
+			}
+			s.raster.SetPixel(col, row)
+		}
+	}
+	return nil
+}
+
+func (s *ForestFireModel) Properties() api.IProperties {
+	return raster.NewProperties(300, 300, 1500, 100, 1)
+}
+
+func (s *ForestFireModel) Reset() {
+	fmt.Println(("--- fire reset ---"))
+	s.raster.Clear()
+
+	w := s.raster.Width()
+	h := s.raster.Height()
+
+	s.raster.SetPixelColor(s.emptyColor)
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			*s.cells.at(col, row) = FCell{}
+			s.raster.SetPixel(col, row)
+		}
+	}
+
+	s.nextFire = 0
+	s.burning = map[int]int{}
+	s.burnt = map[int]int{}
+	s.fires.reset()
+	s.density = []float64{}
+	s.record()
+}
+
+func (s *ForestFireModel) Step() bool {
+	w := s.raster.Width()
+	h := s.raster.Height()
+
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			s.cells.at(col, row).nextState = s.cells.at(col, row).state
+		}
+	}
+
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			c := s.cells.at(col, row)
+			switch c.state {
+			case 0: // Empty
+				if rand.Float64() < s.growth {
+					c.nextState = 1
+				}
+			case 1: // Tree
+				if c.nextState == 1 && rand.Float64() < s.lightning {
+					s.ignite(col, row)
+				}
+			case 2: // Burning
+				c.nextState = 0
+				for _, n := range neighbors(4) {
+					nc := col + n[0]
+					nr := row + n[1]
+					if nc < 0 || nc >= w || nr < 0 || nr >= h {
+						continue
+					}
+					t := s.cells.at(nc, nr)
+					if t.state == 1 && t.nextState == 1 {
+						t.nextState = 2
+						t.fire = c.fire
+						s.burnt[c.fire]++
+					}
+				}
+			}
+		}
+	}
+
+	// Copy next-state to current-state
+	for k := range s.burning {
+		s.burning[k] = 0
+	}
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			c := s.cells.at(col, row)
+			if c.state != c.nextState {
+				c.state = c.nextState
+				switch c.state {
+				case 0:
+					s.raster.SetPixelColor(s.emptyColor)
+				case 1:
+					s.raster.SetPixelColor(s.treeColor)
+				case 2:
+					s.raster.SetPixelColor(s.burningColor)
+				}
+				s.raster.SetPixel(col, row)
+			}
+			if c.state == 2 {
+				s.burning[c.fire]++
+			}
+		}
+	}
+
+	// Fires that burnt out, in the order they started
+	out := []int{}
+	for k := range s.burnt {
+		if s.burning[k] == 0 {
+			out = append(out, k)
+		}
+	}
+	sort.Ints(out)
+	for _, k := range out {
+		s.fires.add(s.burnt[k])
+		delete(s.burnt, k)
+		delete(s.burning, k)
+	}
+
+	s.record()
+
+	return true
+}
@@ -0,0 +1,341 @@
+package simulation
+
+import (
+	"Netron1-Go/api"
+	"Netron1-Go/raster"
+	"container/heap"
+	"fmt"
+	"image/color"
+	"math/rand"
+	"strings"
+)
+
+// The invasion percolation model gives every cell a random strength.
+// Starting from the center, the invaded cluster always invades the
+// weakest cell on its boundary. The invasion stops when the cluster
+// reaches an edge. Strengths below the percolation threshold pc are
+// invaded about uniformly and hardly any above it, so pc is estimated
+// from where the histogram of invaded strengths drops.
+//   invasion rate <cells per step>
+//   invasion degree <4..8>
+//   invasion stop <edge|none>
+//   invasion stats     invaded density, cluster geometry and pc estimate
+
+type InvasionModel struct {
+	infectedColor color.RGBA
+	boundaryColor color.RGBA
+
+	raster api.IRasterBuffer
+	// Strength of each cell. Invaded cells are marked with -1.
+	strength *FloatGrid
+	queued   *BitGrid
+	boundary siteHeap
+
+	rate int
+	// degree goes from 4 to 8
+	degree     int
+	stopAtEdge bool
+
+	invaded   int
+	maxInvade float64
+	// Invaded cells by strength, in invadedBins bins
+	histogram []int
+}
+
+const invadedBins = 100
+
+// site is a boundary cell waiting to be invaded.
+type site struct {
+	col, row int
+	strength float64
+}
+
+// siteHeap orders boundary cells weakest first.
+type siteHeap []site
+
+func (h siteHeap) Len() int            { return len(h) }
+func (h siteHeap) Less(i, j int) bool  { return h[i].strength < h[j].strength }
+func (h siteHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *siteHeap) Push(x interface{}) { *h = append(*h, x.(site)) }
+func (h *siteHeap) Pop() interface{} {
+	old := *h
+	s := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return s
+}
+
+func NewInvasionModel() api.IModel {
+	o := new(InvasionModel)
+	// Invaded = Blue
+	o.infectedColor = color.RGBA{R: 0, G: 0, B: 255, A: 255}
+	// Boundary = Yellow
+	o.boundaryColor = color.RGBA{R: 255, G: 220, B: 0, A: 255}
+
+	return o
+}
+
+func (s *InvasionModel) Name() string {
+	return "InvasionModel"
+}
+
+func (s *InvasionModel) Configure(rasterBuffer api.IRasterBuffer) {
+	s.raster = rasterBuffer
+	s.rate = 20
+	s.degree = 4
+	s.stopAtEdge = true
+
+	rand.Seed(13163)
+
+	s.strength = NewFloatGrid(s.raster.Width(), s.raster.Height())
+	s.queued = NewBitGrid(s.raster.Width(), s.raster.Height())
+	s.histogram = make([]int, invadedBins)
+}
+
+// SetParameter sets rate or degree by name.
+func (s *InvasionModel) SetParameter(name string, value float64) error {
+	switch name {
+	case "rate":
+		if value < 1 {
+			return fmt.Errorf("rate must be at least 1")
+		}
+		s.rate = int(value)
+	case "degree":
+		if value < 4 || value > 8 {
+			return fmt.Errorf("degree must be 4 to 8")
+		}
+		s.degree = int(value)
+	default:
+		return fmt.Errorf("unknown parameter: %s", name)
+	}
+	return nil
+}
+
+// SendEvent receives an event from the host simulation
+func (s *InvasionModel) SendEvent(event string) error {
+	fields := strings.Fields(event)
+	if len(fields) < 2 || fields[0] != "invasion" {
+		return unhandled(event)
+	}
+
+	if fields[1] == "stop" && len(fields) == 3 {
+		if fields[2] != "edge" && fields[2] != "none" {
+			return fmt.Errorf("usage: invasion stop <edge|none>")
+		}
+		s.stopAtEdge = fields[2] == "edge"
+		fmt.Println("stop at edge: ", s.stopAtEdge)
+		return nil
+	}
+
+	args, err := parseInts(fields[2:])
+	if err != nil {
+		return fmt.Errorf("invasion: %v", err)
+	}
+
+	switch {
+	case fields[1] == "rate" && len(args) == 1:
+		if err := s.SetParameter("rate", float64(args[0])); err != nil {
+			return err
+		}
+		fmt.Println("invasion rate: ", s.rate)
+	case fields[1] == "degree" && len(args) == 1:
+		if err := s.SetParameter("degree", float64(args[0])); err != nil {
+			return err
+		}
+		fmt.Println("degree: ", s.degree)
+	case fields[1] == "stats":
+		s.printStats()
+	default:
+		return fmt.Errorf("unknown invasion command: %s", event)
+	}
+	return nil
+}
+
+func (s *InvasionModel) printStats() {
+	g := measureClusters(s.raster.Width(), s.raster.Height(), s.degree, func(col, row int) bool {
+		return s.strength.get(col, row) < 0
+	})
+	fmt.Println("invaded: ", s.invaded, ", boundary: ", s.boundary.Len())
+	fmt.Println(g.toString(s.raster.Width() * s.raster.Height()))
+
+	if pc, ok := s.estimatePc(); ok {
+		fmt.Printf("max invaded strength: %.4f, pc estimate: %.4f\n", s.maxInvade, pc)
+	} else {
+		fmt.Printf("max invaded strength: %.4f\n", s.maxInvade)
+	}
+}
+
+// estimatePc finds the strength where the histogram of invaded
+// strengths drops to a twentieth of its level. The level is the mean
+// of the bins under 0.25, below pc for every degree. On a finite
+// lattice the bins just below pc are only partly invaded, so the
+// cutoff is where the histogram runs out rather than where it first
+// dips. The bin it drops in adds the part of a bin its count fills.
+// Returns false without a drop, e.g. after invading past an edge.
+func (s *InvasionModel) estimatePc() (float64, bool) {
+	low := invadedBins / 4
+	level := 0.0
+	for _, n := range s.histogram[:low] {
+		level += float64(n)
+	}
+	level /= float64(low)
+	if level == 0 {
+		return 0, false
+	}
+
+	for b := low; b < invadedBins; b++ {
+		n := float64(s.histogram[b])
+		if n < level/20 {
+			return (float64(b) + n/level) / invadedBins, true
+		}
+	}
+	return 0, false
+}
+
+// invade adds col,row to the cluster and its neighbors to the
+// boundary. Returns true if the cell is on an edge.
+func (s *InvasionModel) invade(col, row int) bool {
+	w := s.raster.Width()
+	h := s.raster.Height()
+
+	b := int(s.strength.get(col, row) * invadedBins)
+	if b >= invadedBins {
+		b = invadedBins - 1
+	}
+	s.histogram[b]++
+	if s.strength.get(col, row) > s.maxInvade {
+		s.maxInvade = s.strength.get(col, row)
+	}
+	s.strength.set(col, row, -1)
+	s.invaded++
+	s.raster.SetPixelColor(s.infectedColor)
+	s.raster.SetPixel(col, row)
+
+	s.raster.SetPixelColor(s.boundaryColor)
+	for _, n := range neighbors(s.degree) {
+		nc := col + n[0]
+		nr := row + n[1]
+		if !s.queued.in(nc, nr) || s.queued.get(nc, nr) {
+			continue
+		}
+		s.queued.set(nc, nr, true)
+		heap.Push(&s.boundary, site{col: nc, row: nr, strength: s.strength.get(nc, nr)})
+		s.raster.SetPixel(nc, nr)
+	}
+
+	return col == 0 || col == w-1 || row == 0 || row == h-1
+}
+
+// Snapshot returns the strengths, the invaded cluster and its
+// boundary.
+func (s *InvasionModel) Snapshot() []byte {
+	w := stateWriter{}
+	w.floats(s.strength.values)
+	w.bits(s.queued)
+	w.int(len(s.boundary))
+	for _, b := range s.boundary {
+		w.int(b.col)
+		w.int(b.row)
+	}
+	w.int(s.invaded)
+	w.float(s.maxInvade)
+	w.ints(s.histogram)
+	return w.buf
+}
+
+// Restore sets the cluster and its boundary from a snapshot and
+// redraws the cells.
+func (s *InvasionModel) Restore(snapshot []byte) error {
+	r := stateReader{buf: snapshot}
+	strength := r.floats(len(s.strength.values))
+	queued := r.bits(s.queued)
+	boundary := make(siteHeap, r.count())
+	for i := range boundary {
+		boundary[i].col = r.int()
+		boundary[i].row = r.int()
+		if !s.strength.in(boundary[i].col, boundary[i].row) {
+			return errBadSnapshot
+		}
+	}
+	invaded := r.int()
+	maxInvade := r.float()
+	histogram := r.ints(invadedBins)
+	if err := r.done(); err != nil {
+		return err
+	}
+
+	copy(s.strength.values, strength)
+	copy(s.queued.bits, queued)
+	for i := range boundary {
+		boundary[i].strength = s.strength.get(boundary[i].col, boundary[i].row)
+	}
+	s.boundary = boundary
+	s.invaded = invaded
+	s.maxInvade = maxInvade
+	copy(s.histogram, histogram)
+
+	w := s.raster.Width()
+	h := s.raster.Height()
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			v := s.strength.get(col, row)
+			switch {
+			case v < 0:
+				s.raster.SetPixelColor(s.infectedColor)
+			case s.queued.get(col, row):
+				s.raster.SetPixelColor(s.boundaryColor)
+			default:
+				g := uint8(255 - 100*v)
+				s.raster.SetPixelColor(color.RGBA{R: g, G: g, B: g, A: 255})
+			}
+			s.raster.SetPixel(col, row)
+		}
+	}
+	return nil
+}
+
+func (s *InvasionModel) Properties() api.IProperties {
+	return raster.NewProperties(300, 300, 1500, 100, 1)
+}
+
+func (s *InvasionModel) Reset() {
+	fmt.Println(("--- invasion reset ---"))
+	s.raster.Clear()
+
+	w := s.raster.Width()
+	h := s.raster.Height()
+
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			s.strength.set(col, row, rand.Float64())
+			s.queued.set(col, row, false)
+			// Stronger cells are darker
+			g := uint8(255 - 100*s.strength.get(col, row))
+			s.raster.SetPixelColor(color.RGBA{R: g, G: g, B: g, A: 255})
+			s.raster.SetPixel(col, row)
+		}
+	}
+
+	s.boundary = siteHeap{}
+	s.invaded = 0
+	for i := range s.histogram {
+		s.histogram[i] = 0
+	}
+	s.maxInvade = 0
+
+	s.queued.set(w/2, h/2, true)
+	s.invade(w/2, h/2)
+}
+
+func (s *InvasionModel) Step() bool {
+	for i := 0; i < s.rate; i++ {
+		if s.boundary.Len() == 0 {
+			return false
+		}
+		next := heap.Pop(&s.boundary).(site)
+		if s.invade(next.col, next.row) && s.stopAtEdge {
+			return false
+		}
+	}
+
+	return true
+}
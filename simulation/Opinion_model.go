@@ -0,0 +1,566 @@
+package simulation
+
+import (
+	"Netron1-Go/api"
+	"Netron1-Go/raster"
+	"context"
+	"fmt"
+	"image/color"
+	"math/rand"
+	"strings"
+)
+
+// The opinion model runs voter, majority and Sznajd dynamics with q
+// opinions. Each step is one sweep of w*h random updates:
+//   voter      a cell copies a random neighbor
+//   majority   a cell adopts its neighbors' most common opinion, or
+//              with probability noise a random opinion
+//   sznajd     a cell and a random neighbor that agree convince all
+//              of their neighbors
+// Zealots never change their opinion, like knowledge centers. They are
+// added with the mouse (left = opinion 0, right = opinion 1) or:
+//   opinion rule <voter|majority|sznajd>
+//   opinion states <2..4>
+//   opinion degree <4..8>
+//   opinion degrees <file.png>       per cell degrees from a degree map
+//   opinion noise <0..1>
+//   opinion zealot <col> <row> <opinion>
+//   opinion zealots <count> <opinion>
+//   opinion clear                    removes the zealots
+//   opinion stats                    fractions, interface density, consensus
+//   opinion consensus <trials> <maxSteps>   mean consensus time, run in
+//                                           the background
+//   opinion export                   writes the interface density series
+
+const (
+	voterRule = iota
+	majorityRule
+	sznajdRule
+)
+
+var opinionRules = []string{"voter", "majority", "sznajd"}
+
+type OpinionModel struct {
+	opinionColors []color.RGBA
+	zealotColors  []color.RGBA
+
+	raster api.IRasterBuffer
+	cells  *Grid
+	zealot *BitGrid
+
+	rule   int
+	states int
+	// Opinions from the next reset, 0 = unchanged
+	nextStates int
+	// degree goes from 4 to 8
+	degree int
+	// Imported degree map. nil = degree for every cell
+	degreeMap *IntGrid
+	noise     float64
+
+	step      int
+	consensus int
+
+	// Fraction of disagreeing neighbor pairs and of each opinion per step
+	interfaces []float64
+	fractions  [][]float64
+
+	jobs
+}
+
+func NewOpinionModel() api.IModel {
+	o := new(OpinionModel)
+	o.opinionColors = []color.RGBA{
+		{R: 255, G: 127, B: 0, A: 255}, // Orange
+		{R: 0, G: 255, B: 100, A: 255}, // Green
+		{R: 0, G: 200, B: 200, A: 255}, // Teal
+		{R: 255, G: 0, B: 255, A: 255}, // Purple
+	}
+	o.zealotColors = []color.RGBA{
+		{R: 150, G: 60, B: 0, A: 255},
+		{R: 0, G: 120, B: 40, A: 255},
+		{R: 0, G: 90, B: 90, A: 255},
+		{R: 120, G: 0, B: 120, A: 255},
+	}
+
+	return o
+}
+
+func (s *OpinionModel) Name() string {
+	return "OpinionModel"
+}
+
+// Palette returns the opinion and zealot colors.
+func (s *OpinionModel) Palette() color.Palette {
+	p := color.Palette{}
+	for _, c := range s.opinionColors {
+		p = append(p, c)
+	}
+	for _, c := range s.zealotColors {
+		p = append(p, c)
+	}
+	return p
+}
+
+func (s *OpinionModel) Configure(rasterBuffer api.IRasterBuffer) {
+	s.raster = rasterBuffer
+	s.rule = voterRule
+	s.states = 2
+	s.degree = 4
+	s.noise = 0.05
+
+	rand.Seed(13163)
+
+	s.cells = NewGrid(s.raster.Width(), s.raster.Height())
+	s.zealot = NewBitGrid(s.raster.Width(), s.raster.Height())
+}
+
+// SetParameter sets states, taking effect on reset, degree or noise
+// by name.
+func (s *OpinionModel) SetParameter(name string, value float64) error {
+	switch name {
+	case "states":
+		if value < 2 || int(value) > len(s.opinionColors) {
+			return fmt.Errorf("states must be 2 to %d", len(s.opinionColors))
+		}
+		s.nextStates = int(value)
+	case "degree":
+		if value < 4 || value > 8 {
+			return fmt.Errorf("degree must be 4 to 8")
+		}
+		s.degree = int(value)
+		s.degreeMap = nil
+		s.assignDegrees()
+	case "noise":
+		return setChance(&s.noise, name, value)
+	default:
+		return fmt.Errorf("unknown parameter: %s", name)
+	}
+	return nil
+}
+
+// SendEvent receives an event from the host simulation
+func (s *OpinionModel) SendEvent(event string) error {
+	fields := strings.Fields(event)
+	if len(fields) < 2 {
+		return unhandled(event)
+	}
+
+	switch fields[0] {
+	case "mouse":
+		// mouse down <button> <col> <row>
+		if len(fields) != 5 || fields[1] != "down" {
+			return nil
+		}
+		args, err := parseInts(fields[2:])
+		if err != nil {
+			return nil
+		}
+		switch args[0] {
+		case 1: // Left
+			return s.addZealot(args[1], args[2], 0)
+		case 3: // Right
+			return s.addZealot(args[1], args[2], 1)
+		}
+		return nil
+	case "opinion":
+		return s.opinionEvent(fields[1:])
+	}
+	return unhandled(event)
+}
+
+func (s *OpinionModel) opinionEvent(fields []string) error {
+	switch {
+	case fields[0] == "rule" && len(fields) == 2:
+		for i, r := range opinionRules {
+			if r == fields[1] {
+				s.rule = i
+				fmt.Println("opinion rule: ", r)
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown opinion rule: %s", fields[1])
+	case fields[0] == "degrees" && len(fields) == 2:
+		degrees, err := loadDegreeMap(dataPath(fields[1]), s.raster.Width(), s.raster.Height())
+		if err != nil {
+			return fmt.Errorf("degree map: %v", err)
+		}
+		s.degreeMap = degrees
+		s.assignDegrees()
+		fmt.Println("Imported degree map from: " + dataPath(fields[1]))
+		return nil
+	}
+
+	args, err := parseFloats(fields[1:])
+	if err != nil {
+		return fmt.Errorf("opinion: %v", err)
+	}
+
+	switch {
+	case fields[0] == "states" && len(args) == 1:
+		if err := s.SetParameter("states", args[0]); err != nil {
+			return err
+		}
+		fmt.Println("opinions: ", s.nextStates, " (takes effect on reset)")
+	case fields[0] == "degree" && len(args) == 1:
+		if err := s.SetParameter("degree", args[0]); err != nil {
+			return err
+		}
+		fmt.Println("degree: ", s.degree)
+	case fields[0] == "noise" && len(args) == 1:
+		if err := s.SetParameter("noise", args[0]); err != nil {
+			return err
+		}
+		fmt.Println("noise: ", s.noise)
+	case fields[0] == "zealot" && len(args) == 3:
+		return s.addZealot(int(args[0]), int(args[1]), int(args[2]))
+	case fields[0] == "zealots" && len(args) == 2:
+		for i := 0; i < int(args[0]); i++ {
+			if err := s.addZealot(rand.Intn(s.raster.Width()), rand.Intn(s.raster.Height()), int(args[1])); err != nil {
+				return err
+			}
+		}
+	case fields[0] == "clear":
+		s.zealot.clear()
+		s.draw()
+		fmt.Println("zealots removed")
+	case fields[0] == "stats":
+		s.printStats()
+	case fields[0] == "consensus" && len(args) == 2 && args[0] >= 1:
+		s.start(s.consensusTrials(int(args[0]), int(args[1])))
+		fmt.Println("consensus trials started")
+	case fields[0] == "export":
+		path := dataPath(s.Name() + "_interfaces.csv")
+		names := []string{"interface"}
+		for i := range s.fractions {
+			names = append(names, fmt.Sprintf("opinion%d", i))
+		}
+		if err := writeColumnsCSV(path, "step", names, append([][]float64{s.interfaces}, s.fractions...)); err != nil {
+			return fmt.Errorf("export failed: %v", err)
+		}
+		fmt.Println("Exported stats to: " + path)
+	default:
+		return fmt.Errorf("unknown opinion command: %s", strings.Join(fields, " "))
+	}
+	return nil
+}
+
+func (s *OpinionModel) addZealot(col, row, opinion int) error {
+	if col < 0 || col >= s.raster.Width() || row < 0 || row >= s.raster.Height() || opinion < 0 || opinion >= s.states {
+		return fmt.Errorf("invalid zealot: %d %d %d", col, row, opinion)
+	}
+	s.zealot.set(col, row, true)
+	s.cells.at(col, row).state = opinion
+	s.drawCell(col, row)
+	// A zealot may break the consensus
+	s.consensus = -1
+	return nil
+}
+
+func (s *OpinionModel) assignDegrees() {
+	for i := range s.cells.cells {
+		if s.degreeMap != nil {
+			s.cells.cells[i].degree = s.degreeMap.values[i]
+		} else {
+			s.cells.cells[i].degree = s.degree
+		}
+	}
+}
+
+func (s *OpinionModel) printStats() {
+	n := len(s.interfaces)
+	if n == 0 {
+		return
+	}
+
+	fmt.Println("step: ", s.step, ", rule: ", opinionRules[s.rule])
+	for i := range s.fractions {
+		fmt.Printf("opinion %d: %.4f\n", i, s.fractions[i][n-1])
+	}
+	fmt.Printf("interface density: %.4f\n", s.interfaces[n-1])
+	if s.consensus >= 0 {
+		fmt.Println("consensus at step: ", s.consensus)
+	}
+}
+
+// consensusTrials returns a job that runs a copy of the model until
+// consensus or maxSteps and reports the mean consensus time. The
+// copy keeps the zealots.
+func (s *OpinionModel) consensusTrials(trials, maxSteps int) job {
+	m := s.copy()
+	return func(ctx context.Context) (string, error) {
+		total, reached := 0, 0
+		for t := 0; t < trials; t++ {
+			m.populate()
+			for ctx.Err() == nil && m.step < maxSteps && m.Step() {
+			}
+			if err := ctx.Err(); err != nil {
+				return "", err
+			}
+			if m.consensus >= 0 {
+				total += m.consensus
+				reached++
+			}
+		}
+
+		report := fmt.Sprintf("consensus reached: %d/%d", reached, trials)
+		if reached > 0 {
+			report += fmt.Sprintf(", mean time: %.1f steps", float64(total)/float64(reached))
+		}
+		return report, nil
+	}
+}
+
+// copy returns a model with the same parameters, cells and zealots, on
+// a raster of its own.
+func (s *OpinionModel) copy() *OpinionModel {
+	c := *s
+	c.jobs = jobs{}
+	c.raster = raster.NewRasterBuffer(s.raster.Width(), s.raster.Height())
+	c.cells = s.cells.clone()
+	c.zealot = s.zealot.clone()
+	c.interfaces = nil
+	c.fractions = nil
+	return &c
+}
+
+// neighbor returns a random neighbor of col,row.
+func (s *OpinionModel) neighbor(col, row int) (int, int) {
+	w := s.raster.Width()
+	h := s.raster.Height()
+	offsets := neighbors(s.cells.at(col, row).degree)
+
+	for {
+		n := offsets[rand.Intn(len(offsets))]
+		nc := col + n[0]
+		nr := row + n[1]
+		if nc >= 0 && nc < w && nr >= 0 && nr < h {
+			return nc, nr
+		}
+	}
+}
+
+// majority returns the most common opinion among the neighbors of
+// col,row. Ties keep the cell's opinion if it is one of them.
+func (s *OpinionModel) majority(col, row int) int {
+	w := s.raster.Width()
+	h := s.raster.Height()
+	counts := make([]int, s.states)
+
+	for _, n := range neighbors(s.cells.at(col, row).degree) {
+		nc := col + n[0]
+		nr := row + n[1]
+		if nc >= 0 && nc < w && nr >= 0 && nr < h {
+			counts[s.cells.at(nc, nr).state]++
+		}
+	}
+
+	best := s.cells.at(col, row).state
+	for o, c := range counts {
+		if c > counts[best] {
+			best = o
+		}
+	}
+	return best
+}
+
+// convince sets the opinion of col,row unless it is a zealot.
+func (s *OpinionModel) convince(col, row, opinion int) {
+	if s.zealot.get(col, row) || s.cells.at(col, row).state == opinion {
+		return
+	}
+	s.cells.at(col, row).state = opinion
+	s.drawCell(col, row)
+}
+
+// update applies the rule to one random cell.
+func (s *OpinionModel) update() {
+	w := s.raster.Width()
+	h := s.raster.Height()
+	col, row := rand.Intn(w), rand.Intn(h)
+
+	switch s.rule {
+	case voterRule:
+		nc, nr := s.neighbor(col, row)
+		s.convince(col, row, s.cells.at(nc, nr).state)
+	case majorityRule:
+		if rand.Float64() < s.noise {
+			s.convince(col, row, rand.Intn(s.states))
+		} else {
+			s.convince(col, row, s.majority(col, row))
+		}
+	case sznajdRule:
+		nc, nr := s.neighbor(col, row)
+		opinion := s.cells.at(col, row).state
+		if s.cells.at(nc, nr).state != opinion {
+			return
+		}
+		for _, pair := range [][2]int{{col, row}, {nc, nr}} {
+			for _, n := range neighbors(s.cells.at(pair[0], pair[1]).degree) {
+				c := pair[0] + n[0]
+				r := pair[1] + n[1]
+				if c >= 0 && c < w && r >= 0 && r < h {
+					s.convince(c, r, opinion)
+				}
+			}
+		}
+	}
+}
+
+// record appends the interface density and the opinion fractions.
+// Returns true if every cell has the same opinion.
+func (s *OpinionModel) record() bool {
+	w := s.raster.Width()
+	h := s.raster.Height()
+	counts := make([]int, s.states)
+	pairs, disagree := 0, 0
+
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			o := s.cells.at(col, row).state
+			counts[o]++
+			if col+1 < w {
+				pairs++
+				if s.cells.at(col+1, row).state != o {
+					disagree++
+				}
+			}
+			if row+1 < h {
+				pairs++
+				if s.cells.at(col, row+1).state != o {
+					disagree++
+				}
+			}
+		}
+	}
+
+	s.interfaces = append(s.interfaces, float64(disagree)/float64(pairs))
+	for i := range s.fractions {
+		s.fractions[i] = append(s.fractions[i], float64(counts[i])/float64(w*h))
+	}
+
+	return disagree == 0
+}
+
+func (s *OpinionModel) drawCell(col, row int) {
+	o := s.cells.at(col, row).state
+	if s.zealot.get(col, row) {
+		s.raster.SetPixelColor(s.zealotColors[o])
+	} else {
+		s.raster.SetPixelColor(s.opinionColors[o])
+	}
+	s.raster.SetPixel(col, row)
+}
+
+func (s *OpinionModel) draw() {
+	for col := 0; col < s.raster.Width(); col += 1 {
+		for row := 0; row < s.raster.Height(); row += 1 {
+			s.drawCell(col, row)
+		}
+	}
+}
+
+// Snapshot returns the opinions and the zealots. The degrees are
+// parameters, so a branch keeps the current ones.
+func (s *OpinionModel) Snapshot() []byte {
+	w := stateWriter{}
+	w.int(s.states)
+	w.int(len(s.cells.cells))
+	for _, c := range s.cells.cells {
+		w.int(c.state)
+	}
+	w.bits(s.zealot)
+	w.int(s.step)
+	w.int(s.consensus)
+	w.int(len(s.interfaces))
+	return w.buf
+}
+
+// Restore sets the opinions and the zealots from a snapshot, cuts the
+// series back to its step and redraws the cells. The snapshot must
+// have as many opinions as the model.
+func (s *OpinionModel) Restore(snapshot []byte) error {
+	r := stateReader{buf: snapshot}
+	if r.int() != s.states || r.int() != len(s.cells.cells) {
+		return errBadSnapshot
+	}
+	states := make([]int, len(s.cells.cells))
+	for i := range states {
+		states[i] = r.int()
+		if states[i] < 0 || states[i] >= s.states {
+			return errBadSnapshot
+		}
+	}
+	zealot := r.bits(s.zealot)
+	step := r.int()
+	consensus := r.int()
+	n := r.length(len(s.interfaces))
+	if err := r.done(); err != nil {
+		return err
+	}
+
+	for i := range states {
+		s.cells.cells[i].state = states[i]
+	}
+	copy(s.zealot.bits, zealot)
+	s.step = step
+	s.consensus = consensus
+	s.interfaces = s.interfaces[:n]
+	for i := range s.fractions {
+		s.fractions[i] = s.fractions[i][:n]
+	}
+	s.draw()
+	return nil
+}
+
+func (s *OpinionModel) Properties() api.IProperties {
+	return raster.NewProperties(300, 300, 1500, 100, 1)
+}
+
+func (s *OpinionModel) Reset() {
+	fmt.Println(("--- opinion reset ---"))
+	s.raster.Clear()
+	s.populate()
+	s.draw()
+}
+
+// populate gives every cell that isn't a zealot a random opinion.
+func (s *OpinionModel) populate() {
+	if s.nextStates > 0 {
+		s.states = s.nextStates
+		s.nextStates = 0
+	}
+	s.assignDegrees()
+	for col := 0; col < s.cells.w; col++ {
+		for row := 0; row < s.cells.h; row++ {
+			c := s.cells.at(col, row)
+			if !s.zealot.get(col, row) || c.state >= s.states {
+				s.zealot.set(col, row, false)
+				c.state = rand.Intn(s.states)
+			}
+		}
+	}
+
+	s.step = 0
+	s.consensus = -1
+	s.interfaces = []float64{}
+	s.fractions = make([][]float64, s.states)
+	if s.record() {
+		s.consensus = 0
+	}
+}
+
+func (s *OpinionModel) Step() bool {
+	n := s.raster.Width() * s.raster.Height()
+	for i := 0; i < n; i++ {
+		s.update()
+	}
+	s.step++
+
+	if s.record() && s.consensus < 0 {
+		s.consensus = s.step
+		fmt.Println("consensus at step: ", s.step)
+	}
+
+	return s.consensus < 0
+}
@@ -0,0 +1,390 @@
+package simulation
+
+import (
+	"Netron1-Go/api"
+	"Netron1-Go/raster"
+	"context"
+	"fmt"
+	"image/color"
+	"math/rand"
+	"strings"
+)
+
+// The percolation model is static site or bond percolation on the
+// square lattice. Reset occupies sites, or opens bonds, with
+// probability p and labels the clusters. Running the model then burns
+// the clusters from the left edge one shell per step, which animates
+// the incipient cluster near pc (0.5 bond, ~0.5927 site) and measures
+// the shortest path across.
+//   perc mode <site|bond>
+//   perc p <p>
+//   perc stats       cluster geometry, mean cluster size and spanning
+//   perc sweep <from> <to> <step> <trials>
+//                    spanning probability and mean cluster size per p,
+//                    run in the background
+
+type PercolationModel struct {
+	emptyColor    color.RGBA
+	occupiedColor color.RGBA
+	largestColor  color.RGBA
+
+	raster api.IRasterBuffer
+
+	bond bool
+	p    float64
+
+	// Occupied sites, or open bonds to the right and bottom neighbors
+	occupied  *BitGrid
+	bondRight *BitGrid
+	bondDown  *BitGrid
+
+	geometry ClusterGeometry
+	labels   *IntGrid
+
+	// Step each cell burnt at. 0 = not burnt
+	burnt    *IntGrid
+	front    [][2]int
+	burnStep int
+	crossed  int
+
+	jobs
+}
+
+func NewPercolationModel() api.IModel {
+	o := new(PercolationModel)
+	// Empty = White
+	o.emptyColor = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	// Occupied = Gray
+	o.occupiedColor = color.RGBA{R: 170, G: 170, B: 170, A: 255}
+	// Largest cluster = Blue
+	o.largestColor = color.RGBA{R: 0, G: 0, B: 255, A: 255}
+
+	return o
+}
+
+func (s *PercolationModel) Name() string {
+	return "PercolationModel"
+}
+
+func (s *PercolationModel) Configure(rasterBuffer api.IRasterBuffer) {
+	s.raster = rasterBuffer
+	s.bond = false
+	s.p = 0.5927
+
+	rand.Seed(13163)
+
+	w := s.raster.Width()
+	h := s.raster.Height()
+	s.occupied = NewBitGrid(w, h)
+	s.bondRight = NewBitGrid(w, h)
+	s.bondDown = NewBitGrid(w, h)
+	s.burnt = NewIntGrid(w, h)
+}
+
+// SetParameter sets p by name.
+func (s *PercolationModel) SetParameter(name string, value float64) error {
+	if name != "p" {
+		return fmt.Errorf("unknown parameter: %s", name)
+	}
+	if value < 0 || value > 1 {
+		return fmt.Errorf("p must be 0 to 1")
+	}
+	s.p = value
+	return nil
+}
+
+// SendEvent receives an event from the host simulation
+func (s *PercolationModel) SendEvent(event string) error {
+	fields := strings.Fields(event)
+	if len(fields) < 2 || fields[0] != "perc" {
+		return unhandled(event)
+	}
+
+	if fields[1] == "mode" && len(fields) == 3 {
+		if fields[2] != "site" && fields[2] != "bond" {
+			return fmt.Errorf("usage: perc mode <site|bond>")
+		}
+		s.bond = fields[2] == "bond"
+		fmt.Println("bond percolation: ", s.bond)
+		return nil
+	}
+
+	args, err := parseFloats(fields[2:])
+	if err != nil {
+		return fmt.Errorf("percolation: %v", err)
+	}
+
+	switch {
+	case fields[1] == "p" && len(args) == 1:
+		if err := s.SetParameter("p", args[0]); err != nil {
+			return err
+		}
+		fmt.Println("p: ", s.p)
+	case fields[1] == "stats":
+		s.printStats()
+	case fields[1] == "sweep" && len(args) == 4 && args[2] > 0 && args[3] >= 1:
+		s.start(s.sweep(args[0], args[1], args[2], int(args[3])))
+		fmt.Println("perc sweep started")
+	default:
+		return fmt.Errorf("unknown perc command: %s", event)
+	}
+	return nil
+}
+
+func (s *PercolationModel) printStats() {
+	kind := "site"
+	if s.bond {
+		kind = "bond"
+	}
+	fmt.Printf("%s percolation, p: %.4f\n", kind, s.p)
+	fmt.Println(s.geometry.toString(s.raster.Width() * s.raster.Height()))
+	fmt.Printf("mean cluster size: %.2f\n", s.geometry.meanSize())
+	if s.crossed > 0 {
+		fmt.Println("burnt across in: ", s.crossed, " steps")
+	} else {
+		fmt.Println("burning steps: ", s.burnStep)
+	}
+}
+
+// linked returns true if c,r and its neighbor nc,nr are connected.
+func (s *PercolationModel) linked(c, r, nc, nr int) bool {
+	if !s.bond {
+		return s.occupied.get(nc, nr)
+	}
+
+	switch {
+	case nc == c+1:
+		return s.bondRight.get(c, r)
+	case nc == c-1:
+		return s.bondRight.get(nc, nr)
+	case nr == r+1:
+		return s.bondDown.get(c, r)
+	default:
+		return s.bondDown.get(nc, nr)
+	}
+}
+
+// occupy draws a new configuration and labels its clusters.
+func (s *PercolationModel) occupy() {
+	w := s.raster.Width()
+	h := s.raster.Height()
+
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			if s.bond {
+				s.occupied.set(col, row, true)
+				s.bondRight.set(col, row, col < w-1 && rand.Float64() < s.p)
+				s.bondDown.set(col, row, row < h-1 && rand.Float64() < s.p)
+			} else {
+				s.occupied.set(col, row, rand.Float64() < s.p)
+			}
+		}
+	}
+
+	s.geometry, s.labels = measureLinkedClusters(w, h, 4,
+		func(col, row int) bool { return s.occupied.get(col, row) }, s.linked)
+}
+
+// sweep returns a job that measures the spanning probability and mean
+// cluster size over trials for each p on a copy of the model and
+// estimates pc where the spanning probability crosses 1/2.
+func (s *PercolationModel) sweep(from, to, step float64, trials int) job {
+	m := s.copy()
+	return func(ctx context.Context) (string, error) {
+		pc, prev, prevP := -1.0, 0.0, from
+		var report strings.Builder
+
+		fmt.Fprintln(&report, "p, spanning probability, mean cluster size")
+		for m.p = from; m.p <= to+step/2; m.p += step {
+			spanning, mean := 0, 0.0
+			for t := 0; t < trials; t++ {
+				if err := ctx.Err(); err != nil {
+					return "", err
+				}
+				m.occupy()
+				if m.geometry.spansX {
+					spanning++
+				}
+				mean += m.geometry.meanSize()
+			}
+			prob := float64(spanning) / float64(trials)
+			fmt.Fprintf(&report, "%.4f, %.3f, %.2f\n", m.p, prob, mean/float64(trials))
+
+			if pc < 0 && prob >= 0.5 {
+				pc = m.p
+				if m.p > from {
+					pc = prevP + (0.5-prev)/(prob-prev)*(m.p-prevP)
+				}
+			}
+			prev, prevP = prob, m.p
+		}
+		if pc >= 0 {
+			fmt.Fprintf(&report, "pc estimate: %.4f\n", pc)
+		}
+		return report.String(), nil
+	}
+}
+
+// copy returns a model with the same parameters, and grids and a
+// raster of its own.
+func (s *PercolationModel) copy() *PercolationModel {
+	c := *s
+	c.jobs = jobs{}
+	w := s.raster.Width()
+	h := s.raster.Height()
+	c.raster = raster.NewRasterBuffer(w, h)
+	c.occupied = NewBitGrid(w, h)
+	c.bondRight = NewBitGrid(w, h)
+	c.bondDown = NewBitGrid(w, h)
+	c.burnt = NewIntGrid(w, h)
+	c.labels = nil
+	c.front = nil
+	return &c
+}
+
+func (s *PercolationModel) draw() {
+	w := s.raster.Width()
+	h := s.raster.Height()
+
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			switch {
+			case s.geometry.largestLabel != 0 && s.labels.get(col, row) == s.geometry.largestLabel:
+				s.raster.SetPixelColor(s.largestColor)
+			case s.occupied.get(col, row) && (!s.bond || s.geometry.sizes[s.labels.get(col, row)-1] > 1):
+				s.raster.SetPixelColor(s.occupiedColor)
+			default:
+				s.raster.SetPixelColor(s.emptyColor)
+			}
+			s.raster.SetPixel(col, row)
+		}
+	}
+}
+
+// burnColor fades from red to yellow as the fire moves on.
+func burnColor(step int) color.RGBA {
+	return color.RGBA{R: 255, G: uint8((step * 2) % 256), B: 0, A: 255}
+}
+
+// Snapshot returns the configuration, whether it is of bonds, and how
+// far the fire has burnt.
+func (s *PercolationModel) Snapshot() []byte {
+	w := stateWriter{}
+	w.bool(s.bond)
+	w.bits(s.occupied)
+	w.bits(s.bondRight)
+	w.bits(s.bondDown)
+	w.ints(s.burnt.values)
+	w.int(len(s.front))
+	for _, c := range s.front {
+		w.int(c[0])
+		w.int(c[1])
+	}
+	w.int(s.burnStep)
+	w.int(s.crossed)
+	return w.buf
+}
+
+// Restore sets the configuration and the fire from a snapshot,
+// labels the clusters again and redraws the cells.
+func (s *PercolationModel) Restore(snapshot []byte) error {
+	r := stateReader{buf: snapshot}
+	bond := r.bool()
+	occupied := r.bits(s.occupied)
+	bondRight := r.bits(s.bondRight)
+	bondDown := r.bits(s.bondDown)
+	burnt := r.ints(len(s.burnt.values))
+	front := make([][2]int, r.count())
+	for i := range front {
+		front[i] = [2]int{r.int(), r.int()}
+		if !s.burnt.in(front[i][0], front[i][1]) {
+			return errBadSnapshot
+		}
+	}
+	burnStep := r.int()
+	crossed := r.int()
+	if err := r.done(); err != nil {
+		return err
+	}
+
+	s.bond = bond
+	copy(s.occupied.bits, occupied)
+	copy(s.bondRight.bits, bondRight)
+	copy(s.bondDown.bits, bondDown)
+	copy(s.burnt.values, burnt)
+	s.front = front
+	s.burnStep = burnStep
+	s.crossed = crossed
+
+	w := s.raster.Width()
+	h := s.raster.Height()
+	s.geometry, s.labels = measureLinkedClusters(w, h, 4,
+		func(col, row int) bool { return s.occupied.get(col, row) }, s.linked)
+	s.draw()
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			if step := s.burnt.get(col, row); step != 0 {
+				s.raster.SetPixelColor(burnColor(step))
+				s.raster.SetPixel(col, row)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *PercolationModel) Properties() api.IProperties {
+	return raster.NewProperties(300, 300, 1500, 100, 1)
+}
+
+func (s *PercolationModel) Reset() {
+	fmt.Println(("--- percolation reset ---"))
+	s.raster.Clear()
+
+	s.occupy()
+	s.draw()
+
+	// Light the left edge
+	s.front = [][2]int{}
+	s.burnStep = 1
+	s.crossed = 0
+	s.burnt.fill(0)
+	s.raster.SetPixelColor(burnColor(s.burnStep))
+	for row := 0; row < s.raster.Height(); row += 1 {
+		if s.occupied.get(0, row) {
+			s.burnt.set(0, row, s.burnStep)
+			s.front = append(s.front, [2]int{0, row})
+			s.raster.SetPixel(0, row)
+		}
+	}
+}
+
+func (s *PercolationModel) Step() bool {
+	w := s.raster.Width()
+
+	if len(s.front) == 0 {
+		return false
+	}
+
+	s.burnStep++
+	s.raster.SetPixelColor(burnColor(s.burnStep))
+	next := [][2]int{}
+	for _, c := range s.front {
+		for _, n := range neighbors(4) {
+			nc := c[0] + n[0]
+			nr := c[1] + n[1]
+			if !s.burnt.in(nc, nr) || s.burnt.get(nc, nr) != 0 || !s.linked(c[0], c[1], nc, nr) {
+				continue
+			}
+			s.burnt.set(nc, nr, s.burnStep)
+			next = append(next, [2]int{nc, nr})
+			s.raster.SetPixel(nc, nr)
+			if nc == w-1 && s.crossed == 0 {
+				s.crossed = s.burnStep - 1
+				fmt.Println("fire crossed the grid in ", s.crossed, " steps")
+			}
+		}
+	}
+	s.front = next
+
+	return len(s.front) > 0
+}
@@ -2,10 +2,11 @@ package simulation
 
 import (
 	"Netron1-Go/api"
-	"Netron1-Go/gui"
+	"Netron1-Go/raster"
 	"fmt"
 	"image/color"
 	"math/rand"
+	"strings"
 )
 
 type SIRModel struct {
@@ -13,9 +14,10 @@ type SIRModel struct {
 	susceptibleColor color.RGBA // cell type = 2
 	removedColor     color.RGBA // cell type = 3
 
-	raster           api.IRasterBuffer
-	cellStates       [][]int
-	cellNextStates   [][]int
+	raster api.IRasterBuffer
+	cells  *Grid
+	// The grid is stepped in concurrent tiles
+	stepper          *gridStepper
 	transmissionRate float32
 }
 
@@ -35,33 +37,88 @@ func (s *SIRModel) Name() string {
 	return "SIRModel"
 }
 
+// Palette returns the state colors.
+func (s *SIRModel) Palette() color.Palette {
+	return color.Palette{
+		s.infectedColor,
+		s.susceptibleColor,
+		s.removedColor,
+	}
+}
+
 func (s *SIRModel) Configure(rasterBuffer api.IRasterBuffer) {
 	s.raster = rasterBuffer
 	s.transmissionRate = 0.5
 	rand.Seed(131)
 
-	s.cellStates = make([][]int, s.raster.Height())
-	s.cellNextStates = make([][]int, s.raster.Height())
-	for i := range s.cellStates {
-		s.cellStates[i] = make([]int, s.raster.Width())
-		s.cellNextStates[i] = make([]int, s.raster.Width())
+	s.cells = NewGrid(s.raster.Width(), s.raster.Height())
+	s.stepper = newGridStepper(s.cells, sisActive)
+}
+
+// Prevalence is the fraction of cells infected.
+func (s *SIRModel) Prevalence() float64 {
+	return s.cells.fraction(1)
+}
+
+// SetParameter sets transmission by name.
+func (s *SIRModel) SetParameter(name string, value float64) error {
+	if name != "transmission" {
+		return fmt.Errorf("unknown parameter: %s", name)
+	}
+	if value < 0 || value > 1 {
+		return fmt.Errorf("transmission must be 0 to 1")
+	}
+	s.transmissionRate = float32(value)
+	return nil
+}
+
+// SendEvent receives an event from the host simulation. "sparse
+// <on|off>" only steps the active cells and the cells they reach.
+func (s *SIRModel) SendEvent(event string) error {
+	if ok, err := s.stepper.event(strings.Fields(event)); ok {
+		return err
 	}
+	return unhandled(event)
 }
 
-// SendEvent receives an event from the host simulation
-func (s *SIRModel) SendEvent(event string) {
+// Snapshot returns the cells.
+func (s *SIRModel) Snapshot() []byte {
+	w := stateWriter{}
+	w.cells(s.cells)
+	return w.buf
+}
+
+// Restore sets the cells from a snapshot and redraws them. The tiles
+// take new random streams, as a branch does.
+func (s *SIRModel) Restore(snapshot []byte) error {
+	r := stateReader{buf: snapshot}
+	cells := r.cells(s.cells)
+	if err := r.done(); err != nil {
+		return err
+	}
+
+	s.stepper.seed(rand.Int63())
+	copy(s.cells.cells, cells)
+	s.stepper.rebuild()
+
+	w := s.raster.Width()
+	h := s.raster.Height()
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			s.drawCell(col, row)
+		}
+	}
+	return nil
 }
 
 func (s *SIRModel) Properties() api.IProperties {
-	return gui.NewProperties(300, 300, 1500, 100, 1)
+	return raster.NewProperties(300, 300, 1500, 100, 1)
 }
 
 func (s *SIRModel) Reset() {
 	fmt.Println(("--- sir reset ---"))
 	s.raster.Clear()
-
-	// Start with the center "cell" infected = Blue
-	s.raster.SetPixelColor(s.infectedColor)
+	s.stepper.seed(rand.Int63())
 
 	w := s.raster.Width()
 	h := s.raster.Height()
@@ -71,117 +128,68 @@ func (s *SIRModel) Reset() {
 
 	for col := 0; col < w; col += 1 {
 		for row := 0; row < h; row += 1 {
-			s.cellStates[col][row] = 2     // Susceptible
-			s.cellNextStates[col][row] = 0 // Undetermined
+			s.cells.at(col, row).state = 2 // Susceptible
+			s.cells.at(col, row).nextState = 2
 		}
 	}
 
-	s.cellStates[cx][cy] = 1 // Infected
+	// Start with the center "cell" infected = Blue
+	s.cells.at(cx, cy).state = 1 // Infected
+	s.stepper.rebuild()
 
 	for col := 0; col < w; col += 1 {
 		for row := 0; row < h; row += 1 {
-			if s.cellStates[col][row] == 1 {
-				s.raster.SetPixelColor(s.infectedColor)
-			} else if s.cellStates[col][row] == 3 {
-				s.raster.SetPixelColor(s.removedColor)
-			} else {
-				s.raster.SetPixelColor(s.susceptibleColor)
-			}
-			s.raster.SetPixel(col, row)
+			s.drawCell(col, row)
 		}
 	}
 
 }
 
+// stepCell updates the next-state of col,row using the tile's random
+// stream.
+func (s *SIRModel) stepCell(t *Tile, col, row int) {
+	cell := s.cells.at(col, row)
+
+	switch cell.state {
+	case 1:
+		// Transition from Infected to Removed
+		cell.nextState = 3
+	case 2:
+		// Each infected neighbor tries to infect the cell
+		reachedBy(s.cells, col, row, func(c, r int, n [2]int) {
+			if s.cells.at(c, r).state == 1 && t.rng.Float32() < s.transmissionRate {
+				// Cell is now infected
+				cell.nextState = 1
+				s.stepper.counts[t.index]++
+			}
+		})
+	case 0:
+		// This cell is now determined to susceptible
+		cell.nextState = 2
+	}
+}
+
 func (s *SIRModel) Step() bool {
 	// The current "step" works on the current-state but updates the next-state
 	// Once done, the next-state is copied back to the current-state.
-	w := s.raster.Width()
-	h := s.raster.Height()
-	ce := 0
-	infected := 0
+	infected := s.stepper.step(s.stepCell)
 
-	for col := 0; col < w; col += 1 {
-		for row := 0; row < h; row += 1 {
-			// fmt.Println("row-col: ", row, ",", col, " = ", s.cellStates[col][row])
-			if s.cellStates[col][row] == 1 { // Is infected
-				// Transition from Infected to Removed
-				s.cellNextStates[col][row] = 3
-
-				// Check neighbors.
-				ce = col + 1
-				if ce < w { // Right
-					// If neighbor isn't (infected AND they arent removed) = Suceptible
-					// then randomize against transmission rate
-					if s.cellStates[ce][row] != 3 {
-						chance := rand.Float32()
-						if chance < s.transmissionRate {
-							// Cell is now infected
-							s.cellNextStates[ce][row] = 1
-							infected++
-						}
-					}
-				}
-
-				ce = col - 1
-				if ce >= 0 { // Left
-					if s.cellStates[ce][row] != 3 {
-						chance := rand.Float32()
-						if chance < s.transmissionRate {
-							// Cell is now infected
-							s.cellNextStates[ce][row] = 1
-							infected++
-						}
-					}
-				}
-
-				ce = row - 1
-				if ce >= 0 { // Top
-					if s.cellStates[col][ce] != 3 {
-						chance := rand.Float32()
-						if chance < s.transmissionRate {
-							// Cell is now infected
-							s.cellNextStates[col][ce] = 1
-							infected++
-						}
-					}
-				}
-
-				ce = row + 1
-				if ce < h { // Bottom
-					if s.cellStates[col][ce] != 3 {
-						chance := rand.Float32()
-						if chance < s.transmissionRate {
-							// Cell is bottom infected
-							s.cellNextStates[col][ce] = 1
-							infected++
-						}
-					}
-				}
-			} else {
-				if s.cellStates[col][row] == 0 {
-					// This cell is now determined to susceptible
-					s.cellNextStates[col][row] = 2
-				}
-			}
-		}
-	}
-
-	// Copy next-state to current-state
-	for col := 0; col < w; col += 1 {
-		for row := 0; row < h; row += 1 {
-			s.cellStates[col][row] = s.cellNextStates[col][row]
-			if s.cellStates[col][row] == 1 {
-				s.raster.SetPixelColor(s.infectedColor)
-			} else if s.cellStates[col][row] == 2 {
-				s.raster.SetPixelColor(s.susceptibleColor)
-			} else {
-				s.raster.SetPixelColor(s.removedColor)
-			}
-			s.raster.SetPixel(col, row)
-		}
-	}
+	s.stepper.update(func(col, row, was int) {
+		s.drawCell(col, row)
+	})
 
 	// fmt.Println("Newly infected: ", infected)
 	return infected > 0
 }
+
+func (s *SIRModel) drawCell(col, row int) {
+	switch s.cells.at(col, row).state {
+	case 1:
+		s.raster.SetPixelColor(s.infectedColor)
+	case 2:
+		s.raster.SetPixelColor(s.susceptibleColor)
+	default:
+		s.raster.SetPixelColor(s.removedColor)
+	}
+	s.raster.SetPixel(col, row)
+}
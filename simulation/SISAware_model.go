@@ -0,0 +1,406 @@
+package simulation
+
+import (
+	"Netron1-Go/api"
+	"Netron1-Go/raster"
+	"context"
+	"fmt"
+	"image/color"
+	"math/rand"
+	"strings"
+)
+
+// The awareness model couples two SIS layers on the same population:
+// awareness spreads like knowledge and infection like the SIS models.
+// An aware cell's chance of being infected is lowered by a factor, and
+// an infected cell becomes aware by itself with some chance. Each
+// layer has its own rates and neighborhood:
+//   infection <rate|drop|degree> <value>
+//   awareness <rate|drop|degree> <value>
+//   aware factor <0..1>     acceptible rate multiplier of aware cells
+//   aware self <0..1>       chance per step infected cells become aware
+//   aware view <infection|awareness|both>
+//   aware sparse <on|off>   only step the active cells and their neighbors
+//   aware sweep <from> <to> <step> <runs> <maxSteps>
+//                           outbreaks from one infected cell for a range
+//                           of infection rates, run in the background
+//   aware stats
+//   aware export            writes the prevalence of both layers
+
+type SISAwareModel struct {
+	infectedColor    color.RGBA
+	awareColor       color.RGBA
+	bothColor        color.RGBA
+	susceptibleColor color.RGBA
+
+	raster api.IRasterBuffer
+
+	infection *Layer
+	awareness *Layer
+
+	awareFactor float64
+	selfAware   float64
+	view        string
+	sparse      bool
+
+	// Fraction of infected, aware and aware infected cells per step
+	infected      []float64
+	aware         []float64
+	awareInfected []float64
+
+	jobs
+}
+
+func NewSISAwareModel() api.IModel {
+	o := new(SISAwareModel)
+	// Infected = Blue
+	o.infectedColor = color.RGBA{R: 0, G: 0, B: 255, A: 255}
+	// Aware = Orange
+	o.awareColor = color.RGBA{R: 255, G: 127, B: 0, A: 255}
+	// Infected and aware = Purple
+	o.bothColor = color.RGBA{R: 160, G: 0, B: 160, A: 255}
+	// Susceptible = Skin
+	o.susceptibleColor = color.RGBA{R: 255, G: 225, B: 200, A: 255}
+
+	return o
+}
+
+func (s *SISAwareModel) Name() string {
+	return "SISAwareModel"
+}
+
+// Palette returns the state colors.
+func (s *SISAwareModel) Palette() color.Palette {
+	return color.Palette{
+		s.infectedColor,
+		s.awareColor,
+		s.bothColor,
+		s.susceptibleColor,
+	}
+}
+
+func (s *SISAwareModel) Configure(rasterBuffer api.IRasterBuffer) {
+	s.raster = rasterBuffer
+	s.awareFactor = 0.3
+	s.selfAware = 0.2
+	s.view = "both"
+
+	rand.Seed(13163)
+
+	w := s.raster.Width()
+	h := s.raster.Height()
+	s.infection = NewLayer("infection", w, h, 0.5, 0.3, 4)
+	s.awareness = NewLayer("awareness", w, h, 0.3, 0.2, 8)
+}
+
+// SetParameter sets factor, self or a layer's rate, drop or degree,
+// e.g. infection_rate, by name.
+func (s *SISAwareModel) SetParameter(name string, value float64) error {
+	switch name {
+	case "factor":
+		return setChance(&s.awareFactor, name, value)
+	case "self":
+		return setChance(&s.selfAware, name, value)
+	}
+	for _, l := range []*Layer{s.infection, s.awareness} {
+		if strings.HasPrefix(name, l.name+"_") {
+			return l.set(strings.TrimPrefix(name, l.name+"_"), value)
+		}
+	}
+	return fmt.Errorf("unknown parameter: %s", name)
+}
+
+// SendEvent receives an event from the host simulation
+func (s *SISAwareModel) SendEvent(event string) error {
+	fields := strings.Fields(event)
+	if len(fields) < 2 {
+		return unhandled(event)
+	}
+
+	switch fields[0] {
+	case "infection":
+		return s.infection.event(fields[1:])
+	case "awareness":
+		return s.awareness.event(fields[1:])
+	case "aware":
+		return s.awareEvent(fields[1:])
+	}
+	return unhandled(event)
+}
+
+func (s *SISAwareModel) awareEvent(fields []string) error {
+	if fields[0] == "sparse" && len(fields) == 2 {
+		if fields[1] != "on" && fields[1] != "off" {
+			return fmt.Errorf("usage: aware sparse <on|off>")
+		}
+		s.setSparse(fields[1] == "on")
+		fmt.Println("sparse stepping: ", fields[1])
+		return nil
+	}
+
+	if fields[0] == "view" && len(fields) == 2 {
+		switch fields[1] {
+		case "infection", "awareness", "both":
+			s.view = fields[1]
+			s.draw()
+		default:
+			return fmt.Errorf("usage: aware view <infection|awareness|both>")
+		}
+		return nil
+	}
+
+	args, err := parseFloats(fields[1:])
+	if err != nil {
+		return fmt.Errorf("aware: %v", err)
+	}
+
+	switch {
+	case fields[0] == "factor" && len(args) == 1:
+		if err := s.SetParameter("factor", args[0]); err != nil {
+			return err
+		}
+		fmt.Println("aware factor: ", s.awareFactor)
+	case fields[0] == "self" && len(args) == 1:
+		if err := s.SetParameter("self", args[0]); err != nil {
+			return err
+		}
+		fmt.Println("self awareness: ", s.selfAware)
+	case fields[0] == "sweep" && len(args) == 5 && args[2] > 0 && args[3] >= 1 && args[4] >= 1:
+		s.start(s.sweep(args[0], args[1], args[2], int(args[3]), int(args[4])))
+		fmt.Println("aware sweep started")
+	case fields[0] == "stats":
+		s.printStats()
+	case fields[0] == "export":
+		path := dataPath(s.Name() + "_layers.csv")
+		err := writeColumnsCSV(path, "step", []string{"infected", "aware", "aware_infected"},
+			[][]float64{s.infected, s.aware, s.awareInfected})
+		if err != nil {
+			return fmt.Errorf("export failed: %v", err)
+		}
+		fmt.Println("Exported stats to: " + path)
+	default:
+		return fmt.Errorf("unknown aware command: %s", strings.Join(fields, " "))
+	}
+	return nil
+}
+
+// Prevalence is the fraction of cells infected at the last step.
+func (s *SISAwareModel) Prevalence() float64 {
+	return s.infected[len(s.infected)-1]
+}
+
+func (s *SISAwareModel) printStats() {
+	n := len(s.infected)
+	if n == 0 {
+		return
+	}
+
+	fmt.Println("step: ", n-1)
+	fmt.Println(s.infection.toString())
+	fmt.Println(s.awareness.toString())
+	fmt.Printf("aware factor: %.3f, self awareness: %.3f\n", s.awareFactor, s.selfAware)
+	fmt.Printf("infected: %.4f, aware: %.4f, aware infected: %.4f\n", s.infected[n-1], s.aware[n-1], s.awareInfected[n-1])
+}
+
+func (s *SISAwareModel) setSparse(sparse bool) {
+	s.sparse = sparse
+	s.infection.setSparse(sparse)
+	s.awareness.setSparse(sparse)
+}
+
+// sweep returns a job that runs outbreaks from a single infected cell
+// for each infection rate on a copy of the model and reports how long
+// they last, how many cell steps they infect and how often they
+// survive maxSteps. Nothing is drawn, so with sparse stepping
+// sub-critical rates cost little on any grid size.
+func (s *SISAwareModel) sweep(from, to, step float64, runs, maxSteps int) job {
+	m := s.copy()
+	return func(ctx context.Context) (string, error) {
+		var report strings.Builder
+		report.WriteString("rate, duration, size, survival")
+		for r := from; r <= to+step/2; r += step {
+			m.infection.rate = r
+			duration, size, survived := 0, 0.0, 0
+			for i := 0; i < runs; i++ {
+				if err := ctx.Err(); err != nil {
+					return "", err
+				}
+				d, n := m.outbreak(maxSteps)
+				duration += d
+				size += n
+				if d == maxSteps {
+					survived++
+				}
+			}
+			fmt.Fprintf(&report, "\n%.4f, %.2f, %.2f, %.3f", r, float64(duration)/float64(runs), size/float64(runs), float64(survived)/float64(runs))
+		}
+		return report.String(), nil
+	}
+}
+
+// copy returns a model with the same parameters, and layers and a
+// raster of its own.
+func (s *SISAwareModel) copy() *SISAwareModel {
+	c := *s
+	c.jobs = jobs{}
+	c.raster = raster.NewRasterBuffer(s.raster.Width(), s.raster.Height())
+	c.infection = s.infection.clone()
+	c.awareness = s.awareness.clone()
+	c.infected = nil
+	c.aware = nil
+	c.awareInfected = nil
+	return &c
+}
+
+// outbreak runs from one infected cell until the infection dies out or
+// maxSteps. Returns the steps taken and the infected cells summed over
+// the steps.
+func (s *SISAwareModel) outbreak(maxSteps int) (int, float64) {
+	cells := float64(s.raster.Width() * s.raster.Height())
+
+	s.infection.clear()
+	s.awareness.clear()
+	s.infection.seed(1)
+
+	size := 1.0
+	for step := 1; step <= maxSteps; step++ {
+		infected, _ := s.advance()
+		if infected == 0 {
+			return step, size
+		}
+		size += infected * cells
+	}
+	return maxSteps, size
+}
+
+func (s *SISAwareModel) record(infected, aware float64) {
+	both := 0
+	s.infection.forActive(func(col, row int) {
+		if s.awareness.active(col, row) {
+			both++
+		}
+	})
+
+	s.infected = append(s.infected, infected)
+	s.aware = append(s.aware, aware)
+	s.awareInfected = append(s.awareInfected, float64(both)/float64(s.raster.Width()*s.raster.Height()))
+}
+
+func (s *SISAwareModel) draw() {
+	for col := 0; col < s.raster.Width(); col += 1 {
+		for row := 0; row < s.raster.Height(); row += 1 {
+			s.drawCell(col, row)
+		}
+	}
+}
+
+// drawChanged redraws the cells that changed in either layer.
+func (s *SISAwareModel) drawChanged() {
+	for _, l := range []*Layer{s.infection, s.awareness} {
+		for _, i := range l.frontier.changed {
+			s.drawCell(i/l.cells.h, i%l.cells.h)
+		}
+	}
+}
+
+func (s *SISAwareModel) drawCell(col, row int) {
+	infected := s.infection.active(col, row) && s.view != "awareness"
+	aware := s.awareness.active(col, row) && s.view != "infection"
+	switch {
+	case infected && aware:
+		s.raster.SetPixelColor(s.bothColor)
+	case infected:
+		s.raster.SetPixelColor(s.infectedColor)
+	case aware:
+		s.raster.SetPixelColor(s.awareColor)
+	default:
+		s.raster.SetPixelColor(s.susceptibleColor)
+	}
+	s.raster.SetPixel(col, row)
+}
+
+// Snapshot returns the cells of both layers.
+func (s *SISAwareModel) Snapshot() []byte {
+	w := stateWriter{}
+	w.cells(s.infection.cells)
+	w.cells(s.awareness.cells)
+	w.int(len(s.infected))
+	return w.buf
+}
+
+// Restore sets both layers from a snapshot, cuts the prevalence series
+// back to its step and redraws the cells. Sparse layers rebuild their
+// frontiers from the active cells.
+func (s *SISAwareModel) Restore(snapshot []byte) error {
+	r := stateReader{buf: snapshot}
+	infection := r.cells(s.infection.cells)
+	awareness := r.cells(s.awareness.cells)
+	n := r.length(len(s.infected))
+	if err := r.done(); err != nil {
+		return err
+	}
+
+	copy(s.infection.cells.cells, infection)
+	copy(s.awareness.cells.cells, awareness)
+	s.setSparse(s.sparse)
+	s.infected = s.infected[:n]
+	s.aware = s.aware[:n]
+	s.awareInfected = s.awareInfected[:n]
+	s.draw()
+	return nil
+}
+
+func (s *SISAwareModel) Properties() api.IProperties {
+	return raster.NewProperties(300, 300, 1500, 100, 1)
+}
+
+func (s *SISAwareModel) Reset() {
+	fmt.Println(("--- aware reset ---"))
+	s.raster.Clear()
+
+	s.infection.clear()
+	s.awareness.clear()
+	s.infection.seed(20)
+
+	s.infected = []float64{}
+	s.aware = []float64{}
+	s.awareInfected = []float64{}
+	s.record(s.infection.update(), s.awareness.update())
+	s.draw()
+}
+
+func (s *SISAwareModel) Step() bool {
+	infected, aware := s.advance()
+	s.record(infected, aware)
+	if s.sparse {
+		s.drawChanged()
+	} else {
+		s.draw()
+	}
+
+	return infected > 0
+}
+
+// advance steps both layers and returns the infected and aware
+// fractions.
+func (s *SISAwareModel) advance() (float64, float64) {
+	s.infection.drop()
+	s.awareness.drop()
+
+	s.infection.spread(func(col, row int) float64 {
+		if s.awareness.active(col, row) {
+			return s.awareFactor
+		}
+		return 1
+	})
+	s.awareness.spread(func(col, row int) float64 { return 1 })
+
+	// Infection triggers awareness
+	s.infection.forActive(func(col, row int) {
+		if rand.Float64() < s.selfAware {
+			s.awareness.activate(col, row)
+		}
+	})
+
+	return s.infection.update(), s.awareness.update()
+}
@@ -2,15 +2,28 @@ package simulation
 
 import (
 	"Netron1-Go/api"
-	"Netron1-Go/gui"
+	"Netron1-Go/raster"
 	"fmt"
 	"image/color"
 	"math/rand"
+	"strings"
 )
 
 // The city model is based on "zones". Each zone has an epic center
 // that is the most connected and active.
 // In the city more people tend to meditate verse the suburbs.
+//
+// Cities can move, grow or shrink while the simulation runs. Drag a
+// city with the left mouse button, nudge the selected city with the
+// keypad arrows, or use the console "city" commands.
+//
+// Instead of the four hand placed cities a layout can be generated or
+// loaded from a degree map image:
+//   city generate <cities> <seed> [exponent] [suburbs] [corridors 0|1]
+//   city export <file.png>   saves the degree map
+//   city import <file.png>   loads a (possibly edited) degree map
+//   city default             back to the hand placed cities
+// The layout is kept across resets.
 
 type SISCityModel struct {
 	undetermenedColor color.RGBA // cell type = 0
@@ -24,7 +37,7 @@ type SISCityModel struct {
 	degree8Color color.RGBA
 
 	raster api.IRasterBuffer
-	cells  [][]Cell
+	cells  *Grid
 
 	acceptibleRate float64
 	// The chance they will drop meditation.
@@ -33,6 +46,15 @@ type SISCityModel struct {
 
 	// degree goes from 4 to 8
 	degree int
+
+	cityMap cityMap
+	// Generated layout or imported degree map. nil = hand placed cities
+	layout    *CityLayout
+	degreeMap *IntGrid
+
+	// The grid is stepped in concurrent tiles
+	tiles        *TileGrid
+	tileInfected []int
 }
 
 func NewSISCityModel() api.IModel {
@@ -58,8 +80,51 @@ func (s *SISCityModel) Name() string {
 	return "SISCityModel"
 }
 
+// Palette returns the state colors.
+func (s *SISCityModel) Palette() color.Palette {
+	return color.Palette{
+		s.undetermenedColor,
+		s.infectedColor,
+		s.susceptibleColor,
+		s.removedColor,
+		s.degree5Color,
+		s.degree6Color,
+		s.degree7Color,
+		s.degree8Color,
+	}
+}
+
+// SetParameter sets accept, drop or size by name.
+func (s *SISCityModel) SetParameter(name string, value float64) error {
+	switch name {
+	case "accept":
+		if value < 0 || value > 1 {
+			return fmt.Errorf("accept must be 0 to 1")
+		}
+		s.acceptibleRate = value
+	case "drop":
+		if value < 0 || value > 1 {
+			return fmt.Errorf("drop must be 0 to 1")
+		}
+		s.dropRate = value
+	case "size":
+		if value <= 0 {
+			return fmt.Errorf("size must be positive")
+		}
+		s.stepSize = value
+	default:
+		return fmt.Errorf("unknown parameter: %s", name)
+	}
+	return nil
+}
+
+// Prevalence is the fraction of cells infected.
+func (s *SISCityModel) Prevalence() float64 {
+	return s.cells.fraction(1)
+}
+
 // SendEvent receives an event from the host simulation
-func (s *SISCityModel) SendEvent(event string) {
+func (s *SISCityModel) SendEvent(event string) error {
 	switch event {
 	case "inc accept": // decrease acceptible rate
 		s.acceptibleRate -= s.stepSize
@@ -79,11 +144,130 @@ func (s *SISCityModel) SendEvent(event string) {
 	case "dec size": // decrease step size
 		s.stepSize -= 0.005
 		fmt.Println("stepSize: ", s.stepSize)
+	default:
+		fields := strings.Fields(event)
+		if len(fields) > 1 && fields[0] == "city" {
+			switch fields[1] {
+			case "generate", "export", "import", "default":
+				return s.layoutEvent(fields[1:])
+			}
+		}
+		stamp, err := s.cityMap.event(fields)
+		if stamp {
+			s.cityMap.stamp(s.cells)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *SISCityModel) layoutEvent(fields []string) error {
+	w := s.raster.Width()
+	h := s.raster.Height()
+
+	switch fields[0] {
+	case "generate":
+		args, err := parseFloats(fields[1:])
+		if err != nil || len(args) < 2 || args[0] < 1 || (len(args) > 3 && args[3] < 0) {
+			return fmt.Errorf("usage: city generate <cities> <seed> [exponent] [suburbs] [corridors 0|1]")
+		}
+		layout := NewCityLayout(int(args[0]), int64(args[1]))
+		if len(args) > 2 {
+			layout.exponent = args[2]
+		}
+		if len(args) > 3 {
+			layout.suburbs = int(args[3])
+		}
+		if len(args) > 4 {
+			layout.corridors = args[4] != 0
+		}
+		s.layout = layout
+		s.degreeMap = nil
+		fmt.Println("Layout: " + layout.toString())
+	case "export":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: city export <file.png>")
+		}
+		if err := saveDegreeMap(dataPath(fields[1]), s.cells); err != nil {
+			return fmt.Errorf("export failed: %v", err)
+		}
+		fmt.Println("Exported degree map to: " + dataPath(fields[1]))
+		return nil
+	case "import":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: city import <file.png>")
+		}
+		degrees, err := loadDegreeMap(dataPath(fields[1]), w, h)
+		if err != nil {
+			return fmt.Errorf("import failed: %v", err)
+		}
+		s.degreeMap = degrees
+		s.layout = nil
+		fmt.Println("Imported degree map from: " + dataPath(fields[1]))
+	case "default":
+		s.layout = nil
+		s.degreeMap = nil
+	}
+
+	s.buildLayout()
+	s.cityMap.stamp(s.cells)
+	return nil
+}
+
+// buildLayout places the cities of the current layout.
+func (s *SISCityModel) buildLayout() {
+	s.cityMap.clear()
+
+	switch {
+	case s.degreeMap != nil:
+		s.cityMap.base = s.degreeMap
+	case s.layout != nil:
+		cities, corridors := s.layout.generate(s.raster.Width(), s.raster.Height())
+		s.cityMap.cities = cities
+		s.cityMap.corridors = corridors
+	default:
+		s.buildCity(100, 100)
+		s.buildCity(105, 165)
+		s.buildCity(165, 115)
+		s.buildCity(165, 165)
 	}
 }
 
+// Snapshot returns the cells, with their degrees, and where the cities
+// are.
+func (s *SISCityModel) Snapshot() []byte {
+	w := stateWriter{}
+	w.cities(&s.cityMap)
+	w.cells(s.cells)
+	return w.buf
+}
+
+// Restore sets the cells and the cities from a snapshot and redraws
+// the cells. The tiles take new random streams, as a branch does.
+func (s *SISCityModel) Restore(snapshot []byte) error {
+	r := stateReader{buf: snapshot}
+	cities := r.cities(&s.cityMap)
+	cells := r.cells(s.cells)
+	if err := r.done(); err != nil {
+		return err
+	}
+
+	s.tiles.seed(rand.Int63())
+	setCities(&s.cityMap, cities)
+	copy(s.cells.cells, cells)
+
+	w := s.raster.Width()
+	h := s.raster.Height()
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			s.drawCell(col, row)
+		}
+	}
+	return nil
+}
+
 func (s *SISCityModel) Properties() api.IProperties {
-	return gui.NewProperties(300, 300, 1500, 100, 1)
+	return raster.NewProperties(300, 300, 1500, 100, 1)
 }
 
 func (s *SISCityModel) Configure(rasterBuffer api.IRasterBuffer) {
@@ -93,15 +277,16 @@ func (s *SISCityModel) Configure(rasterBuffer api.IRasterBuffer) {
 
 	rand.Seed(131)
 
-	s.cells = make([][]Cell, s.raster.Height())
-	for i := range s.cells {
-		s.cells[i] = make([]Cell, s.raster.Width())
-	}
+	s.cells = NewGrid(s.raster.Width(), s.raster.Height())
+
+	s.tiles = NewTileGrid(s.raster.Width(), s.raster.Height(), tileSize)
+	s.tileInfected = make([]int, len(s.tiles.tiles))
 }
 
 func (s *SISCityModel) Reset() {
 	fmt.Println(("--- sir reset ---"))
 	s.raster.Clear()
+	s.tiles.seed(rand.Int63())
 
 	w := s.raster.Width()
 	h := s.raster.Height()
@@ -109,8 +294,8 @@ func (s *SISCityModel) Reset() {
 	// Create two zones. Each zone is a square.
 	for col := 0; col < w; col += 1 {
 		for row := 0; row < h; row += 1 {
-			s.cells[col][row].state = 2     // Susceptible
-			s.cells[col][row].nextState = 2 // Undetermined
+			s.cells.at(col, row).state = 2     // Susceptible
+			s.cells.at(col, row).nextState = 2 // Undetermined
 		}
 	}
 
@@ -119,14 +304,12 @@ func (s *SISCityModel) Reset() {
 	radius := 10
 	for col := px; col < px+radius; col += 1 {
 		for row := py; row < py+radius; row += 1 {
-			s.cells[col][row].state = 1
+			s.cells.at(col, row).state = 1
 		}
 	}
 
-	s.buildCity(100, 100)
-	s.buildCity(105, 165)
-	s.buildCity(165, 115)
-	s.buildCity(165, 165)
+	s.buildLayout()
+	s.cityMap.stamp(s.cells)
 
 	for col := 0; col < w; col += 1 {
 		for row := 0; row < h; row += 1 {
@@ -135,175 +318,67 @@ func (s *SISCityModel) Reset() {
 	}
 }
 
+// buildCity adds a city with its top/left corner at px,py.
 func (s *SISCityModel) buildCity(px, py int) {
 	radius := 40
 
-	// Create largest area first
-	for col := px; col < px+radius; col += 1 {
-		for row := py; row < py+radius; row += 1 {
-			s.cells[col][row].degree = 5
-		}
-	}
-
-	px += 5
-	py += 5
-	radius -= 10
-	for col := px; col < px+radius; col += 1 {
-		for row := py; row < py+radius; row += 1 {
-			s.cells[col][row].degree = 6
-		}
-	}
+	s.cityMap.add(NewCity(float64(px+radius/2), float64(py+radius/2), float64(radius), 5, 4))
+}
 
-	px += 5
-	py += 5
-	radius -= 10
-	for col := px; col < px+radius; col += 1 {
-		for row := py; row < py+radius; row += 1 {
-			s.cells[col][row].degree = 7
-		}
-	}
+// stepCell updates the next-state of col,row using the tile's random
+// stream.
+func (s *SISCityModel) stepCell(t *Tile, col, row int) {
+	cell := s.cells.at(col, row)
 
-	px += 5
-	py += 5
-	radius -= 10
-	for col := px; col < px+radius; col += 1 {
-		for row := py; row < py+radius; row += 1 {
-			s.cells[col][row].degree = 8
+	switch cell.state {
+	case 1:
+		// How likely will they drop it.
+		if t.rng.Float64() < s.dropRate {
+			cell.nextState = 2 // Suceptible
 		}
+	case 2:
+		// Each infected neighbor reaching this cell tries to infect it.
+		// Higher degree cells also reach diagonals.
+		reachedBy(s.cells, col, row, func(c, r int, n [2]int) {
+			if s.cells.at(c, r).state == 1 && t.rng.Float64() < s.acceptibleRate && cell.nextState != 1 {
+				// Cell is now infected
+				cell.nextState = 1
+				s.tileInfected[t.index]++
+			}
+		})
 	}
 }
 
-func (s *SISCityModel) moveCity(dx, dy int) {
-}
-
 func (s *SISCityModel) Step() bool {
 	// The current "step" works on the current-state but updates the next-state
 	// Once done, the next-state is copied back to the current-state.
 	w := s.raster.Width()
 	h := s.raster.Height()
-	ce := 0
 	infected := 0
 
-	for col := 0; col < w; col += 1 {
-		for row := 0; row < h; row += 1 {
-			switch s.cells[col][row].state {
-			case 1:
-				// How likely will they drop it.
-				if rand.Float64() < s.dropRate {
-					s.cells[col][row].nextState = 2 // Suceptible
-				}
-
-				// Check neighbors.
-				ce = col + 1
-				if ce < w { // Right
-					// If neighbor isn't (infected AND they are acceptible) = Suceptible
-					if s.cells[ce][row].state == 2 {
-						if rand.Float64() < s.acceptibleRate {
-							// Cell is now infected
-							s.cells[ce][row].nextState = 1
-							infected++
-						}
-					}
-				}
-
-				ce = col - 1
-				if ce >= 0 { // Left
-					if s.cells[ce][row].state == 2 {
-						if rand.Float64() < s.acceptibleRate {
-							// Cell is now infected
-							s.cells[ce][row].nextState = 1
-							infected++
-						}
-					}
-				}
-
-				ce = row - 1
-				if ce >= 0 { // Top
-					if s.cells[col][ce].state == 2 {
-						if rand.Float64() < s.acceptibleRate {
-							// Cell is now infected
-							s.cells[col][ce].nextState = 1
-							infected++
-						}
-					}
-				}
-
-				ce = row + 1
-				if ce < h { // Bottom
-					if s.cells[col][ce].state == 2 {
-						if rand.Float64() < s.acceptibleRate {
-							// Cell is bottom infected
-							s.cells[col][ce].nextState = 1
-							infected++
-						}
-					}
-				}
-
-				if s.cells[col][row].degree > 4 {
-					// top/right
-					ce = row - 1
-					re := col + 1
-					if ce >= 0 { // Top
-						if s.cells[re][ce].state == 2 {
-							if rand.Float64() < s.acceptibleRate {
-								// Cell is now infected
-								s.cells[col][ce].nextState = 1
-								infected++
-							}
-						}
-					}
-				}
-				if s.cells[col][row].degree > 5 {
-					// bottom/right
-					ce = row + 1
-					re := col + 1
-					if ce >= 0 { // Top
-						if s.cells[re][ce].state == 2 {
-							if rand.Float64() < s.acceptibleRate {
-								// Cell is now infected
-								s.cells[col][ce].nextState = 1
-								infected++
-							}
-						}
-					}
-				}
-				if s.cells[col][row].degree > 6 {
-					// bottom/left
-					ce = row + 1
-					re := col - 1
-					if ce >= 0 { // Top
-						if s.cells[re][ce].state == 2 {
-							if rand.Float64() < s.acceptibleRate {
-								// Cell is now infected
-								s.cells[col][ce].nextState = 1
-								infected++
-							}
-						}
-					}
-				}
-				if s.cells[col][row].degree > 7 {
-					// top/left
-					ce = row - 1
-					re := col - 1
-					if ce >= 0 { // Top
-						if s.cells[re][ce].state == 2 {
-							if rand.Float64() < s.acceptibleRate {
-								// Cell is now infected
-								s.cells[col][ce].nextState = 1
-								infected++
-							}
-						}
-					}
-				}
+	if s.cityMap.update(w, h) {
+		s.cityMap.stamp(s.cells)
+	}
+
+	// Tiles run concurrently. Each cell only updates its own next-state
+	// by pulling infections from its infected neighbors.
+	s.tiles.run(func(t *Tile) {
+		s.tileInfected[t.index] = 0
+		for col := t.x0; col < t.x1; col += 1 {
+			for row := t.y0; row < t.y1; row += 1 {
+				s.stepCell(t, col, row)
 			}
 		}
+	})
+	for _, n := range s.tileInfected {
+		infected += n
 	}
 
 	// Copy next-state to current-state
 	for col := 0; col < w; col += 1 {
 		for row := 0; row < h; row += 1 {
 			s.drawCell(col, row)
-			s.cells[col][row].state = s.cells[col][row].nextState
+			s.cells.at(col, row).state = s.cells.at(col, row).nextState
 		}
 	}
 
@@ -312,7 +387,7 @@ func (s *SISCityModel) Step() bool {
 }
 
 func (s *SISCityModel) drawCell(col, row int) {
-	switch s.cells[col][row].degree {
+	switch s.cells.at(col, row).degree {
 	case 5:
 		s.raster.SetPixelColor(s.degree5Color)
 	case 6:
@@ -323,11 +398,11 @@ func (s *SISCityModel) drawCell(col, row int) {
 		s.raster.SetPixelColor(s.degree8Color)
 	}
 
-	switch s.cells[col][row].state {
+	switch s.cells.at(col, row).state {
 	case 1:
 		s.raster.SetPixelColor(s.infectedColor)
 	case 2:
-		if s.cells[col][row].degree < 5 {
+		if s.cells.at(col, row).degree < 5 {
 			s.raster.SetPixelColor(s.susceptibleColor)
 		}
 		// default:
@@ -2,10 +2,13 @@ package simulation
 
 import (
 	"Netron1-Go/api"
-	"Netron1-Go/gui"
+	"Netron1-Go/raster"
 	"fmt"
+	"image"
 	"image/color"
+	"math"
 	"math/rand"
+	"strings"
 )
 
 // The Dynamic Correlation (DC) model studies the DC between two
@@ -16,6 +19,29 @@ import (
 //
 // A trail of knowledge centers is created each which an increasing knowlege level.
 // This causes the info to travel in one direction.
+//
+// The flow mode selects how info travels along the trail:
+//   flow trail           the trail of higher degree patches only
+//   flow directed        transmission is biased by a direction field
+//                        pointing along the trail
+//   flow bidirectional   seeds start at both ends of the trail
+//   flow bias <0..1>     direction bias. Transmission against the field is
+//                        scaled by 1-bias, so 1 = none against the field
+//   flow stats           reports how the two fronts met and interfered
+// Mode changes take effect on the next reset.
+//
+// The trail's patches are cities and can be dragged with the mouse or
+// moved with the "city" commands while the simulation runs.
+//
+// The DC is measured between probe regions. Each step the activity of
+// every region is recorded, from which the lagged cross-correlation,
+// mutual information and propagation delay between regions are computed:
+//   probe add <col> <row> <width> <height>   records from the current step
+//   probe clear
+//   probe list
+//   probe lag <maxLag>
+//   probe analyze
+//   probe export     writes series/correlation CSVs and a correlation plot
 
 type SISDynCorrModel struct {
 	undetermenedColor color.RGBA // cell type = 0
@@ -29,7 +55,7 @@ type SISDynCorrModel struct {
 	degree8Color color.RGBA
 
 	raster api.IRasterBuffer
-	cells  [][]Cell
+	cells  *Grid
 
 	acceptibleRate float64
 	// The chance they will drop meditation.
@@ -38,6 +64,69 @@ type SISDynCorrModel struct {
 
 	// degree goes from 4 to 8
 	degree int
+
+	probes []*ProbeRegion
+	maxLag int
+
+	flowMode int
+	flowBias float64
+	// Patches of the trail in the order info should flow
+	cityMap cityMap
+	flow    *flowGrid
+	step    int
+
+	// The grid is stepped in concurrent tiles
+	tiles   *TileGrid
+	tallies []frontTally
+
+	// Front measurements in bidirectional mode
+	meetStep   int
+	meetCol    int
+	meetRow    int
+	collisions int
+	takeovers  int
+	frontSizes [3]int
+}
+
+const (
+	trailFlow         = iota // Info follows the trail of higher degree patches
+	directedFlow             // Transmission is biased along the trail
+	bidirectionalFlow        // Info starts at both ends of the trail
+)
+
+// frontTally counts a tile's infections and front interactions in
+// one step.
+type frontTally struct {
+	infected   int
+	collisions int
+	takeovers  int
+	// First cell in the tile where the fronts met
+	meet *[2]int
+}
+
+// flowCell holds a cell's direction field and, in bidirectional mode,
+// which front (1 = start, 2 = end) it was infected by.
+type flowCell struct {
+	dirX, dirY float64
+
+	origin     int
+	nextOrigin int
+	// Step the cell was last claimed by a front
+	claimed int
+}
+
+// flowGrid is a grid of flowCells.
+type flowGrid struct {
+	Dims
+	cells []flowCell
+}
+
+func newFlowGrid(w, h int) *flowGrid {
+	return &flowGrid{Dims: Dims{w: w, h: h}, cells: make([]flowCell, w*h)}
+}
+
+func (g *flowGrid) at(col, row int) *flowCell {
+	return &g.cells[g.index(col, row)]
 }
 
 func NewSISDynCorrModel() api.IModel {
@@ -56,6 +145,8 @@ func NewSISDynCorrModel() api.IModel {
 	o.degree8Color = color.RGBA{R: 125, G: 125, B: 125, A: 255}
 
 	o.stepSize = 0.005
+	o.maxLag = 100
+	o.flowBias = 0.8
 	return o
 }
 
@@ -63,8 +154,51 @@ func (s *SISDynCorrModel) Name() string {
 	return "SISDynCorrModel"
 }
 
+// Palette returns the state colors.
+func (s *SISDynCorrModel) Palette() color.Palette {
+	return color.Palette{
+		s.undetermenedColor,
+		s.infectedColor,
+		s.susceptibleColor,
+		s.removedColor,
+		s.degree5Color,
+		s.degree6Color,
+		s.degree7Color,
+		s.degree8Color,
+	}
+}
+
+// SetParameter sets accept, drop or size by name.
+func (s *SISDynCorrModel) SetParameter(name string, value float64) error {
+	switch name {
+	case "accept":
+		if value < 0 || value > 1 {
+			return fmt.Errorf("accept must be 0 to 1")
+		}
+		s.acceptibleRate = value
+	case "drop":
+		if value < 0 || value > 1 {
+			return fmt.Errorf("drop must be 0 to 1")
+		}
+		s.dropRate = value
+	case "size":
+		if value <= 0 {
+			return fmt.Errorf("size must be positive")
+		}
+		s.stepSize = value
+	default:
+		return fmt.Errorf("unknown parameter: %s", name)
+	}
+	return nil
+}
+
+// Prevalence is the fraction of cells infected.
+func (s *SISDynCorrModel) Prevalence() float64 {
+	return s.cells.fraction(1)
+}
+
 // SendEvent receives an event from the host simulation
-func (s *SISDynCorrModel) SendEvent(event string) {
+func (s *SISDynCorrModel) SendEvent(event string) error {
 	switch event {
 	case "inc accept": // decrease acceptible rate
 		s.acceptibleRate -= s.stepSize
@@ -84,11 +218,267 @@ func (s *SISDynCorrModel) SendEvent(event string) {
 	case "dec size": // decrease step size
 		s.stepSize -= 0.005
 		fmt.Println("stepSize: ", s.stepSize)
+	default:
+		fields := strings.Fields(event)
+		if len(fields) > 1 && fields[0] == "probe" {
+			return s.probeEvent(fields[1:])
+		}
+		if len(fields) > 1 && fields[0] == "flow" {
+			return s.flowEvent(fields[1:])
+		}
+		rebuild, err := s.cityMap.event(fields)
+		if rebuild {
+			s.buildTrail()
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *SISDynCorrModel) flowEvent(fields []string) error {
+	switch fields[0] {
+	case "trail":
+		s.flowMode = trailFlow
+		fmt.Println("flowMode: trail")
+	case "directed":
+		s.flowMode = directedFlow
+		fmt.Println("flowMode: directed")
+	case "bidirectional":
+		s.flowMode = bidirectionalFlow
+		fmt.Println("flowMode: bidirectional")
+	case "bias":
+		args, err := parseFloats(fields[1:])
+		if err != nil || len(args) != 1 || args[0] < 0 || args[0] > 1 {
+			return fmt.Errorf("flow bias must be 0 to 1")
+		}
+		s.flowBias = args[0]
+		fmt.Println("flowBias: ", s.flowBias)
+	case "stats":
+		s.printFlowStats()
+	default:
+		return fmt.Errorf("unknown flow command: %s", strings.Join(fields, " "))
+	}
+	return nil
+}
+
+func (s *SISDynCorrModel) printFlowStats() {
+	if s.flowMode != bidirectionalFlow {
+		fmt.Println("Front stats are only measured in bidirectional mode")
+		return
+	}
+
+	fmt.Println("step: ", s.step)
+	fmt.Println("front sizes (start, end): ", s.frontSizes[1], ", ", s.frontSizes[2])
+	if s.meetStep < 0 {
+		fmt.Println("fronts haven't met")
+	} else {
+		fmt.Printf("fronts met at step %d at [%d,%d]\n", s.meetStep, s.meetCol, s.meetRow)
+	}
+	fmt.Println("collisions (cells claimed by both fronts in one step): ", s.collisions)
+	fmt.Println("takeovers (cells reinfected by the other front): ", s.takeovers)
+}
+
+func (s *SISDynCorrModel) probeEvent(fields []string) error {
+	args, err := parseInts(fields[1:])
+	if err != nil {
+		return fmt.Errorf("probe: %v", err)
+	}
+
+	switch {
+	case fields[0] == "add" && len(args) == 4:
+		if args[0] < 0 || args[1] < 0 || args[2] < 1 || args[3] < 1 ||
+			args[0]+args[2] > s.raster.Width() || args[1]+args[3] > s.raster.Height() {
+			return fmt.Errorf("probe out of bounds")
+		}
+		// A probe added during a run starts at the current step
+		p := NewProbeRegion(args[0], args[1], args[2], args[3])
+		p.restart(s.step)
+		s.recordProbe(p)
+		s.probes = append(s.probes, p)
+		fmt.Println("Probes: ", len(s.probes))
+	case fields[0] == "clear":
+		s.probes = []*ProbeRegion{}
+		fmt.Println("Probes cleared")
+	case fields[0] == "list":
+		for i, p := range s.probes {
+			fmt.Println(i, ": ", p.toString())
+		}
+	case fields[0] == "lag" && len(args) == 1 && args[0] > 0:
+		s.maxLag = args[0]
+		fmt.Println("maxLag: ", s.maxLag)
+	case fields[0] == "analyze":
+		return s.analyzeProbes()
+	case fields[0] == "export":
+		return s.exportProbes()
+	default:
+		return fmt.Errorf("unknown probe command: %s", strings.Join(fields, " "))
+	}
+	return nil
+}
+
+// probePairs returns the names and cross-correlations of every
+// pair of probes.
+func (s *SISDynCorrModel) probePairs() ([]string, [][2]int, [][]float64) {
+	names := []string{}
+	pairs := [][2]int{}
+	corrs := [][]float64{}
+
+	for i := 0; i < len(s.probes); i++ {
+		for j := i + 1; j < len(s.probes); j++ {
+			names = append(names, fmt.Sprintf("probe%d-probe%d", i, j))
+			pairs = append(pairs, [2]int{i, j})
+			a, b := overlap(s.probes[i], s.probes[j])
+			corrs = append(corrs, crossCorrelation(a, b, s.maxLag))
+		}
+	}
+
+	return names, pairs, corrs
+}
+
+func (s *SISDynCorrModel) analyzeProbes() error {
+	names, pairs, corrs := s.probePairs()
+	if len(pairs) == 0 {
+		return fmt.Errorf("at least two probes are required")
+	}
+
+	for i, pair := range pairs {
+		a := s.probes[pair[0]]
+		b := s.probes[pair[1]]
+
+		x, y := overlap(a, b)
+		lag, peak := peakLag(corrs[i], s.maxLag)
+		fmt.Println("--- " + names[i] + " ---")
+		fmt.Printf("peak correlation: %.4f at lag %d\n", peak, lag)
+		fmt.Printf("mutual information: %.4f bits (lag 0), %.4f bits (lag %d)\n",
+			mutualInformation(x, y, 0, 8),
+			mutualInformation(x, y, lag, 8), lag)
+
+		ta := a.arrival(0.1)
+		tb := b.arrival(0.1)
+		if ta < 0 || tb < 0 {
+			fmt.Println("propagation delay: front hasn't reached both probes")
+		} else {
+			fmt.Println("propagation delay: ", tb-ta, " steps")
+		}
+	}
+	return nil
+}
+
+func (s *SISDynCorrModel) exportProbes() error {
+	names, pairs, corrs := s.probePairs()
+	if len(pairs) == 0 {
+		return fmt.Errorf("at least two probes are required")
+	}
+
+	base := dataPath(s.Name())
+
+	if err := writeSeriesCSV(base+"_series.csv", s.probes); err != nil {
+		return fmt.Errorf("export failed: %v", err)
+	}
+
+	if err := writeCorrelationCSV(base+"_correlation.csv", names, corrs, s.maxLag); err != nil {
+		return fmt.Errorf("export failed: %v", err)
 	}
+
+	lags := make([]float64, 2*s.maxLag+1)
+	for i := range lags {
+		lags[i] = float64(i - s.maxLag)
+	}
+	if err := savePlot(base+"_correlation.png", lags, corrs); err != nil {
+		return fmt.Errorf("export failed: %v", err)
+	}
+
+	fmt.Println("Exported probes to: " + base + "_*")
+	return nil
+}
+
+func (s *SISDynCorrModel) recordProbes() {
+	for _, p := range s.probes {
+		s.recordProbe(p)
+	}
+}
+
+func (s *SISDynCorrModel) recordProbe(p *ProbeRegion) {
+	p.record(func(col, row int) bool {
+		return s.cells.at(col, row).state == 1
+	})
+}
+
+// Snapshot returns the cells, with their degrees, where the trail's
+// patches are and the fronts. The parameters aren't part of it, so a
+// branch keeps the current ones.
+func (s *SISDynCorrModel) Snapshot() []byte {
+	w := stateWriter{}
+	w.int(s.step)
+	w.int(s.meetStep)
+	w.int(s.meetCol)
+	w.int(s.meetRow)
+	w.int(s.collisions)
+	w.int(s.takeovers)
+	w.ints(s.frontSizes[:])
+	w.cities(&s.cityMap)
+	w.cells(s.cells)
+
+	origins := make([]int, len(s.flow.cells))
+	for i := range origins {
+		origins[i] = s.flow.cells[i].origin
+	}
+	w.ints(origins)
+	return w.buf
+}
+
+// Restore sets the cells, the trail and the fronts from a snapshot,
+// drops the probe samples after its step and redraws the cells. The
+// tiles take new random streams, as a branch does.
+func (s *SISDynCorrModel) Restore(snapshot []byte) error {
+	r := stateReader{buf: snapshot}
+	step := r.int()
+	meetStep, meetCol, meetRow := r.int(), r.int(), r.int()
+	collisions, takeovers := r.int(), r.int()
+	frontSizes := r.ints(len(s.frontSizes))
+	cities := r.cities(&s.cityMap)
+	cells := r.cells(s.cells)
+	origins := r.ints(len(s.flow.cells))
+	if err := r.done(); err != nil {
+		return err
+	}
+
+	s.step = step
+	s.meetStep, s.meetCol, s.meetRow = meetStep, meetCol, meetRow
+	s.collisions, s.takeovers = collisions, takeovers
+	copy(s.frontSizes[:], frontSizes)
+	s.tiles.seed(rand.Int63())
+	setCities(&s.cityMap, cities)
+	s.buildTrail()
+	copy(s.cells.cells, cells)
+	for i := range origins {
+		f := &s.flow.cells[i]
+		f.origin = origins[i]
+		f.nextOrigin = origins[i]
+		f.claimed = 0
+	}
+	for _, p := range s.probes {
+		if p.start > step {
+			// Added after the snapshot, it starts again from here
+			p.restart(step)
+			s.recordProbe(p)
+		} else {
+			p.truncate(step)
+		}
+	}
+
+	w := s.raster.Width()
+	h := s.raster.Height()
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			s.drawCell(col, row)
+		}
+	}
+	return nil
 }
 
 func (s *SISDynCorrModel) Properties() api.IProperties {
-	return gui.NewProperties(1200, 600, 1500, 100, 2)
+	return raster.NewProperties(1200, 600, 1500, 100, 2)
 }
 
 func (s *SISDynCorrModel) Configure(rasterBuffer api.IRasterBuffer) {
@@ -98,10 +488,11 @@ func (s *SISDynCorrModel) Configure(rasterBuffer api.IRasterBuffer) {
 
 	rand.Seed(131)
 
-	s.cells = make([][]Cell, s.raster.Width())
-	for i := range s.cells {
-		s.cells[i] = make([]Cell, s.raster.Height())
-	}
+	s.cells = NewGrid(s.raster.Width(), s.raster.Height())
+	s.flow = newFlowGrid(s.raster.Width(), s.raster.Height())
+
+	s.tiles = NewTileGrid(s.raster.Width(), s.raster.Height(), tileSize)
+	s.tallies = make([]frontTally, len(s.tiles.tiles))
 }
 
 func (s *SISDynCorrModel) Reset() {
@@ -114,20 +505,24 @@ func (s *SISDynCorrModel) Reset() {
 	// Create two zones. Each zone is a square.
 	for col := 0; col < w; col += 1 {
 		for row := 0; row < h; row += 1 {
-			s.cells[col][row].state = 2     // Susceptible
-			s.cells[col][row].nextState = 2 // Undetermined
+			s.cells.at(col, row).state = 2     // Susceptible
+			s.cells.at(col, row).nextState = 2 // Undetermined
+			*s.flow.at(col, row) = flowCell{}
 		}
 	}
 
-	px := 40
-	py := 200
-	radius := 10
-	for col := px; col < px+radius; col += 1 {
-		for row := py; row < py+radius; row += 1 {
-			s.cells[col][row].state = 1
-		}
+	s.step = 0
+	s.tiles.seed(rand.Int63())
+	s.meetStep = -1
+	s.collisions = 0
+	s.takeovers = 0
+
+	s.seed(40, 200, 1)
+	if s.flowMode == bidirectionalFlow {
+		s.seed(200, 160, 2)
 	}
 
+	s.cityMap.clear()
 	s.buildLFP(50, 200)
 	s.buildPath(60, 195)
 	s.buildPath(65, 190)
@@ -160,34 +555,175 @@ func (s *SISDynCorrModel) Reset() {
 
 	s.buildLFP(190, 160)
 
+	s.buildTrail()
+
 	for col := 0; col < w; col += 1 {
 		for row := 0; row < h; row += 1 {
 			s.drawCell(col, row)
 		}
 	}
+
+	// By default probe the first and last LFP of the trail.
+	if len(s.probes) == 0 {
+		s.probes = append(s.probes, NewProbeRegion(50, 200, 10, 10))
+		s.probes = append(s.probes, NewProbeRegion(190, 160, 10, 10))
+	}
+	for _, p := range s.probes {
+		p.restart(0)
+	}
+	s.recordProbes()
 }
 
-func (s *SISDynCorrModel) buildLFP(px, py int) {
+// seed infects a square of cells belonging to the given front.
+func (s *SISDynCorrModel) seed(px, py, origin int) {
 	radius := 10
 
 	for col := px; col < px+radius; col += 1 {
 		for row := py; row < py+radius; row += 1 {
-			s.cells[col][row].degree = 7
+			s.cells.at(col, row).state = 1
+			s.cells.at(col, row).nextState = 1
+			s.flow.at(col, row).origin = origin
+			s.flow.at(col, row).nextOrigin = origin
 		}
 	}
 }
 
-func (s *SISDynCorrModel) buildPath(px, py int) {
-	radius := 5
+// buildTrail stamps the trail's degrees and, in directed mode, its
+// direction field.
+func (s *SISDynCorrModel) buildTrail() {
+	w := s.raster.Width()
+	h := s.raster.Height()
 
-	for col := px; col < px+radius; col += 1 {
-		for row := py; row < py+radius; row += 1 {
-			s.cells[col][row].degree = 6
+	s.cityMap.stamp(s.cells)
+
+	if s.flowMode == directedFlow {
+		s.buildDirectionField(w, h)
+	}
+}
+
+// buildDirectionField points each trail cell towards the center
+// of the next patch on the trail.
+func (s *SISDynCorrModel) buildDirectionField(w, h int) {
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			s.flow.at(col, row).dirX = 0
+			s.flow.at(col, row).dirY = 0
+		}
+	}
+
+	trail := s.cityMap.cities
+	for i, c := range trail {
+		from := c.bounds()
+		to := from
+		if i+1 < len(trail) {
+			to = trail[i+1].bounds()
+		} else if i > 0 {
+			from = trail[i-1].bounds()
+		}
+
+		dx := float64(to.Min.X+to.Max.X-from.Min.X-from.Max.X) / 2
+		dy := float64(to.Min.Y+to.Max.Y-from.Min.Y-from.Max.Y) / 2
+		l := math.Hypot(dx, dy)
+		if l == 0 {
+			continue
+		}
+
+		r := c.bounds().Intersect(image.Rect(0, 0, w, h))
+		for col := r.Min.X; col < r.Max.X; col += 1 {
+			for row := r.Min.Y; row < r.Max.Y; row += 1 {
+				s.flow.at(col, row).dirX = dx / l
+				s.flow.at(col, row).dirY = dy / l
+			}
 		}
 	}
 }
 
-func (s *SISDynCorrModel) moveCity(dx, dy int) {
+// transmissionBias scales the acceptible rate of a transmission from
+// col,row along offset n. Transmissions against the direction field
+// are scaled by 1-bias, the others keep the acceptible rate. Outside
+// of directed mode there is no bias.
+func (s *SISDynCorrModel) transmissionBias(col, row int, n [2]int) float64 {
+	if s.flowMode != directedFlow {
+		return 1
+	}
+
+	f := s.flow.at(col, row)
+	if f.dirX*float64(n[0])+f.dirY*float64(n[1]) < 0 {
+		return 1 - s.flowBias
+	}
+	return 1
+}
+
+// claim records which front infects the cell ce,re. Cells claimed by
+// both fronts in the same step are collisions.
+func (s *SISDynCorrModel) claim(tally *frontTally, col, row, ce, re int) {
+	origin := s.flow.at(col, row).origin
+	target := s.flow.at(ce, re)
+
+	if target.claimed == s.step && target.nextOrigin != origin {
+		tally.collisions++
+	}
+	if target.origin != 0 && target.origin != origin {
+		tally.takeovers++
+	}
+
+	target.claimed = s.step
+	target.nextOrigin = origin
+}
+
+// stepCell updates the next-state of col,row using the tile's random
+// stream.
+func (s *SISDynCorrModel) stepCell(t *Tile, tally *frontTally, col, row int, bidirectional bool) {
+	cell := s.cells.at(col, row)
+
+	switch cell.state {
+	case 1:
+		// How likely will they drop it.
+		if t.rng.Float64() < s.dropRate {
+			cell.nextState = 2 // Suceptible
+		}
+
+		if bidirectional && s.meetStep < 0 && tally.meet == nil {
+			// Infected neighbors from the other front
+			reachedBy(s.cells, col, row, func(c, r int, n [2]int) {
+				if tally.meet == nil && s.cells.at(c, r).state == 1 && s.flow.at(c, r).origin != s.flow.at(col, row).origin {
+					tally.meet = &[2]int{col, row}
+				}
+			})
+		}
+	case 2:
+		// Each infected neighbor reaching this cell tries to infect it.
+		// Higher degree cells also reach diagonals.
+		reachedBy(s.cells, col, row, func(c, r int, n [2]int) {
+			if s.cells.at(c, r).state != 1 {
+				return
+			}
+			if t.rng.Float64() < s.acceptibleRate*s.transmissionBias(c, r, n) {
+				// Cell is now infected
+				if cell.nextState != 1 {
+					cell.nextState = 1
+					tally.infected++
+				}
+				if bidirectional {
+					s.claim(tally, c, r, col, row)
+				}
+			}
+		})
+	}
+}
+
+// buildLFP adds a degree 7 patch with its top/left corner at px,py.
+func (s *SISDynCorrModel) buildLFP(px, py int) {
+	radius := 10.0
+
+	s.cityMap.add(NewCity(float64(px)+radius/2, float64(py)+radius/2, radius, 7, 1))
+}
+
+// buildPath adds a degree 6 patch with its top/left corner at px,py.
+func (s *SISDynCorrModel) buildPath(px, py int) {
+	radius := 5.0
+
+	s.cityMap.add(NewCity(float64(px)+radius/2, float64(py)+radius/2, radius, 6, 1))
 }
 
 func (s *SISDynCorrModel) Step() bool {
@@ -195,138 +731,68 @@ func (s *SISDynCorrModel) Step() bool {
 	// Once done, the next-state is copied back to the current-state.
 	w := s.raster.Width()
 	h := s.raster.Height()
-	ce := 0
 	infected := 0
+	bidirectional := s.flowMode == bidirectionalFlow
 
-	for col := 0; col < w; col += 1 {
-		for row := 0; row < h; row += 1 {
-			switch s.cells[col][row].state {
-			case 1:
-				// How likely will they drop it.
-				if rand.Float64() < s.dropRate {
-					s.cells[col][row].nextState = 2 // Suceptible
-				}
-
-				// Check neighbors.
-				ce = col + 1
-				if ce < w { // Right
-					// If neighbor isn't (infected AND they are acceptible) = Suceptible
-					if s.cells[ce][row].state == 2 {
-						if rand.Float64() < s.acceptibleRate {
-							// Cell is now infected
-							s.cells[ce][row].nextState = 1
-							infected++
-						}
-					}
-				}
+	s.step++
 
-				ce = col - 1
-				if ce >= 0 { // Left
-					if s.cells[ce][row].state == 2 {
-						if rand.Float64() < s.acceptibleRate {
-							// Cell is now infected
-							s.cells[ce][row].nextState = 1
-							infected++
-						}
-					}
-				}
-
-				ce = row - 1
-				if ce >= 0 { // Top
-					if s.cells[col][ce].state == 2 {
-						if rand.Float64() < s.acceptibleRate {
-							// Cell is now infected
-							s.cells[col][ce].nextState = 1
-							infected++
-						}
-					}
-				}
-
-				ce = row + 1
-				if ce < h { // Bottom
-					if s.cells[col][ce].state == 2 {
-						if rand.Float64() < s.acceptibleRate {
-							// Cell is bottom infected
-							s.cells[col][ce].nextState = 1
-							infected++
-						}
-					}
-				}
+	if s.cityMap.update(w, h) {
+		s.buildTrail()
+	}
 
-				if s.cells[col][row].degree > 4 {
-					// top/right
-					ce = row - 1
-					re := col + 1
-					if ce >= 0 { // Top
-						if s.cells[re][ce].state == 2 {
-							if rand.Float64() < s.acceptibleRate {
-								// Cell is now infected
-								s.cells[col][ce].nextState = 1
-								infected++
-							}
-						}
-					}
-				}
-				if s.cells[col][row].degree > 5 {
-					// bottom/right
-					ce = row + 1
-					re := col + 1
-					if ce >= 0 { // Top
-						if s.cells[re][ce].state == 2 {
-							if rand.Float64() < s.acceptibleRate {
-								// Cell is now infected
-								s.cells[col][ce].nextState = 1
-								infected++
-							}
-						}
-					}
-				}
-				if s.cells[col][row].degree > 6 {
-					// bottom/left
-					ce = row + 1
-					re := col - 1
-					if ce >= 0 { // Top
-						if s.cells[re][ce].state == 2 {
-							if rand.Float64() < s.acceptibleRate {
-								// Cell is now infected
-								s.cells[col][ce].nextState = 1
-								infected++
-							}
-						}
-					}
-				}
-				if s.cells[col][row].degree > 7 {
-					// top/left
-					ce = row - 1
-					re := col - 1
-					if ce >= 0 { // Top
-						if s.cells[re][ce].state == 2 {
-							if rand.Float64() < s.acceptibleRate {
-								// Cell is now infected
-								s.cells[col][ce].nextState = 1
-								infected++
-							}
-						}
-					}
-				}
+	// Tiles run concurrently. Each cell only updates its own next-state
+	// by pulling infections from its infected neighbors.
+	s.tiles.run(func(t *Tile) {
+		tally := &s.tallies[t.index]
+		*tally = frontTally{}
+		for col := t.x0; col < t.x1; col += 1 {
+			for row := t.y0; row < t.y1; row += 1 {
+				s.stepCell(t, tally, col, row, bidirectional)
 			}
 		}
+	})
+
+	var meet *[2]int
+	for _, tally := range s.tallies {
+		infected += tally.infected
+		s.collisions += tally.collisions
+		s.takeovers += tally.takeovers
+		// The first meeting in scan order
+		if tally.meet != nil && (meet == nil || tally.meet[0] < meet[0] || (tally.meet[0] == meet[0] && tally.meet[1] < meet[1])) {
+			meet = tally.meet
+		}
+	}
+	if meet != nil {
+		s.meetStep = s.step
+		s.meetCol = meet[0]
+		s.meetRow = meet[1]
+		fmt.Printf("Fronts met at step %d at [%d,%d]\n", s.step, s.meetCol, s.meetRow)
 	}
 
 	// Copy next-state to current-state
+	s.frontSizes = [3]int{}
 	for col := 0; col < w; col += 1 {
 		for row := 0; row < h; row += 1 {
 			s.drawCell(col, row)
-			s.cells[col][row].state = s.cells[col][row].nextState
+			s.cells.at(col, row).state = s.cells.at(col, row).nextState
+			if bidirectional {
+				f := s.flow.at(col, row)
+				f.origin = f.nextOrigin
+				if s.cells.at(col, row).state == 1 {
+					s.frontSizes[f.origin]++
+				}
+			}
 		}
 	}
 
+	s.recordProbes()
+
 	// fmt.Println("Newly infected: ", infected)
 	return infected > 0
 }
 
 func (s *SISDynCorrModel) drawCell(col, row int) {
-	switch s.cells[col][row].degree {
+	switch s.cells.at(col, row).degree {
 	case 5:
 		s.raster.SetPixelColor(s.degree5Color)
 	case 6:
@@ -337,11 +803,11 @@ func (s *SISDynCorrModel) drawCell(col, row int) {
 		s.raster.SetPixelColor(s.degree8Color)
 	}
 
-	switch s.cells[col][row].state {
+	switch s.cells.at(col, row).state {
 	case 1:
 		s.raster.SetPixelColor(s.infectedColor)
 	case 2:
-		if s.cells[col][row].degree < 5 {
+		if s.cells.at(col, row).degree < 5 {
 			s.raster.SetPixelColor(s.susceptibleColor)
 		}
 		// default:
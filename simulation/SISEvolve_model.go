@@ -0,0 +1,412 @@
+package simulation
+
+import (
+	"Netron1-Go/api"
+	"Netron1-Go/raster"
+	"fmt"
+	"image/color"
+	"math"
+	"math/rand"
+	"strings"
+)
+
+// The evolve model is an SIS model where each infection carries a
+// transmissibility trait. The trait is inherited on transmission with
+// a gaussian mutation. Transmissibility costs a faster recovery:
+//   recover = base + coef * trait^exponent
+// so the trait evolves to balance spreading against persisting.
+//   evolve mutation <sd>
+//   evolve cost <base> <coef> <exponent>
+//   evolve seed <trait>          initial trait of the seeded cells
+//   evolve view <state|trait>    colors cells by state or trait value
+//   evolve stats                 trait distribution and prevalence
+//   evolve export                writes the trait series and histogram
+
+const traitBins = 20
+
+type SISEvolveModel struct {
+	susceptibleColor color.RGBA
+	infectedColor    color.RGBA
+
+	raster api.IRasterBuffer
+	cells  *EGrid
+
+	mutation     float64
+	baseRecover  float64
+	costCoef     float64
+	costExponent float64
+	seedTrait    float64
+	seeds        int
+	viewTrait    bool
+
+	// Trait distribution of the infected cells per step
+	prevalence []float64
+	traitMean  []float64
+	traitSD    []float64
+	// Fraction of infected cells in each trait bin per step
+	histogram [traitBins][]float64
+}
+
+func NewSISEvolveModel() api.IModel {
+	o := new(SISEvolveModel)
+	// Susceptible = Skin
+	o.susceptibleColor = color.RGBA{R: 255, G: 225, B: 200, A: 255}
+	// Infected = Blue
+	o.infectedColor = color.RGBA{R: 0, G: 0, B: 255, A: 255}
+
+	return o
+}
+
+func (s *SISEvolveModel) Name() string {
+	return "SISEvolveModel"
+}
+
+func (s *SISEvolveModel) Configure(rasterBuffer api.IRasterBuffer) {
+	s.raster = rasterBuffer
+	s.mutation = 0.02
+	s.baseRecover = 0.1
+	s.costCoef = 0.5
+	s.costExponent = 2
+	s.seedTrait = 0.3
+	s.seeds = 50
+	s.viewTrait = true
+
+	rand.Seed(13163)
+
+	s.cells = NewEGrid(s.raster.Width(), s.raster.Height())
+}
+
+// SetParameter sets mutation or seed, the initial trait, by name.
+func (s *SISEvolveModel) SetParameter(name string, value float64) error {
+	switch name {
+	case "mutation":
+		if value < 0 {
+			return fmt.Errorf("mutation can't be negative")
+		}
+		s.mutation = value
+	case "seed":
+		return setChance(&s.seedTrait, name, value)
+	default:
+		return fmt.Errorf("unknown parameter: %s", name)
+	}
+	return nil
+}
+
+// SendEvent receives an event from the host simulation
+func (s *SISEvolveModel) SendEvent(event string) error {
+	fields := strings.Fields(event)
+	if len(fields) < 2 || fields[0] != "evolve" {
+		return unhandled(event)
+	}
+
+	if fields[1] == "view" && len(fields) == 3 {
+		switch fields[2] {
+		case "state":
+			s.viewTrait = false
+		case "trait":
+			s.viewTrait = true
+		default:
+			return fmt.Errorf("usage: evolve view <state|trait>")
+		}
+		s.draw()
+		return nil
+	}
+
+	args, err := parseFloats(fields[2:])
+	if err != nil {
+		return fmt.Errorf("evolve: %v", err)
+	}
+
+	switch {
+	case fields[1] == "mutation" && len(args) == 1:
+		if err := s.SetParameter("mutation", args[0]); err != nil {
+			return err
+		}
+		fmt.Println("mutation sd: ", s.mutation)
+	case fields[1] == "cost" && len(args) == 3:
+		s.baseRecover = args[0]
+		s.costCoef = args[1]
+		s.costExponent = args[2]
+		fmt.Printf("recover = %g + %g * trait^%g\n", s.baseRecover, s.costCoef, s.costExponent)
+	case fields[1] == "seed" && len(args) == 1:
+		if err := s.SetParameter("seed", args[0]); err != nil {
+			return err
+		}
+		fmt.Println("seed trait: ", s.seedTrait)
+	case fields[1] == "stats":
+		s.printStats()
+	case fields[1] == "export":
+		return s.exportStats()
+	default:
+		return fmt.Errorf("unknown evolve command: %s", event)
+	}
+	return nil
+}
+
+// Prevalence is the fraction of cells infected at the last step.
+func (s *SISEvolveModel) Prevalence() float64 {
+	return s.prevalence[len(s.prevalence)-1]
+}
+
+// recoverRate is the chance per step an infection with the given
+// trait recovers.
+func (s *SISEvolveModel) recoverRate(trait float64) float64 {
+	return s.baseRecover + s.costCoef*math.Pow(trait, s.costExponent)
+}
+
+// mutate returns a child trait clamped to 0..1.
+func (s *SISEvolveModel) mutate(trait float64) float64 {
+	return math.Max(0, math.Min(1, trait+s.mutation*rand.NormFloat64()))
+}
+
+func (s *SISEvolveModel) printStats() {
+	n := len(s.prevalence)
+	if n == 0 {
+		return
+	}
+
+	fmt.Println("step: ", n-1)
+	fmt.Printf("prevalence: %.4f, trait: %.4f (sd %.4f), recover: %.4f\n",
+		s.prevalence[n-1], s.traitMean[n-1], s.traitSD[n-1], s.recoverRate(s.traitMean[n-1]))
+
+	for b := 0; b < traitBins; b++ {
+		f := s.histogram[b][n-1]
+		if f > 0 {
+			fmt.Printf("[%.2f-%.2f) %6.4f %s\n", float64(b)/traitBins, float64(b+1)/traitBins, f, strings.Repeat("#", int(f*50)))
+		}
+	}
+}
+
+func (s *SISEvolveModel) exportStats() error {
+	base := dataPath(s.Name())
+
+	err := writeColumnsCSV(base+"_trait.csv", "step", []string{"prevalence", "mean", "sd"},
+		[][]float64{s.prevalence, s.traitMean, s.traitSD})
+	if err != nil {
+		return fmt.Errorf("export failed: %v", err)
+	}
+
+	names := make([]string, traitBins)
+	for b := range names {
+		names[b] = fmt.Sprintf("%.2f", float64(b)/traitBins)
+	}
+	if err := writeColumnsCSV(base+"_histogram.csv", "step", names, s.histogram[:]); err != nil {
+		return fmt.Errorf("export failed: %v", err)
+	}
+
+	steps := make([]float64, len(s.traitMean))
+	for i := range steps {
+		steps[i] = float64(i)
+	}
+	if err := savePlot(base+"_trait.png", steps, [][]float64{s.traitMean, s.prevalence}); err != nil {
+		return fmt.Errorf("export failed: %v", err)
+	}
+
+	fmt.Println("Exported stats to: " + base + "_*")
+	return nil
+}
+
+// record appends the prevalence and the trait distribution.
+func (s *SISEvolveModel) record() {
+	w := s.raster.Width()
+	h := s.raster.Height()
+	bins := [traitBins]int{}
+	n, sum, sum2 := 0, 0.0, 0.0
+
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			c := s.cells.at(col, row)
+			if !c.infected {
+				continue
+			}
+			n++
+			sum += c.trait
+			sum2 += c.trait * c.trait
+			b := int(c.trait * traitBins)
+			if b == traitBins {
+				b--
+			}
+			bins[b]++
+		}
+	}
+
+	mean, sd := 0.0, 0.0
+	if n > 0 {
+		mean = sum / float64(n)
+		sd = math.Sqrt(math.Max(0, sum2/float64(n)-mean*mean))
+	}
+
+	s.prevalence = append(s.prevalence, float64(n)/float64(w*h))
+	s.traitMean = append(s.traitMean, mean)
+	s.traitSD = append(s.traitSD, sd)
+	for b := range bins {
+		f := 0.0
+		if n > 0 {
+			f = float64(bins[b]) / float64(n)
+		}
+		s.histogram[b] = append(s.histogram[b], f)
+	}
+}
+
+// traitColor maps a trait from 0 (blue) to 1 (red).
+func traitColor(trait float64) color.RGBA {
+	return color.RGBA{R: uint8(255 * trait), G: 0, B: uint8(255 * (1 - trait)), A: 255}
+}
+
+func (s *SISEvolveModel) draw() {
+	w := s.raster.Width()
+	h := s.raster.Height()
+
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			c := s.cells.at(col, row)
+			if !c.infected {
+				s.raster.SetPixelColor(s.susceptibleColor)
+			} else if s.viewTrait {
+				s.raster.SetPixelColor(traitColor(c.trait))
+			} else {
+				s.raster.SetPixelColor(s.infectedColor)
+			}
+			s.raster.SetPixel(col, row)
+		}
+	}
+}
+
+// Snapshot returns the infected cells and their traits.
+func (s *SISEvolveModel) Snapshot() []byte {
+	w := stateWriter{}
+	w.int(len(s.cells.cells))
+	for _, c := range s.cells.cells {
+		w.bool(c.infected)
+		w.float(c.trait)
+	}
+	w.int(len(s.prevalence))
+	return w.buf
+}
+
+// Restore sets the cells from a snapshot, cuts the trait series back
+// to its step and redraws the cells.
+func (s *SISEvolveModel) Restore(snapshot []byte) error {
+	r := stateReader{buf: snapshot}
+	if r.int() != len(s.cells.cells) {
+		return errBadSnapshot
+	}
+	cells := make([]ECell, len(s.cells.cells))
+	for i := range cells {
+		cells[i].infected = r.bool()
+		cells[i].trait = r.float()
+		// Traits index the histogram bins
+		if !(cells[i].trait >= 0 && cells[i].trait <= 1) {
+			return errBadSnapshot
+		}
+	}
+	n := r.length(len(s.prevalence))
+	if err := r.done(); err != nil {
+		return err
+	}
+
+	copy(s.cells.cells, cells)
+	s.prevalence = s.prevalence[:n]
+	s.traitMean = s.traitMean[:n]
+	s.traitSD = s.traitSD[:n]
+	for b := range s.histogram {
+		s.histogram[b] = s.histogram[b][:n]
+	}
+	s.draw()
+	return nil
+}
+
+func (s *SISEvolveModel) Properties() api.IProperties {
+	return raster.NewProperties(300, 300, 1500, 100, 1)
+}
+
+func (s *SISEvolveModel) Reset() {
+	fmt.Println(("--- evolve reset ---"))
+	s.raster.Clear()
+
+	w := s.raster.Width()
+	h := s.raster.Height()
+
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			*s.cells.at(col, row) = ECell{}
+		}
+	}
+
+	for i := 0; i < s.seeds; i++ {
+		c := s.cells.at(rand.Intn(w), rand.Intn(h))
+		c.infected = true
+		c.trait = s.seedTrait
+	}
+
+	s.prevalence = []float64{}
+	s.traitMean = []float64{}
+	s.traitSD = []float64{}
+	for b := range s.histogram {
+		s.histogram[b] = []float64{}
+	}
+	s.record()
+	s.draw()
+}
+
+func (s *SISEvolveModel) Step() bool {
+	w := s.raster.Width()
+	h := s.raster.Height()
+
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			c := s.cells.at(col, row)
+			c.nextInfected = c.infected
+			c.nextTrait = c.trait
+			c.offers = 0
+			if c.infected && rand.Float64() < s.recoverRate(c.trait) {
+				c.nextInfected = false
+			}
+		}
+	}
+
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			c := s.cells.at(col, row)
+			if !c.infected {
+				continue
+			}
+
+			for _, n := range neighbors(4) {
+				nc := col + n[0]
+				nr := row + n[1]
+				if nc < 0 || nc >= w || nr < 0 || nr >= h {
+					continue
+				}
+				t := s.cells.at(nc, nr)
+				if t.infected || rand.Float64() >= c.trait {
+					continue
+				}
+				// Keep one of the infections offered at random
+				t.offers++
+				if rand.Intn(t.offers) == 0 {
+					t.nextInfected = true
+					t.nextTrait = s.mutate(c.trait)
+				}
+			}
+		}
+	}
+
+	// Copy next-state to current-state
+	infected := false
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			c := s.cells.at(col, row)
+			c.infected = c.nextInfected
+			c.trait = c.nextTrait
+			if c.infected {
+				infected = true
+			}
+		}
+	}
+
+	s.record()
+	s.draw()
+
+	return infected
+}
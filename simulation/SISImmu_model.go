@@ -2,12 +2,22 @@ package simulation
 
 import (
 	"Netron1-Go/api"
-	"Netron1-Go/gui"
+	"Netron1-Go/raster"
 	"fmt"
 	"image/color"
 	"math/rand"
+	"strings"
 )
 
+// The immunity model is SIRS: recovering confers immunity for a
+// duration drawn from a distribution, after which the cell is
+// susceptible again. A few cells are permanently immune.
+//   immu dist <fixed|exp|gamma|uniform> <mean> [shape|half width]
+//   immu stats     prevalence and the period of recurrent waves
+//   immu export    writes the S/I/R series and the infected autocorrelation
+//   sparse <on|off>  only steps the active cells and the cells they reach
+// Spontaneous introductions are set with the "spont" commands.
+
 type SISimmuModel struct {
 	undetermenedColor color.RGBA // cell type = 0
 	infectedColor     color.RGBA // cell type = 1
@@ -17,7 +27,9 @@ type SISimmuModel struct {
 	raster api.IRasterBuffer
 	// cellStates     [][]int
 	// cellNextStates [][]int
-	cells [][]Cell
+	cells *Grid
+	// The grid is stepped in concurrent tiles
+	stepper *gridStepper
 
 	acceptibleRate float64
 
@@ -28,11 +40,19 @@ type SISimmuModel struct {
 	// The chance they will try meditation
 	pickupRate float64
 
-	// The chance that someone spontaneously starts meditating.
-	spontaneousRate float64
+	// Spontaneous introductions of meditation.
+	spontaneous *SpontaneousProcess
+	cases       caseCounts
 
 	// The chance the person has no interest at all
 	immunityRate float64
+	// How long recovered cells stay immune
+	immunity *Distribution
+
+	// Fraction of cells in each state per step
+	susceptible []float64
+	infected    []float64
+	immune      []float64
 }
 
 func NewSISimmuModel() api.IModel {
@@ -52,34 +72,241 @@ func (s *SISimmuModel) Name() string {
 	return "SISimmuModel"
 }
 
+// Palette returns the state colors.
+func (s *SISimmuModel) Palette() color.Palette {
+	return color.Palette{
+		s.undetermenedColor,
+		s.infectedColor,
+		s.susceptibleColor,
+		s.removedColor,
+	}
+}
+
 func (s *SISimmuModel) Configure(rasterBuffer api.IRasterBuffer) {
 	s.raster = rasterBuffer
 	s.acceptibleRate = 0.26 // 26 = below threshold
 	s.repeatRate = 0.2
 	s.dropRate = 0.9
 	s.pickupRate = 0.5
-	s.spontaneousRate = 0.25
 	s.immunityRate = 0.01
+	s.immunity, _ = NewDistribution("exp", 20, 0)
 
 	rand.Seed(13163)
 
-	s.cells = make([][]Cell, s.raster.Height())
-	for i := range s.cells {
-		s.cells[i] = make([]Cell, s.raster.Width())
+	s.cells = NewGrid(s.raster.Width(), s.raster.Height())
+	s.stepper = newGridStepper(s.cells, immuActive)
+
+	// Same expected introductions per step as a single coin flip of 0.25
+	s.spontaneous = NewSpontaneousProcess(s.raster.Width(), s.raster.Height(), 0.25/float64(s.raster.Width()*s.raster.Height()))
+}
+
+// immuActive reports the cells sparse steps visit: infected cells,
+// immune cells whose immunity wanes and cells with a next state still
+// to be copied.
+func immuActive(c *Cell) bool {
+	return c.state == 1 || (c.state == 3 && c.timer > 0) || c.nextState != c.state
+}
+
+// SetParameter sets accept, drop, pickup or immune, the permanently
+// immune fraction, by name.
+func (s *SISimmuModel) SetParameter(name string, value float64) error {
+	switch name {
+	case "accept":
+		return setChance(&s.acceptibleRate, name, value)
+	case "drop":
+		return setChance(&s.dropRate, name, value)
+	case "pickup":
+		return setChance(&s.pickupRate, name, value)
+	case "immune":
+		return setChance(&s.immunityRate, name, value)
 	}
+	return fmt.Errorf("unknown parameter: %s", name)
+}
+
+// Prevalence is the fraction of cells infected.
+func (s *SISimmuModel) Prevalence() float64 {
+	return s.cells.fraction(1)
 }
 
 // SendEvent receives an event from the host simulation
-func (s *SISimmuModel) SendEvent(event string) {
+func (s *SISimmuModel) SendEvent(event string) error {
+	fields := strings.Fields(event)
+	if ok, err := s.spontaneous.event(fields); ok {
+		return err
+	}
+	if ok, err := s.stepper.event(fields); ok {
+		return err
+	}
+
+	if len(fields) == 2 && fields[0] == "spont" && fields[1] == "stats" {
+		fmt.Println(s.cases.toString())
+		return nil
+	}
+
+	if len(fields) < 2 || fields[0] != "immu" {
+		return unhandled(event)
+	}
+
+	switch fields[1] {
+	case "dist":
+		usage := fmt.Errorf("usage: immu dist <fixed|exp|gamma|uniform> <mean> [shape|half width]")
+		if len(fields) < 4 {
+			return usage
+		}
+		args, err := parseFloats(fields[3:])
+		if err != nil {
+			return usage
+		}
+		shape := 0.0
+		if len(args) > 1 {
+			shape = args[1]
+		}
+		d, err := NewDistribution(fields[2], args[0], shape)
+		if err != nil {
+			return fmt.Errorf("immunity: %v", err)
+		}
+		s.immunity = d
+		fmt.Println("immunity: " + s.immunity.toString())
+	case "stats":
+		s.printStats()
+	case "export":
+		return s.exportStats()
+	default:
+		return fmt.Errorf("unknown immu command: %s", event)
+	}
+	return nil
+}
+
+func (s *SISimmuModel) printStats() {
+	n := len(s.infected)
+	if n == 0 {
+		return
+	}
+
+	fmt.Println("step: ", n-1)
+	fmt.Printf("S: %.4f, I: %.4f, R: %.4f\n", s.susceptible[n-1], s.infected[n-1], s.immune[n-1])
+	fmt.Println(s.cases.toString())
+
+	// Skip the initial transient
+	endemic := s.infected[n/4:]
+	mean, min, max := 0.0, 1.0, 0.0
+	for _, v := range endemic {
+		mean += v
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	mean /= float64(len(endemic))
+	fmt.Printf("endemic prevalence: %.4f [%.4f-%.4f]\n", mean, min, max)
+
+	period, strength := oscillationPeriod(endemic, len(endemic)/2)
+	if period < 0 {
+		fmt.Println("no recurrent waves detected")
+	} else {
+		fmt.Printf("wave period: %d steps (autocorrelation %.3f)\n", period, strength)
+	}
+}
+
+func (s *SISimmuModel) exportStats() error {
+	base := dataPath(s.Name())
+
+	err := writeColumnsCSV(base+"_sir.csv", "step", []string{"susceptible", "infected", "immune", "introduced", "transmitted"},
+		[][]float64{s.susceptible, s.infected, s.immune, s.cases.introduced, s.cases.transmitted})
+	if err != nil {
+		return fmt.Errorf("export failed: %v", err)
+	}
+
+	maxLag := len(s.infected) / 2
+	auto := crossCorrelation(s.infected, s.infected, maxLag)[maxLag:]
+	lags := make([]float64, len(auto))
+	for i := range lags {
+		lags[i] = float64(i)
+	}
+	if err := savePlot(base+"_autocorrelation.png", lags, [][]float64{auto}); err != nil {
+		return fmt.Errorf("export failed: %v", err)
+	}
+
+	fmt.Println("Exported stats to: " + base + "_*")
+	return nil
+}
+
+// record appends the fraction of cells in each state.
+func (s *SISimmuModel) record() {
+	w := s.raster.Width()
+	h := s.raster.Height()
+	counts := [4]int{}
+
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			counts[s.cells.at(col, row).state]++
+		}
+	}
+
+	n := float64(w * h)
+	s.susceptible = append(s.susceptible, float64(counts[2])/n)
+	s.infected = append(s.infected, float64(counts[1])/n)
+	s.immune = append(s.immune, float64(counts[3])/n)
+}
+
+// Snapshot returns the cells, with their immunity timers, and how
+// many steps were recorded.
+func (s *SISimmuModel) Snapshot() []byte {
+	w := stateWriter{}
+	w.cells(s.cells)
+	w.int(len(s.infected))
+	w.int(len(s.cases.introduced))
+	return w.buf
+}
+
+// Restore sets the cells from a snapshot, drops the steps recorded
+// after it and redraws the cells. The tiles take new random streams,
+// as a branch does.
+func (s *SISimmuModel) Restore(snapshot []byte) error {
+	r := stateReader{buf: snapshot}
+	cells := r.cells(s.cells)
+	n := r.length(len(s.infected))
+	cases := r.length(len(s.cases.introduced))
+	if err := r.done(); err != nil {
+		return err
+	}
+	s.stepper.seed(rand.Int63())
+	copy(s.cells.cells, cells)
+	s.stepper.rebuild()
+	s.susceptible = s.susceptible[:n]
+	s.infected = s.infected[:n]
+	s.immune = s.immune[:n]
+	s.cases.introduced = s.cases.introduced[:cases]
+	s.cases.transmitted = s.cases.transmitted[:cases]
+
+	w := s.raster.Width()
+	h := s.raster.Height()
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			switch s.cells.at(col, row).state {
+			case 1:
+				s.raster.SetPixelColor(s.infectedColor)
+			case 3:
+				s.raster.SetPixelColor(s.removedColor)
+			default:
+				s.raster.SetPixelColor(s.susceptibleColor)
+			}
+			s.raster.SetPixel(col, row)
+		}
+	}
+	return nil
 }
 
 func (s *SISimmuModel) Properties() api.IProperties {
-	return gui.NewProperties(300, 300, 1500, 100, 1)
+	return raster.NewProperties(300, 300, 1500, 100, 1)
 }
 
 func (s *SISimmuModel) Reset() {
 	fmt.Println(("--- sir reset ---"))
 	s.raster.Clear()
+	s.stepper.seed(rand.Int63())
 
 	w := s.raster.Width()
 	h := s.raster.Height()
@@ -88,20 +315,23 @@ func (s *SISimmuModel) Reset() {
 		for row := 0; row < h; row += 1 {
 			// Is this person have no interest ever
 			if rand.Float64() < s.immunityRate {
-				s.cells[col][row].state = 3 // Immune
-				s.cells[col][row].nextState = 3
+				s.cells.at(col, row).state = 3 // Immune
+				s.cells.at(col, row).nextState = 3
+				s.cells.at(col, row).timer = -1 // Forever
 			} else {
-				s.cells[col][row].state = 2 // Susceptible
-				s.cells[col][row].nextState = 2
+				s.cells.at(col, row).state = 2 // Susceptible
+				s.cells.at(col, row).nextState = 2
+				s.cells.at(col, row).timer = 0
 			}
 		}
 	}
+	s.stepper.rebuild()
 
 	for col := 0; col < w; col += 1 {
 		for row := 0; row < h; row += 1 {
-			if s.cells[col][row].state == 1 {
+			if s.cells.at(col, row).state == 1 {
 				s.raster.SetPixelColor(s.infectedColor)
-			} else if s.cells[col][row].state == 3 {
+			} else if s.cells.at(col, row).state == 3 {
 				s.raster.SetPixelColor(s.removedColor)
 			} else {
 				s.raster.SetPixelColor(s.susceptibleColor)
@@ -109,103 +339,89 @@ func (s *SISimmuModel) Reset() {
 			s.raster.SetPixel(col, row)
 		}
 	}
+
+	s.susceptible = []float64{}
+	s.infected = []float64{}
+	s.immune = []float64{}
+	s.record()
+	// No cases at step 0, so the case rows line up with S/I/R
+	s.cases.reset()
+	s.cases.record(0, 0)
 }
 
-func (s *SISimmuModel) Step() bool {
-	// The current "step" works on the current-state but updates the next-state
-	// Once done, the next-state is copied back to the current-state.
-	w := s.raster.Width()
-	h := s.raster.Height()
-	ce := 0
-	infected := 0
+// stepCell updates the next-state and the timer of col,row using the
+// tile's random stream.
+func (s *SISimmuModel) stepCell(t *Tile, col, row int) {
+	cell := s.cells.at(col, row)
 
-	for col := 0; col < w; col += 1 {
-		for row := 0; row < h; row += 1 {
-			if s.cells[col][row].state == 1 { // Is infected
-				// How likely will they drop it.
-				if rand.Float64() < s.dropRate {
-					s.cells[col][row].nextState = 2 // Suceptible
-				}
-
-				// Check neighbors.
-				ce = col + 1
-				if ce < w { // Right
-					// If neighbor isn't (infected AND they are acceptible) = Suceptible
-					if s.cells[ce][row].state == 2 {
-						if rand.Float64() < s.acceptibleRate {
-							// Cell is now infected
-							s.cells[ce][row].nextState = 1
-							infected++
-						}
-					}
-				}
-
-				ce = col - 1
-				if ce >= 0 { // Left
-					if s.cells[ce][row].state == 2 {
-						if rand.Float64() < s.acceptibleRate {
-							// Cell is now infected
-							s.cells[ce][row].nextState = 1
-							infected++
-						}
-					}
-				}
-
-				ce = row - 1
-				if ce >= 0 { // Top
-					if s.cells[col][ce].state == 2 {
-						if rand.Float64() < s.acceptibleRate {
-							// Cell is now infected
-							s.cells[col][ce].nextState = 1
-							infected++
-						}
-					}
-				}
-
-				ce = row + 1
-				if ce < h { // Bottom
-					if s.cells[col][ce].state == 2 {
-						if rand.Float64() < s.acceptibleRate {
-							// Cell is bottom infected
-							s.cells[col][ce].nextState = 1
-							infected++
-						}
-					}
-				}
+	switch cell.state {
+	case 3: // Is immune
+		// Immunity wanes
+		if cell.timer > 0 {
+			cell.timer--
+			if cell.timer == 0 {
+				cell.nextState = 2 // Suceptible
 			}
 		}
+	case 1: // Is infected
+		// How likely will they drop it. Recovering confers immunity.
+		if t.rng.Float64() < s.dropRate {
+			cell.timer = s.immunity.sample(t.rng)
+			if cell.timer > 0 {
+				cell.nextState = 3 // Immune
+			} else {
+				cell.timer = 0
+				cell.nextState = 2 // Suceptible
+			}
+		}
+	case 2:
+		// Each infected neighbor tries to infect the cell
+		reachedBy(s.cells, col, row, func(c, r int, n [2]int) {
+			if s.cells.at(c, r).state == 1 && t.rng.Float64() < s.acceptibleRate {
+				// Cell is now infected
+				cell.nextState = 1
+				s.stepper.counts[t.index]++
+			}
+		})
 	}
+}
 
-	if rand.Float64() < s.spontaneousRate {
-		// pick a col and row to infect
-		col := int(rand.Float64()*float64(s.raster.Width())) - 1
-		if col < 0 {
-			col = 0
-		}
-		row := int(rand.Float64()*float64(s.raster.Width())) - 1
-		if row < 0 {
-			row = 0
-		}
-		if s.cells[col][row].state != 3 {
-			s.cells[col][row].nextState = 1
-			infected++
+func (s *SISimmuModel) Step() bool {
+	// The current "step" works on the current-state but updates the next-state
+	// Once done, the next-state is copied back to the current-state.
+	s.stepper.step(s.stepCell)
+
+	introduced := s.spontaneous.introduce(func(col, row int) bool {
+		// Only susceptible cells that a neighbor didn't just infect
+		cell := s.cells.at(col, row)
+		if cell.state != 2 || cell.nextState == 1 {
+			return false
 		}
-	}
+		cell.nextState = 1
+		s.stepper.touch(col, row)
+		return true
+	})
 
 	// Copy next-state to current-state
-	for col := 0; col < w; col += 1 {
-		for row := 0; row < h; row += 1 {
-			s.cells[col][row].state = s.cells[col][row].nextState
-			if s.cells[col][row].state == 1 {
-				s.raster.SetPixelColor(s.infectedColor)
-			} else if s.cells[col][row].state == 2 {
-				s.raster.SetPixelColor(s.susceptibleColor)
-			} else if s.cells[col][row].state == 3 {
-				s.raster.SetPixelColor(s.removedColor)
-			}
-			s.raster.SetPixel(col, row)
+	cases := 0
+	s.stepper.update(func(col, row, was int) {
+		cell := s.cells.at(col, row)
+		if was != 1 && cell.state == 1 {
+			cases++
 		}
-	}
+		if cell.state == 1 {
+			s.raster.SetPixelColor(s.infectedColor)
+		} else if cell.state == 2 {
+			s.raster.SetPixelColor(s.susceptibleColor)
+		} else if cell.state == 3 {
+			s.raster.SetPixelColor(s.removedColor)
+		}
+		s.raster.SetPixel(col, row)
+	})
+
+	s.record()
+
+	s.cases.record(introduced, cases-introduced)
 
 	// fmt.Println("Newly infected: ", infected)
 	return true //infected > 0
@@ -2,10 +2,11 @@ package simulation
 
 import (
 	"Netron1-Go/api"
-	"Netron1-Go/gui"
+	"Netron1-Go/raster"
 	"fmt"
 	"image/color"
 	"math/rand"
+	"strings"
 )
 
 // The Knowledge model is based on "information" and "sequences".
@@ -17,11 +18,14 @@ import (
 
 // For example, Orange can't gain Purple directly but Teal can.
 
-// type KnowledgeCenter struct {
-// 	col, row  int
-// 	color     color.RGBA
-// 	knowledge int
-// }
+// Knowledge centers teach their level to neighbors. They can be
+// added/removed with the mouse (left/right button) or the console:
+//   kc add <col> <row> <level> [capacity]
+//   kc remove <col> <row>
+//   kc schedule <col> <row> <relocatePeriod> <relocateRadius> <lifetime>
+//   kc level <level>       level used for mouse placement
+//   kc capacity <cells>    capacity for new centers
+//   kc list                prints each center and its reach
 
 type SISKnowledgeModel struct {
 	blueColor   color.RGBA
@@ -32,9 +36,12 @@ type SISKnowledgeModel struct {
 	susColor    color.RGBA // cell type = 2
 
 	raster api.IRasterBuffer
-	cells  [][]KCell
+	cells  *KGrid
 
-	knowledgeCenters []KCell
+	knowledgeCenters []*KnowledgeCenter
+	// Level and capacity given to newly placed centers
+	centerLevel    int
+	centerCapacity int
 
 	acceptableRate float64
 	// The chance they will drop meditation.
@@ -58,27 +65,210 @@ func (s *SISKnowledgeModel) Name() string {
 	return "SISKnowledgeModel"
 }
 
+// Palette returns the state colors.
+func (s *SISKnowledgeModel) Palette() color.Palette {
+	return color.Palette{
+		s.blueColor,
+		s.orangeColor,
+		s.greenColor,
+		s.tealColor,
+		s.purpleColor,
+		s.susColor,
+	}
+}
+
 func (s *SISKnowledgeModel) Configure(rasterBuffer api.IRasterBuffer) {
 	s.raster = rasterBuffer
 	s.acceptableRate = 0.23 // 0.22
 	s.dropRate = 0.4        // 0.6
+	s.centerLevel = 1
+	s.centerCapacity = 4
 
 	rand.Seed(131)
 
-	s.knowledgeCenters = []KCell{} //make([]KnowledgeCenter, 4)
+	s.knowledgeCenters = []*KnowledgeCenter{}
+
+	s.cells = NewKGrid(s.raster.Width(), s.raster.Height())
+}
 
-	s.cells = make([][]KCell, s.raster.Height())
-	for i := range s.cells {
-		s.cells[i] = make([]KCell, s.raster.Width())
+// SetParameter sets accept, drop or level, the level of centers placed
+// with the mouse, by name.
+func (s *SISKnowledgeModel) SetParameter(name string, value float64) error {
+	switch name {
+	case "accept":
+		return setChance(&s.acceptableRate, name, value)
+	case "drop":
+		return setChance(&s.dropRate, name, value)
+	case "level":
+		if value < 1 || value > 4 {
+			return fmt.Errorf("knowledge level must be 1 to 4")
+		}
+		s.centerLevel = int(value)
+		return nil
 	}
+	return fmt.Errorf("unknown parameter: %s", name)
+}
+
+// Prevalence is the fraction of cells with knowledge.
+func (s *SISKnowledgeModel) Prevalence() float64 {
+	n := 0
+	for i := range s.cells.cells {
+		if s.cells.cells[i].state == 1 {
+			n++
+		}
+	}
+	return float64(n) / float64(len(s.cells.cells))
 }
 
 // SendEvent receives an event from the host simulation
-func (s *SISKnowledgeModel) SendEvent(event string) {
+func (s *SISKnowledgeModel) SendEvent(event string) error {
+	fields := strings.Fields(event)
+	if len(fields) == 0 {
+		return unhandled(event)
+	}
+
+	switch fields[0] {
+	case "mouse":
+		// mouse down <button> <col> <row>
+		if len(fields) != 5 || fields[1] != "down" {
+			return nil
+		}
+		args, err := parseInts(fields[2:])
+		if err != nil {
+			return nil
+		}
+		switch args[0] {
+		case 1: // Left
+			_, err = s.addCenter(args[1], args[2], s.centerLevel, s.centerCapacity)
+		case 3: // Right
+			err = s.removeCenter(args[1], args[2])
+		}
+		s.drawKnowledgeCenters()
+		return err
+	case "kc":
+		return s.centerEvent(fields[1:])
+	}
+	return unhandled(event)
+}
+
+func (s *SISKnowledgeModel) centerEvent(fields []string) error {
+	if len(fields) == 0 {
+		return fmt.Errorf("usage: kc <add|remove|schedule|level|capacity|list>")
+	}
+
+	args, err := parseInts(fields[1:])
+	if err != nil {
+		return fmt.Errorf("knowledge center: %v", err)
+	}
+
+	switch {
+	case fields[0] == "add" && (len(args) == 3 || len(args) == 4):
+		capacity := s.centerCapacity
+		if len(args) == 4 {
+			capacity = args[3]
+		}
+		_, err = s.addCenter(args[0], args[1], args[2], capacity)
+	case fields[0] == "remove" && len(args) == 2:
+		err = s.removeCenter(args[0], args[1])
+	case fields[0] == "schedule" && len(args) == 5:
+		k := s.findCenter(args[0], args[1])
+		if k == nil {
+			return fmt.Errorf("no knowledge center at: %d,%d", args[0], args[1])
+		}
+		if args[2] < 0 || args[3] < 0 || args[4] < 0 {
+			return fmt.Errorf("knowledge center schedule can't be negative")
+		}
+		k.relocatePeriod = args[2]
+		k.relocateRadius = args[3]
+		k.lifetime = args[4]
+		fmt.Println("Knowledge center scheduled: " + k.toString())
+	case fields[0] == "level" && len(args) == 1:
+		if err := s.SetParameter("level", float64(args[0])); err != nil {
+			return err
+		}
+		fmt.Println("centerLevel: ", s.centerLevel)
+	case fields[0] == "capacity" && len(args) == 1:
+		if args[0] < 0 {
+			return fmt.Errorf("knowledge center capacity can't be negative")
+		}
+		s.centerCapacity = args[0]
+		fmt.Println("centerCapacity: ", s.centerCapacity)
+	case fields[0] == "list":
+		for _, k := range s.knowledgeCenters {
+			fmt.Println(k.toString())
+		}
+	default:
+		return fmt.Errorf("unknown knowledge center command: %s", strings.Join(fields, " "))
+	}
+
+	s.drawKnowledgeCenters()
+	return err
+}
+
+// Snapshot returns the cells' knowledge and the centers with their
+// schedules.
+func (s *SISKnowledgeModel) Snapshot() []byte {
+	w := stateWriter{}
+	w.int(len(s.cells.cells))
+	for _, c := range s.cells.cells {
+		w.ints([]int{c.knowledge, c.nextKnowledge, c.state, c.nextState})
+	}
+	w.int(len(s.knowledgeCenters))
+	for _, k := range s.knowledgeCenters {
+		w.ints([]int{k.col, k.row, k.knowledge, k.capacity, k.taught, k.relocatePeriod, k.relocateRadius, k.lifetime, k.age, k.reach})
+	}
+	return w.buf
+}
+
+// Restore sets the cells and the centers from a snapshot and redraws
+// them. Centers added since are gone and removed ones come back.
+func (s *SISKnowledgeModel) Restore(snapshot []byte) error {
+	r := stateReader{buf: snapshot}
+	if r.int() != len(s.cells.cells) {
+		return errBadSnapshot
+	}
+	cells := make([][]int, len(s.cells.cells))
+	for i := range cells {
+		cells[i] = r.ints(4)
+	}
+	centers := make([]*KnowledgeCenter, r.count())
+	for i := range centers {
+		v := r.ints(10)
+		if v == nil || !s.cells.in(v[0], v[1]) || v[2] < 1 || v[2] > 4 {
+			return errBadSnapshot
+		}
+		k := NewKnowledgeCenter(v[0], v[1], s.knowledgeColor(v[2]), v[2], v[3])
+		k.taught, k.relocatePeriod, k.relocateRadius, k.lifetime, k.age, k.reach = v[4], v[5], v[6], v[7], v[8], v[9]
+		centers[i] = k
+	}
+	if err := r.done(); err != nil {
+		return err
+	}
+
+	for i, v := range cells {
+		c := &s.cells.cells[i]
+		c.knowledge, c.nextKnowledge, c.state, c.nextState = v[0], v[1], v[2], v[3]
+		c.knowledgeCenter = false
+		c.center = nil
+	}
+	s.knowledgeCenters = centers
+	for _, k := range centers {
+		c := s.cells.at(k.col, k.row)
+		c.knowledgeCenter = true
+		c.center = k
+	}
+
+	for col := 0; col < s.raster.Width(); col += 1 {
+		for row := 0; row < s.raster.Height(); row += 1 {
+			s.drawCell(col, row)
+		}
+	}
+	s.drawKnowledgeCenters()
+	return nil
 }
 
 func (s *SISKnowledgeModel) Properties() api.IProperties {
-	return gui.NewProperties(300, 300, 1500, 100, 1)
+	return raster.NewProperties(300, 300, 1500, 100, 1)
 }
 
 func (s *SISKnowledgeModel) Reset() {
@@ -91,10 +281,7 @@ func (s *SISKnowledgeModel) Reset() {
 	// Initialize population
 	for col := 0; col < w; col += 1 {
 		for row := 0; row < h; row += 1 {
-			s.cells[col][row].state = 0 // No knowledge
-			s.cells[col][row].nextState = 0
-			s.cells[col][row].row = row
-			s.cells[col][row].col = col
+			*s.cells.at(col, row) = KCell{col: col, row: row} // No knowledge
 		}
 	}
 
@@ -104,24 +291,21 @@ func (s *SISKnowledgeModel) Reset() {
 	radius := 4
 	for col := px; col < px+radius; col += 1 {
 		for row := py; row < py+radius; row += 1 {
-			s.cells[col][row].state = 1     // has knowledge
-			s.cells[col][row].knowledge = 1 // orange knowledge
+			s.cells.at(col, row).state = 1     // has knowledge
+			s.cells.at(col, row).knowledge = 1 // orange knowledge
+			s.cells.at(col, row).nextState = 1
+			s.cells.at(col, row).nextKnowledge = 1
 		}
 	}
 
 	// Create 4 knowledge centers with different skills levels
 	distance := 15
 
-	s.knowledgeCenters = append(s.knowledgeCenters, NewKCellCenter(px, px, color.RGBA{R: 255, G: 127, B: 0, A: 255}, 1))
-	s.knowledgeCenters = append(s.knowledgeCenters, NewKCellCenter(px+distance, px, color.RGBA{R: 0, G: 255, B: 100, A: 255}, 2))
-	s.knowledgeCenters = append(s.knowledgeCenters, NewKCellCenter(px+distance, px+distance, color.RGBA{R: 0, G: 200, B: 200, A: 255}, 3))
-	s.knowledgeCenters = append(s.knowledgeCenters, NewKCellCenter(px, px+distance, color.RGBA{R: 255, G: 0, B: 255, A: 255}, 4))
-	// Mark them on the grid
-	for _, k := range s.knowledgeCenters {
-		s.cells[k.col][k.row].state = 1
-		s.cells[k.col][k.row].knowledge = k.knowledge
-		s.cells[k.col][k.row].knowledgeCenter = k.knowledgeCenter
-	}
+	s.knowledgeCenters = []*KnowledgeCenter{}
+	s.addCenter(px, py, 1, s.centerCapacity)
+	s.addCenter(px+distance, py, 2, s.centerCapacity)
+	s.addCenter(px+distance, py+distance, 3, s.centerCapacity)
+	s.addCenter(px, py+distance, 4, s.centerCapacity)
 
 	s.drawKnowledgeCenters()
 }
@@ -134,9 +318,11 @@ func (s *SISKnowledgeModel) Step() bool {
 	ce := 0
 	knowledged := 0
 
+	s.updateCenters(w, h)
+
 	for col := 0; col < w; col += 1 {
 		for row := 0; row < h; row += 1 {
-			cenC := &s.cells[col][row] // Center
+			cenC := s.cells.at(col, row) // Center
 			// if s.regionKnowledge(col, row) == 2 {
 			// 	fmt.Println("C: " + cenC.toString())
 			// }
@@ -148,7 +334,7 @@ func (s *SISKnowledgeModel) Step() bool {
 				// knowledge or receives it.
 				ce = col + 1
 				if ce < w { // Right
-					nei := &s.cells[ce][row]
+					nei := s.cells.at(ce, row)
 					if nei.state == 0 {
 						// The neighbor has NO knowledge. If they are receptive
 						// then the neighbor gains the center's knowledge.
@@ -160,13 +346,13 @@ func (s *SISKnowledgeModel) Step() bool {
 					} else {
 						// The neighbor has knowledge. If it is higher then
 						// take on that knowledge.
-						cenC.nextKnowledge = s.gainKnowledge(cenC.knowledge, nei.knowledge)
+						s.learn(cenC, nei)
 					}
 				}
 
 				ce = col - 1
 				if ce >= 0 { // Left
-					nei := &s.cells[ce][row]
+					nei := s.cells.at(ce, row)
 					if nei.state == 0 {
 						if rand.Float64() < s.acceptableRate {
 							nei.nextKnowledge = cenC.knowledge
@@ -174,13 +360,13 @@ func (s *SISKnowledgeModel) Step() bool {
 							knowledged++
 						}
 					} else {
-						cenC.nextKnowledge = s.gainKnowledge(cenC.knowledge, nei.knowledge)
+						s.learn(cenC, nei)
 					}
 				}
 
 				ce = row - 1
 				if ce >= 0 { // Top
-					nei := &s.cells[col][ce]
+					nei := s.cells.at(col, ce)
 					if nei.state == 0 {
 						if rand.Float64() < s.acceptableRate {
 							nei.nextKnowledge = cenC.knowledge
@@ -188,13 +374,13 @@ func (s *SISKnowledgeModel) Step() bool {
 							knowledged++
 						}
 					} else {
-						cenC.nextKnowledge = s.gainKnowledge(cenC.knowledge, nei.knowledge)
+						s.learn(cenC, nei)
 					}
 				}
 
 				ce = row + 1
 				if ce < h { // Bottom
-					nei := &s.cells[col][ce]
+					nei := s.cells.at(col, ce)
 					if nei.state == 0 {
 						if rand.Float64() < s.acceptableRate {
 							nei.nextKnowledge = cenC.knowledge
@@ -202,7 +388,7 @@ func (s *SISKnowledgeModel) Step() bool {
 							knowledged++
 						}
 					} else {
-						cenC.nextKnowledge = s.gainKnowledge(cenC.knowledge, nei.knowledge)
+						s.learn(cenC, nei)
 					}
 				}
 
@@ -217,6 +403,8 @@ func (s *SISKnowledgeModel) Step() bool {
 		}
 	}
 
+	knowledged += s.teachNeighbors(w, h)
+
 	// Copy next-state to current-state
 	s.draw(w, h)
 	s.drawKnowledgeCenters()
@@ -246,18 +434,193 @@ func (s *SISKnowledgeModel) gainKnowledge(cenK, neiK int) int {
 	return cenK
 }
 
+// learn raises cen's knowledge if the neighbor is one level higher.
+// Knowledge centers only teach while they have capacity left.
+func (s *SISKnowledgeModel) learn(cen, nei *KCell) {
+	k := s.gainKnowledge(cen.knowledge, nei.knowledge)
+	if k <= cen.nextKnowledge {
+		return
+	}
+
+	if nei.center != nil {
+		if !nei.center.canTeach() {
+			return
+		}
+		nei.center.teach()
+	}
+
+	cen.nextKnowledge = k
+}
+
+// teachNeighbors lets each center pass its level on to neighbors
+// that have no knowledge yet.
+func (s *SISKnowledgeModel) teachNeighbors(w, h int) int {
+	taught := 0
+
+	for _, k := range s.knowledgeCenters {
+		for _, n := range [][2]int{{1, 0}, {-1, 0}, {0, -1}, {0, 1}} {
+			if !k.canTeach() {
+				break
+			}
+
+			col := k.col + n[0]
+			row := k.row + n[1]
+			if col < 0 || col >= w || row < 0 || row >= h {
+				continue
+			}
+
+			nei := s.cells.at(col, row)
+			if nei.knowledgeCenter || nei.state != 0 || nei.nextState != 0 {
+				continue
+			}
+
+			if rand.Float64() < s.acceptableRate {
+				nei.nextKnowledge = k.knowledge
+				nei.nextState = 1
+				k.teach()
+				taught++
+			}
+		}
+	}
+
+	return taught
+}
+
+// updateCenters ages each center and applies its relocation and
+// closing schedule.
+func (s *SISKnowledgeModel) updateCenters(w, h int) {
+	open := s.knowledgeCenters[:0]
+
+	for _, k := range s.knowledgeCenters {
+		k.age++
+		k.taught = 0
+
+		if k.closed() {
+			s.releaseCenter(k)
+			fmt.Println("Knowledge center closed: " + k.toString())
+			continue
+		}
+
+		if k.relocating() {
+			col := k.col + rand.Intn(2*k.relocateRadius+1) - k.relocateRadius
+			row := k.row + rand.Intn(2*k.relocateRadius+1) - k.relocateRadius
+			if col >= 0 && col < w && row >= 0 && row < h && !s.cells.at(col, row).knowledgeCenter {
+				s.releaseCenter(k)
+				k.col = col
+				k.row = row
+				s.occupyCenter(k)
+			}
+		}
+
+		open = append(open, k)
+	}
+
+	s.knowledgeCenters = open
+}
+
+func (s *SISKnowledgeModel) addCenter(col, row, level, capacity int) (*KnowledgeCenter, error) {
+	if col < 0 || col >= s.raster.Width() || row < 0 || row >= s.raster.Height() {
+		return nil, fmt.Errorf("knowledge center out of bounds: %d,%d", col, row)
+	}
+
+	if level < 1 || level > 4 {
+		return nil, fmt.Errorf("knowledge level must be 1 to 4")
+	}
+
+	if capacity < 0 {
+		return nil, fmt.Errorf("knowledge center capacity can't be negative")
+	}
+
+	// Centers take 2x2 cells, which must not overlap for findCenter
+	// to tell them apart
+	for _, p := range [][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+		if k := s.findCenter(col+p[0], row+p[1]); k != nil {
+			return nil, fmt.Errorf("knowledge center already at: %d,%d", k.col, k.row)
+		}
+	}
+
+	k := NewKnowledgeCenter(col, row, s.knowledgeColor(level), level, capacity)
+	s.knowledgeCenters = append(s.knowledgeCenters, k)
+	s.occupyCenter(k)
+
+	return k, nil
+}
+
+func (s *SISKnowledgeModel) removeCenter(col, row int) error {
+	k := s.findCenter(col, row)
+	if k == nil {
+		return fmt.Errorf("no knowledge center at: %d,%d", col, row)
+	}
+
+	for i, c := range s.knowledgeCenters {
+		if c == k {
+			s.knowledgeCenters = append(s.knowledgeCenters[:i], s.knowledgeCenters[i+1:]...)
+			break
+		}
+	}
+
+	s.releaseCenter(k)
+	fmt.Println("Knowledge center removed: " + k.toString())
+	return nil
+}
+
+// findCenter returns the center drawn at col,row or nil.
+func (s *SISKnowledgeModel) findCenter(col, row int) *KnowledgeCenter {
+	for _, k := range s.knowledgeCenters {
+		if col >= k.col && col <= k.col+1 && row >= k.row && row <= k.row+1 {
+			return k
+		}
+	}
+
+	return nil
+}
+
+// occupyCenter marks the center on the grid.
+func (s *SISKnowledgeModel) occupyCenter(k *KnowledgeCenter) {
+	c := s.cells.at(k.col, k.row)
+	c.state = 1
+	c.nextState = 1
+	c.knowledge = k.knowledge
+	c.nextKnowledge = k.knowledge
+	c.knowledgeCenter = true
+	c.center = k
+}
+
+// releaseCenter turns the center's cell back into a regular cell
+// that keeps the center's knowledge.
+func (s *SISKnowledgeModel) releaseCenter(k *KnowledgeCenter) {
+	c := s.cells.at(k.col, k.row)
+	c.knowledgeCenter = false
+	c.center = nil
+	c.nextState = c.state
+	c.nextKnowledge = c.knowledge
+}
+
+func (s *SISKnowledgeModel) knowledgeColor(knowledge int) color.RGBA {
+	switch knowledge {
+	case 1:
+		return s.orangeColor
+	case 2:
+		return s.greenColor
+	case 3:
+		return s.tealColor
+	default:
+		return s.purpleColor
+	}
+}
+
 func (s *SISKnowledgeModel) drawMap(c, r int) {
 	fmt.Println("========================================")
 	for col := c - 5; col < c+5; col += 1 {
 		fmt.Print("|")
 		for row := r - 5; row < r+5; row += 1 {
-			if s.cells[col][row].knowledgeCenter {
-				fmt.Print(s.cells[col][row].knowledge, "+")
+			if s.cells.at(col, row).knowledgeCenter {
+				fmt.Print(s.cells.at(col, row).knowledge, "+")
 			} else {
 				if col == c && row == r {
-					fmt.Print(s.cells[col][row].knowledge, ".")
+					fmt.Print(s.cells.at(col, row).knowledge, ".")
 				} else {
-					fmt.Print(s.cells[col][row].knowledge, " ")
+					fmt.Print(s.cells.at(col, row).knowledge, " ")
 				}
 			}
 		}
@@ -291,8 +654,8 @@ func (s *SISKnowledgeModel) drawKnowledgeCenters() {
 func (s *SISKnowledgeModel) draw(w, h int) {
 	for col := 0; col < w; col += 1 {
 		for row := 0; row < h; row += 1 {
-			if s.cells[col][row].state == 1 {
-				switch s.cells[col][row].knowledge {
+			if s.cells.at(col, row).state == 1 {
+				switch s.cells.at(col, row).knowledge {
 				case 1:
 					s.raster.SetPixelColor(s.orangeColor)
 				case 2:
@@ -308,17 +671,17 @@ func (s *SISKnowledgeModel) draw(w, h int) {
 
 			s.raster.SetPixel(col, row)
 
-			if !s.cells[col][row].knowledgeCenter {
-				s.cells[col][row].state = s.cells[col][row].nextState
-				s.cells[col][row].knowledge = s.cells[col][row].nextKnowledge
+			if !s.cells.at(col, row).knowledgeCenter {
+				s.cells.at(col, row).state = s.cells.at(col, row).nextState
+				s.cells.at(col, row).knowledge = s.cells.at(col, row).nextKnowledge
 			}
 		}
 	}
 }
 
 func (s *SISKnowledgeModel) drawCell(col, row int) {
-	if s.cells[col][row].state == 1 {
-		switch s.cells[col][row].knowledge {
+	if s.cells.at(col, row).state == 1 {
+		switch s.cells.at(col, row).knowledge {
 		case 1:
 			s.raster.SetPixelColor(s.orangeColor)
 		case 2:
@@ -0,0 +1,497 @@
+package simulation
+
+import (
+	"Netron1-Go/api"
+	"Netron1-Go/raster"
+	"fmt"
+	"image/color"
+	"math/rand"
+	"strings"
+)
+
+// The strain model spreads two or more strains with different
+// transmissibility and recovery rates on the same lattice. Recovering
+// from a strain gives immunity to it and partial (cross) immunity to
+// the others until the memory wanes.
+//   strain add <transmit> <recover>
+//   strain set <index> <transmit> <recover>
+//   strain seed <index> <count>    infects random cells, e.g. to invade
+//   strain mode <exclusive|superinfection|coinfection>
+//   strain cross <0..1>            cross immunity. 0 = none, 1 = full
+//   strain super <0..1>            chance a superinfection succeeds
+//   strain coinfect <0..1>         chance a coinfection succeeds
+//   strain wane <rate>             chance per step the memory is lost
+//   strain list
+//   strain stats                   prevalence per strain
+//   strain export                  writes the prevalence series
+
+type SISStrainModel struct {
+	susceptibleColor color.RGBA
+	removedColor     color.RGBA
+
+	raster api.IRasterBuffer
+	cells  *StrainGrid
+
+	strains []*Strain
+	mode    int
+
+	crossImmunity  float64
+	superRate      float64
+	coinfectRate   float64
+	waneRate       float64
+	seedsPerStrain int
+
+	// Fraction of cells infected by each strain per step
+	prevalence [][]float64
+	coinfected []float64
+}
+
+func NewSISStrainModel() api.IModel {
+	o := new(SISStrainModel)
+	// Susceptible = Skin
+	o.susceptibleColor = color.RGBA{R: 255, G: 225, B: 200, A: 255}
+	// Recovered = Gray
+	o.removedColor = color.RGBA{R: 200, G: 200, B: 200, A: 255}
+
+	return o
+}
+
+func (s *SISStrainModel) Name() string {
+	return "SISStrainModel"
+}
+
+func (s *SISStrainModel) Configure(rasterBuffer api.IRasterBuffer) {
+	s.raster = rasterBuffer
+	s.mode = exclusiveInfection
+	s.crossImmunity = 0.5
+	s.superRate = 0.5
+	s.coinfectRate = 0.3
+	s.waneRate = 0.02
+	s.seedsPerStrain = 20
+
+	// The second strain is fitter
+	s.strains = []*Strain{
+		NewStrain(0, 0.5, 0.3),
+		NewStrain(1, 0.6, 0.3),
+	}
+
+	rand.Seed(13163)
+
+	s.cells = NewStrainGrid(s.raster.Width(), s.raster.Height())
+}
+
+// SetParameter sets cross, super, coinfect or wane by name.
+func (s *SISStrainModel) SetParameter(name string, value float64) error {
+	switch name {
+	case "cross":
+		return setChance(&s.crossImmunity, name, value)
+	case "super":
+		return setChance(&s.superRate, name, value)
+	case "coinfect":
+		return setChance(&s.coinfectRate, name, value)
+	case "wane":
+		return setChance(&s.waneRate, name, value)
+	}
+	return fmt.Errorf("unknown parameter: %s", name)
+}
+
+// Prevalence is the fraction of cells infected with any strain.
+func (s *SISStrainModel) Prevalence() float64 {
+	n := 0
+	for i := range s.cells.cells {
+		if s.cells.cells[i].strains != 0 {
+			n++
+		}
+	}
+	return float64(n) / float64(len(s.cells.cells))
+}
+
+// SendEvent receives an event from the host simulation
+func (s *SISStrainModel) SendEvent(event string) error {
+	fields := strings.Fields(event)
+	if len(fields) < 2 || fields[0] != "strain" {
+		return unhandled(event)
+	}
+
+	args, err := parseFloats(fields[2:])
+	if err != nil {
+		if fields[1] == "mode" && len(fields) == 3 {
+			return s.setMode(fields[2])
+		}
+		return fmt.Errorf("strain: %v", err)
+	}
+
+	switch {
+	case fields[1] == "add" && len(args) == 2:
+		if len(s.strains) == maxStrains {
+			return fmt.Errorf("at most %d strains", maxStrains)
+		}
+		s.strains = append(s.strains, NewStrain(len(s.strains), args[0], args[1]))
+		s.prevalence = append(s.prevalence, make([]float64, len(s.coinfected)))
+		fmt.Println("strain ", len(s.strains)-1, ": ", s.strains[len(s.strains)-1].toString())
+	case fields[1] == "set" && len(args) == 3:
+		i := int(args[0])
+		if i < 0 || i >= len(s.strains) {
+			return fmt.Errorf("no strain: %d", i)
+		}
+		s.strains[i].transmit = args[1]
+		s.strains[i].recover = args[2]
+		fmt.Println("strain ", i, ": ", s.strains[i].toString())
+	case fields[1] == "seed" && len(args) == 2:
+		i := int(args[0])
+		if i < 0 || i >= len(s.strains) {
+			return fmt.Errorf("no strain: %d", i)
+		}
+		fmt.Println("seeded ", s.seed(i, int(args[1])), " cells with strain ", i)
+	case fields[1] == "cross" && len(args) == 1:
+		if err := s.SetParameter("cross", args[0]); err != nil {
+			return err
+		}
+		fmt.Println("cross immunity: ", s.crossImmunity)
+	case fields[1] == "super" && len(args) == 1:
+		if err := s.SetParameter("super", args[0]); err != nil {
+			return err
+		}
+		fmt.Println("superinfection rate: ", s.superRate)
+	case fields[1] == "coinfect" && len(args) == 1:
+		if err := s.SetParameter("coinfect", args[0]); err != nil {
+			return err
+		}
+		fmt.Println("coinfection rate: ", s.coinfectRate)
+	case fields[1] == "wane" && len(args) == 1:
+		if err := s.SetParameter("wane", args[0]); err != nil {
+			return err
+		}
+		fmt.Println("wane rate: ", s.waneRate)
+	case fields[1] == "list":
+		fmt.Println("mode: ", infectionModes[s.mode])
+		fmt.Printf("cross immunity: %.2f, superinfection: %.2f, coinfection: %.2f, wane: %.3f\n",
+			s.crossImmunity, s.superRate, s.coinfectRate, s.waneRate)
+		for i, st := range s.strains {
+			fmt.Println(i, ": ", st.toString())
+		}
+	case fields[1] == "stats":
+		s.printStats()
+	case fields[1] == "export":
+		return s.exportStats()
+	default:
+		return fmt.Errorf("unknown strain command: %s", event)
+	}
+	return nil
+}
+
+func (s *SISStrainModel) setMode(mode string) error {
+	for i, m := range infectionModes {
+		if m == mode {
+			s.mode = i
+			fmt.Println("infection mode: ", mode)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown infection mode: %s", mode)
+}
+
+// seed infects up to count random cells that aren't infected with
+// strain i.
+func (s *SISStrainModel) seed(i, count int) int {
+	w := s.raster.Width()
+	h := s.raster.Height()
+	bit := uint8(1) << i
+
+	seeded := 0
+	for try := 0; try < count*10 && seeded < count; try++ {
+		c := s.cells.at(rand.Intn(w), rand.Intn(h))
+		if c.strains&bit != 0 {
+			continue
+		}
+		if s.mode != coInfection {
+			c.strains = 0
+		}
+		c.strains |= bit
+		seeded++
+	}
+
+	return seeded
+}
+
+// susceptibility is the chance a cell can be infected with strain i
+// given the strains it has recovered from.
+func (s *SISStrainModel) susceptibility(c *StrainCell, i int) float64 {
+	bit := uint8(1) << i
+	if c.memory&bit != 0 {
+		return 0
+	}
+	if c.memory != 0 {
+		return 1 - s.crossImmunity
+	}
+	return 1
+}
+
+// infect tries to infect c with strain i according to the infection
+// mode.
+func (s *SISStrainModel) infect(c *StrainCell, i int) {
+	bit := uint8(1) << i
+	if c.strains&bit != 0 || c.nextStrains&bit != 0 {
+		return
+	}
+
+	if rand.Float64() >= s.strains[i].transmit*s.susceptibility(c, i) {
+		return
+	}
+
+	if c.strains == 0 {
+		if s.mode == coInfection {
+			c.nextStrains |= bit
+			return
+		}
+		// Pick one of the strains trying to infect the cell
+		c.offers++
+		if rand.Intn(c.offers) == 0 {
+			c.nextStrains = bit
+		}
+		return
+	}
+
+	switch s.mode {
+	case superInfection:
+		// Replace a less transmissible strain
+		for j := range s.strains {
+			if c.strains&(1<<j) != 0 && s.strains[j].transmit < s.strains[i].transmit && rand.Float64() < s.superRate {
+				c.nextStrains = bit
+				return
+			}
+		}
+	case coInfection:
+		if rand.Float64() < s.coinfectRate {
+			c.nextStrains |= bit
+		}
+	}
+}
+
+func (s *SISStrainModel) printStats() {
+	n := len(s.coinfected)
+	if n == 0 {
+		return
+	}
+
+	fmt.Println("step: ", n-1, ", mode: ", infectionModes[s.mode])
+	for i := range s.strains {
+		// Skip the initial transient
+		endemic := s.prevalence[i][n/4:]
+		mean := 0.0
+		for _, v := range endemic {
+			mean += v
+		}
+		mean /= float64(len(endemic))
+
+		status := ""
+		if s.prevalence[i][n-1] == 0 {
+			status = " (extinct)"
+		}
+		fmt.Printf("strain %d: prevalence %.4f, mean %.4f%s\n", i, s.prevalence[i][n-1], mean, status)
+	}
+	fmt.Printf("coinfected: %.4f\n", s.coinfected[n-1])
+}
+
+func (s *SISStrainModel) exportStats() error {
+	path := dataPath(s.Name() + "_prevalence.csv")
+
+	names := []string{}
+	for i := range s.strains {
+		names = append(names, fmt.Sprintf("strain%d", i))
+	}
+	names = append(names, "coinfected")
+
+	if err := writeColumnsCSV(path, "step", names, append(s.prevalence, s.coinfected)); err != nil {
+		return fmt.Errorf("export failed: %v", err)
+	}
+
+	fmt.Println("Exported stats to: " + path)
+	return nil
+}
+
+// record appends the fraction of cells infected by each strain.
+func (s *SISStrainModel) record() {
+	w := s.raster.Width()
+	h := s.raster.Height()
+	counts := make([]int, len(s.strains))
+	coinfected := 0
+
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			mask := s.cells.at(col, row).strains
+			for i := range s.strains {
+				if mask&(1<<i) != 0 {
+					counts[i]++
+				}
+			}
+			if strainCount(mask) > 1 {
+				coinfected++
+			}
+		}
+	}
+
+	n := float64(w * h)
+	for i := range s.strains {
+		s.prevalence[i] = append(s.prevalence[i], float64(counts[i])/n)
+	}
+	s.coinfected = append(s.coinfected, float64(coinfected)/n)
+}
+
+func (s *SISStrainModel) draw() {
+	w := s.raster.Width()
+	h := s.raster.Height()
+
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			c := s.cells.at(col, row)
+			if c.strains != 0 {
+				s.raster.SetPixelColor(mixColors(s.strains, c.strains))
+			} else if c.memory != 0 {
+				s.raster.SetPixelColor(s.removedColor)
+			} else {
+				s.raster.SetPixelColor(s.susceptibleColor)
+			}
+			s.raster.SetPixel(col, row)
+		}
+	}
+}
+
+// Snapshot returns the strains and memory of the cells. The strains
+// themselves are parameters, so a branch keeps the current ones.
+func (s *SISStrainModel) Snapshot() []byte {
+	w := stateWriter{}
+	w.int(len(s.cells.cells))
+	for _, c := range s.cells.cells {
+		w.int(int(c.strains))
+		w.int(int(c.nextStrains))
+		w.int(int(c.memory))
+	}
+	w.int(len(s.coinfected))
+	return w.buf
+}
+
+// Restore sets the cells from a snapshot, cuts the prevalence series
+// back to its step and redraws the cells.
+func (s *SISStrainModel) Restore(snapshot []byte) error {
+	r := stateReader{buf: snapshot}
+	if r.int() != len(s.cells.cells) {
+		return errBadSnapshot
+	}
+	masks := make([]uint8, 3*len(s.cells.cells))
+	for i := range masks {
+		v := r.int()
+		if v < 0 || v >= 1<<len(s.strains) {
+			return errBadSnapshot
+		}
+		masks[i] = uint8(v)
+	}
+	n := r.length(len(s.coinfected))
+	if err := r.done(); err != nil {
+		return err
+	}
+
+	for i := range s.cells.cells {
+		c := &s.cells.cells[i]
+		c.strains, c.nextStrains, c.memory = masks[3*i], masks[3*i+1], masks[3*i+2]
+	}
+	for i := range s.prevalence {
+		s.prevalence[i] = s.prevalence[i][:n]
+	}
+	s.coinfected = s.coinfected[:n]
+	s.draw()
+	return nil
+}
+
+func (s *SISStrainModel) Properties() api.IProperties {
+	return raster.NewProperties(300, 300, 1500, 100, 1)
+}
+
+func (s *SISStrainModel) Reset() {
+	fmt.Println(("--- strain reset ---"))
+	s.raster.Clear()
+
+	w := s.raster.Width()
+	h := s.raster.Height()
+
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			*s.cells.at(col, row) = StrainCell{}
+		}
+	}
+
+	for i := range s.strains {
+		s.seed(i, s.seedsPerStrain)
+	}
+
+	s.prevalence = make([][]float64, len(s.strains))
+	s.coinfected = []float64{}
+	s.record()
+	s.draw()
+}
+
+func (s *SISStrainModel) Step() bool {
+	w := s.raster.Width()
+	h := s.raster.Height()
+
+	// Recovery and waning immunity
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			c := s.cells.at(col, row)
+			c.nextStrains = c.strains
+			c.offers = 0
+
+			if c.memory != 0 && rand.Float64() < s.waneRate {
+				c.memory = 0
+			}
+
+			for i, st := range s.strains {
+				bit := uint8(1) << i
+				if c.strains&bit != 0 && rand.Float64() < st.recover {
+					c.nextStrains &^= bit
+					c.memory |= bit
+				}
+			}
+		}
+	}
+
+	// Transmission
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			mask := s.cells.at(col, row).strains
+			if mask == 0 {
+				continue
+			}
+
+			for _, n := range neighbors(4) {
+				nc := col + n[0]
+				nr := row + n[1]
+				if nc < 0 || nc >= w || nr < 0 || nr >= h {
+					continue
+				}
+				for i := range s.strains {
+					if mask&(1<<i) != 0 {
+						s.infect(s.cells.at(nc, nr), i)
+					}
+				}
+			}
+		}
+	}
+
+	// Copy next-state to current-state
+	infected := false
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			c := s.cells.at(col, row)
+			c.strains = c.nextStrains
+			if c.strains != 0 {
+				infected = true
+			}
+		}
+	}
+
+	s.record()
+	s.draw()
+
+	return infected
+}
@@ -2,10 +2,11 @@ package simulation
 
 import (
 	"Netron1-Go/api"
-	"Netron1-Go/gui"
+	"Netron1-Go/raster"
 	"fmt"
 	"image/color"
 	"math/rand"
+	"strings"
 )
 
 type SISModel struct {
@@ -14,9 +15,10 @@ type SISModel struct {
 	susceptibleColor  color.RGBA // cell type = 2
 	removedColor      color.RGBA // cell type = 3
 
-	raster         api.IRasterBuffer
-	cellStates     [][]int
-	cellNextStates [][]int
+	raster api.IRasterBuffer
+	cells  *Grid
+	// The grid is stepped in concurrent tiles
+	stepper *gridStepper
 
 	acceptibleRate float64
 
@@ -45,6 +47,16 @@ func (s *SISModel) Name() string {
 	return "SISModel"
 }
 
+// Palette returns the state colors.
+func (s *SISModel) Palette() color.Palette {
+	return color.Palette{
+		s.undetermenedColor,
+		s.infectedColor,
+		s.susceptibleColor,
+		s.removedColor,
+	}
+}
+
 func (s *SISModel) Configure(rasterBuffer api.IRasterBuffer) {
 	s.raster = rasterBuffer
 	s.acceptibleRate = 0.28
@@ -54,20 +66,21 @@ func (s *SISModel) Configure(rasterBuffer api.IRasterBuffer) {
 
 	rand.Seed(131)
 
-	s.cellStates = make([][]int, s.raster.Height())
-	s.cellNextStates = make([][]int, s.raster.Height())
-	for i := range s.cellStates {
-		s.cellStates[i] = make([]int, s.raster.Width())
-		s.cellNextStates[i] = make([]int, s.raster.Width())
-	}
+	s.cells = NewGrid(s.raster.Width(), s.raster.Height())
+	s.stepper = newGridStepper(s.cells, sisActive)
+}
+
+// sisActive reports the cells sparse steps visit in the SIS, SISa and
+// SIR models: infected cells, undetermined cells, which settle on
+// their own, and cells with a next state still to be copied.
+func sisActive(c *Cell) bool {
+	return c.state == 1 || c.state == 0 || c.nextState != c.state
 }
 
 func (s *SISModel) Reset() {
 	fmt.Println(("--- sir reset ---"))
 	s.raster.Clear()
-
-	// Start with the center "cell" infected = Blue
-	s.raster.SetPixelColor(s.infectedColor)
+	s.stepper.seed(rand.Int63())
 
 	w := s.raster.Width()
 	h := s.raster.Height()
@@ -77,152 +90,140 @@ func (s *SISModel) Reset() {
 
 	for col := 0; col < w; col += 1 {
 		for row := 0; row < h; row += 1 {
-			s.cellStates[col][row] = 2     // Susceptible
-			s.cellNextStates[col][row] = 0 // Undetermined
+			s.cells.at(col, row).state = 2     // Susceptible
+			s.cells.at(col, row).nextState = 0 // Undetermined
 		}
 	}
 
-	s.cellStates[cx][cy] = 1 // Infected
-	s.cellStates[cx][cy+1] = 1
-	s.cellStates[cx][cy+2] = 1
-	s.cellStates[cx][cy-1] = 1
-	s.cellStates[cx][cy-2] = 1
-
-	s.cellStates[cx-1][cy] = 1
-	s.cellStates[cx-1][cy+1] = 1
-	s.cellStates[cx-1][cy+2] = 1
-	s.cellStates[cx-1][cy-1] = 1
-	s.cellStates[cx-1][cy-2] = 1
-
-	s.cellStates[cx-2][cy] = 1
-	s.cellStates[cx-2][cy+1] = 1
-	s.cellStates[cx-2][cy+2] = 1
-	s.cellStates[cx-2][cy-1] = 1
-	s.cellStates[cx-2][cy-2] = 1
-
-	s.cellStates[cx+1][cy] = 1
-	s.cellStates[cx+1][cy+1] = 1
-	s.cellStates[cx+1][cy+2] = 1
-	s.cellStates[cx+1][cy-1] = 1
-	s.cellStates[cx+1][cy-2] = 1
-
-	s.cellStates[cx+2][cy] = 1
-	s.cellStates[cx+2][cy+1] = 1
-	s.cellStates[cx+2][cy+2] = 1
-	s.cellStates[cx+2][cy-1] = 1
-	s.cellStates[cx+2][cy-2] = 1
+	// Start with a 5x5 square in the center infected = Blue
+	for col := cx - 2; col <= cx+2; col += 1 {
+		for row := cy - 2; row <= cy+2; row += 1 {
+			s.cells.at(col, row).state = 1
+		}
+	}
+	s.stepper.rebuild()
 
 	for col := 0; col < w; col += 1 {
 		for row := 0; row < h; row += 1 {
-			if s.cellStates[col][row] == 1 {
-				s.raster.SetPixelColor(s.infectedColor)
-			} else if s.cellStates[col][row] == 3 {
-				s.raster.SetPixelColor(s.removedColor)
-			} else {
-				s.raster.SetPixelColor(s.susceptibleColor)
-			}
-			s.raster.SetPixel(col, row)
+			s.drawCell(col, row)
 		}
 	}
 }
 
-// SendEvent receives an event from the host simulation
-func (s *SISModel) SendEvent(event string) {
+// Prevalence is the fraction of cells infected.
+func (s *SISModel) Prevalence() float64 {
+	return s.cells.fraction(1)
 }
 
-func (s *SISModel) Properties() api.IProperties {
-	return gui.NewProperties(300, 300, 1500, 100, 1)
+// SetParameter sets accept, drop or pickup by name.
+func (s *SISModel) SetParameter(name string, value float64) error {
+	switch name {
+	case "accept":
+		return setChance(&s.acceptibleRate, name, value)
+	case "drop":
+		return setChance(&s.dropRate, name, value)
+	case "pickup":
+		return setChance(&s.pickupRate, name, value)
+	}
+	return fmt.Errorf("unknown parameter: %s", name)
 }
 
-func (s *SISModel) Step() bool {
-	// The current "step" works on the current-state but updates the next-state
-	// Once done, the next-state is copied back to the current-state.
+// SendEvent receives an event from the host simulation. "sparse
+// <on|off>" only steps the active cells and the cells they reach.
+func (s *SISModel) SendEvent(event string) error {
+	if ok, err := s.stepper.event(strings.Fields(event)); ok {
+		return err
+	}
+	return unhandled(event)
+}
+
+// Snapshot returns the cells.
+func (s *SISModel) Snapshot() []byte {
+	w := stateWriter{}
+	w.cells(s.cells)
+	return w.buf
+}
+
+// Restore sets the cells from a snapshot and redraws them. The tiles
+// take new random streams, as a branch does.
+func (s *SISModel) Restore(snapshot []byte) error {
+	r := stateReader{buf: snapshot}
+	cells := r.cells(s.cells)
+	if err := r.done(); err != nil {
+		return err
+	}
+
+	s.stepper.seed(rand.Int63())
+	copy(s.cells.cells, cells)
+	s.stepper.rebuild()
+
 	w := s.raster.Width()
 	h := s.raster.Height()
-	ce := 0
-	infected := 0
-
 	for col := 0; col < w; col += 1 {
 		for row := 0; row < h; row += 1 {
-			if s.cellStates[col][row] == 1 { // Is infected
-				// How likely will they drop it.
-				if rand.Float64() < s.dropRate {
-					s.cellNextStates[col][row] = 2 // Suceptible
-				}
-
-				// Check neighbors.
-				ce = col + 1
-				if ce < w { // Right
-					// If neighbor isn't (infected AND they are acceptible) = Suceptible
-					if s.cellStates[ce][row] != 3 {
-						if rand.Float64() < s.acceptibleRate {
-							// Cell is now infected
-							s.cellNextStates[ce][row] = 1
-							infected++
-						}
-					}
-				}
-
-				ce = col - 1
-				if ce >= 0 { // Left
-					if s.cellStates[ce][row] != 3 {
-						if rand.Float64() < s.acceptibleRate {
-							// Cell is now infected
-							s.cellNextStates[ce][row] = 1
-							infected++
-						}
-					}
-				}
-
-				ce = row - 1
-				if ce >= 0 { // Top
-					if s.cellStates[col][ce] != 3 {
-						if rand.Float64() < s.acceptibleRate {
-							// Cell is now infected
-							s.cellNextStates[col][ce] = 1
-							infected++
-						}
-					}
-				}
-
-				ce = row + 1
-				if ce < h { // Bottom
-					if s.cellStates[col][ce] != 3 {
-						if rand.Float64() < s.acceptibleRate {
-							// Cell is bottom infected
-							s.cellNextStates[col][ce] = 1
-							infected++
-						}
-					}
-				}
-			} else {
-				if s.cellStates[col][row] == 0 {
-					// This person hasn't experienced meditation yet.
-					if rand.Float64() < s.pickupRate {
-						s.cellNextStates[col][row] = 2 // Suceptible
-					}
-				}
-			}
+			s.drawCell(col, row)
 		}
 	}
+	return nil
+}
 
-	// Copy next-state to current-state
-	for col := 0; col < w; col += 1 {
-		for row := 0; row < h; row += 1 {
-			s.cellStates[col][row] = s.cellNextStates[col][row]
-			if s.cellStates[col][row] == 1 {
-				s.raster.SetPixelColor(s.infectedColor)
-			} else if s.cellStates[col][row] == 2 {
-				s.raster.SetPixelColor(s.susceptibleColor)
-			} else if s.cellStates[col][row] == 3 {
-				s.raster.SetPixelColor(s.removedColor)
-			} else {
-				s.raster.SetPixelColor(s.undetermenedColor)
-			}
-			s.raster.SetPixel(col, row)
+func (s *SISModel) Properties() api.IProperties {
+	return raster.NewProperties(300, 300, 1500, 100, 1)
+}
+
+// stepCell updates the next-state of col,row using the tile's random
+// stream. Infection wins over dropping and picking up.
+func (s *SISModel) stepCell(t *Tile, col, row int) {
+	cell := s.cells.at(col, row)
+
+	switch cell.state {
+	case 1:
+		// How likely will they drop it.
+		if t.rng.Float64() < s.dropRate {
+			cell.nextState = 2 // Suceptible
 		}
+	case 0:
+		// This person hasn't experienced meditation yet.
+		if t.rng.Float64() < s.pickupRate {
+			cell.nextState = 2 // Suceptible
+		}
+	case 3:
+		return
 	}
 
+	// Each infected neighbor tries to infect the cell
+	reachedBy(s.cells, col, row, func(c, r int, n [2]int) {
+		if s.cells.at(c, r).state == 1 && t.rng.Float64() < s.acceptibleRate {
+			// Cell is now infected
+			cell.nextState = 1
+			s.stepper.counts[t.index]++
+		}
+	})
+}
+
+func (s *SISModel) Step() bool {
+	// The current "step" works on the current-state but updates the next-state
+	// Once done, the next-state is copied back to the current-state.
+	infected := s.stepper.step(s.stepCell)
+
+	s.stepper.update(func(col, row, was int) {
+		s.drawCell(col, row)
+	})
+
 	// fmt.Println("Newly infected: ", infected)
 	return infected > 0
 }
+
+func (s *SISModel) drawCell(col, row int) {
+	switch s.cells.at(col, row).state {
+	case 1:
+		s.raster.SetPixelColor(s.infectedColor)
+	case 2:
+		s.raster.SetPixelColor(s.susceptibleColor)
+	case 3:
+		s.raster.SetPixelColor(s.removedColor)
+	default:
+		s.raster.SetPixelColor(s.undetermenedColor)
+	}
+	s.raster.SetPixel(col, row)
+}
@@ -2,10 +2,11 @@ package simulation
 
 import (
 	"Netron1-Go/api"
-	"Netron1-Go/gui"
+	"Netron1-Go/raster"
 	"fmt"
 	"image/color"
 	"math/rand"
+	"strings"
 )
 
 type SISaModel struct {
@@ -14,9 +15,10 @@ type SISaModel struct {
 	susceptibleColor  color.RGBA // cell type = 2
 	removedColor      color.RGBA // cell type = 3
 
-	raster         api.IRasterBuffer
-	cellStates     [][]int
-	cellNextStates [][]int
+	raster api.IRasterBuffer
+	cells  *Grid
+	// The grid is stepped in concurrent tiles
+	stepper *gridStepper
 
 	acceptibleRate float64
 
@@ -27,8 +29,9 @@ type SISaModel struct {
 	// The chance they will try meditation
 	pickupRate float64
 
-	// The chance that someone spontaneously starts meditating.
-	spontaneousRate float64
+	// Spontaneous introductions of meditation.
+	spontaneous *SpontaneousProcess
+	cases       caseCounts
 }
 
 func NewSISaModel() api.IModel {
@@ -48,166 +51,203 @@ func (s *SISaModel) Name() string {
 	return "SISaModel"
 }
 
+// Palette returns the state colors.
+func (s *SISaModel) Palette() color.Palette {
+	return color.Palette{
+		s.undetermenedColor,
+		s.infectedColor,
+		s.susceptibleColor,
+		s.removedColor,
+	}
+}
+
 func (s *SISaModel) Configure(rasterBuffer api.IRasterBuffer) {
 	s.raster = rasterBuffer
 	s.acceptibleRate = 0.26
 	s.repeatRate = 0.2
 	s.dropRate = 0.9
 	s.pickupRate = 0.5
-	s.spontaneousRate = 0.5
 
 	rand.Seed(13163)
 
-	s.cellStates = make([][]int, s.raster.Height())
-	s.cellNextStates = make([][]int, s.raster.Height())
-	for i := range s.cellStates {
-		s.cellStates[i] = make([]int, s.raster.Width())
-		s.cellNextStates[i] = make([]int, s.raster.Width())
+	s.cells = NewGrid(s.raster.Width(), s.raster.Height())
+	s.stepper = newGridStepper(s.cells, sisActive)
+
+	// Same expected introductions per step as a single coin flip of 0.5
+	s.spontaneous = NewSpontaneousProcess(s.raster.Width(), s.raster.Height(), 0.5/float64(s.raster.Width()*s.raster.Height()))
+}
+
+// SetParameter sets accept, drop or pickup by name.
+func (s *SISaModel) SetParameter(name string, value float64) error {
+	switch name {
+	case "accept":
+		return setChance(&s.acceptibleRate, name, value)
+	case "drop":
+		return setChance(&s.dropRate, name, value)
+	case "pickup":
+		return setChance(&s.pickupRate, name, value)
 	}
+	return fmt.Errorf("unknown parameter: %s", name)
+}
+
+// Prevalence is the fraction of cells infected.
+func (s *SISaModel) Prevalence() float64 {
+	return s.cells.fraction(1)
 }
 
 // SendEvent receives an event from the host simulation
-func (s *SISaModel) SendEvent(event string) {
+func (s *SISaModel) SendEvent(event string) error {
+	fields := strings.Fields(event)
+	if ok, err := s.spontaneous.event(fields); ok {
+		return err
+	}
+	if ok, err := s.stepper.event(fields); ok {
+		return err
+	}
+
+	if len(fields) == 2 && fields[0] == "spont" && fields[1] == "stats" {
+		fmt.Println(s.cases.toString())
+		return nil
+	}
+	return unhandled(event)
+}
+
+// Snapshot returns the cells and how many steps of cases were
+// counted.
+func (s *SISaModel) Snapshot() []byte {
+	w := stateWriter{}
+	w.cells(s.cells)
+	w.int(len(s.cases.introduced))
+	return w.buf
+}
+
+// Restore sets the cells from a snapshot, drops the cases counted
+// after it and redraws the cells. The tiles take new random streams,
+// as a branch does.
+func (s *SISaModel) Restore(snapshot []byte) error {
+	r := stateReader{buf: snapshot}
+	cells := r.cells(s.cells)
+	n := r.length(len(s.cases.introduced))
+	if err := r.done(); err != nil {
+		return err
+	}
+
+	s.stepper.seed(rand.Int63())
+	copy(s.cells.cells, cells)
+	s.stepper.rebuild()
+	s.cases.introduced = s.cases.introduced[:n]
+	s.cases.transmitted = s.cases.transmitted[:n]
+
+	w := s.raster.Width()
+	h := s.raster.Height()
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			s.drawCell(col, row)
+		}
+	}
+	return nil
 }
 
 func (s *SISaModel) Properties() api.IProperties {
-	return gui.NewProperties(300, 300, 1500, 100, 1)
+	return raster.NewProperties(300, 300, 1500, 100, 1)
 }
 
 func (s *SISaModel) Reset() {
 	fmt.Println(("--- sir reset ---"))
 	s.raster.Clear()
-
-	// Start with the center "cell" infected = Blue
-	s.raster.SetPixelColor(s.infectedColor)
+	s.stepper.seed(rand.Int63())
 
 	w := s.raster.Width()
 	h := s.raster.Height()
 
 	for col := 0; col < w; col += 1 {
 		for row := 0; row < h; row += 1 {
-			s.cellStates[col][row] = 2     // Susceptible
-			s.cellNextStates[col][row] = 0 // Undetermined
+			s.cells.at(col, row).state = 2     // Susceptible
+			s.cells.at(col, row).nextState = 0 // Undetermined
 		}
 	}
+	s.stepper.rebuild()
 
 	for col := 0; col < w; col += 1 {
 		for row := 0; row < h; row += 1 {
-			if s.cellStates[col][row] == 1 {
-				s.raster.SetPixelColor(s.infectedColor)
-			} else if s.cellStates[col][row] == 3 {
-				s.raster.SetPixelColor(s.removedColor)
-			} else {
-				s.raster.SetPixelColor(s.susceptibleColor)
-			}
-			s.raster.SetPixel(col, row)
+			s.drawCell(col, row)
 		}
 	}
+
+	s.cases.reset()
 }
 
-func (s *SISaModel) Step() bool {
-	// The current "step" works on the current-state but updates the next-state
-	// Once done, the next-state is copied back to the current-state.
-	w := s.raster.Width()
-	h := s.raster.Height()
-	ce := 0
-	infected := 0
+// stepCell updates the next-state of col,row using the tile's random
+// stream. Infection wins over dropping and picking up.
+func (s *SISaModel) stepCell(t *Tile, col, row int) {
+	cell := s.cells.at(col, row)
 
-	for col := 0; col < w; col += 1 {
-		for row := 0; row < h; row += 1 {
-			if s.cellStates[col][row] == 1 { // Is infected
-				// How likely will they drop it.
-				if rand.Float64() < s.dropRate {
-					s.cellNextStates[col][row] = 2 // Suceptible
-				}
-
-				// Check neighbors.
-				ce = col + 1
-				if ce < w { // Right
-					// If neighbor isn't (infected AND they are acceptible) = Suceptible
-					if s.cellStates[ce][row] != 3 {
-						if rand.Float64() < s.acceptibleRate {
-							// Cell is now infected
-							s.cellNextStates[ce][row] = 1
-							infected++
-						}
-					}
-				}
-
-				ce = col - 1
-				if ce >= 0 { // Left
-					if s.cellStates[ce][row] != 3 {
-						if rand.Float64() < s.acceptibleRate {
-							// Cell is now infected
-							s.cellNextStates[ce][row] = 1
-							infected++
-						}
-					}
-				}
-
-				ce = row - 1
-				if ce >= 0 { // Top
-					if s.cellStates[col][ce] != 3 {
-						if rand.Float64() < s.acceptibleRate {
-							// Cell is now infected
-							s.cellNextStates[col][ce] = 1
-							infected++
-						}
-					}
-				}
-
-				ce = row + 1
-				if ce < h { // Bottom
-					if s.cellStates[col][ce] != 3 {
-						if rand.Float64() < s.acceptibleRate {
-							// Cell is bottom infected
-							s.cellNextStates[col][ce] = 1
-							infected++
-						}
-					}
-				}
-			} else {
-				if s.cellStates[col][row] == 0 {
-					// This person hasn't experienced meditation yet.
-					if rand.Float64() < s.pickupRate {
-						s.cellNextStates[col][row] = 2 // Suceptible
-					}
-				}
-			}
+	switch cell.state {
+	case 1:
+		// How likely will they drop it.
+		if t.rng.Float64() < s.dropRate {
+			cell.nextState = 2 // Suceptible
 		}
+	case 0:
+		// This person hasn't experienced meditation yet.
+		if t.rng.Float64() < s.pickupRate {
+			cell.nextState = 2 // Suceptible
+		}
+	case 3:
+		return
 	}
 
-	if rand.Float64() < s.spontaneousRate {
-		// pick a col and row to infect
-		col := int(rand.Float64()*float64(s.raster.Width())) - 1
-		if col < 0 {
-			col = 0
+	// Each infected neighbor tries to infect the cell
+	reachedBy(s.cells, col, row, func(c, r int, n [2]int) {
+		if s.cells.at(c, r).state == 1 && t.rng.Float64() < s.acceptibleRate {
+			// Cell is now infected
+			cell.nextState = 1
+			s.stepper.counts[t.index]++
 		}
-		row := int(rand.Float64()*float64(s.raster.Width())) - 1
-		if row < 0 {
-			row = 0
+	})
+}
+
+func (s *SISaModel) Step() bool {
+	// The current "step" works on the current-state but updates the next-state
+	// Once done, the next-state is copied back to the current-state.
+	s.stepper.step(s.stepCell)
+
+	introduced := s.spontaneous.introduce(func(col, row int) bool {
+		// Only susceptible cells that a neighbor didn't just infect
+		cell := s.cells.at(col, row)
+		if cell.state != 2 || cell.nextState == 1 {
+			return false
 		}
-		s.cellNextStates[col][row] = 1
-		infected++
-	}
+		cell.nextState = 1
+		s.stepper.touch(col, row)
+		return true
+	})
 
 	// Copy next-state to current-state
-	for col := 0; col < w; col += 1 {
-		for row := 0; row < h; row += 1 {
-			s.cellStates[col][row] = s.cellNextStates[col][row]
-			if s.cellStates[col][row] == 1 {
-				s.raster.SetPixelColor(s.infectedColor)
-			} else if s.cellStates[col][row] == 2 {
-				s.raster.SetPixelColor(s.susceptibleColor)
-			} else if s.cellStates[col][row] == 3 {
-				s.raster.SetPixelColor(s.removedColor)
-			} else {
-				s.raster.SetPixelColor(s.undetermenedColor)
-			}
-			s.raster.SetPixel(col, row)
+	cases := 0
+	s.stepper.update(func(col, row, was int) {
+		if was != 1 && s.cells.at(col, row).state == 1 {
+			cases++
 		}
-	}
+		s.drawCell(col, row)
+	})
+
+	s.cases.record(introduced, cases-introduced)
 
 	// fmt.Println("Newly infected: ", infected)
 	return true //infected > 0
 }
+
+func (s *SISaModel) drawCell(col, row int) {
+	switch s.cells.at(col, row).state {
+	case 1:
+		s.raster.SetPixelColor(s.infectedColor)
+	case 2:
+		s.raster.SetPixelColor(s.susceptibleColor)
+	case 3:
+		s.raster.SetPixelColor(s.removedColor)
+	default:
+		s.raster.SetPixelColor(s.undetermenedColor)
+	}
+	s.raster.SetPixel(col, row)
+}
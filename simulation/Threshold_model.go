@@ -0,0 +1,392 @@
+package simulation
+
+import (
+	"Netron1-Go/api"
+	"Netron1-Go/raster"
+	"fmt"
+	"image/color"
+	"math"
+	"math/rand"
+	"strings"
+)
+
+// The threshold model is a complex contagion: a cell adopts only once
+// enough of its neighbors are active, and never drops it. Each cell
+// has its own threshold drawn uniformly from mean +/- spread, either
+// as a count of active neighbors or as a fraction of its neighbors.
+//
+// The model runs cascades one after another. A cascade starts from a
+// small cluster of seed cells and ends when no cell adopts. Fresh
+// cascades start on an inactive grid, otherwise cascades accumulate.
+//   threshold count <mean> [spread]      at least k active neighbors
+//   threshold fraction <mean> [spread]   at least a fraction phi
+//   threshold degree <4..8>
+//   threshold seed <cells>
+//   threshold fresh <on|off>
+//   threshold stats                      cascade size statistics
+//   threshold export                     cascade sizes and distribution
+
+type ThresholdModel struct {
+	infectedColor    color.RGBA // cell type = 1
+	susceptibleColor color.RGBA // cell type = 2
+	adoptedColor     color.RGBA
+	seedColor        color.RGBA
+
+	raster api.IRasterBuffer
+	cells  *Grid
+
+	// degree goes from 4 to 8
+	degree int
+
+	fractional bool
+	mean       float64
+	spread     float64
+
+	seedSize int
+	fresh    bool
+
+	running     bool
+	cascadeSize int
+	cascades    avalancheSizes
+}
+
+func NewThresholdModel() api.IModel {
+	o := new(ThresholdModel)
+	// Infected = Blue
+	o.infectedColor = color.RGBA{R: 0, G: 0, B: 255, A: 255}
+	// Susceptible = Skin
+	o.susceptibleColor = color.RGBA{R: 255, G: 225, B: 200, A: 255}
+	// Adopted this step = Light blue
+	o.adoptedColor = color.RGBA{R: 100, G: 180, B: 255, A: 255}
+	// Seed = Red
+	o.seedColor = color.RGBA{R: 255, G: 0, B: 0, A: 255}
+
+	return o
+}
+
+func (s *ThresholdModel) Name() string {
+	return "ThresholdModel"
+}
+
+// Palette returns the state colors.
+func (s *ThresholdModel) Palette() color.Palette {
+	return color.Palette{
+		s.infectedColor,
+		s.susceptibleColor,
+		s.adoptedColor,
+		s.seedColor,
+	}
+}
+
+func (s *ThresholdModel) Configure(rasterBuffer api.IRasterBuffer) {
+	s.raster = rasterBuffer
+	s.degree = 8
+	s.fractional = true
+	s.mean = 0.35
+	s.spread = 0.2
+	s.seedSize = 3
+	s.fresh = true
+
+	rand.Seed(13163)
+
+	s.cells = NewGrid(s.raster.Width(), s.raster.Height())
+}
+
+// SetParameter sets mean, spread, degree or seed by name.
+func (s *ThresholdModel) SetParameter(name string, value float64) error {
+	switch name {
+	case "mean":
+		s.mean = value
+		s.assignThresholds()
+	case "spread":
+		if value < 0 {
+			return fmt.Errorf("spread can't be negative")
+		}
+		s.spread = value
+		s.assignThresholds()
+	case "degree":
+		if value < 4 || value > 8 {
+			return fmt.Errorf("degree must be 4 to 8")
+		}
+		s.degree = int(value)
+	case "seed":
+		if value < 1 {
+			return fmt.Errorf("seed must be at least 1")
+		}
+		s.seedSize = int(value)
+	default:
+		return fmt.Errorf("unknown parameter: %s", name)
+	}
+	return nil
+}
+
+// Prevalence is the fraction of cells active.
+func (s *ThresholdModel) Prevalence() float64 {
+	return s.cells.fraction(1)
+}
+
+// SendEvent receives an event from the host simulation
+func (s *ThresholdModel) SendEvent(event string) error {
+	fields := strings.Fields(event)
+	if len(fields) < 2 || fields[0] != "threshold" {
+		return unhandled(event)
+	}
+
+	if fields[1] == "fresh" && len(fields) == 3 {
+		if fields[2] != "on" && fields[2] != "off" {
+			return fmt.Errorf("usage: threshold fresh <on|off>")
+		}
+		s.fresh = fields[2] == "on"
+		fmt.Println("fresh cascades: ", s.fresh)
+		return nil
+	}
+
+	args, err := parseFloats(fields[2:])
+	if err != nil {
+		return fmt.Errorf("threshold: %v", err)
+	}
+
+	switch {
+	case (fields[1] == "count" || fields[1] == "fraction") && (len(args) == 1 || len(args) == 2):
+		s.fractional = fields[1] == "fraction"
+		s.mean = args[0]
+		s.spread = 0
+		if len(args) == 2 {
+			s.spread = args[1]
+		}
+		s.assignThresholds()
+		fmt.Println(s.toString())
+	case fields[1] == "degree" && len(args) == 1:
+		if err := s.SetParameter("degree", args[0]); err != nil {
+			return err
+		}
+		fmt.Println(s.toString())
+	case fields[1] == "seed" && len(args) == 1:
+		if err := s.SetParameter("seed", args[0]); err != nil {
+			return err
+		}
+		fmt.Println("seed cells: ", s.seedSize)
+	case fields[1] == "stats":
+		fmt.Println(s.toString())
+		fmt.Println(s.cascades.toString(s.raster.Width() * s.raster.Height() / 2))
+	case fields[1] == "export":
+		base := dataPath(s.Name() + "_cascades")
+		if err := s.cascades.export(base); err != nil {
+			return fmt.Errorf("export failed: %v", err)
+		}
+		fmt.Println("Exported cascades to: " + base + "_*")
+	default:
+		return fmt.Errorf("unknown threshold command: %s", event)
+	}
+	return nil
+}
+
+func (s *ThresholdModel) toString() string {
+	kind := "count"
+	if s.fractional {
+		kind = "fraction"
+	}
+	return fmt.Sprintf("threshold %s: %.3f +/- %.3f, degree: %d, seed cells: %d", kind, s.mean, s.spread, s.degree, s.seedSize)
+}
+
+// assignThresholds draws every cell's threshold.
+func (s *ThresholdModel) assignThresholds() {
+	for i := range s.cells.cells {
+		t := s.mean + s.spread*(2*rand.Float64()-1)
+		if s.fractional {
+			t = math.Min(1, t)
+		}
+		s.cells.cells[i].threshold = math.Max(0, t)
+	}
+}
+
+// seed starts a cascade from a random inactive cell and up to
+// seedSize-1 of its inactive neighbors. Returns false if every cell
+// is active.
+func (s *ThresholdModel) seed() bool {
+	w := s.raster.Width()
+	h := s.raster.Height()
+
+	if s.fresh {
+		for col := 0; col < w; col += 1 {
+			for row := 0; row < h; row += 1 {
+				s.cells.at(col, row).state = 2
+				s.cells.at(col, row).nextState = 2
+			}
+		}
+		s.draw()
+	}
+
+	col, row := rand.Intn(w), rand.Intn(h)
+	for try := 0; s.cells.at(col, row).state == 1; try++ {
+		if try == w*h {
+			return false
+		}
+		col, row = rand.Intn(w), rand.Intn(h)
+	}
+
+	s.cascadeSize = 0
+	s.activate(col, row)
+	for _, n := range neighbors(s.degree) {
+		if s.cascadeSize == s.seedSize {
+			break
+		}
+		nc := col + n[0]
+		nr := row + n[1]
+		if nc >= 0 && nc < w && nr >= 0 && nr < h && s.cells.at(nc, nr).state != 1 {
+			s.activate(nc, nr)
+		}
+	}
+
+	s.running = true
+	return true
+}
+
+func (s *ThresholdModel) activate(col, row int) {
+	s.cells.at(col, row).state = 1
+	s.cells.at(col, row).nextState = 1
+	s.cascadeSize++
+	s.raster.SetPixelColor(s.seedColor)
+	s.raster.SetPixel(col, row)
+}
+
+// adopts returns true if enough of the cell's neighbors are active.
+func (s *ThresholdModel) adopts(col, row int) bool {
+	w := s.raster.Width()
+	h := s.raster.Height()
+	active, total := 0, 0
+
+	for _, n := range neighbors(s.degree) {
+		nc := col + n[0]
+		nr := row + n[1]
+		if nc < 0 || nc >= w || nr < 0 || nr >= h {
+			continue
+		}
+		total++
+		if s.cells.at(nc, nr).state == 1 {
+			active++
+		}
+	}
+
+	if active == 0 {
+		return false
+	}
+	if s.fractional {
+		return float64(active) >= s.cells.at(col, row).threshold*float64(total)
+	}
+	return float64(active) >= s.cells.at(col, row).threshold
+}
+
+func (s *ThresholdModel) draw() {
+	w := s.raster.Width()
+	h := s.raster.Height()
+
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			if s.cells.at(col, row).state == 1 {
+				s.raster.SetPixelColor(s.infectedColor)
+			} else {
+				s.raster.SetPixelColor(s.susceptibleColor)
+			}
+			s.raster.SetPixel(col, row)
+		}
+	}
+}
+
+// Snapshot returns the cells, with their thresholds, and the running
+// cascade.
+func (s *ThresholdModel) Snapshot() []byte {
+	w := stateWriter{}
+	w.cells(s.cells)
+	w.bool(s.running)
+	w.int(s.cascadeSize)
+	w.int(len(s.cascades.sizes))
+	return w.buf
+}
+
+// Restore sets the cells and the cascade from a snapshot, drops the
+// cascades that ended after it and redraws the cells.
+func (s *ThresholdModel) Restore(snapshot []byte) error {
+	r := stateReader{buf: snapshot}
+	cells := r.cells(s.cells)
+	running := r.bool()
+	cascadeSize := r.int()
+	n := r.length(len(s.cascades.sizes))
+	if err := r.done(); err != nil {
+		return err
+	}
+
+	copy(s.cells.cells, cells)
+	s.running = running
+	s.cascadeSize = cascadeSize
+	s.cascades.sizes = s.cascades.sizes[:n]
+	s.draw()
+	return nil
+}
+
+func (s *ThresholdModel) Properties() api.IProperties {
+	return raster.NewProperties(300, 300, 1500, 100, 1)
+}
+
+func (s *ThresholdModel) Reset() {
+	fmt.Println(("--- threshold reset ---"))
+	s.raster.Clear()
+
+	w := s.raster.Width()
+	h := s.raster.Height()
+
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			s.cells.at(col, row).state = 2 // Susceptible
+			s.cells.at(col, row).nextState = 2
+		}
+	}
+	s.assignThresholds()
+
+	s.running = false
+	s.cascades.reset()
+	s.draw()
+}
+
+func (s *ThresholdModel) Step() bool {
+	if !s.running {
+		// Without room for a cascade the run is over
+		return s.seed()
+	}
+
+	w := s.raster.Width()
+	h := s.raster.Height()
+	adopted := 0
+
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			if s.cells.at(col, row).state != 1 && s.adopts(col, row) {
+				s.cells.at(col, row).nextState = 1
+				adopted++
+			}
+		}
+	}
+
+	// Copy next-state to current-state
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			c := s.cells.at(col, row)
+			if c.state == c.nextState {
+				continue
+			}
+			c.state = c.nextState
+			s.raster.SetPixelColor(s.adoptedColor)
+			s.raster.SetPixel(col, row)
+		}
+	}
+
+	s.cascadeSize += adopted
+	if adopted == 0 {
+		// The cascade died out
+		s.cascades.add(s.cascadeSize)
+		s.running = false
+		s.draw()
+	}
+
+	return true
+}
@@ -0,0 +1,105 @@
+package simulation
+
+import (
+	"fmt"
+	"math"
+)
+
+// avalancheSizes collects the sizes of cascades, fires and other
+// avalanches.
+type avalancheSizes struct {
+	sizes []int
+}
+
+func (a *avalancheSizes) reset() {
+	a.sizes = []int{}
+}
+
+func (a *avalancheSizes) add(size int) {
+	a.sizes = append(a.sizes, size)
+}
+
+// summary returns the mean and max size and the fraction of
+// avalanches of at least large cells.
+func (a *avalancheSizes) summary(large int) (mean float64, max int, largeFraction float64) {
+	if len(a.sizes) == 0 {
+		return 0, 0, 0
+	}
+
+	count := 0
+	for _, s := range a.sizes {
+		mean += float64(s)
+		if s > max {
+			max = s
+		}
+		if s >= large {
+			count++
+		}
+	}
+
+	n := float64(len(a.sizes))
+	return mean / n, max, float64(count) / n
+}
+
+func (a *avalancheSizes) toString(large int) string {
+	mean, max, largeFraction := a.summary(large)
+	return fmt.Sprintf("avalanches: %d, mean size: %.2f, max size: %d, size >= %d: %.4f",
+		len(a.sizes), mean, max, large, largeFraction)
+}
+
+// distribution bins the sizes in logarithmic bins, binsPerDecade per
+// factor of 10. It returns the bins' geometric centers and the
+// probability density, count / (total * bin width), so that a power
+// law shows as a straight line on a log-log plot. Empty bins are left
+// out.
+func (a *avalancheSizes) distribution(binsPerDecade int) (centers, density []float64) {
+	counts := map[int]int{}
+	total := 0
+	for _, s := range a.sizes {
+		if s < 1 {
+			continue
+		}
+		counts[int(math.Log10(float64(s))*float64(binsPerDecade))]++
+		total++
+	}
+
+	for b := 0; len(counts) > 0; b++ {
+		c, ok := counts[b]
+		if !ok {
+			continue
+		}
+		delete(counts, b)
+		lo := math.Pow(10, float64(b)/float64(binsPerDecade))
+		hi := math.Pow(10, float64(b+1)/float64(binsPerDecade))
+		centers = append(centers, math.Sqrt(lo*hi))
+		density = append(density, float64(c)/(float64(total)*(hi-lo)))
+	}
+
+	return centers, density
+}
+
+// export writes the sizes and their log-log distribution as CSVs and
+// plots the distribution with log10 axes.
+func (a *avalancheSizes) export(base string) error {
+	sizes := make([]float64, len(a.sizes))
+	for i, s := range a.sizes {
+		sizes[i] = float64(s)
+	}
+	if err := writeColumnsCSV(base+"_sizes.csv", "avalanche", []string{"size"}, [][]float64{sizes}); err != nil {
+		return err
+	}
+
+	centers, density := a.distribution(5)
+	if err := writeColumnsCSV(base+"_distribution.csv", "size", []string{"density"}, [][]float64{density}, centers...); err != nil {
+		return err
+	}
+
+	logSize := make([]float64, len(centers))
+	logDensity := make([]float64, len(density))
+	for i := range centers {
+		logSize[i] = math.Log10(centers[i])
+		logDensity[i] = math.Log10(density[i])
+	}
+
+	return savePlot(base+"_distribution.png", logSize, [][]float64{logDensity})
+}
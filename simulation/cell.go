@@ -5,4 +5,10 @@ type Cell struct {
 
 	state     int
 	nextState int
+
+	// Steps until an immune cell becomes susceptible. -1 = never
+	timer int
+
+	// Active neighbors (count or fraction) needed to adopt
+	threshold float64
 }
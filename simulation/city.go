@@ -0,0 +1,298 @@
+package simulation
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+// City is a square of cells whose degree increases towards its
+// center in nested squares. Cities have a position, size and velocity
+// and may grow or shrink over time.
+type City struct {
+	// Center of the city
+	x, y float64
+	size float64
+
+	// Cells per step
+	vx, vy float64
+	// Size change per step. The growth reverses at min/max size.
+	growth           float64
+	minSize, maxSize float64
+
+	// Degree of the outer square and the number of nested squares
+	degree int
+	levels int
+	// Radial cities are circles whose degree increases smoothly
+	// towards the center.
+	radial bool
+}
+
+// NewCity creates a still city centered at x,y.
+func NewCity(x, y, size float64, degree, levels int) *City {
+	o := new(City)
+	o.x = x
+	o.y = y
+	o.size = size
+	o.minSize = size
+	o.maxSize = size
+	o.degree = degree
+	o.levels = levels
+	return o
+}
+
+// bounds returns the cells covered by the city.
+func (c *City) bounds() image.Rectangle {
+	size := int(math.Round(c.size))
+	left := int(math.Round(c.x - c.size/2))
+	top := int(math.Round(c.y - c.size/2))
+	return image.Rect(left, top, left+size, top+size)
+}
+
+func (c *City) contains(col, row int) bool {
+	return image.Pt(col, row).In(c.bounds())
+}
+
+// update moves and resizes the city. Cities bounce off the grid's
+// edges. Returns true if the city covers different cells afterwards.
+func (c *City) update(w, h int) bool {
+	before := c.bounds()
+
+	c.x += c.vx
+	c.y += c.vy
+	half := c.size / 2
+	if c.x-half < 0 || c.x+half > float64(w) {
+		c.vx = -c.vx
+		c.x = math.Max(half, math.Min(float64(w)-half, c.x))
+	}
+	if c.y-half < 0 || c.y+half > float64(h) {
+		c.vy = -c.vy
+		c.y = math.Max(half, math.Min(float64(h)-half, c.y))
+	}
+
+	c.size += c.growth
+	if c.size > c.maxSize || c.size < c.minSize {
+		c.growth = -c.growth
+		c.size = math.Max(c.minSize, math.Min(c.maxSize, c.size))
+	}
+
+	return c.bounds() != before
+}
+
+// stamp writes the city's degrees into cells. Each nested square
+// is inset by an equal step and has a degree one higher.
+func (c *City) stamp(g *Grid) {
+	r := c.bounds()
+	size := r.Dx()
+
+	if c.radial {
+		c.stampRadial(g, r.Intersect(image.Rect(0, 0, g.w, g.h)))
+		return
+	}
+
+	for l := 0; l < c.levels; l++ {
+		inset := l * size / (2 * c.levels)
+		sq := image.Rect(r.Min.X+inset, r.Min.Y+inset, r.Max.X-inset, r.Max.Y-inset).Intersect(image.Rect(0, 0, g.w, g.h))
+		for col := sq.Min.X; col < sq.Max.X; col += 1 {
+			for row := sq.Min.Y; row < sq.Max.Y; row += 1 {
+				g.at(col, row).degree = c.degree + l
+			}
+		}
+	}
+}
+
+// stampRadial raises the degree with the distance to the center.
+func (c *City) stampRadial(g *Grid, r image.Rectangle) {
+	radius := c.size / 2
+
+	for col := r.Min.X; col < r.Max.X; col += 1 {
+		for row := r.Min.Y; row < r.Max.Y; row += 1 {
+			d := math.Hypot(float64(col)+0.5-c.x, float64(row)+0.5-c.y)
+			if d > radius {
+				continue
+			}
+			l := int((1 - d/radius) * float64(c.levels))
+			if l >= c.levels {
+				l = c.levels - 1
+			}
+			g.at(col, row).degree = c.degree + l
+		}
+	}
+}
+
+func (c *City) toString() string {
+	return fmt.Sprintf("(%.1f,%.1f) size: %.1f, velocity: (%.2f,%.2f), growth: %.2f [%.1f-%.1f]",
+		c.x, c.y, c.size, c.vx, c.vy, c.growth, c.minSize, c.maxSize)
+}
+
+// cityMap is the set of cities placed on a grid and the city selected
+// for keyboard/mouse moves. Cities stamped later cover earlier ones.
+type cityMap struct {
+	cities    []*City
+	corridors []*Corridor
+	selected  *City
+
+	// Imported degree map the cities are stamped on. nil = degree 4
+	base *IntGrid
+
+	// The selected city follows the mouse while dragging
+	dragging       bool
+	dragDX, dragDY float64
+}
+
+func (m *cityMap) clear() {
+	m.cities = []*City{}
+	m.corridors = []*Corridor{}
+	m.base = nil
+	m.selected = nil
+	m.dragging = false
+}
+
+func (m *cityMap) add(c *City) {
+	m.cities = append(m.cities, c)
+}
+
+// update moves and resizes every city. Returns true if the degree
+// map needs to be stamped again.
+func (m *cityMap) update(w, h int) bool {
+	changed := false
+	for _, c := range m.cities {
+		if m.dragging && c == m.selected {
+			continue
+		}
+		if c.update(w, h) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// stamp rebuilds the degree map from the corridors and cities.
+func (m *cityMap) stamp(g *Grid) {
+	for i := range g.cells {
+		if m.base != nil {
+			g.cells[i].degree = m.base.values[i]
+		} else {
+			g.cells[i].degree = 0
+		}
+	}
+
+	for _, c := range m.corridors {
+		c.stamp(g)
+	}
+
+	for _, c := range m.cities {
+		c.stamp(g)
+	}
+}
+
+// cityAt returns the top most city covering col,row or nil.
+func (m *cityMap) cityAt(col, row int) *City {
+	for i := len(m.cities) - 1; i >= 0; i-- {
+		if m.cities[i].contains(col, row) {
+			return m.cities[i]
+		}
+	}
+	return nil
+}
+
+// moveCity moves the selected city by dx,dy.
+func (m *cityMap) moveCity(dx, dy int) bool {
+	if m.selected == nil {
+		return false
+	}
+	m.selected.x += float64(dx)
+	m.selected.y += float64(dy)
+	return true
+}
+
+// event handles mouse drags and city commands:
+//
+//	city list
+//	city select <index>
+//	city move <dx> <dy>
+//	city velocity <vx> <vy>
+//	city growth <rate> <minSize> <maxSize>
+//
+// Returns true if the degree map needs to be stamped again, and an
+// error for a bad city command or an event that is neither.
+func (m *cityMap) event(fields []string) (bool, error) {
+	if len(fields) >= 2 && fields[0] == "mouse" {
+		return m.mouseEvent(fields[1:]), nil
+	}
+
+	if len(fields) < 2 || fields[0] != "city" {
+		return false, unhandled(strings.Join(fields, " "))
+	}
+
+	args, err := parseFloats(fields[2:])
+	if err != nil {
+		return false, fmt.Errorf("city: %v", err)
+	}
+
+	switch {
+	case fields[1] == "list":
+		for i, c := range m.cities {
+			mark := " "
+			if c == m.selected {
+				mark = "*"
+			}
+			fmt.Println(mark, i, ": ", c.toString())
+		}
+	case fields[1] == "select" && len(args) == 1:
+		i := int(args[0])
+		if i < 0 || i >= len(m.cities) {
+			return false, fmt.Errorf("no city: %d", i)
+		}
+		m.selected = m.cities[i]
+		fmt.Println("Selected city: ", m.selected.toString())
+	case fields[1] == "move" && len(args) == 2:
+		return m.moveCity(int(args[0]), int(args[1])), nil
+	case m.selected == nil:
+		return false, fmt.Errorf("no city selected")
+	case fields[1] == "velocity" && len(args) == 2:
+		m.selected.vx = args[0]
+		m.selected.vy = args[1]
+		fmt.Println("City: ", m.selected.toString())
+	case fields[1] == "growth" && len(args) == 3 && args[1] > 0 && args[1] <= args[2]:
+		m.selected.growth = args[0]
+		m.selected.minSize = args[1]
+		m.selected.maxSize = args[2]
+		m.selected.size = math.Max(args[1], math.Min(args[2], m.selected.size))
+		fmt.Println("City: ", m.selected.toString())
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown city command: %s", strings.Join(fields, " "))
+	}
+
+	return false, nil
+}
+
+// mouseEvent selects a city with the left button and drags it.
+func (m *cityMap) mouseEvent(fields []string) bool {
+	args, err := parseInts(fields[1:])
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case fields[0] == "down" && len(args) == 3 && args[0] == 1:
+		c := m.cityAt(args[1], args[2])
+		if c == nil {
+			return false
+		}
+		m.selected = c
+		m.dragging = true
+		m.dragDX = c.x - float64(args[1])
+		m.dragDY = c.y - float64(args[2])
+	case fields[0] == "drag" && len(args) == 2 && m.dragging:
+		m.selected.x = float64(args[0]) + m.dragDX
+		m.selected.y = float64(args[1]) + m.dragDY
+		return true
+	case fields[0] == "up":
+		m.dragging = false
+	}
+
+	return false
+}
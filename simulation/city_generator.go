@@ -0,0 +1,237 @@
+package simulation
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+)
+
+// degreeMapColors are the gray levels of degrees 4 to 8 in a degree
+// map image. They match the models' degree colors so a screenshot of
+// a layout can be edited and loaded back.
+var degreeMapColors = []uint8{255, 200, 175, 150, 125}
+
+// Corridor is a strip of higher degree cells connecting two cities.
+// Corridors follow their cities when they move.
+type Corridor struct {
+	from, to *City
+	width    float64
+	degree   int
+}
+
+func NewCorridor(from, to *City, width float64, degree int) *Corridor {
+	return &Corridor{from: from, to: to, width: width, degree: degree}
+}
+
+// stamp raises the degree of cells along the corridor. Cells
+// that already have a higher degree are left alone.
+func (c *Corridor) stamp(g *Grid) {
+	dx := c.to.x - c.from.x
+	dy := c.to.y - c.from.y
+	steps := int(math.Hypot(dx, dy)*2) + 1
+	half := c.width / 2
+
+	for i := 0; i <= steps; i++ {
+		t := float64(i) / float64(steps)
+		x := c.from.x + dx*t
+		y := c.from.y + dy*t
+		for col := int(x - half); col < int(math.Ceil(x+half)); col += 1 {
+			for row := int(y - half); row < int(math.Ceil(y+half)); row += 1 {
+				if !g.in(col, row) {
+					continue
+				}
+				if g.at(col, row).degree < c.degree {
+					g.at(col, row).degree = c.degree
+				}
+			}
+		}
+	}
+}
+
+// CityLayout generates cities with power law (Zipf) distributed
+// sizes and radial degree gradients, optionally surrounded by
+// suburbs and connected by corridors. The same seed and parameters
+// always generate the same layout.
+type CityLayout struct {
+	seed   int64
+	cities int
+
+	// Sizes follow P(size > s) ~ s^-exponent, limited to min/max size
+	exponent float64
+	minSize  float64
+	maxSize  float64
+
+	// Suburbs per city
+	suburbs   int
+	corridors bool
+}
+
+func NewCityLayout(cities int, seed int64) *CityLayout {
+	o := new(CityLayout)
+	o.seed = seed
+	o.cities = cities
+	o.exponent = 1.2
+	o.minSize = 12
+	o.maxSize = 90
+	o.suburbs = 0
+	o.corridors = true
+	return o
+}
+
+// generate returns the cities and corridors of the layout for a
+// w x h grid. Cities are ordered smallest first so that larger
+// cities are stamped over smaller ones.
+func (l *CityLayout) generate(w, h int) ([]*City, []*Corridor) {
+	rng := rand.New(rand.NewSource(l.seed))
+
+	sizes := make([]float64, l.cities)
+	for i := range sizes {
+		u := rng.Float64()
+		sizes[i] = math.Min(l.maxSize, l.minSize*math.Pow(1-u, -1/l.exponent))
+	}
+	sort.Sort(sort.Reverse(sort.Float64Slice(sizes)))
+
+	cities := []*City{}
+	for _, size := range sizes {
+		c := NewCity(0, 0, size, 5, 4)
+		c.radial = true
+		l.place(c, cities, rng, w, h)
+		cities = append(cities, c)
+	}
+
+	corridors := []*Corridor{}
+	if l.corridors {
+		// Connect each city to the nearest larger city.
+		for i := 1; i < len(cities); i++ {
+			nearest := cities[0]
+			for _, c := range cities[:i] {
+				if distance(cities[i], c) < distance(cities[i], nearest) {
+					nearest = c
+				}
+			}
+			corridors = append(corridors, NewCorridor(cities[i], nearest, 3, 5))
+		}
+	}
+
+	suburbs := []*City{}
+	for _, c := range cities {
+		for i := 0; i < l.suburbs; i++ {
+			angle := rng.Float64() * 2 * math.Pi
+			d := c.size * (0.6 + 0.4*rng.Float64())
+			sub := NewCity(c.x+d*math.Cos(angle), c.y+d*math.Sin(angle), c.size*(0.15+0.15*rng.Float64()), 5, 2)
+			sub.radial = true
+			sub.x = math.Max(0, math.Min(float64(w), sub.x))
+			sub.y = math.Max(0, math.Min(float64(h), sub.y))
+			suburbs = append(suburbs, sub)
+			if l.corridors {
+				corridors = append(corridors, NewCorridor(sub, c, 2, 5))
+			}
+		}
+	}
+
+	for i, j := 0, len(cities)-1; i < j; i, j = i+1, j-1 {
+		cities[i], cities[j] = cities[j], cities[i]
+	}
+
+	return append(suburbs, cities...), corridors
+}
+
+// place picks a position for c inside the grid that doesn't overlap
+// the cities already placed, if one can be found.
+func (l *CityLayout) place(c *City, placed []*City, rng *rand.Rand, w, h int) {
+	half := c.size / 2
+
+	for try := 0; try < 100; try++ {
+		c.x = half + rng.Float64()*math.Max(0, float64(w)-c.size)
+		c.y = half + rng.Float64()*math.Max(0, float64(h)-c.size)
+
+		free := true
+		for _, p := range placed {
+			if distance(c, p) < (c.size+p.size)/2 {
+				free = false
+				break
+			}
+		}
+		if free {
+			return
+		}
+	}
+}
+
+func (l *CityLayout) toString() string {
+	return fmt.Sprintf("cities: %d, seed: %d, exponent: %.2f, size: [%.1f-%.1f], suburbs: %d, corridors: %t",
+		l.cities, l.seed, l.exponent, l.minSize, l.maxSize, l.suburbs, l.corridors)
+}
+
+func distance(a, b *City) float64 {
+	return math.Hypot(a.x-b.x, a.y-b.y)
+}
+
+// saveDegreeMap writes the cells' degrees as a gray scale PNG.
+func saveDegreeMap(path string, g *Grid) error {
+	img := image.NewGray(image.Rect(0, 0, g.w, g.h))
+	for col := 0; col < g.w; col += 1 {
+		for row := 0; row < g.h; row += 1 {
+			// Degrees are clamped to 4..8 as for the neighbors
+			d := len(neighbors(g.at(col, row).degree))
+			img.SetGray(col, row, color.Gray{Y: degreeMapColors[d-4]})
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return png.Encode(f, img)
+}
+
+// loadDegreeMap reads a degree map image scaled to w x h. Each
+// pixel maps to the degree with the nearest gray level.
+func loadDegreeMap(path string, w, h int) (*IntGrid, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+
+	b := img.Bounds()
+	degrees := NewIntGrid(w, h)
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			x := b.Min.X + col*b.Dx()/w
+			y := b.Min.Y + row*b.Dy()/h
+			gray := color.GrayModel.Convert(img.At(x, y)).(color.Gray)
+
+			nearest := 0
+			for i, g := range degreeMapColors {
+				if absInt(int(g)-int(gray.Y)) < absInt(int(degreeMapColors[nearest])-int(gray.Y)) {
+					nearest = i
+				}
+			}
+			if nearest > 0 {
+				degrees.set(col, row, 4+nearest)
+			}
+		}
+	}
+
+	return degrees, nil
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
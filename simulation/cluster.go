@@ -0,0 +1,162 @@
+package simulation
+
+import (
+	"fmt"
+	"math"
+)
+
+// floodFill visits the cluster of cells connected to col,row through
+// the neighbors of the given degree for which member returns true.
+// visit is called once per cell of the cluster, before its neighbors
+// are examined, so it can mark the cell to exclude it from member.
+// Returns the size of the cluster.
+func floodFill(w, h, degree, col, row int, member func(col, row int) bool, visit func(col, row int)) int {
+	if !member(col, row) {
+		return 0
+	}
+	return linkedFill(w, h, degree, col, row, func(c, r, nc, nr int) bool { return member(nc, nr) }, visit)
+}
+
+// linkedFill is floodFill for clusters whose cells are joined by
+// links, such as open bonds. linked returns true if the cell c,r
+// reaches its neighbor nc,nr and the neighbor hasn't been visited.
+func linkedFill(w, h, degree, col, row int, linked func(c, r, nc, nr int) bool, visit func(col, row int)) int {
+	size := 0
+	visit(col, row)
+	stack := [][2]int{{col, row}}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		size++
+
+		for _, n := range neighbors(degree) {
+			nc := c[0] + n[0]
+			nr := c[1] + n[1]
+			if nc < 0 || nc >= w || nr < 0 || nr >= h || !linked(c[0], c[1], nc, nr) {
+				continue
+			}
+			visit(nc, nr)
+			stack = append(stack, [2]int{nc, nr})
+		}
+	}
+
+	return size
+}
+
+// ClusterGeometry describes the clusters of a set of cells and the
+// shape of the largest one.
+type ClusterGeometry struct {
+	members  int
+	clusters int
+	largest  int
+	// Radius of gyration of the largest cluster
+	gyration float64
+	// The largest cluster touches opposite edges
+	spansX, spansY bool
+
+	sizes        []int
+	largestLabel int
+}
+
+// measureClusters labels the clusters of cells for which member
+// returns true and measures their geometry.
+func measureClusters(w, h, degree int, member func(col, row int) bool) ClusterGeometry {
+	g, _ := measureLinkedClusters(w, h, degree, member, func(c, r, nc, nr int) bool { return member(nc, nr) })
+	return g
+}
+
+// measureLinkedClusters labels the clusters of member cells joined by
+// links and measures their geometry. Labels start at 1, 0 = not a
+// member.
+func measureLinkedClusters(w, h, degree int, member func(col, row int) bool, linked func(c, r, nc, nr int) bool) (ClusterGeometry, *IntGrid) {
+	labels := NewIntGrid(w, h)
+
+	g := ClusterGeometry{}
+	largestLabel := 0
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			if labels.get(col, row) != 0 || !member(col, row) {
+				continue
+			}
+			g.clusters++
+			label := g.clusters
+			size := linkedFill(w, h, degree, col, row,
+				func(c, r, nc, nr int) bool { return labels.get(nc, nr) == 0 && linked(c, r, nc, nr) },
+				func(c, r int) { labels.set(c, r, label) })
+			g.members += size
+			g.sizes = append(g.sizes, size)
+			if size > g.largest {
+				g.largest = size
+				largestLabel = label
+			}
+		}
+	}
+
+	if largestLabel == 0 {
+		return g, labels
+	}
+
+	minX, maxX, minY, maxY := w, -1, h, -1
+	sx, sy, sxx := 0.0, 0.0, 0.0
+	for col := 0; col < w; col += 1 {
+		for row := 0; row < h; row += 1 {
+			if labels.get(col, row) != largestLabel {
+				continue
+			}
+			x, y := float64(col), float64(row)
+			sx += x
+			sy += y
+			sxx += x*x + y*y
+			minX = minInt(minX, col)
+			maxX = maxInt(maxX, col)
+			minY = minInt(minY, row)
+			maxY = maxInt(maxY, row)
+		}
+	}
+
+	n := float64(g.largest)
+	g.gyration = math.Sqrt(math.Max(0, sxx/n-(sx/n)*(sx/n)-(sy/n)*(sy/n)))
+	g.spansX = minX == 0 && maxX == w-1
+	g.spansY = minY == 0 && maxY == h-1
+	g.largestLabel = largestLabel
+
+	return g, labels
+}
+
+// meanSize is the mean size of the cluster a member cell belongs to,
+// sum(s^2) / sum(s), leaving out a spanning largest cluster.
+func (g ClusterGeometry) meanSize() float64 {
+	sum, sum2 := 0.0, 0.0
+	skipped := false
+	for _, s := range g.sizes {
+		if !skipped && s == g.largest && (g.spansX || g.spansY) {
+			skipped = true
+			continue
+		}
+		sum += float64(s)
+		sum2 += float64(s) * float64(s)
+	}
+	if sum == 0 {
+		return 0
+	}
+	return sum2 / sum
+}
+
+func (g ClusterGeometry) toString(cells int) string {
+	return fmt.Sprintf("density: %.4f, clusters: %d, largest: %d (%.4f), gyration radius: %.2f, spans x: %t, y: %t",
+		float64(g.members)/float64(cells), g.clusters, g.largest, float64(g.largest)/float64(cells), g.gyration, g.spansX, g.spansY)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
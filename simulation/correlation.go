@@ -0,0 +1,318 @@
+package simulation
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+// ProbeRegion is a rectangular region of cells whose activity
+// (fraction of infected cells) is recorded each step. A probe added
+// during a run starts at a later step than the others, so series are
+// compared over the steps they share.
+type ProbeRegion struct {
+	col, row      int
+	width, height int
+
+	// Step of the first sample
+	start    int
+	activity []float64
+}
+
+func NewProbeRegion(col, row, width, height int) *ProbeRegion {
+	o := new(ProbeRegion)
+	o.col = col
+	o.row = row
+	o.width = width
+	o.height = height
+	return o
+}
+
+// record appends the region's current activity.
+func (p *ProbeRegion) record(active func(col, row int) bool) {
+	count := 0
+	for col := p.col; col < p.col+p.width; col += 1 {
+		for row := p.row; row < p.row+p.height; row += 1 {
+			if active(col, row) {
+				count++
+			}
+		}
+	}
+	p.activity = append(p.activity, float64(count)/float64(p.width*p.height))
+}
+
+// restart clears the samples. The next one is of step start.
+func (p *ProbeRegion) restart(start int) {
+	p.start = start
+	p.activity = []float64{}
+}
+
+// end returns the step after the last sample.
+func (p *ProbeRegion) end() int {
+	return p.start + len(p.activity)
+}
+
+// truncate drops the samples after step.
+func (p *ProbeRegion) truncate(step int) {
+	n := step - p.start + 1
+	if n < 0 {
+		n = 0
+	}
+	if n < len(p.activity) {
+		p.activity = p.activity[:n]
+	}
+}
+
+// arrival returns the first step the region's activity reached
+// threshold, or -1 if it never did.
+func (p *ProbeRegion) arrival(threshold float64) int {
+	for t, a := range p.activity {
+		if a >= threshold {
+			return p.start + t
+		}
+	}
+	return -1
+}
+
+func (p *ProbeRegion) toString() string {
+	return fmt.Sprintf("[%d,%d] %dx%d, samples: %d from step %d", p.col, p.row, p.width, p.height, len(p.activity), p.start)
+}
+
+// overlap returns the activity of a and b over the steps both have
+// samples for.
+func overlap(a, b *ProbeRegion) ([]float64, []float64) {
+	start, end := a.start, a.end()
+	if b.start > start {
+		start = b.start
+	}
+	if b.end() < end {
+		end = b.end()
+	}
+	if end <= start {
+		return nil, nil
+	}
+	return a.activity[start-a.start : end-a.start], b.activity[start-b.start : end-b.start]
+}
+
+// crossCorrelation returns the Pearson correlation between a(t) and
+// b(t+lag) for lag = -maxLag..maxLag. A peak at a positive lag means
+// activity in b follows activity in a.
+func crossCorrelation(a, b []float64, maxLag int) []float64 {
+	corr := make([]float64, 2*maxLag+1)
+	for lag := -maxLag; lag <= maxLag; lag++ {
+		x, y := lagged(a, b, lag)
+		corr[lag+maxLag] = pearson(x, y)
+	}
+	return corr
+}
+
+// lagged returns the overlapping parts of a(t) and b(t+lag).
+func lagged(a, b []float64, lag int) ([]float64, []float64) {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	if lag >= 0 {
+		if lag >= n {
+			return nil, nil
+		}
+		return a[:n-lag], b[lag:n]
+	}
+	if -lag >= n {
+		return nil, nil
+	}
+	return a[-lag:n], b[:n+lag]
+}
+
+func pearson(x, y []float64) float64 {
+	n := float64(len(x))
+	if n < 2 {
+		return 0
+	}
+
+	mx, my := 0.0, 0.0
+	for i := range x {
+		mx += x[i]
+		my += y[i]
+	}
+	mx /= n
+	my /= n
+
+	sxy, sxx, syy := 0.0, 0.0, 0.0
+	for i := range x {
+		dx := x[i] - mx
+		dy := y[i] - my
+		sxy += dx * dy
+		sxx += dx * dx
+		syy += dy * dy
+	}
+
+	if sxx == 0 || syy == 0 {
+		return 0
+	}
+
+	return sxy / math.Sqrt(sxx*syy)
+}
+
+// mutualInformation estimates the mutual information (in bits)
+// between a(t) and b(t+lag) using equal width bins.
+func mutualInformation(a, b []float64, lag, bins int) float64 {
+	x, y := lagged(a, b, lag)
+	if len(x) == 0 {
+		return 0
+	}
+
+	bx := binIndices(x, bins)
+	by := binIndices(y, bins)
+
+	joint := make([]float64, bins*bins)
+	px := make([]float64, bins)
+	py := make([]float64, bins)
+	n := float64(len(x))
+	for i := range bx {
+		joint[bx[i]*bins+by[i]] += 1 / n
+		px[bx[i]] += 1 / n
+		py[by[i]] += 1 / n
+	}
+
+	mi := 0.0
+	for i := 0; i < bins; i++ {
+		for j := 0; j < bins; j++ {
+			p := joint[i*bins+j]
+			if p > 0 {
+				mi += p * math.Log2(p/(px[i]*py[j]))
+			}
+		}
+	}
+
+	return mi
+}
+
+func binIndices(values []float64, bins int) []int {
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+	}
+
+	idx := make([]int, len(values))
+	if max == min {
+		return idx
+	}
+
+	for i, v := range values {
+		b := int((v - min) / (max - min) * float64(bins))
+		if b >= bins {
+			b = bins - 1
+		}
+		idx[i] = b
+	}
+	return idx
+}
+
+// peakLag returns the lag with the largest correlation.
+func peakLag(corr []float64, maxLag int) (int, float64) {
+	best := 0
+	for i, c := range corr {
+		if c > corr[best] {
+			best = i
+		}
+	}
+	return best - maxLag, corr[best]
+}
+
+// oscillationPeriod estimates the period of recurrent waves as the
+// lag of the highest autocorrelation peak after the autocorrelation
+// first turns negative. Returns -1 if the series doesn't oscillate.
+func oscillationPeriod(series []float64, maxLag int) (int, float64) {
+	auto := crossCorrelation(series, series, maxLag)[maxLag:]
+
+	start := -1
+	for lag, c := range auto {
+		if c < 0 {
+			start = lag
+			break
+		}
+	}
+	if start < 0 {
+		return -1, 0
+	}
+
+	best := -1
+	for lag := start + 1; lag < len(auto)-1; lag++ {
+		if auto[lag] > 0 && auto[lag] >= auto[lag-1] && auto[lag] >= auto[lag+1] {
+			if best < 0 || auto[lag] > auto[best] {
+				best = lag
+			}
+		}
+	}
+	if best < 0 {
+		return -1, 0
+	}
+
+	return best, auto[best]
+}
+
+// writeSeriesCSV writes one column per probe's activity, a row per
+// step. Steps before a probe's first sample are left empty.
+func writeSeriesCSV(path string, probes []*ProbeRegion) error {
+	names := []string{}
+	columns := [][]float64{}
+	for i, p := range probes {
+		names = append(names, fmt.Sprintf("probe%d", i))
+		column := make([]float64, p.start, p.end())
+		for t := range column {
+			column[t] = math.NaN()
+		}
+		columns = append(columns, append(column, p.activity...))
+	}
+
+	return writeColumnsCSV(path, "step", names, columns)
+}
+
+// writeCorrelationCSV writes one column per probe pair's correlation.
+func writeCorrelationCSV(path string, names []string, corrs [][]float64, maxLag int) error {
+	lags := make([]float64, 2*maxLag+1)
+	for i := range lags {
+		lags[i] = float64(i - maxLag)
+	}
+
+	return writeColumnsCSV(path, "lag", names, corrs, lags...)
+}
+
+// writeColumnsCSV writes named columns of values. Rows are indexed by
+// their row number unless index values are given. NaN values and
+// columns shorter than others are left empty.
+func writeColumnsCSV(path, indexName string, names []string, columns [][]float64, index ...float64) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n := len(index)
+	for _, c := range columns {
+		if len(c) > n {
+			n = len(c)
+		}
+	}
+
+	fmt.Fprintln(f, indexName+","+strings.Join(names, ","))
+	for t := 0; t < n; t++ {
+		line := []string{fmt.Sprint(t)}
+		if t < len(index) {
+			line[0] = fmt.Sprintf("%g", index[t])
+		}
+		for _, c := range columns {
+			if t < len(c) && !math.IsNaN(c[t]) {
+				line = append(line, fmt.Sprintf("%g", c[t]))
+			} else {
+				line = append(line, "")
+			}
+		}
+		fmt.Fprintln(f, strings.Join(line, ","))
+	}
+
+	return nil
+}
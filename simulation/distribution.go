@@ -0,0 +1,87 @@
+package simulation
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// Distribution draws durations, in steps, from a fixed, exponential,
+// gamma or uniform distribution with the given mean.
+type Distribution struct {
+	kind string
+	mean float64
+	// Gamma shape, or the half width of a uniform distribution
+	shape float64
+}
+
+func NewDistribution(kind string, mean, shape float64) (*Distribution, error) {
+	switch kind {
+	case "fixed", "exp":
+	case "gamma":
+		if shape <= 0 {
+			return nil, fmt.Errorf("gamma shape must be > 0")
+		}
+	case "uniform":
+		if shape < 0 || shape > mean {
+			return nil, fmt.Errorf("uniform half width must be 0 to mean")
+		}
+	default:
+		return nil, fmt.Errorf("unknown distribution: %s", kind)
+	}
+
+	if mean < 0 {
+		return nil, fmt.Errorf("mean must be >= 0")
+	}
+
+	return &Distribution{kind: kind, mean: mean, shape: shape}, nil
+}
+
+// sample draws a duration rounded to whole steps from rng.
+func (d *Distribution) sample(rng *rand.Rand) int {
+	v := d.mean
+
+	switch d.kind {
+	case "exp":
+		v = rng.ExpFloat64() * d.mean
+	case "gamma":
+		v = gamma(rng, d.shape) * d.mean / d.shape
+	case "uniform":
+		v = d.mean + (2*rng.Float64()-1)*d.shape
+	}
+
+	return int(math.Round(v))
+}
+
+func (d *Distribution) toString() string {
+	switch d.kind {
+	case "gamma":
+		return fmt.Sprintf("gamma, mean: %g, shape: %g", d.mean, d.shape)
+	case "uniform":
+		return fmt.Sprintf("uniform, mean: %g, half width: %g", d.mean, d.shape)
+	}
+	return fmt.Sprintf("%s, mean: %g", d.kind, d.mean)
+}
+
+// gamma draws from a unit scale gamma distribution using
+// Marsaglia and Tsang's method.
+func gamma(rng *rand.Rand, shape float64) float64 {
+	if shape < 1 {
+		return gamma(rng, shape+1) * math.Pow(rng.Float64(), 1/shape)
+	}
+
+	d := shape - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rng.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := rng.Float64()
+		if math.Log(u) < 0.5*x*x+d-d*v+d*math.Log(v) {
+			return d * v
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package simulation
+
+// ECell is a cell whose infection carries an evolving trait.
+type ECell struct {
+	infected     bool
+	nextInfected bool
+
+	// Transmissibility of the infection. Only meaningful while infected.
+	trait     float64
+	nextTrait float64
+
+	// Infections offered to the cell this step. One is kept at random.
+	offers int
+}
+
+// EGrid is a grid of ECells.
+type EGrid struct {
+	Dims
+	cells []ECell
+}
+
+func NewEGrid(w, h int) *EGrid {
+	return &EGrid{Dims: Dims{w: w, h: h}, cells: make([]ECell, w*h)}
+}
+
+func (g *EGrid) at(col, row int) *ECell {
+	return &g.cells[g.index(col, row)]
+}
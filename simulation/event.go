@@ -0,0 +1,51 @@
+package simulation
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseInts converts event arguments into integers.
+func parseInts(args []string) ([]int, error) {
+	values := make([]int, len(args))
+	for i, a := range args {
+		v, err := strconv.Atoi(a)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// parseFloats converts event arguments into floats.
+func parseFloats(args []string) ([]float64, error) {
+	values := make([]float64, len(args))
+	for i, a := range args {
+		v, err := strconv.ParseFloat(a, 64)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// setChance sets *p to value, which must be a chance from 0 to 1.
+func setChance(p *float64, name string, value float64) error {
+	if value < 0 || value > 1 {
+		return fmt.Errorf("%s must be 0 to 1", name)
+	}
+	*p = value
+	return nil
+}
+
+// unhandled is what SendEvent returns for an event the model has no
+// command for. Mouse events are optional and ignored.
+func unhandled(event string) error {
+	if strings.HasPrefix(event, "mouse ") {
+		return nil
+	}
+	return fmt.Errorf("unknown command: %s", event)
+}
@@ -0,0 +1,25 @@
+package simulation
+
+// FCell is a forest cell.
+type FCell struct {
+	// 0 = empty, 1 = tree, 2 = burning
+	state     int
+	nextState int
+
+	// Fire burning the cell. Used to measure each fire's size.
+	fire int
+}
+
+// FGrid is a grid of FCells.
+type FGrid struct {
+	Dims
+	cells []FCell
+}
+
+func NewFGrid(w, h int) *FGrid {
+	return &FGrid{Dims: Dims{w: w, h: h}, cells: make([]FCell, w*h)}
+}
+
+func (g *FGrid) at(col, row int) *FCell {
+	return &g.cells[g.index(col, row)]
+}
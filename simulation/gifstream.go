@@ -0,0 +1,275 @@
+package simulation
+
+import (
+	"bufio"
+	"compress/lzw"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+)
+
+// GIF recordings are encoded on a goroutine of their own so the
+// stepping loop only copies each frame. At most gifQueue frames wait to
+// be encoded; past that, writing a frame waits for the encoder. Frames
+// are written to the file as they're encoded, so memory doesn't grow
+// with the length of the run.
+//
+// The palette is the model's state colors, if it has an
+// api.IPalette, and then the other colors of the first frame, up to
+// 256. Pixels of those colors are written exactly, others get the
+// nearest color in the palette. Nothing is dithered.
+
+const gifQueue = 8
+
+type gifStream struct {
+	bounds image.Rectangle
+	delay  int
+
+	// Frames to encode, and the buffers returned once they have been
+	frames chan *image.RGBA
+	free   chan *image.RGBA
+	// Buffers made so far, at most gifQueue+1
+	buffers int
+
+	// Closed by the encoder when it fails, after setting err
+	failed chan struct{}
+	// Closed by the encoder when it returns
+	done chan struct{}
+	err  error
+
+	// Owned by the encoder
+	f       *os.File
+	w       *bufio.Writer
+	palette color.Palette
+	index   map[color.RGBA]uint8
+	pixels  *image.Paletted
+}
+
+func newGifWriter(rec recordSettings) (frameWriter, error) {
+	f, err := os.Create(filepath.Join(rec.dir, "run.gif"))
+	if err != nil {
+		return nil, err
+	}
+
+	g := &gifStream{
+		bounds:  rec.bounds,
+		delay:   rec.delay,
+		frames:  make(chan *image.RGBA, gifQueue),
+		free:    make(chan *image.RGBA, gifQueue+1),
+		failed:  make(chan struct{}),
+		done:    make(chan struct{}),
+		f:       f,
+		w:       bufio.NewWriter(f),
+		palette: rec.palette,
+	}
+	go g.encode()
+	return g, nil
+}
+
+// write queues a copy of img to be encoded. It returns the encoder's
+// error if it has failed.
+func (g *gifStream) write(img *image.RGBA, step int) error {
+	if img.Bounds() != g.bounds {
+		return fmt.Errorf("frame size changed from %v to %v", g.bounds, img.Bounds())
+	}
+
+	var buf *image.RGBA
+	select {
+	case buf = <-g.free:
+	case <-g.failed:
+		return g.err
+	default:
+		if g.buffers <= gifQueue {
+			buf = image.NewRGBA(g.bounds)
+			g.buffers++
+		} else {
+			// The queue is full, wait for the encoder
+			select {
+			case buf = <-g.free:
+			case <-g.failed:
+				return g.err
+			}
+		}
+	}
+
+	copy(buf.Pix, img.Pix)
+	g.frames <- buf
+	return nil
+}
+
+// close waits for the queued frames to be encoded and finishes the
+// file.
+func (g *gifStream) close() error {
+	close(g.frames)
+	<-g.done
+	return g.err
+}
+
+// encode encodes the queued frames until the queue is closed.
+func (g *gifStream) encode() {
+	defer close(g.done)
+
+	var err error
+	first := true
+	for img := range g.frames {
+		if err == nil {
+			if first {
+				err = g.header(img)
+				first = false
+			}
+			if err == nil {
+				err = g.frame(img)
+			}
+			if err != nil {
+				g.err = err
+				close(g.failed)
+			}
+		}
+		// After an error the frames are only drained
+		g.free <- img
+	}
+
+	if err == nil && !first {
+		g.w.WriteByte(0x3b)
+		err = g.w.Flush()
+	}
+	if cerr := g.f.Close(); err == nil {
+		err = cerr
+	}
+	if g.err == nil {
+		g.err = err
+	}
+}
+
+// header builds the palette from the first frame and writes the GIF
+// header, the global color table and the loop extension.
+func (g *gifStream) header(img *image.RGBA) error {
+	g.index = map[color.RGBA]uint8{}
+	palette := color.Palette{}
+	add := func(c color.RGBA) {
+		c.A = 255
+		if _, ok := g.index[c]; !ok && len(palette) < 256 {
+			g.index[c] = uint8(len(palette))
+			palette = append(palette, c)
+		}
+	}
+	for _, c := range g.palette {
+		add(color.RGBAModel.Convert(c).(color.RGBA))
+	}
+	for i := 0; i+3 < len(img.Pix) && len(palette) < 256; i += 4 {
+		add(color.RGBA{R: img.Pix[i], G: img.Pix[i+1], B: img.Pix[i+2]})
+	}
+
+	// The color table holds a power of 2 colors, at least 4
+	bits := 2
+	for 1<<bits < len(palette) {
+		bits++
+	}
+	for len(palette) < 1<<bits {
+		palette = append(palette, color.RGBA{A: 255})
+	}
+	g.palette = palette
+	g.pixels = image.NewPaletted(g.bounds, palette)
+
+	w, h := g.bounds.Dx(), g.bounds.Dy()
+	g.w.WriteString("GIF89a")
+	binary.Write(g.w, binary.LittleEndian, [2]uint16{uint16(w), uint16(h)})
+	// Global color table of 2^bits colors, 8 bit color resolution
+	g.w.Write([]byte{0x80 | 0x70 | byte(bits-1), 0, 0})
+	for _, c := range palette {
+		rgba := c.(color.RGBA)
+		g.w.Write([]byte{rgba.R, rgba.G, rgba.B})
+	}
+	// Loop forever
+	g.w.Write([]byte{0x21, 0xff, 11})
+	g.w.WriteString("NETSCAPE2.0")
+	_, err := g.w.Write([]byte{3, 1, 0, 0, 0})
+	return err
+}
+
+// frame maps img to the palette and writes it with its delay.
+func (g *gifStream) frame(img *image.RGBA) error {
+	var last color.RGBA
+	var lastIndex uint8
+	for i, j := 0, 0; i+3 < len(img.Pix); i, j = i+4, j+1 {
+		c := color.RGBA{R: img.Pix[i], G: img.Pix[i+1], B: img.Pix[i+2], A: 255}
+		if i == 0 || c != last {
+			index, ok := g.index[c]
+			if !ok {
+				index = uint8(g.palette.Index(c))
+				g.index[c] = index
+			}
+			last, lastIndex = c, index
+		}
+		g.pixels.Pix[j] = lastIndex
+	}
+
+	w, h := g.bounds.Dx(), g.bounds.Dy()
+	// Graphic control extension: the delay, no transparency
+	g.w.Write([]byte{0x21, 0xf9, 4, 0x04})
+	binary.Write(g.w, binary.LittleEndian, uint16(g.delay))
+	g.w.Write([]byte{0, 0})
+	// Image descriptor: the whole screen, global color table
+	g.w.WriteByte(0x2c)
+	binary.Write(g.w, binary.LittleEndian, [4]uint16{0, 0, uint16(w), uint16(h)})
+	g.w.WriteByte(0)
+
+	bits := 2
+	for 1<<bits < len(g.palette) {
+		bits++
+	}
+	g.w.WriteByte(byte(bits))
+	blocks := &gifBlocks{w: g.w}
+	lz := lzw.NewWriter(blocks, lzw.LSB, bits)
+	if _, err := lz.Write(g.pixels.Pix); err != nil {
+		return err
+	}
+	if err := lz.Close(); err != nil {
+		return err
+	}
+	return blocks.close()
+}
+
+// gifBlocks splits the image data into the sub-blocks of up to 255
+// bytes GIF stores it in.
+type gifBlocks struct {
+	w   *bufio.Writer
+	buf [256]byte
+	n   int
+}
+
+func (b *gifBlocks) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		k := copy(b.buf[1+b.n:], p)
+		b.n += k
+		p = p[k:]
+		if b.n == 255 {
+			if err := b.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (b *gifBlocks) flush() error {
+	if b.n == 0 {
+		return nil
+	}
+	b.buf[0] = byte(b.n)
+	_, err := b.w.Write(b.buf[:1+b.n])
+	b.n = 0
+	return err
+}
+
+// close writes the last sub-block and the terminator.
+func (b *gifBlocks) close() error {
+	if err := b.flush(); err != nil {
+		return err
+	}
+	return b.w.WriteByte(0)
+}
@@ -0,0 +1,146 @@
+package simulation
+
+import "fmt"
+
+// Dims is the size of a grid stored column by column in a single
+// slice. Cell col,row is at index col*h + row so the models' column
+// then row loops walk memory in order.
+type Dims struct {
+	w, h int
+}
+
+// in returns true if col,row is inside the grid.
+func (d Dims) in(col, row int) bool {
+	return col >= 0 && col < d.w && row >= 0 && row < d.h
+}
+
+// index returns the slice index of col,row. It panics outside the
+// grid rather than wrapping into the next column.
+func (d Dims) index(col, row int) int {
+	if col < 0 || col >= d.w || row < 0 || row >= d.h {
+		panic(fmt.Sprintf("cell [%d,%d] is outside the %dx%d grid", col, row, d.w, d.h))
+	}
+	return col*d.h + row
+}
+
+// Grid is a grid of Cells.
+type Grid struct {
+	Dims
+	cells []Cell
+}
+
+func NewGrid(w, h int) *Grid {
+	return &Grid{Dims: Dims{w: w, h: h}, cells: make([]Cell, w*h)}
+}
+
+func (g *Grid) at(col, row int) *Cell {
+	return &g.cells[g.index(col, row)]
+}
+
+// fraction returns the fraction of cells in state.
+func (g *Grid) fraction(state int) float64 {
+	n := 0
+	for i := range g.cells {
+		if g.cells[i].state == state {
+			n++
+		}
+	}
+	return float64(n) / float64(len(g.cells))
+}
+
+// clone returns a copy of the grid.
+func (g *Grid) clone() *Grid {
+	c := NewGrid(g.w, g.h)
+	copy(c.cells, g.cells)
+	return c
+}
+
+// IntGrid is a grid of ints such as degrees or cluster labels.
+type IntGrid struct {
+	Dims
+	values []int
+}
+
+func NewIntGrid(w, h int) *IntGrid {
+	return &IntGrid{Dims: Dims{w: w, h: h}, values: make([]int, w*h)}
+}
+
+func (g *IntGrid) get(col, row int) int {
+	return g.values[g.index(col, row)]
+}
+
+func (g *IntGrid) set(col, row, v int) {
+	g.values[g.index(col, row)] = v
+}
+
+func (g *IntGrid) fill(v int) {
+	for i := range g.values {
+		g.values[i] = v
+	}
+}
+
+// fraction returns the fraction of cells equal to v.
+func (g *IntGrid) fraction(v int) float64 {
+	n := 0
+	for _, x := range g.values {
+		if x == v {
+			n++
+		}
+	}
+	return float64(n) / float64(len(g.values))
+}
+
+// FloatGrid is a grid of float64s.
+type FloatGrid struct {
+	Dims
+	values []float64
+}
+
+func NewFloatGrid(w, h int) *FloatGrid {
+	return &FloatGrid{Dims: Dims{w: w, h: h}, values: make([]float64, w*h)}
+}
+
+func (g *FloatGrid) get(col, row int) float64 {
+	return g.values[g.index(col, row)]
+}
+
+func (g *FloatGrid) set(col, row int, v float64) {
+	g.values[g.index(col, row)] = v
+}
+
+// BitGrid is a bit packed grid of flags, 64 cells per word.
+type BitGrid struct {
+	Dims
+	bits []uint64
+}
+
+func NewBitGrid(w, h int) *BitGrid {
+	return &BitGrid{Dims: Dims{w: w, h: h}, bits: make([]uint64, (w*h+63)/64)}
+}
+
+// clone returns a copy of the grid.
+func (g *BitGrid) clone() *BitGrid {
+	c := NewBitGrid(g.w, g.h)
+	copy(c.bits, g.bits)
+	return c
+}
+
+func (g *BitGrid) get(col, row int) bool {
+	i := g.index(col, row)
+	return g.bits[i/64]&(1<<(i%64)) != 0
+}
+
+func (g *BitGrid) set(col, row int, v bool) {
+	i := g.index(col, row)
+	if v {
+		g.bits[i/64] |= 1 << (i % 64)
+	} else {
+		g.bits[i/64] &^= 1 << (i % 64)
+	}
+}
+
+func (g *BitGrid) clear() {
+	for i := range g.bits {
+		g.bits[i] = 0
+	}
+}
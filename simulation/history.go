@@ -0,0 +1,269 @@
+package simulation
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The history keeps the frames rendered during a run so they can be
+// viewed again and a new run branched from them. Each frame holds the
+// pixels and, for models that implement api.ISnapshot, the model's
+// state, both compressed. The newest frames are kept in memory. Older
+// ones are dropped or, if spilling is on, written to files in a
+// temporary directory until those reach their own limit.
+
+const (
+	historyMemory = 200
+	historyDisk   = 0
+)
+
+type frame struct {
+	step   int
+	pixels []byte
+	state  []byte
+	// File the frame was spilled to
+	path string
+}
+
+type history struct {
+	// Oldest first. frames[:spilled] are on disk.
+	frames  []*frame
+	spilled int
+
+	memory int
+	disk   int
+	dir    string
+
+	// Index of the frame shown, -1 = live
+	view int
+
+	zip *flate.Writer
+}
+
+func newHistory(memory, disk int) *history {
+	h := new(history)
+	h.memory = memory
+	h.disk = disk
+	h.view = -1
+	h.zip, _ = flate.NewWriter(nil, flate.BestSpeed)
+	return h
+}
+
+func (h *history) compress(data []byte) []byte {
+	var buf bytes.Buffer
+	h.zip.Reset(&buf)
+	h.zip.Write(data)
+	h.zip.Close()
+	return buf.Bytes()
+}
+
+func decompress(data []byte) ([]byte, error) {
+	if data == nil {
+		return nil, nil
+	}
+	return ioutil.ReadAll(flate.NewReader(bytes.NewReader(data)))
+}
+
+// add appends a frame. Nothing is kept if the memory limit is 0.
+func (h *history) add(step int, pixels, state []byte) error {
+	if h.memory == 0 {
+		return nil
+	}
+
+	f := &frame{step: step, pixels: h.compress(pixels)}
+	if state != nil {
+		f.state = h.compress(state)
+	}
+	h.frames = append(h.frames, f)
+	return h.trim()
+}
+
+// trim keeps the newest frames in memory, spills older ones and drops
+// the frames beyond both limits.
+func (h *history) trim() error {
+	for len(h.frames) > h.memory+h.disk {
+		h.drop()
+	}
+
+	// Frames come back from disk if there's room, e.g. after a branch
+	for h.spilled > 0 && len(h.frames)-h.spilled < h.memory {
+		if err := h.unspill(h.frames[h.spilled-1]); err != nil {
+			return err
+		}
+		h.spilled--
+	}
+
+	for len(h.frames)-h.spilled > h.memory {
+		if err := h.spill(h.frames[h.spilled]); err != nil {
+			// Keep running without spilling
+			h.disk = 0
+			for len(h.frames) > h.memory {
+				h.drop()
+			}
+			return err
+		}
+		h.spilled++
+	}
+	return nil
+}
+
+// drop removes the oldest frame.
+func (h *history) drop() {
+	if f := h.frames[0]; f.path != "" {
+		os.Remove(f.path)
+		h.spilled--
+	}
+	h.frames[0] = nil
+	h.frames = h.frames[1:]
+	if h.view > 0 {
+		h.view--
+	}
+}
+
+// spill writes a frame to a file and frees its memory.
+func (h *history) spill(f *frame) error {
+	if h.dir == "" {
+		dir, err := ioutil.TempDir("", "netron-history")
+		if err != nil {
+			return err
+		}
+		h.dir = dir
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(len(f.pixels)))
+	buf.Write(f.pixels)
+	buf.Write(f.state)
+
+	path := filepath.Join(h.dir, fmt.Sprintf("frame%d", f.step))
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	f.path = path
+	f.pixels = nil
+	f.state = nil
+	return nil
+}
+
+// read returns the compressed pixels and state of a frame, reading
+// them back if it was spilled.
+func (f *frame) read() ([]byte, []byte, error) {
+	if f.path == "" {
+		return f.pixels, f.state, nil
+	}
+
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) < 4 {
+		return nil, nil, fmt.Errorf("%s is truncated", f.path)
+	}
+	n := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+	if int(n) > len(data) {
+		return nil, nil, fmt.Errorf("%s is truncated", f.path)
+	}
+	if int(n) == len(data) {
+		return data, nil, nil
+	}
+	return data[:n], data[n:], nil
+}
+
+// unspill reads a spilled frame back into memory.
+func (h *history) unspill(f *frame) error {
+	pixels, state, err := f.read()
+	if err != nil {
+		return err
+	}
+	os.Remove(f.path)
+	f.path = ""
+	f.pixels = pixels
+	f.state = state
+	return nil
+}
+
+// load returns the pixels and the model state of frame i. The state
+// is nil if the model has none.
+func (h *history) load(i int) ([]byte, []byte, error) {
+	pixels, state, err := h.frames[i].read()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p, err := decompress(pixels)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := decompress(state)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p, s, nil
+}
+
+// truncate removes the frames after frame i.
+func (h *history) truncate(i int) error {
+	for _, f := range h.frames[i+1:] {
+		if f.path != "" {
+			os.Remove(f.path)
+		}
+	}
+	h.frames = h.frames[:i+1]
+	if h.spilled > len(h.frames) {
+		h.spilled = len(h.frames)
+	}
+	if h.view >= len(h.frames) {
+		h.view = -1
+	}
+	return h.trim()
+}
+
+// resize changes the limits, trimming the frames beyond them.
+func (h *history) resize(memory, disk int) error {
+	h.memory = memory
+	h.disk = disk
+	if memory == 0 {
+		h.clear()
+		return nil
+	}
+	return h.trim()
+}
+
+func (h *history) clear() {
+	for _, f := range h.frames {
+		if f.path != "" {
+			os.Remove(f.path)
+		}
+	}
+	h.frames = nil
+	h.spilled = 0
+	h.view = -1
+}
+
+// close clears the history and removes the spill directory.
+func (h *history) close() {
+	h.clear()
+	if h.dir != "" {
+		os.RemoveAll(h.dir)
+		h.dir = ""
+	}
+}
+
+// viewed returns the index of the frame shown.
+func (h *history) viewed() int {
+	return h.viewedAt(h.view)
+}
+
+// viewedAt returns the index of view, where -1 is the newest frame.
+func (h *history) viewedAt(view int) int {
+	if view < 0 {
+		return len(h.frames) - 1
+	}
+	return view
+}
@@ -0,0 +1,233 @@
+package simulation
+
+import (
+	"Netron1-Go/api"
+	"Netron1-Go/raster"
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testFrame returns distinct pixels and state for step.
+func testFrame(step int) ([]byte, []byte) {
+	return bytes.Repeat([]byte{byte(step)}, 1000), []byte(fmt.Sprintf("state %d", step))
+}
+
+func checkFrames(t *testing.T, h *history, steps []int) {
+	t.Helper()
+	if len(h.frames) != len(steps) {
+		t.Fatalf("%d frames, want %d", len(h.frames), len(steps))
+	}
+	for i, step := range steps {
+		pixels, state, err := h.load(i)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		wantPixels, wantState := testFrame(step)
+		if h.frames[i].step != step || !bytes.Equal(pixels, wantPixels) || !bytes.Equal(state, wantState) {
+			t.Errorf("frame %d is step %d, want %d", i, h.frames[i].step, step)
+		}
+	}
+}
+
+func TestHistoryLimit(t *testing.T) {
+	h := newHistory(3, 0)
+	defer h.close()
+	for step := 0; step < 10; step++ {
+		pixels, state := testFrame(step)
+		h.add(step, pixels, state)
+	}
+	checkFrames(t, h, []int{7, 8, 9})
+
+	h.truncate(1)
+	checkFrames(t, h, []int{7, 8})
+
+}
+
+func TestHistorySpill(t *testing.T) {
+	h := newHistory(2, 3)
+	for step := 0; step < 10; step++ {
+		pixels, state := testFrame(step)
+		if err := h.add(step, pixels, state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkFrames(t, h, []int{5, 6, 7, 8, 9})
+	if h.spilled != 3 {
+		t.Errorf("%d frames spilled, want 3", h.spilled)
+	}
+
+	// Branching from a spilled frame drops the frames after it
+	h.truncate(1)
+	checkFrames(t, h, []int{5, 6})
+	// The newest frames are back in memory
+	files, _ := os.ReadDir(h.dir)
+	if h.spilled != 0 || len(files) != 0 {
+		t.Errorf("%d frames spilled, %d files, want none", h.spilled, len(files))
+	}
+
+	h.resize(1, 0)
+	checkFrames(t, h, []int{6})
+
+	dir := h.dir
+	h.close()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("spill directory left behind: %v", err)
+	}
+}
+
+// TestSnapshotRestore restores each model to an earlier step and
+// checks its state matches the snapshot taken there.
+func TestSnapshotRestore(t *testing.T) {
+	for _, c := range models {
+		m := newModel(c.new, 300, 300)
+		m.Reset()
+		for i := 0; i < 5; i++ {
+			m.Step()
+		}
+		s, ok := m.(api.ISnapshot)
+		if !ok {
+			t.Errorf("%s: no snapshots", m.Name())
+			continue
+		}
+		snapshot := s.Snapshot()
+		for i := 0; i < 5; i++ {
+			m.Step()
+		}
+
+		if err := s.Restore(snapshot); err != nil {
+			t.Fatalf("%s: %v", m.Name(), err)
+		}
+		if !bytes.Equal(s.Snapshot(), snapshot) {
+			t.Errorf("%s: restored state differs from the snapshot", m.Name())
+		}
+		if err := s.Restore(snapshot[:len(snapshot)/2]); err == nil {
+			t.Errorf("%s: restored a truncated snapshot", m.Name())
+		}
+	}
+}
+
+// TestSnapshotBranch checks each model restored to a step and stepped
+// with the same random numbers repeats the same run.
+func TestSnapshotBranch(t *testing.T) {
+	for _, c := range models {
+		rb := raster.NewRasterBuffer(300, 300)
+		m := c.new()
+		m.Configure(rb)
+		m.Reset()
+		m.Step()
+		s := m.(api.ISnapshot)
+		snapshot := s.Snapshot()
+
+		run := func() uint64 {
+			// Restoring takes random numbers for the tiled models
+			rand.Seed(7)
+			if err := s.Restore(snapshot); err != nil {
+				t.Fatalf("%s: %v", m.Name(), err)
+			}
+			for i := 0; i < 5; i++ {
+				m.Step()
+			}
+			return pixelHash(rb)
+		}
+		if first, second := run(), run(); second != first {
+			t.Errorf("%s: branch hash %#x, original %#x", m.Name(), second, first)
+		}
+	}
+}
+
+// TestSnapshotLayout checks a SISDynCorr restore moves a city back
+// along with the degrees it stamped.
+func TestSnapshotLayout(t *testing.T) {
+	m := newModel(NewSISDynCorrModel, 300, 300)
+	m.Reset()
+	m.Step()
+	s := m.(api.ISnapshot)
+	snapshot := s.Snapshot()
+
+	for _, event := range []string{"city select 0", "city move 40 0"} {
+		if err := m.SendEvent(event); err != nil {
+			t.Fatalf("%s: %v", event, err)
+		}
+	}
+	m.Step()
+	if bytes.Equal(s.Snapshot(), snapshot) {
+		t.Fatal("moving the city didn't change the snapshot")
+	}
+
+	if err := s.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(s.Snapshot(), snapshot) {
+		t.Error("restored layout differs from the snapshot")
+	}
+}
+
+// TestSnapshotEvolveTraits checks traits out of 0..1, which would
+// index past the histogram, aren't restored.
+func TestSnapshotEvolveTraits(t *testing.T) {
+	m := newModel(NewSISEvolveModel, 30, 30).(*SISEvolveModel)
+	m.Reset()
+	for _, trait := range []float64{-0.1, 1.5, math.NaN()} {
+		m.cells.cells[0].trait = trait
+		snapshot := m.Snapshot()
+		m.cells.cells[0].trait = 0
+		if err := m.Restore(snapshot); err == nil {
+			t.Errorf("restored trait %g", trait)
+		}
+	}
+}
+
+func TestScrubAndBranch(t *testing.T) {
+	sim, in, out, done := startSimulation(context.Background(), NewSISModel())
+
+	runUntil(t, in, out, api.Until{Steps: 20})
+	for _, c := range []struct {
+		cmd   api.Command
+		reply string
+		state State
+	}{
+		{api.NewFrameCommand(-5), "step 15 (frame 16 of 21)", Completed},
+		{api.NewFrameCommand(-100), "step 0 (frame 1 of 21)", Completed},
+		{api.NewFrameCommand(3), "step 3 (frame 4 of 21)", Completed},
+		{api.NewCommand(api.LiveCommand), "live step 20", Completed},
+		{api.NewFrameCommand(-10), "step 10 (frame 11 of 21)", Completed},
+		{api.NewCommand(api.BranchCommand), "branched at step 10", Paused},
+		{api.NewFrameCommand(-1), "step 9 (frame 10 of 11)", Paused},
+	} {
+		ev := send(t, in, out, c.cmd)
+		if ev.Kind != api.DoneEvent || ev.Message != c.reply {
+			t.Errorf("%v: got %v, want %q", c.cmd.Kind, ev, c.reply)
+		}
+		if got := sim.State(); got != c.state {
+			t.Errorf("%v: state %v, want %v", c.cmd.Kind, got, c.state)
+		}
+	}
+
+	// Resuming goes live and the branch runs to the run's condition
+	send(t, in, out, api.NewCommand(api.ResumeCommand))
+	if ev := <-out; ev.Kind != api.CompletedEvent {
+		t.Errorf("got %v, want completed", ev)
+	}
+	if status := send(t, in, out, api.NewCommand(api.StatusCommand)).Message; !strings.HasPrefix(status, "completed, step 20 ") {
+		t.Errorf("status %q", status)
+	}
+
+	send(t, in, out, api.NewCommand(api.ExitCommand))
+	exited(t, done)
+}
+
+func TestBranchWithoutSnapshot(t *testing.T) {
+	_, in, out, done := startSimulation(context.Background(), &finiteModel{IModel: NewSISModel(), n: 20})
+
+	if ev := send(t, in, out, api.NewCommand(api.BranchCommand)); ev.Kind != api.ErrorEvent {
+		t.Errorf("branch: got %v", ev)
+	}
+	send(t, in, out, api.NewCommand(api.ExitCommand))
+	exited(t, done)
+}
@@ -0,0 +1,66 @@
+package simulation
+
+import (
+	"Netron1-Go/api"
+	"context"
+	"strings"
+)
+
+// Some model commands, e.g. parameter sweeps, run the model many
+// times. They start jobs, which run in the background on a copy of the
+// model so the simulation keeps stepping and answering commands. A
+// job's report is sent as an api.ReportEvent when it's done. Jobs are
+// cancelled when the simulation exits.
+//
+// Copies draw on the shared random source, so a run stepped while a
+// job works takes different random numbers than it would otherwise.
+
+// job is work started by a model command. It returns its report, or
+// ctx's error if it was cancelled first.
+type job func(ctx context.Context) (string, error)
+
+// jobs holds the jobs a model's commands started until the simulation
+// runs them. Models embed it.
+type jobs struct {
+	started []job
+}
+
+func (j *jobs) start(jb job) {
+	j.started = append(j.started, jb)
+}
+
+// takeJobs returns the jobs started since the last call.
+func (j *jobs) takeJobs() []job {
+	started := j.started
+	j.started = nil
+	return started
+}
+
+// jobModel is implemented by models that embed jobs.
+type jobModel interface {
+	takeJobs() []job
+}
+
+// runJobs starts the jobs the model's last command started.
+func (s *Simulation) runJobs() {
+	m, ok := s.model.(jobModel)
+	if !ok {
+		return
+	}
+	ctx := s.jobCtx
+	for _, jb := range m.takeJobs() {
+		s.jobsRunning.Add(1)
+		go func(jb job) {
+			defer s.jobsRunning.Done()
+			report, err := jb(ctx)
+			ev := api.Event{Kind: api.ReportEvent, Message: strings.TrimRight(report, "\n")}
+			if err != nil {
+				ev = api.Event{Kind: api.ErrorEvent, Message: err.Error()}
+			}
+			select {
+			case s.reports <- ev:
+			case <-ctx.Done():
+			}
+		}(jb)
+	}
+}
@@ -8,6 +8,7 @@ import (
 // KCell is a knowledge cell
 type KCell struct {
 	knowledgeCenter bool
+	center          *KnowledgeCenter
 	col, row        int
 	color           color.RGBA
 
@@ -28,17 +29,20 @@ type KCell struct {
 	nextState int
 }
 
-func NewKCellCenter(col, row int, color color.RGBA, knowledge int) KCell {
-	k := KCell{
-		col:             col,
-		row:             row,
-		color:           color,
-		knowledge:       knowledge,
-		knowledgeCenter: true,
-		state:           1}
-	return k
-}
-
 func (k *KCell) toString() string {
 	return fmt.Sprintf("[%d,%d] (%d->%d) k: |%d|, KCenter: %t", k.col, k.row, k.state, k.nextState, k.knowledge, k.knowledgeCenter)
 }
+
+// KGrid is a grid of KCells.
+type KGrid struct {
+	Dims
+	cells []KCell
+}
+
+func NewKGrid(w, h int) *KGrid {
+	return &KGrid{Dims: Dims{w: w, h: h}, cells: make([]KCell, w*h)}
+}
+
+func (g *KGrid) at(col, row int) *KCell {
+	return &g.cells[g.index(col, row)]
+}
@@ -0,0 +1,67 @@
+package simulation
+
+import (
+	"fmt"
+	"image/color"
+)
+
+// KnowledgeCenter is a cell that teaches its knowledge level to
+// neighboring cells. Centers can be added or removed while the
+// simulation is running and may relocate or close on a schedule.
+type KnowledgeCenter struct {
+	col, row  int
+	color     color.RGBA
+	knowledge int
+
+	// Number of cells the center can teach per step. 0 = unlimited
+	capacity int
+	taught   int
+
+	// Steps between relocations. 0 = never relocates
+	relocatePeriod int
+	// Max distance (in cells) a center jumps when relocating
+	relocateRadius int
+	// Steps until the center closes. 0 = never closes
+	lifetime int
+
+	age int
+
+	// Number of cells that acquired this center's level from it.
+	reach int
+}
+
+func NewKnowledgeCenter(col, row int, color color.RGBA, knowledge, capacity int) *KnowledgeCenter {
+	k := &KnowledgeCenter{
+		col:       col,
+		row:       row,
+		color:     color,
+		knowledge: knowledge,
+		capacity:  capacity,
+	}
+	return k
+}
+
+// canTeach returns true if the center still has capacity this step.
+func (k *KnowledgeCenter) canTeach() bool {
+	return k.capacity == 0 || k.taught < k.capacity
+}
+
+// teach records that a cell acquired the center's level.
+func (k *KnowledgeCenter) teach() {
+	k.taught++
+	k.reach++
+}
+
+// closed returns true once the center has outlived its lifetime.
+func (k *KnowledgeCenter) closed() bool {
+	return k.lifetime > 0 && k.age >= k.lifetime
+}
+
+// relocating returns true if the center moves on this step.
+func (k *KnowledgeCenter) relocating() bool {
+	return k.relocatePeriod > 0 && k.age > 0 && k.age%k.relocatePeriod == 0
+}
+
+func (k *KnowledgeCenter) toString() string {
+	return fmt.Sprintf("[%d,%d] k: |%d|, capacity: %d, age: %d, reach: %d", k.col, k.row, k.knowledge, k.capacity, k.age, k.reach)
+}
@@ -0,0 +1,227 @@
+package simulation
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// Layer is one SIS process, such as infection or awareness, running on
+// a population shared with other layers. Cells are active (1) or
+// inactive (2).
+type Layer struct {
+	name  string
+	cells *Grid
+
+	// The chance an active cell activates an inactive neighbor
+	rate float64
+	// The chance an active cell becomes inactive
+	dropRate float64
+	// degree goes from 4 to 8
+	degree int
+
+	// Sparse mode only visits the active cells and the neighbors they
+	// reach instead of scanning the grid. The touched cells are the
+	// inactive cells activated this step.
+	sparse   bool
+	frontier frontier
+}
+
+func NewLayer(name string, w, h int, rate, dropRate float64, degree int) *Layer {
+	o := new(Layer)
+	o.name = name
+	o.rate = rate
+	o.dropRate = dropRate
+	o.degree = degree
+	o.cells = NewGrid(w, h)
+	o.clear()
+	return o
+}
+
+func (l *Layer) active(col, row int) bool {
+	return l.cells.at(col, row).state == 1
+}
+
+// clone returns a copy of the layer.
+func (l *Layer) clone() *Layer {
+	c := *l
+	c.cells = l.cells.clone()
+	c.frontier = l.frontier.clone()
+	return &c
+}
+
+// setSparse switches between scanning the grid and visiting only the
+// active cells.
+func (l *Layer) setSparse(sparse bool) {
+	l.sparse = sparse
+	if !sparse {
+		l.frontier.reset()
+		return
+	}
+	l.frontier.rebuild(len(l.cells.cells), func(i int) bool {
+		return l.cells.cells[i].state == 1
+	})
+}
+
+// clear makes every cell inactive.
+func (l *Layer) clear() {
+	if l.sparse {
+		// Only the frontier is active
+		for _, i := range l.frontier.active {
+			l.cells.cells[i].state = 2
+			l.cells.cells[i].nextState = 2
+		}
+	} else {
+		for i := range l.cells.cells {
+			l.cells.cells[i].state = 2
+			l.cells.cells[i].nextState = 2
+		}
+	}
+	l.frontier.reset()
+}
+
+// seed activates count random cells.
+func (l *Layer) seed(count int) {
+	for i := 0; i < count; i++ {
+		col, row := rand.Intn(l.cells.w), rand.Intn(l.cells.h)
+		c := l.cells.at(col, row)
+		if c.state == 1 {
+			continue
+		}
+		c.state = 1
+		c.nextState = 1
+		if l.sparse {
+			l.frontier.active = append(l.frontier.active, l.cells.index(col, row))
+		}
+	}
+}
+
+// forActive calls fn for every active cell.
+func (l *Layer) forActive(fn func(col, row int)) {
+	if l.sparse {
+		for _, i := range l.frontier.active {
+			fn(i/l.cells.h, i%l.cells.h)
+		}
+		return
+	}
+	for col := 0; col < l.cells.w; col += 1 {
+		for row := 0; row < l.cells.h; row += 1 {
+			if l.cells.at(col, row).state == 1 {
+				fn(col, row)
+			}
+		}
+	}
+}
+
+// drop starts a step: active cells become inactive with the drop rate.
+func (l *Layer) drop() {
+	if l.sparse {
+		// Inactive cells outside the frontier already have their next
+		// state set
+		for _, i := range l.frontier.active {
+			c := &l.cells.cells[i]
+			c.nextState = 1
+			if rand.Float64() < l.dropRate {
+				c.nextState = 2
+			}
+		}
+		return
+	}
+
+	for i := range l.cells.cells {
+		c := &l.cells.cells[i]
+		c.nextState = c.state
+		if c.state == 1 && rand.Float64() < l.dropRate {
+			c.nextState = 2
+		}
+	}
+}
+
+// spread lets active cells activate inactive neighbors. The chance is
+// the layer's rate scaled by susceptibility of the neighbor.
+func (l *Layer) spread(susceptibility func(col, row int) float64) {
+	l.forActive(func(col, row int) {
+		for _, n := range neighbors(l.degree) {
+			nc := col + n[0]
+			nr := row + n[1]
+			if !l.cells.in(nc, nr) {
+				continue
+			}
+			t := l.cells.at(nc, nr)
+			if t.state == 2 && t.nextState == 2 && rand.Float64() < l.rate*susceptibility(nc, nr) {
+				l.activate(nc, nr)
+			}
+		}
+	})
+}
+
+// activate makes col,row active next step.
+func (l *Layer) activate(col, row int) {
+	c := l.cells.at(col, row)
+	if l.sparse && c.state == 2 && c.nextState == 2 {
+		l.frontier.touched = append(l.frontier.touched, l.cells.index(col, row))
+	}
+	c.nextState = 1
+}
+
+// update copies the next states and returns the active fraction.
+func (l *Layer) update() float64 {
+	if l.sparse {
+		return l.updateSparse()
+	}
+
+	active := 0
+	for i := range l.cells.cells {
+		c := &l.cells.cells[i]
+		c.state = c.nextState
+		if c.state == 1 {
+			active++
+		}
+	}
+	return float64(active) / float64(len(l.cells.cells))
+}
+
+// updateSparse copies the next states of the frontier and the touched
+// cells, and rebuilds the frontier from them.
+func (l *Layer) updateSparse() float64 {
+	l.frontier.update(func(i int) (bool, bool) {
+		c := &l.cells.cells[i]
+		was := c.state
+		c.state = c.nextState
+		return c.state == 1, c.state != was
+	})
+	return float64(len(l.frontier.active)) / float64(len(l.cells.cells))
+}
+
+// set sets rate, drop or degree by name.
+func (l *Layer) set(name string, value float64) error {
+	switch name {
+	case "rate":
+		return setChance(&l.rate, l.name+" rate", value)
+	case "drop":
+		return setChance(&l.dropRate, l.name+" drop", value)
+	case "degree":
+		if value < 4 || value > 8 {
+			return fmt.Errorf("%s degree must be 4 to 8", l.name)
+		}
+		l.degree = int(value)
+		return nil
+	}
+	return fmt.Errorf("unknown %s parameter: %s", l.name, name)
+}
+
+// event handles "<rate|drop|degree> <value>" for the layer.
+func (l *Layer) event(fields []string) error {
+	args, err := parseFloats(fields[1:])
+	if err != nil || len(args) != 1 {
+		return fmt.Errorf("usage: %s <rate|drop|degree> <value>", l.name)
+	}
+	if err := l.set(fields[0], args[0]); err != nil {
+		return err
+	}
+	fmt.Println(l.toString())
+	return nil
+}
+
+func (l *Layer) toString() string {
+	return fmt.Sprintf("%s rate: %.3f, drop: %.3f, degree: %d", l.name, l.rate, l.dropRate, l.degree)
+}
@@ -0,0 +1,206 @@
+package simulation
+
+import (
+	"Netron1-Go/api"
+	"Netron1-Go/raster"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// newAwareModel returns a configured SISAwareModel on a w x h grid with
+// a sub-critical infection rate.
+func newAwareModel(w, h int, sparse bool) *SISAwareModel {
+	m := NewSISAwareModel().(*SISAwareModel)
+	m.Configure(raster.NewRasterBuffer(w, h))
+	m.infection.rate = 0.1
+	m.setSparse(sparse)
+	return m
+}
+
+// outbreaks returns the durations and sizes of n outbreaks.
+func outbreaks(m *SISAwareModel, n int) ([]float64, []float64) {
+	durations := make([]float64, n)
+	sizes := make([]float64, n)
+	for i := range durations {
+		d, size := m.outbreak(1000)
+		durations[i] = float64(d)
+		sizes[i] = size
+	}
+	return durations, sizes
+}
+
+func meanSE(xs []float64) (float64, float64) {
+	mean, sum2 := 0.0, 0.0
+	for _, x := range xs {
+		mean += x
+	}
+	mean /= float64(len(xs))
+	for _, x := range xs {
+		sum2 += (x - mean) * (x - mean)
+	}
+	return mean, math.Sqrt(sum2/float64(len(xs)-1)) / math.Sqrt(float64(len(xs)))
+}
+
+// ksStatistic is the largest distance between the empirical
+// distribution functions of a and b.
+func ksStatistic(a, b []float64) float64 {
+	a = append([]float64{}, a...)
+	b = append([]float64{}, b...)
+	sort.Float64s(a)
+	sort.Float64s(b)
+
+	d := 0.0
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		x := math.Min(a[i], b[j])
+		for i < len(a) && a[i] == x {
+			i++
+		}
+		for j < len(b) && b[j] == x {
+			j++
+		}
+		d = math.Max(d, math.Abs(float64(i)/float64(len(a))-float64(j)/float64(len(b))))
+	}
+	return d
+}
+
+// sirOutbreaks returns the durations and sizes of n SIR outbreaks
+// below the threshold.
+func sirOutbreaks(n int, seed int64, sparse bool) ([]float64, []float64) {
+	m := newModel(NewSIRModel, 40, 40).(*SIRModel)
+	m.SetParameter("transmission", 0.4)
+	m.stepper.setSparse(sparse)
+	rand.Seed(seed)
+
+	durations := make([]float64, n)
+	sizes := make([]float64, n)
+	for i := range durations {
+		m.Reset()
+		for m.Step() {
+			durations[i]++
+		}
+		sizes[i] = 1 - m.cells.fraction(2)
+	}
+	return durations, sizes
+}
+
+// sameDistribution checks samples of full and sparse stepping have the
+// same mean and distribution.
+func sameDistribution(t *testing.T, name string, full, sparse []float64) {
+	t.Helper()
+	fm, fse := meanSE(full)
+	sm, sse := meanSE(sparse)
+	if math.Abs(fm-sm) > 4*math.Hypot(fse, sse) {
+		t.Errorf("%s: mean %.3f (full) vs %.3f (sparse)", name, fm, sm)
+	}
+
+	// Two sample Kolmogorov-Smirnov test at alpha = 0.001
+	d := ksStatistic(full, sparse)
+	if limit := 1.949 * math.Sqrt(2.0/float64(len(full))); d > limit {
+		t.Errorf("%s: KS distance %.4f above %.4f", name, d, limit)
+	}
+}
+
+func TestSparseOutbreakDistribution(t *testing.T) {
+	const n = 3000
+
+	rand.Seed(1)
+	fullDurations, fullSizes := outbreaks(newAwareModel(60, 60, false), n)
+	rand.Seed(2)
+	sparseDurations, sparseSizes := outbreaks(newAwareModel(60, 60, true), n)
+	sameDistribution(t, "duration", fullDurations, sparseDurations)
+	sameDistribution(t, "size", fullSizes, sparseSizes)
+
+	// The grid models step sparsely too. Full SIR steps scan the grid
+	// so they take fewer outbreaks.
+	fullDurations, fullSizes = sirOutbreaks(n/3, 1, false)
+	sparseDurations, sparseSizes = sirOutbreaks(n/3, 2, true)
+	sameDistribution(t, "SIR duration", fullDurations, sparseDurations)
+	sameDistribution(t, "SIR size", fullSizes, sparseSizes)
+}
+
+func TestSparseFrontierMatchesGrid(t *testing.T) {
+	rand.Seed(3)
+	m := newAwareModel(60, 40, true)
+	m.infection.rate = 0.3
+	m.Reset()
+
+	for step := 0; step < 50; step++ {
+		m.Step()
+		for _, l := range []*Layer{m.infection, m.awareness} {
+			inFrontier := make([]bool, len(l.cells.cells))
+			for _, i := range l.frontier.active {
+				if inFrontier[i] {
+					t.Fatalf("step %d: %s cell %d is in the frontier twice", step, l.name, i)
+				}
+				inFrontier[i] = true
+			}
+			for i, c := range l.cells.cells {
+				if (c.state == 1) != inFrontier[i] {
+					t.Fatalf("step %d: %s cell %d has state %d, in frontier: %v", step, l.name, i, c.state, inFrontier[i])
+				}
+				if c.state != c.nextState {
+					t.Fatalf("step %d: %s cell %d has a stale next state", step, l.name, i)
+				}
+			}
+		}
+	}
+}
+
+// TestSparseStepperMatchesGrid checks the frontier of the sparse grid
+// models holds exactly their active cells after every step.
+func TestSparseStepperMatchesGrid(t *testing.T) {
+	for _, new := range []func() api.IModel{NewSISModel, NewSIRModel, NewSISaModel, NewSISimmuModel} {
+		m := newModel(new, 60, 40)
+		if err := m.SendEvent("sparse on"); err != nil {
+			t.Fatal(err)
+		}
+		m.Reset()
+
+		var g *gridStepper
+		switch m := m.(type) {
+		case *SISModel:
+			g = m.stepper
+		case *SIRModel:
+			g = m.stepper
+		case *SISaModel:
+			g = m.stepper
+		case *SISimmuModel:
+			g = m.stepper
+		}
+
+		for step := 0; step < 50; step++ {
+			m.Step()
+			inFrontier := make([]bool, len(g.cells.cells))
+			for _, i := range g.frontier.active {
+				if inFrontier[i] {
+					t.Fatalf("%s step %d: cell %d is in the frontier twice", m.Name(), step, i)
+				}
+				inFrontier[i] = true
+			}
+			for i := range g.cells.cells {
+				c := &g.cells.cells[i]
+				if g.active(c) != inFrontier[i] {
+					t.Fatalf("%s step %d: cell %d has state %d, in frontier: %v", m.Name(), step, i, c.state, inFrontier[i])
+				}
+				if g.visited.get(i/g.cells.h, i%g.cells.h) {
+					t.Fatalf("%s step %d: cell %d is still marked visited", m.Name(), step, i)
+				}
+			}
+		}
+	}
+}
+
+func benchmarkOutbreak(b *testing.B, sparse bool) {
+	rand.Seed(4)
+	m := newAwareModel(1000, 1000, sparse)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.outbreak(1000)
+	}
+}
+
+func BenchmarkOutbreakFull(b *testing.B)   { benchmarkOutbreak(b, false) }
+func BenchmarkOutbreakSparse(b *testing.B) { benchmarkOutbreak(b, true) }
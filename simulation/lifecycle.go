@@ -0,0 +1,65 @@
+package simulation
+
+import (
+	"Netron1-Go/api"
+	"fmt"
+)
+
+// State is where the simulation is in its lifecycle. Only the
+// simulation goroutine changes it.
+//
+//	Idle      configured or reset, waiting for run or step
+//	Running   stepping the model
+//	Paused    running but not stepping
+//	Completed the model finished or the run met its condition
+//	Stopped   stopped by the user
+//	Exited    Start has returned
+type State int
+
+const (
+	Idle State = iota
+	Running
+	Paused
+	Completed
+	Stopped
+	Exited
+)
+
+var stateNames = []string{"idle", "running", "paused", "completed", "stopped", "exited"}
+
+func (s State) String() string {
+	if int(s) < len(stateNames) {
+		return stateNames[s]
+	}
+	return fmt.Sprintf("state(%d)", int(s))
+}
+
+// transitions gives, for the commands that change the state, the state
+// the command moves to from each state it's allowed in. A run
+// finishing on its own moves from Running to Completed.
+var transitions = map[api.CommandKind]map[State]State{
+	api.RunCommand:    {Idle: Running, Completed: Running, Stopped: Running},
+	api.PauseCommand:  {Running: Paused},
+	api.ResumeCommand: {Paused: Running},
+	api.StopCommand:   {Running: Stopped, Paused: Stopped, Completed: Stopped},
+	api.ResetCommand:  {Idle: Idle, Running: Idle, Paused: Idle, Completed: Idle, Stopped: Idle},
+	api.ExitCommand:   {Idle: Exited, Running: Exited, Paused: Exited, Completed: Exited, Stopped: Exited},
+	api.FrameCommand:  {Idle: Idle, Running: Paused, Paused: Paused, Completed: Completed, Stopped: Stopped},
+	api.BranchCommand: {Idle: Paused, Running: Paused, Paused: Paused, Completed: Paused, Stopped: Paused},
+}
+
+// next returns the state kind moves to. Commands that don't change the
+// state leave it as it is. ok is false if kind isn't allowed in s.
+func (s State) next(kind api.CommandKind) (next State, ok bool) {
+	t, changes := transitions[kind]
+	if !changes {
+		return s, s != Exited
+	}
+	next, ok = t[s]
+	return next, ok
+}
+
+// live reports whether a run is under way, paused or not.
+func (s State) live() bool {
+	return s == Running || s == Paused
+}
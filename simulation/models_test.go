@@ -0,0 +1,621 @@
+package simulation
+
+import (
+	"Netron1-Go/api"
+	"Netron1-Go/raster"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// models lists every model with the hash of its raster after
+// goldenSteps steps from Configure and Reset. A model change that
+// alters the dynamics or the random number stream changes its hash.
+var models = []struct {
+	new    func() api.IModel
+	golden uint64
+}{
+	{NewSISModel, 0xea7a6535b4a719fe},
+	{NewSIRModel, 0x61875671cdc1d3a6},
+	{NewSISaModel, 0xec4eedd70a76aa39},
+	{NewSISimmuModel, 0xaffa41c8daf4909d},
+	{NewSISCityModel, 0xf3b20c74af6ae916},
+	{NewSISDynCorrModel, 0xc6de84ba4a69bb07},
+	{NewSISKnowledgeModel, 0x87b61d5902df59a4},
+	{NewSISStrainModel, 0xa57fac14f64c6e35},
+	{NewSISEvolveModel, 0xa24337e6794a5805},
+	{NewThresholdModel, 0x39c5e360d31c3ab5},
+	{NewForestFireModel, 0x049497f473ecb29a},
+	{NewBootstrapModel, 0x928c3f694dcc174e},
+	{NewInvasionModel, 0xa7a5a7259b8532ae},
+	{NewPercolationModel, 0x70727eccef45f23f},
+	{NewOpinionModel, 0xb624b0f688f8dc2d},
+	{NewSISAwareModel, 0x522b09c160935440},
+}
+
+const goldenSteps = 10
+
+// newModel configures a model on a w x h raster.
+func newModel(new func() api.IModel, w, h int) api.IModel {
+	m := new()
+	m.Configure(raster.NewRasterBuffer(w, h))
+	return m
+}
+
+func pixelHash(r api.IRasterBuffer) uint64 {
+	f := fnv.New64a()
+	f.Write(r.Pixels().Pix)
+	return f.Sum64()
+}
+
+func TestModelsGolden(t *testing.T) {
+	for _, c := range models {
+		rb := raster.NewRasterBuffer(300, 300)
+		m := c.new()
+		m.Configure(rb)
+		m.Reset()
+		for i := 0; i < goldenSteps; i++ {
+			m.Step()
+		}
+
+		if got := pixelHash(rb); got != c.golden {
+			t.Errorf("%s: raster hash after %d steps = %#x, want %#x", m.Name(), goldenSteps, got, c.golden)
+		}
+	}
+}
+
+// TestModelsNonSquare steps every model on grids that aren't square.
+// Every cell beyond the square corner must be drawn, so no model
+// mixes up width and height, and the prevalence must stay a fraction.
+func TestModelsNonSquare(t *testing.T) {
+	for _, c := range models {
+		for _, size := range [][2]int{{400, 320}, {320, 400}} {
+			w, h := size[0], size[1]
+			rb := raster.NewRasterBuffer(w, h)
+			m := c.new()
+			m.Configure(rb)
+			m.Reset()
+			for i := 0; i < 5; i++ {
+				m.Step()
+			}
+
+			if p, ok := m.(api.IPrevalence); ok {
+				if v := p.Prevalence(); !(v >= 0 && v <= 1) {
+					t.Errorf("%s %dx%d: prevalence %g", m.Name(), w, h, v)
+				}
+			}
+
+			clear := rb.(*raster.RasterBuffer).ClearColor
+			missed := 0
+			for col := 0; col < w; col++ {
+				for row := 0; row < h; row++ {
+					if col < 320 && row < 320 {
+						continue
+					}
+					if p := rb.GetPixel(col, row); p.A == 0 || p == clear {
+						missed++
+					}
+				}
+			}
+			if missed > 0 {
+				t.Errorf("%s %dx%d: %d cells beyond 320x320 not drawn", m.Name(), w, h, missed)
+			}
+		}
+	}
+}
+
+// TestModelsParameters checks every model has settable parameters
+// and rejects unknown commands and parameters.
+func TestModelsParameters(t *testing.T) {
+	for _, m := range models {
+		model := newModel(m.new, 40, 30)
+		p, ok := model.(api.IParameters)
+		if !ok {
+			t.Errorf("%s: no parameters", model.Name())
+			continue
+		}
+		if err := p.SetParameter("nothing", 0.5); err == nil {
+			t.Errorf("%s: set an unknown parameter", model.Name())
+		}
+		if err := model.SendEvent("nothing 1"); err == nil {
+			t.Errorf("%s: accepted an unknown command", model.Name())
+		}
+	}
+}
+
+// TestModelsBadArguments checks commands with arguments out of range
+// are rejected instead of panicking later.
+func TestModelsBadArguments(t *testing.T) {
+	for _, c := range []struct {
+		new   func() api.IModel
+		event string
+	}{
+		{NewSISCityModel, "city generate 0 5"},
+		{NewSISCityModel, "city generate -1 5"},
+		{NewSISCityModel, "city generate 3 5 1.2 -2"},
+		{NewSISKnowledgeModel, "kc schedule 150 150 10 -1 0"},
+		{NewSISKnowledgeModel, "kc schedule 150 150 -10 1 0"},
+		{NewSISKnowledgeModel, "kc capacity -1"},
+		{NewSISKnowledgeModel, "kc add 10 10 1 -4"},
+		{NewSISKnowledgeModel, "kc add 151 150 1"},
+		{NewSISKnowledgeModel, "kc add 149 149 1"},
+		{NewSISaModel, "spont hub 10 10 5 -1"},
+	} {
+		model := newModel(c.new, 300, 300)
+		model.Reset()
+		if err := model.SendEvent(c.event); err == nil {
+			t.Errorf("%s: accepted %q", model.Name(), c.event)
+		}
+	}
+}
+
+// TestKnowledgeCenterAdjacent checks centers next to each other keep
+// their own 2x2 cells.
+func TestKnowledgeCenterAdjacent(t *testing.T) {
+	m := newModel(NewSISKnowledgeModel, 300, 300).(*SISKnowledgeModel)
+	m.Reset()
+	if err := m.SendEvent("kc add 152 150 2"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range [][4]int{
+		{150, 150, 150, 150},
+		{151, 151, 150, 150},
+		{152, 150, 152, 150},
+		{153, 151, 152, 150},
+	} {
+		k := m.findCenter(c[0], c[1])
+		if k == nil || k.col != c[2] || k.row != c[3] {
+			t.Errorf("center at %d,%d: %v, want %d,%d", c[0], c[1], k, c[2], c[3])
+		}
+	}
+}
+
+// TestModelsPrevalence checks the infection models report their
+// prevalence, so runs can stop on it.
+func TestModelsPrevalence(t *testing.T) {
+	for _, new := range []func() api.IModel{
+		NewSISModel, NewSIRModel, NewSISaModel, NewSISimmuModel,
+		NewSISCityModel, NewSISDynCorrModel, NewSISKnowledgeModel,
+		NewSISStrainModel, NewSISEvolveModel, NewThresholdModel,
+		NewSISAwareModel,
+	} {
+		model := newModel(new, 300, 300)
+		p, ok := model.(api.IPrevalence)
+		if !ok {
+			t.Errorf("%s: no prevalence", model.Name())
+			continue
+		}
+		model.Reset()
+		model.Step()
+		if v := p.Prevalence(); v < 0 || v > 1 {
+			t.Errorf("%s: prevalence %g", model.Name(), v)
+		}
+	}
+}
+
+// TestDegreeMapClamps checks degree maps save degrees out of 4..8
+// clamped to it.
+func TestDegreeMapClamps(t *testing.T) {
+	g := NewGrid(11, 1)
+	for col := range g.cells {
+		g.cells[col].degree = col
+	}
+	path := filepath.Join(t.TempDir(), "degrees.png")
+	if err := saveDegreeMap(path, g); err != nil {
+		t.Fatal(err)
+	}
+	degrees, err := loadDegreeMap(path, 11, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for col, d := range degrees.values {
+		want := len(neighbors(col))
+		if want == 4 {
+			// The darkest gray loads as the model's own degree
+			want = 0
+		}
+		if d != want {
+			t.Errorf("degree %d loaded as %d, want %d", col, d, want)
+		}
+	}
+}
+
+// TestThresholdFull checks a run without fresh cascades completes
+// once every cell is active instead of stepping on doing nothing.
+func TestThresholdFull(t *testing.T) {
+	m := newModel(NewThresholdModel, 30, 30).(*ThresholdModel)
+	if err := m.SendEvent("threshold fresh off"); err != nil {
+		t.Fatal(err)
+	}
+	m.Reset()
+	for i := range m.cells.cells {
+		m.cells.cells[i].state = 1
+	}
+	if m.Step() {
+		t.Error("stepped on with every cell active")
+	}
+}
+
+// TestSISImmuCases checks the case counts have a row for each S/I/R
+// row, starting with none at step 0.
+func TestSISImmuCases(t *testing.T) {
+	s := newModel(NewSISimmuModel, 300, 300).(*SISimmuModel)
+	s.Reset()
+	for i := 0; i < 3; i++ {
+		s.Step()
+	}
+	if len(s.cases.introduced) != len(s.infected) || len(s.cases.transmitted) != len(s.infected) {
+		t.Fatalf("%d case rows, %d S/I/R rows", len(s.cases.introduced), len(s.infected))
+	}
+	if s.cases.introduced[0] != 0 || s.cases.transmitted[0] != 0 {
+		t.Errorf("cases at step 0: %g, %g", s.cases.introduced[0], s.cases.transmitted[0])
+	}
+}
+
+// TestDynCorrBias checks a full flow bias blocks transmission against
+// the direction field and never boosts it along the field.
+func TestDynCorrBias(t *testing.T) {
+	s := newModel(NewSISDynCorrModel, 20, 20).(*SISDynCorrModel)
+	s.flowMode = directedFlow
+	s.flowBias = 1
+	f := s.flow.at(5, 5)
+	f.dirX, f.dirY = 1, 0
+	for _, c := range []struct {
+		n    [2]int
+		want float64
+	}{
+		{[2]int{1, 0}, 1},
+		{[2]int{1, 1}, 1},
+		{[2]int{0, 1}, 1},
+		{[2]int{-1, 0}, 0},
+		{[2]int{-1, 1}, 0},
+	} {
+		if b := s.transmissionBias(5, 5, c.n); b != c.want {
+			t.Errorf("bias along %v = %g, want %g", c.n, b, c.want)
+		}
+	}
+}
+
+// TestSIRFinalSize checks the SIR final size against bond percolation.
+// A cell is infectious for exactly one step, so the cells an outbreak
+// reaches are the bond percolation cluster of the seed with p equal
+// to the transmission rate.
+func TestSIRFinalSize(t *testing.T) {
+	if testing.Short() {
+		t.Skip("statistical test")
+	}
+	const runs = 200
+
+	for _, p := range []float64{0.4, 0.6} {
+		m := newModel(NewSIRModel, 100, 100).(*SIRModel)
+		m.transmissionRate = float32(p)
+		sir := make([]float64, runs)
+		for i := range sir {
+			m.Reset()
+			for m.Step() {
+			}
+			for _, c := range m.cells.cells {
+				if c.state == 3 {
+					sir[i]++
+				}
+			}
+		}
+
+		q := newModel(NewPercolationModel, 100, 100).(*PercolationModel)
+		q.bond = true
+		q.p = p
+		perc := make([]float64, runs)
+		for i := range perc {
+			q.occupy()
+			perc[i] = float64(q.geometry.sizes[q.labels.get(50, 50)-1])
+		}
+
+		sm, sse := meanSE(sir)
+		pm, pse := meanSE(perc)
+		if math.Abs(sm-pm) > 4*math.Hypot(sse, pse) {
+			t.Errorf("p %.2f: SIR final size %.1f +/- %.1f, percolation cluster %.1f +/- %.1f", p, sm, sse, pm, pse)
+		}
+	}
+}
+
+// TestPercolationThreshold checks the sweep's spanning crossover
+// lands near the known thresholds: 0.5927 for sites and 0.5 for
+// bonds on the square lattice.
+func TestPercolationThreshold(t *testing.T) {
+	if testing.Short() {
+		t.Skip("statistical test")
+	}
+
+	for _, c := range []struct {
+		mode     string
+		from, pc float64
+	}{
+		{"site", 0.5, 0.5927},
+		{"bond", 0.4, 0.5},
+	} {
+		rand.Seed(9)
+		m := newModel(NewPercolationModel, 100, 100).(*PercolationModel)
+		if err := m.SendEvent("perc mode " + c.mode); err != nil {
+			t.Fatal(err)
+		}
+		report, err := m.sweep(c.from, c.from+0.2, 0.01, 40)(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var pc float64
+		i := strings.Index(report, "pc estimate: ")
+		if i < 0 {
+			t.Fatalf("%s: no estimate in %q", c.mode, report)
+		}
+		fmt.Sscanf(report[i:], "pc estimate: %g", &pc)
+		if math.Abs(pc-c.pc) > 0.02 {
+			t.Errorf("%s: pc estimate %.4f, want %.4f", c.mode, pc, c.pc)
+		}
+	}
+}
+
+// TestInvasionPc checks the pc estimate of invasion percolation
+// against the site thresholds for 4 and 8 neighbors.
+func TestInvasionPc(t *testing.T) {
+	for _, c := range []struct {
+		degree int
+		pc     float64
+	}{
+		{4, 0.5927},
+		{8, 0.4073},
+	} {
+		m := newModel(NewInvasionModel, 300, 300).(*InvasionModel)
+		if err := m.SetParameter("degree", float64(c.degree)); err != nil {
+			t.Fatal(err)
+		}
+		m.Reset()
+		for m.Step() {
+		}
+		pc, ok := m.estimatePc()
+		if !ok || math.Abs(pc-c.pc) > 0.03 {
+			t.Errorf("degree %d: pc estimate %.4f (%v), want %.4f", c.degree, pc, ok, c.pc)
+		}
+	}
+}
+
+// TestPercolationEmpty checks an empty lattice has no largest
+// cluster to draw.
+func TestPercolationEmpty(t *testing.T) {
+	rb := raster.NewRasterBuffer(20, 20)
+	m := NewPercolationModel()
+	m.Configure(rb)
+	if err := m.SendEvent("perc p 0"); err != nil {
+		t.Fatal(err)
+	}
+	m.Reset()
+
+	pix := rb.Pixels()
+	want := m.(*PercolationModel).emptyColor
+	if got := pix.RGBAAt(10, 10); got != want {
+		t.Errorf("empty cell drawn %v, want %v", got, want)
+	}
+}
+
+// TestSIRInfectsOnce checks, with certain transmission, that the
+// infection is a ring moving out one cell per step: infected cells are
+// removed after one step and never infected again, and no neighbor is
+// missed.
+func TestSIRInfectsOnce(t *testing.T) {
+	const size = 21
+	m := newModel(NewSIRModel, size, size).(*SIRModel)
+	m.SetParameter("transmission", 1)
+	m.Reset()
+
+	c := size / 2
+	for step := 1; step <= c; step++ {
+		m.Step()
+		for col := 0; col < size; col++ {
+			for row := 0; row < size; row++ {
+				d := absInt(col-c) + absInt(row-c)
+				want := 2
+				if d < step {
+					want = 3
+				} else if d == step {
+					want = 1
+				}
+				if got := m.cells.at(col, row).state; got != want {
+					t.Fatalf("step %d: cell %d,%d is %d, want %d", step, col, row, got, want)
+				}
+			}
+		}
+	}
+}
+
+// TestSISModelSpread checks the SIS model's own spreading and
+// dropping: with certain infection and no drop the front moves out a
+// cell in each direction per step, and with certain drop and no
+// infection every infected cell is gone after a step.
+func TestSISModelSpread(t *testing.T) {
+	const size, steps = 100, 10
+	m := newModel(NewSISModel, size, size).(*SISModel)
+	m.SetParameter("accept", 1)
+	m.SetParameter("drop", 0)
+	m.Reset()
+	for i := 0; i < steps; i++ {
+		m.Step()
+	}
+
+	// Distance from the 5x5 seed in the middle
+	c := size / 2
+	for col := 0; col < size; col++ {
+		for row := 0; row < size; row++ {
+			d := maxInt(0, absInt(col-c)-2) + maxInt(0, absInt(row-c)-2)
+			infected := m.cells.at(col, row).state == 1
+			if d >= steps && infected != (d == steps) {
+				t.Fatalf("cell %d,%d at distance %d infected: %v", col, row, d, infected)
+			}
+		}
+	}
+
+	m.SetParameter("accept", 0)
+	m.SetParameter("drop", 1)
+	if m.Step() || m.Prevalence() != 0 {
+		t.Errorf("prevalence %g after dropping", m.Prevalence())
+	}
+}
+
+// TestSISThreshold brackets the epidemic threshold of the SIS model,
+// driven through its parameters. Infection wins over dropping, so a
+// cell can be reinfected in the step it drops. That puts the
+// threshold below the contact process's: about 0.25 at a drop of 0.9
+// on the square lattice, against 1.24*0.9/3 = 0.37. The undetermined
+// state doesn't move it, as undetermined cells are infected like
+// susceptible ones and picking up only recolors them. It does thin
+// the seed: seed cells turn undetermined after the first step unless
+// they are reinfected.
+func TestSISThreshold(t *testing.T) {
+	if testing.Short() {
+		t.Skip("statistical test")
+	}
+	const runs, steps, threshold = 50, 200, 0.25
+
+	m := newModel(NewSISModel, 60, 60).(*SISModel)
+	for name, v := range map[string]float64{"drop": 0.9, "pickup": 0.5} {
+		if err := m.SetParameter(name, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	survival := func(accept float64) float64 {
+		rand.Seed(5)
+		if err := m.SetParameter("accept", accept); err != nil {
+			t.Fatal(err)
+		}
+		survived := 0
+		for i := 0; i < runs; i++ {
+			m.Reset()
+			for step := 0; step < steps && m.Prevalence() > 0; step++ {
+				m.Step()
+			}
+			if m.Prevalence() > 0 {
+				survived++
+			}
+		}
+		return float64(survived) / runs
+	}
+
+	if s := survival(0.8 * threshold); s > 0.02 {
+		t.Errorf("accept %.3f below the threshold: survival %.2f", 0.8*threshold, s)
+	}
+	if s := survival(1.3 * threshold); s < 0.5 {
+		t.Errorf("accept %.3f above the threshold: survival %.2f", 1.3*threshold, s)
+	}
+}
+
+// TestSISAwareThreshold brackets the SIS epidemic threshold on the
+// infection layer of the awareness model with self awareness off,
+// which makes it a plain SIS contact process. TestSISThreshold
+// covers the SIS model itself. The pair approximation puts the
+// threshold at rate = drop/(degree-1); on the square lattice the
+// contact process threshold is about 1.24 times higher.
+func TestSISAwareThreshold(t *testing.T) {
+	if testing.Short() {
+		t.Skip("statistical test")
+	}
+	const runs, steps = 100, 300
+
+	m := newAwareModel(100, 100, true)
+	m.selfAware = 0
+	l := m.infection
+	threshold := 1.24 * l.dropRate / float64(len(neighbors(l.degree))-1)
+
+	survival := func(rate float64) float64 {
+		rand.Seed(5)
+		l.rate = rate
+		survived := 0
+		for i := 0; i < runs; i++ {
+			if d, _ := m.outbreak(steps); d == steps {
+				survived++
+			}
+		}
+		return float64(survived) / runs
+	}
+
+	if s := survival(0.8 * threshold); s > 0.02 {
+		t.Errorf("rate %.3f below the threshold: survival %.2f", 0.8*threshold, s)
+	}
+	if s := survival(1.3 * threshold); s < 0.3 {
+		t.Errorf("rate %.3f above the threshold: survival %.2f", 1.3*threshold, s)
+	}
+}
+
+// TestOpinionStates checks fewer opinions wait for the next reset
+// rather than leaving cells with opinions out of range.
+func TestOpinionStates(t *testing.T) {
+	m := newModel(NewOpinionModel, 100, 100).(*OpinionModel)
+	m.SendEvent("opinion states 4")
+	m.Reset()
+	m.Step()
+
+	m.SendEvent("opinion states 2")
+	m.Step()
+	if m.states != 4 {
+		t.Errorf("%d opinions before the reset, want 4", m.states)
+	}
+
+	m.Reset()
+	for _, c := range m.cells.cells {
+		if c.state >= 2 {
+			t.Fatalf("opinion %d after the reset to 2 opinions", c.state)
+		}
+	}
+}
+
+// TestProbeAddedMidRun adds a probe over the same cells as the first
+// one during a run and checks their series line up by step.
+func TestProbeAddedMidRun(t *testing.T) {
+	m := newModel(NewSISDynCorrModel, 300, 300).(*SISDynCorrModel)
+	m.Reset()
+	for i := 0; i < 5; i++ {
+		m.Step()
+	}
+	first := m.probes[0]
+	m.SendEvent(fmt.Sprintf("probe add %d %d %d %d", first.col, first.row, first.width, first.height))
+	for i := 0; i < 10; i++ {
+		m.Step()
+	}
+
+	added := m.probes[len(m.probes)-1]
+	if added.start != 5 || added.end() != first.end() {
+		t.Fatalf("added probe covers steps %d-%d, want 5-%d", added.start, added.end(), first.end())
+	}
+	a, b := overlap(first, added)
+	if len(a) != 11 {
+		t.Fatalf("%d steps in common, want 11", len(a))
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("step %d: activity %g and %g of the same cells", 5+i, a[i], b[i])
+		}
+	}
+}
+
+func BenchmarkModelStep(b *testing.B) {
+	for _, c := range models {
+		for _, size := range []int{300, 600, 1000} {
+			b.Run(fmt.Sprintf("%s/%d", c.new().Name(), size), func(b *testing.B) {
+				m := newModel(c.new, size, size)
+				m.Reset()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if !m.Step() {
+						b.StopTimer()
+						m.Reset()
+						b.StartTimer()
+					}
+				}
+			})
+		}
+	}
+}
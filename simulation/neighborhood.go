@@ -0,0 +1,37 @@
+package simulation
+
+// neighborOffsets lists [col, row] offsets in the order a cell gains
+// neighbors as its degree increases: the 4 von Neumann neighbors
+// (right, left, top, bottom) followed by the diagonals (top/right,
+// bottom/right, bottom/left, top/left) up to the 8 Moore neighbors.
+var neighborOffsets = [8][2]int{
+	{1, 0}, {-1, 0}, {0, -1}, {0, 1},
+	{1, -1}, {1, 1}, {-1, 1}, {-1, -1},
+}
+
+// neighbors returns the offsets for a cell of the given degree.
+// Degrees are clamped to 4..8.
+func neighbors(degree int) [][2]int {
+	if degree < 4 {
+		degree = 4
+	}
+	if degree > 8 {
+		degree = 8
+	}
+	return neighborOffsets[:degree]
+}
+
+// reachedBy calls fn for every cell whose neighborhood, given its own
+// degree, includes col,row. n is the offset from that cell to col,row.
+// This lets a cell pull infections from its neighbors instead of
+// infected cells pushing them, so a cell only writes its own state.
+func reachedBy(g *Grid, col, row int, fn func(c, r int, n [2]int)) {
+	for i, n := range neighborOffsets {
+		c := col - n[0]
+		r := row - n[1]
+		if !g.in(c, r) || i >= len(neighbors(g.at(c, r).degree)) {
+			continue
+		}
+		fn(c, r, n)
+	}
+}
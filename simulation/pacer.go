@@ -0,0 +1,75 @@
+package simulation
+
+import (
+	"fmt"
+	"time"
+)
+
+// pacer paces the steps of a run to a target rate and measures the
+// rate achieved.
+type pacer struct {
+	// Target steps per second. 0 runs as fast as possible.
+	target float64
+	// When the next step is due
+	next time.Time
+
+	// The rate is measured over windows of about a second
+	windowStart time.Time
+	windowSteps int
+	rate        float64
+}
+
+// start restarts pacing and measuring, e.g. when a run starts or
+// resumes.
+func (p *pacer) start(now time.Time) {
+	p.next = now
+	p.windowStart = now
+	p.windowSteps = 0
+	p.rate = 0
+}
+
+// wait returns how long until the next step is due.
+func (p *pacer) wait(now time.Time) time.Duration {
+	if p.target == 0 {
+		return 0
+	}
+	return p.next.Sub(now)
+}
+
+// stepped schedules the next step and updates the measured rate.
+func (p *pacer) stepped(now time.Time) {
+	if p.target > 0 {
+		period := time.Duration(float64(time.Second) / p.target)
+		p.next = p.next.Add(period)
+		// Catch up at most one step after falling behind
+		if p.next.Before(now.Add(-period)) {
+			p.next = now
+		}
+	}
+
+	p.windowSteps++
+	if d := now.Sub(p.windowStart); d >= time.Second {
+		p.rate = float64(p.windowSteps) / d.Seconds()
+		p.windowStart = now
+		p.windowSteps = 0
+	}
+}
+
+// measured returns the steps per second of the last full window, or of
+// the current one until a window has completed.
+func (p *pacer) measured(now time.Time) float64 {
+	if p.rate > 0 {
+		return p.rate
+	}
+	if d := now.Sub(p.windowStart); d > 0 {
+		return float64(p.windowSteps) / d.Seconds()
+	}
+	return 0
+}
+
+func (p *pacer) targetString() string {
+	if p.target == 0 {
+		return "max"
+	}
+	return fmt.Sprintf("%g", p.target)
+}
@@ -0,0 +1,127 @@
+package simulation
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+)
+
+const (
+	plotWidth  = 640
+	plotHeight = 360
+	plotMargin = 20
+)
+
+// plotColors are assigned to series in order.
+var plotColors = []color.RGBA{
+	{R: 0, G: 0, B: 255, A: 255},
+	{R: 255, G: 127, B: 0, A: 255},
+	{R: 0, G: 160, B: 80, A: 255},
+	{R: 255, G: 0, B: 255, A: 255},
+	{R: 0, G: 200, B: 200, A: 255},
+	{R: 200, G: 0, B: 0, A: 255},
+}
+
+// savePlot renders each series against xs as a line plot and saves
+// it as a PNG. The x and y zero axes are drawn in gray.
+func savePlot(path string, xs []float64, series [][]float64) error {
+	img := image.NewRGBA(image.Rect(0, 0, plotWidth, plotHeight))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+
+	minX, maxX := bounds(xs, 0, 0)
+	minY, maxY := 0.0, 0.0
+	for _, s := range series {
+		minY, maxY = bounds(s, minY, maxY)
+	}
+	if maxX == minX {
+		maxX = minX + 1
+	}
+	if maxY == minY {
+		maxY = minY + 1
+	}
+
+	toPx := func(x, y float64) (int, int) {
+		px := plotMargin + int((x-minX)/(maxX-minX)*float64(plotWidth-2*plotMargin))
+		py := plotHeight - plotMargin - int((y-minY)/(maxY-minY)*float64(plotHeight-2*plotMargin))
+		return px, py
+	}
+
+	gray := color.RGBA{R: 160, G: 160, B: 160, A: 255}
+	x0, y0 := toPx(minX, 0)
+	x1, _ := toPx(maxX, 0)
+	drawLine(img, x0, y0, x1, y0, gray)
+	if minX <= 0 && maxX >= 0 {
+		ax, ay0 := toPx(0, minY)
+		_, ay1 := toPx(0, maxY)
+		drawLine(img, ax, ay0, ax, ay1, gray)
+	}
+
+	for i, s := range series {
+		c := plotColors[i%len(plotColors)]
+		for j := 1; j < len(s) && j < len(xs); j++ {
+			ax, ay := toPx(xs[j-1], s[j-1])
+			bx, by := toPx(xs[j], s[j])
+			drawLine(img, ax, ay, bx, by, c)
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return png.Encode(f, img)
+}
+
+// bounds widens min/max to include every finite value.
+func bounds(values []float64, min, max float64) (float64, float64) {
+	for _, v := range values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+	}
+	return min, max
+}
+
+// drawLine is a Bresenham line.
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, c color.RGBA) {
+	dx := x1 - x0
+	if dx < 0 {
+		dx = -dx
+	}
+	dy := y1 - y0
+	if dy > 0 {
+		dy = -dy
+	}
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+
+	e := dx + dy
+	for {
+		img.SetRGBA(x0, y0, c)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y0 += sy
+		}
+	}
+}
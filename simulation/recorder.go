@@ -0,0 +1,328 @@
+package simulation
+
+import (
+	"Netron1-Go/api"
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The recorder writes the rendered frames of a run to files under
+// <data root>/recordings/<model>/<run id>. Each run gets its own run
+// id, the output being opened by the run's first frame and closed when
+// the run stops, completes, resets or branches. Errors stop the
+// recording rather than the simulation.
+//
+//	png  a numbered PNG file per frame
+//	gif  an animated GIF, see gifstream.go
+//	y4m  a YUV4MPEG2 stream, 4:4:4 and full range
+//	rgb  a raw RGB24 stream, the frame size in the file name
+
+// recordDelay is the default time a frame of a GIF or Y4M recording
+// is shown, in 100ths of a second.
+const recordDelay = 6
+
+var recordFormats = map[string]func(rec recordSettings) (frameWriter, error){
+	"png": newPngWriter,
+	"gif": newGifWriter,
+	"y4m": newY4mWriter,
+	"rgb": newRgbWriter,
+}
+
+// recordSettings are what the writers of a recording are given.
+type recordSettings struct {
+	dir    string
+	bounds image.Rectangle
+	// Frame delay in 100ths of a second
+	delay int
+	// The model's state colors, nil if it has none
+	palette color.Palette
+}
+
+// frameWriter writes the frames of a recording.
+type frameWriter interface {
+	write(img *image.RGBA, step int) error
+	close() error
+}
+
+type recorder struct {
+	// Empty when not recording
+	format string
+	// Record every every-th frame rendered
+	every int
+	// Frame delay in 100ths of a second
+	delay int
+	root  string
+
+	// Frames offered since the output opened
+	offered int
+	out     frameWriter
+	dir     string
+	frames  int
+	// Recordings started, part of the run id
+	runs int
+
+	err error
+}
+
+// start records in format, every every-th frame, each shown for delay
+// 100ths of a second. A delay of 0 keeps the delay set before. A
+// recording under way is finished first.
+func (r *recorder) start(format string, every, delay int) error {
+	if recordFormats[format] == nil {
+		return fmt.Errorf("unknown recording format: %s", format)
+	}
+	if every < 1 {
+		return fmt.Errorf("record every must be at least 1")
+	}
+	if delay < 0 || delay > 0xffff {
+		return fmt.Errorf("bad frame delay: %d", delay)
+	}
+	if r.root == "" {
+		return fmt.Errorf("no data root to record to")
+	}
+	r.finish()
+	r.format = format
+	r.every = every
+	if delay > 0 {
+		r.delay = delay
+	}
+	return nil
+}
+
+// stop finishes the recording and stops recording.
+func (r *recorder) stop() {
+	r.finish()
+	r.format = ""
+}
+
+func (r *recorder) recording() bool {
+	return r.format != ""
+}
+
+// add records img, the frame of step, opening the output if it's the
+// run's first frame.
+func (r *recorder) add(img *image.RGBA, step int, model api.IModel) {
+	if !r.recording() {
+		return
+	}
+	r.offered++
+	if (r.offered-1)%r.every != 0 {
+		return
+	}
+
+	if r.out == nil {
+		if err := r.open(img.Bounds(), model); err != nil {
+			r.fail(err)
+			return
+		}
+	}
+	if err := r.out.write(img, step); err != nil {
+		r.fail(err)
+		return
+	}
+	r.frames++
+}
+
+func (r *recorder) open(bounds image.Rectangle, model api.IModel) error {
+	r.runs++
+	id := fmt.Sprintf("%s-%d", time.Now().Format("20060102-150405"), r.runs)
+	dir := filepath.Join(r.root, "recordings", model.Name(), id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	rec := recordSettings{dir: dir, bounds: bounds, delay: r.delay}
+	if p, ok := model.(api.IPalette); ok {
+		rec.palette = p.Palette()
+	}
+	out, err := recordFormats[r.format](rec)
+	if err != nil {
+		return err
+	}
+	r.out = out
+	r.dir = dir
+	r.frames = 0
+	fmt.Println("Recording to: " + dir)
+	return nil
+}
+
+// finish closes the output, if open. The next frame starts a new run.
+func (r *recorder) finish() {
+	r.offered = 0
+	if r.out == nil {
+		return
+	}
+	err := r.out.close()
+	r.out = nil
+	if err != nil {
+		r.fail(err)
+		return
+	}
+	fmt.Printf("Recorded %d frames to: %s\n", r.frames, r.dir)
+}
+
+// fail stops recording and keeps err to be reported.
+func (r *recorder) fail(err error) {
+	if r.out != nil {
+		r.out.close()
+		r.out = nil
+	}
+	r.format = ""
+	r.offered = 0
+	r.err = err
+}
+
+// takeError returns the error that stopped the recording, once.
+func (r *recorder) takeError() error {
+	err := r.err
+	r.err = nil
+	return err
+}
+
+func (r *recorder) String() string {
+	if !r.recording() {
+		return "not recording"
+	}
+	if r.format == "gif" || r.format == "y4m" {
+		return fmt.Sprintf("recording %s every %d frames, %d/100 s a frame", r.format, r.every, r.delay)
+	}
+	return fmt.Sprintf("recording %s every %d frames", r.format, r.every)
+}
+
+// ---------------------------------------------------------------
+// PNG sequence
+// ---------------------------------------------------------------
+
+type pngWriter struct {
+	dir     string
+	encoder png.Encoder
+}
+
+func newPngWriter(rec recordSettings) (frameWriter, error) {
+	return &pngWriter{dir: rec.dir, encoder: png.Encoder{CompressionLevel: png.BestSpeed}}, nil
+}
+
+func (w *pngWriter) write(img *image.RGBA, step int) error {
+	f, err := os.Create(filepath.Join(w.dir, fmt.Sprintf("frame%06d.png", step)))
+	if err != nil {
+		return err
+	}
+	if err := w.encoder.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (w *pngWriter) close() error {
+	return nil
+}
+
+// ---------------------------------------------------------------
+// Y4M and raw RGB streams
+// ---------------------------------------------------------------
+
+// streamWriter writes frames to a single buffered file.
+type streamWriter struct {
+	f   *os.File
+	w   *bufio.Writer
+	buf []byte
+}
+
+func newStreamWriter(path string) (*streamWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &streamWriter{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (s *streamWriter) close() error {
+	err := s.w.Flush()
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+type y4mWriter struct {
+	*streamWriter
+	bounds image.Rectangle
+}
+
+func newY4mWriter(rec recordSettings) (frameWriter, error) {
+	s, err := newStreamWriter(filepath.Join(rec.dir, "run.y4m"))
+	if err != nil {
+		return nil, err
+	}
+	w := &y4mWriter{streamWriter: s, bounds: rec.bounds}
+	// The frame rate is 100/delay frames per second. RGBToYCbCr gives
+	// full range values, which players take for limited range unless
+	// told.
+	fmt.Fprintf(s.w, "YUV4MPEG2 W%d H%d F100:%d Ip A1:1 C444 XCOLORRANGE=FULL\n", rec.bounds.Dx(), rec.bounds.Dy(), rec.delay)
+	return w, nil
+}
+
+func (w *y4mWriter) write(img *image.RGBA, step int) error {
+	if img.Bounds() != w.bounds {
+		return fmt.Errorf("frame size changed from %v to %v", w.bounds, img.Bounds())
+	}
+	n := w.bounds.Dx() * w.bounds.Dy()
+	if len(w.buf) != 3*n {
+		w.buf = make([]byte, 3*n)
+	}
+	y, cb, cr := w.buf[:n], w.buf[n:2*n], w.buf[2*n:]
+
+	i := 0
+	for row := w.bounds.Min.Y; row < w.bounds.Max.Y; row++ {
+		p := img.Pix[img.PixOffset(w.bounds.Min.X, row):]
+		for col := 0; col < w.bounds.Dx(); col++ {
+			y[i], cb[i], cr[i] = color.RGBToYCbCr(p[4*col], p[4*col+1], p[4*col+2])
+			i++
+		}
+	}
+
+	w.w.WriteString("FRAME\n")
+	_, err := w.w.Write(w.buf)
+	return err
+}
+
+type rgbWriter struct {
+	*streamWriter
+	bounds image.Rectangle
+}
+
+func newRgbWriter(rec recordSettings) (frameWriter, error) {
+	name := fmt.Sprintf("run-%dx%d.rgb", rec.bounds.Dx(), rec.bounds.Dy())
+	s, err := newStreamWriter(filepath.Join(rec.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	return &rgbWriter{streamWriter: s, bounds: rec.bounds}, nil
+}
+
+func (w *rgbWriter) write(img *image.RGBA, step int) error {
+	if img.Bounds() != w.bounds {
+		return fmt.Errorf("frame size changed from %v to %v", w.bounds, img.Bounds())
+	}
+	if len(w.buf) != 3*w.bounds.Dx() {
+		w.buf = make([]byte, 3*w.bounds.Dx())
+	}
+
+	for row := w.bounds.Min.Y; row < w.bounds.Max.Y; row++ {
+		p := img.Pix[img.PixOffset(w.bounds.Min.X, row):]
+		for col := range w.buf[:w.bounds.Dx()] {
+			copy(w.buf[3*col:3*col+3], p[4*col:4*col+3])
+		}
+		if _, err := w.w.Write(w.buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package simulation
+
+import (
+	"Netron1-Go/api"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// record runs a model for 6 steps recording every 2nd frame to root
+// and returns the run directories.
+func record(t *testing.T, root, format string, runs int) []string {
+	t.Helper()
+	sim, in, out, done := startSimulation(context.Background(), &finiteModel{IModel: NewSISModel(), n: 6})
+	sim.SetDataRoot(root)
+
+	if ev := send(t, in, out, api.NewRecordCommand(format, 2, 0)); ev.Kind != api.DoneEvent {
+		t.Fatalf("record %s: got %v", format, ev)
+	}
+	for i := 0; i < runs; i++ {
+		runUntil(t, in, out, api.Until{})
+	}
+	send(t, in, out, api.NewCommand(api.ExitCommand))
+	exited(t, done)
+
+	dirs, _ := filepath.Glob(filepath.Join(root, "recordings", "*", "*"))
+	return dirs
+}
+
+// TestRecordFormats records steps 0, 2, 4 and 6 of a run in each
+// format.
+func TestRecordFormats(t *testing.T) {
+	const frames, size = 4, 300 * 300
+
+	for format, check := range map[string]func(dir string) error{
+		"png": func(dir string) error {
+			for _, step := range []int{0, 2, 4, 6} {
+				if _, err := os.Stat(filepath.Join(dir, fmt.Sprintf("frame%06d.png", step))); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		"gif": func(dir string) error {
+			f, err := os.Open(filepath.Join(dir, "run.gif"))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			anim, err := gif.DecodeAll(f)
+			if err != nil {
+				return err
+			}
+			if len(anim.Image) != frames {
+				return fmt.Errorf("%d frames, want %d", len(anim.Image), frames)
+			}
+			return nil
+		},
+		"y4m": func(dir string) error {
+			data, err := os.ReadFile(filepath.Join(dir, "run.y4m"))
+			if err != nil {
+				return err
+			}
+			header := "YUV4MPEG2 W300 H300 F100:6 Ip A1:1 C444 XCOLORRANGE=FULL\n"
+			if !strings.HasPrefix(string(data), header) {
+				return fmt.Errorf("bad header %q", data[:len(header)])
+			}
+			if want := len(header) + frames*(len("FRAME\n")+3*size); len(data) != want {
+				return fmt.Errorf("%d bytes, want %d", len(data), want)
+			}
+			return nil
+		},
+		"rgb": func(dir string) error {
+			info, err := os.Stat(filepath.Join(dir, "run-300x300.rgb"))
+			if err != nil {
+				return err
+			}
+			if want := int64(frames * 3 * size); info.Size() != want {
+				return fmt.Errorf("%d bytes, want %d", info.Size(), want)
+			}
+			return nil
+		},
+	} {
+		dirs := record(t, t.TempDir(), format, 1)
+		if len(dirs) != 1 {
+			t.Errorf("%s: %d run directories, want 1", format, len(dirs))
+			continue
+		}
+		if err := check(dirs[0]); err != nil {
+			t.Errorf("%s: %v", format, err)
+		}
+	}
+}
+
+// TestRecordRuns checks each run is recorded to its own directory.
+func TestRecordRuns(t *testing.T) {
+	if dirs := record(t, t.TempDir(), "rgb", 3); len(dirs) != 3 {
+		t.Errorf("%d run directories, want 3", len(dirs))
+	}
+}
+
+// TestRecordError checks a recording that can't be written is stopped
+// and reported without stopping the simulation.
+func TestRecordError(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(root, nil, 0644)
+
+	sim, in, out, done := startSimulation(context.Background(), &finiteModel{IModel: NewSISModel(), n: 6})
+	sim.SetDataRoot(root)
+
+	if ev := send(t, in, out, api.NewRecordCommand("avi", 1, 0)); ev.Kind != api.ErrorEvent {
+		t.Errorf("record avi: got %v", ev)
+	}
+	send(t, in, out, api.NewRecordCommand("png", 1, 0))
+
+	in <- api.NewCommand(api.RunCommand)
+	var kinds []api.EventKind
+	for len(kinds) < 3 {
+		ev := <-out
+		kinds = append(kinds, ev.Kind)
+		if ev.Kind == api.ErrorEvent && (ev.ID != 0 || !strings.HasPrefix(ev.Message, "recording stopped")) {
+			t.Errorf("got %v, want an unsolicited recording error", ev)
+		}
+	}
+	if want := []api.EventKind{api.StartedEvent, api.ErrorEvent, api.CompletedEvent}; fmt.Sprint(kinds) != fmt.Sprint(want) {
+		t.Errorf("events %v, want %v", kinds, want)
+	}
+
+	if status := send(t, in, out, api.NewCommand(api.StatusCommand)).Message; strings.Contains(status, "recording") {
+		t.Errorf("still recording: %s", status)
+	}
+	send(t, in, out, api.NewCommand(api.ExitCommand))
+	exited(t, done)
+}
+
+// TestGifStream writes more frames than the encoder queue holds and
+// checks the palette colors come back exactly, colors that first
+// appear after the first frame as the nearest palette color, with the
+// delay set.
+func TestGifStream(t *testing.T) {
+	const frames, delay = 3 * gifQueue, 10
+	palette := color.Palette{
+		color.RGBA{R: 0, G: 0, B: 255, A: 255},
+		color.RGBA{R: 255, G: 225, B: 200, A: 255},
+		color.RGBA{R: 200, G: 200, B: 200, A: 255},
+	}
+	off := color.RGBA{R: 10, G: 0, B: 240, A: 255}
+
+	dir := t.TempDir()
+	bounds := image.Rect(0, 0, 40, 30)
+	w, err := newGifWriter(recordSettings{dir: dir, bounds: bounds, delay: delay, palette: palette})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := image.NewRGBA(bounds)
+	for i := 0; i < frames; i++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			for y := 0; y < bounds.Dy(); y++ {
+				img.Set(x, y, palette[(x+y+i)%len(palette)])
+			}
+		}
+		if i > 0 {
+			// Not in the palette and too late to be added to it
+			img.Set(0, 0, off)
+		}
+		if err := w.write(img, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "run.gif"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	anim, err := gif.DecodeAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anim.Image) != frames {
+		t.Fatalf("%d frames, want %d", len(anim.Image), frames)
+	}
+	for i, frame := range anim.Image {
+		if anim.Delay[i] != delay {
+			t.Errorf("frame %d: delay %d, want %d", i, anim.Delay[i], delay)
+		}
+		for x := 0; x < bounds.Dx(); x++ {
+			for y := 0; y < bounds.Dy(); y++ {
+				want := palette[(x+y+i)%len(palette)]
+				if x == 0 && y == 0 {
+					want = palette[0]
+				}
+				if got := color.RGBAModel.Convert(frame.At(x, y)); got != want {
+					t.Fatalf("frame %d: pixel %d,%d is %v, want %v", i, x, y, got, want)
+				}
+			}
+		}
+	}
+}
@@ -2,47 +2,62 @@ package simulation
 
 import (
 	"Netron1-Go/api"
+	"context"
 	"fmt"
-	"image"
-	"image/color"
-	"image/color/palette"
-	"image/draw"
-	"image/gif"
-	"image/png"
-	"log"
-	"os"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
-const gifOutputPath = "/media/RAMDisk/netron/"
+// dataRoot is where exported data is written and relative file names
+// are read from. SetDataRoot sets it from the config.
+var dataRoot = "."
+
+// dataPath places relative file names under the data root.
+func dataPath(file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(dataRoot, file)
+}
 
 type Simulation struct {
-	debug     int
-	loop      bool
-	running   bool
-	paused    bool
-	completed bool
+	// Steps since the last reset
+	steps int
+	// Step last rendered
+	rendered int
+	// Render every renderEvery-th step while running
+	renderEvery int
+
+	pace  pacer
+	until api.Until
+
+	history *history
+
+	// mu guards state so other goroutines can read it
+	mu    sync.Mutex
+	state State
 
 	raster  api.IRasterBuffer
 	surface api.ISurface
 
 	model api.IModel
 
-	discName   string
-	discNameId int
-	gAni       *gif.GIF
-	// Set to true if you want an animated gif generated.
-	// Note: rendering will considerably slower.
-	// To save gif use the "t" key to stop simulation. Once
-	// stopped the gif is saved.
-	enableGif bool
+	recorder recorder
+
+	// Background jobs started by model commands, see jobs.go
+	jobCtx      context.Context
+	jobsRunning sync.WaitGroup
+	reports     chan api.Event
 }
 
 func NewSimulation() api.ISimulation {
 	o := new(Simulation)
-	o.running = false
-	o.loop = true
-	o.enableGif = false
+	o.state = Idle
+	o.renderEvery = 1
+	o.history = newHistory(historyMemory, historyDisk)
+	o.recorder.delay = recordDelay
+	o.reports = make(chan api.Event)
 	return o
 }
 
@@ -51,175 +66,436 @@ func (s *Simulation) Initialize(rasterBuffer api.IRasterBuffer, surface api.ISur
 	s.surface = surface
 }
 
+// SetDataRoot sets the directory exports and recordings are written
+// under.
+func (s *Simulation) SetDataRoot(root string) {
+	dataRoot = root
+	s.recorder.root = root
+}
+
+// State returns the lifecycle state. It's safe to call from any
+// goroutine.
+func (s *Simulation) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+func (s *Simulation) setState(state State) {
+	s.mu.Lock()
+	s.state = state
+	s.mu.Unlock()
+}
+
 // Boot is the simulation bootstrap. The simulation isn't
-// running until told to do so.
-func (s *Simulation) Start(inChan chan string, outChan chan string) {
-	for s.loop {
-		select {
-		case cmd := <-inChan:
-			switch cmd {
-			case "exit":
-				if s.running {
-					outChan <- "Terminated"
-				} else {
-					if !s.completed {
-						outChan <- "Exited"
+// running until told to do so. Every command is answered with one
+// event carrying its ID. Start returns after an exit command, when
+// ctx is cancelled or when inChan is closed. It never closes outChan.
+func (s *Simulation) Start(ctx context.Context, inChan <-chan api.Command, outChan chan<- api.Event) {
+	defer s.setState(Exited)
+	defer s.history.close()
+	defer s.recorder.stop()
+
+	var cancelJobs context.CancelFunc
+	s.jobCtx, cancelJobs = context.WithCancel(ctx)
+	defer s.jobsRunning.Wait()
+	defer cancelJobs()
+
+	for {
+		var cmd api.Command
+		var ok bool
+
+		if s.state == Running {
+			if wait := s.pace.wait(time.Now()); wait > 0 {
+				// Wait for the next step unless a command comes first
+				timer := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				case cmd, ok = <-inChan:
+					timer.Stop()
+				case ev := <-s.reports:
+					timer.Stop()
+					if !sendEvent(ctx, outChan, ev) {
+						return
 					}
-				}
-				s.loop = false
-			case "run":
-				if s.running {
-					// Starting a run while the sim is already running
-					// isn't allowed.
-					outChan <- "Running"
 					continue
-				}
-
-				s.running = true
-				s.reset()
-				s.surface.Update(true)
-				outChan <- "Started"
-			case "step":
-				s.model.Step()
-				if s.enableGif {
-					s.addGif()
-				}
-				s.surface.Update(true)
-				outChan <- "Stepped"
-			case "pause":
-				if !s.running {
-					outChan <- "Not Running"
+				case <-timer.C:
 					continue
 				}
-
-				if s.paused {
-					outChan <- "Already Paused"
+			} else {
+				select {
+				case <-ctx.Done():
+					return
+				case cmd, ok = <-inChan:
+				case ev := <-s.reports:
+					if !sendEvent(ctx, outChan, ev) {
+						return
+					}
 					continue
-				}
-
-				outChan <- "Paused"
-				s.paused = true
-			case "resume":
-				if !s.paused {
-					outChan <- "Not Paused"
+				default:
+					// The sim is running, make a step
+					if !s.runStep(ctx, outChan) || !s.reportRecorder(ctx, outChan) {
+						return
+					}
 					continue
 				}
-
-				outChan <- "Resumed"
-				s.paused = false
-			case "reset":
-				outChan <- "Reset"
-				s.running = false
-				s.reset()
-				s.surface.Update(true)
-			case "stop":
-				outChan <- "Stopped"
-				s.running = false
-				s.completed = false
-				if s.enableGif {
-					s.saveGif()
-				}
-			case "status":
-				outChan <- fmt.Sprintf("Status: %d", s.debug)
-			default:
-				s.model.SendEvent(cmd)
 			}
-		default:
-			if !s.running {
-				time.Sleep(10 * time.Millisecond)
-				continue
-			}
-
-			if s.paused {
-			} else {
-				// The sim is running, make a step
-				s.running = s.model.Step()
-				// Save image to disc
-				if s.enableGif {
-					s.addGif()
-				}
-				s.surface.Update(true)
-				if !s.running {
-					outChan <- "Complete"
-					s.completed = true
+		} else {
+			// Nothing to do until a command arrives
+			select {
+			case <-ctx.Done():
+				return
+			case cmd, ok = <-inChan:
+			case ev := <-s.reports:
+				if !sendEvent(ctx, outChan, ev) {
+					return
 				}
+				continue
 			}
+		}
 
-			time.Sleep(1 * time.Millisecond)
+		if !ok || !sendEvent(ctx, outChan, s.command(cmd)) || !s.reportRecorder(ctx, outChan) || s.state == Exited {
+			return
 		}
 	}
 }
 
-func (s *Simulation) Configure(model api.IModel) {
-	s.model = model //NewSISCityModel()
-	s.model.Configure(s.raster)
-	s.model.Reset()
-	s.surface.Update(true)
+// reportRecorder sends an error event, with ID 0, if recording failed.
+// It returns false if ctx was cancelled.
+func (s *Simulation) reportRecorder(ctx context.Context, outChan chan<- api.Event) bool {
+	if err := s.recorder.takeError(); err != nil {
+		return sendEvent(ctx, outChan, api.Event{Kind: api.ErrorEvent, Message: fmt.Sprintf("recording stopped: %v", err)})
+	}
+	return true
 }
 
-func (s *Simulation) reset() {
-	s.discNameId = 0
-	s.debug = 0
-	s.paused = false
-	s.completed = false
-	s.gAni = &gif.GIF{}
-	s.gAni.Image = []*image.Paletted{}
-	s.gAni.Delay = []int{}
+// sendEvent sends ev unless ctx is cancelled first.
+func sendEvent(ctx context.Context, outChan chan<- api.Event, ev api.Event) bool {
+	select {
+	case outChan <- ev:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
 
-	s.model.Reset()
+// runStep makes a step of a run. The run completes when the model
+// finishes or the run's stop condition is met. It returns false if
+// ctx was cancelled.
+func (s *Simulation) runStep(ctx context.Context, outChan chan<- api.Event) bool {
+	more := s.step()
+	s.pace.stepped(time.Now())
+
+	reason := s.stopReason()
+	if more && reason == "" {
+		return true
+	}
+
+	s.setState(Completed)
+	s.render()
+	s.recorder.finish()
+	return sendEvent(ctx, outChan, api.Event{Kind: api.CompletedEvent, Message: reason})
 }
 
-func (s *Simulation) save() {
-	s.saveGif()
+// stopReason says why the run's stop condition is met, or is empty if
+// it isn't.
+func (s *Simulation) stopReason() string {
+	u := s.until
+	if u.Steps > 0 && s.steps >= u.Steps {
+		return fmt.Sprintf("ran %d steps", s.steps)
+	}
+	if u.Prevalence > 0 || u.Extinct {
+		p := s.model.(api.IPrevalence).Prevalence()
+		if u.Prevalence > 0 && p >= u.Prevalence {
+			return fmt.Sprintf("prevalence %.4f at step %d", p, s.steps)
+		}
+		if u.Extinct && p == 0 {
+			return fmt.Sprintf("extinct at step %d", s.steps)
+		}
+	}
+	return ""
 }
 
-func (s *Simulation) saveGif() {
-	fn := fmt.Sprintf(gifOutputPath+"%s%d.gif", s.model.Name(), s.discNameId)
-	f, err := os.Create(fn)
+// step steps the model and renders every renderEvery-th step. It
+// returns false once the model has finished.
+func (s *Simulation) step() bool {
+	more := s.model.Step()
+	s.steps++
+	if s.steps%s.renderEvery == 0 {
+		s.render()
+	}
+	return more
+}
 
-	if err != nil {
-		log.Fatalln(err)
+// render shows the current step unless it's already shown.
+func (s *Simulation) render() {
+	if s.rendered == s.steps {
+		return
 	}
+	s.rendered = s.steps
+	s.recorder.add(s.raster.Pixels(), s.steps, s.model)
+	s.keep()
+	s.surface.Update(true)
+}
 
-	err = gif.EncodeAll(f, s.gAni)
+// keep adds the current frame to the history.
+func (s *Simulation) keep() {
+	var state []byte
+	if m, ok := s.model.(api.ISnapshot); ok {
+		state = m.Snapshot()
+	}
+	if err := s.history.add(s.steps, s.raster.Pixels().Pix, state); err != nil {
+		fmt.Println("History: ", err)
+	}
+}
 
+// show puts frame i of the history on the surface. -1 shows the
+// newest frame, which is the live one.
+func (s *Simulation) show(i int) error {
+	pixels, _, err := s.history.load(s.history.viewedAt(i))
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
+	copy(s.raster.Pixels().Pix, pixels)
+	s.surface.Update(true)
+	s.history.view = i
+	return nil
 }
 
-func (s *Simulation) addGif() {
-	img := s.raster.Pixels()
+// live returns from the history to the newest frame.
+func (s *Simulation) live() error {
+	if s.history.view < 0 {
+		return nil
+	}
+	return s.show(-1)
+}
 
-	gifOps := &gif.Options{NumColors: 256, Drawer: draw.FloydSteinberg}
-	pimg := image.NewPaletted(img.Bounds(), palette.Plan9[:gifOps.NumColors])
-	if gifOps.Quantizer != nil {
-		pimg.Palette = gifOps.Quantizer.Quantize(make(color.Palette, 0, gifOps.NumColors), img)
+// branch restores the model to the frame shown and drops the later
+// frames.
+func (s *Simulation) branch() (int, error) {
+	i := s.history.viewed()
+	_, state, err := s.history.load(i)
+	if err != nil {
+		return 0, err
+	}
+	if state == nil {
+		return 0, fmt.Errorf("the frame has no model state")
+	}
+	if err := s.model.(api.ISnapshot).Restore(state); err != nil {
+		return 0, err
 	}
 
-	gifOps.Drawer.Draw(pimg, img.Bounds(), img, image.Point{})
+	if err := s.history.truncate(i); err != nil {
+		fmt.Println("History: ", err)
+	}
+	// The branch is recorded as a new run
+	s.recorder.finish()
+	s.steps = s.history.frames[i].step
+	s.rendered = s.steps
+	return s.steps, s.show(-1)
+}
 
-	s.gAni.Image = append(s.gAni.Image, pimg)
-	spf := 1 / float64(15)
-	s.gAni.Delay = append(s.gAni.Delay, int(spf*100))
+// check rejects a command with bad arguments before it changes the
+// state.
+func (s *Simulation) check(cmd api.Command) error {
+	switch cmd.Kind {
+	case api.RunCommand:
+		u := cmd.Until
+		if u.Steps < 0 || u.Prevalence < 0 || u.Prevalence > 1 {
+			return fmt.Errorf("bad run condition: %+v", u)
+		}
+		if _, ok := s.model.(api.IPrevalence); !ok && (u.Prevalence > 0 || u.Extinct) {
+			return fmt.Errorf("%s doesn't report prevalence", s.model.Name())
+		}
+	case api.SpeedCommand:
+		if cmd.Value < 0 {
+			return fmt.Errorf("speed can't be negative")
+		}
+	case api.RenderCommand:
+		if cmd.Value < 1 {
+			return fmt.Errorf("render every must be at least 1")
+		}
+	case api.FrameCommand, api.LiveCommand:
+		if len(s.history.frames) == 0 {
+			return fmt.Errorf("no frames in the history")
+		}
+	case api.BranchCommand:
+		if _, ok := s.model.(api.ISnapshot); !ok {
+			return fmt.Errorf("%s can't branch", s.model.Name())
+		}
+		if len(s.history.frames) == 0 {
+			return fmt.Errorf("no frames in the history")
+		}
+	case api.HistoryCommand:
+		if cmd.Value < 0 || cmd.Spill < 0 {
+			return fmt.Errorf("history limits can't be negative")
+		}
+	}
+	return nil
+}
 
-	// err = gif.Encode(f, s.raster.Pixels(), gifOps)
+// command carries out cmd and returns the reply.
+func (s *Simulation) command(cmd api.Command) api.Event {
+	next, ok := s.state.next(cmd.Kind)
+	if !ok {
+		return cmd.Error("can't %v a simulation that is %v", cmd.Kind, s.state)
+	}
+	if err := s.check(cmd); err != nil {
+		return cmd.Error("%v", err)
+	}
+	previous := s.state
+	s.setState(next)
 
-	s.discNameId++
+	switch cmd.Kind {
+	case api.ExitCommand:
+		if previous.live() {
+			return cmd.Reply(api.TerminatedEvent, "")
+		}
+		return cmd.Reply(api.ExitedEvent, "")
+	case api.RunCommand:
+		s.until = cmd.Until
+		s.reset()
+		s.surface.Update(true)
+		s.pace.start(time.Now())
+		if s.until.IsZero() {
+			return cmd.Reply(api.StartedEvent, "")
+		}
+		return cmd.Reply(api.StartedEvent, "until "+s.until.String())
+	case api.StepCommand:
+		if err := s.live(); err != nil {
+			return cmd.Error("%v", err)
+		}
+		s.step()
+		s.render()
+		return cmd.Reply(api.SteppedEvent, "")
+	case api.PauseCommand:
+		s.render()
+		return cmd.Reply(api.PausedEvent, "")
+	case api.ResumeCommand:
+		if err := s.live(); err != nil {
+			s.setState(previous)
+			return cmd.Error("%v", err)
+		}
+		s.pace.start(time.Now())
+		return cmd.Reply(api.ResumedEvent, "")
+	case api.ResetCommand:
+		s.reset()
+		s.surface.Update(true)
+		return cmd.Reply(api.ResetEvent, "")
+	case api.StopCommand:
+		s.render()
+		s.recorder.finish()
+		return cmd.Reply(api.StoppedEvent, "")
+	case api.StatusCommand:
+		return cmd.Reply(api.StatusEvent, s.status())
+	case api.SetCommand:
+		p, ok := s.model.(api.IParameters)
+		if !ok {
+			return cmd.Error("%s has no settable parameters", s.model.Name())
+		}
+		if err := p.SetParameter(cmd.Name, cmd.Value); err != nil {
+			return cmd.Error("%v", err)
+		}
+		return cmd.Reply(api.DoneEvent, fmt.Sprintf("%s = %g", cmd.Name, cmd.Value))
+	case api.SpeedCommand:
+		s.pace.target = cmd.Value
+		s.pace.start(time.Now())
+		return cmd.Reply(api.DoneEvent, "speed: "+s.pace.targetString()+" steps/s")
+	case api.RenderCommand:
+		s.renderEvery = int(cmd.Value)
+		return cmd.Reply(api.DoneEvent, fmt.Sprintf("render every %d steps", s.renderEvery))
+	case api.RecordCommand:
+		if cmd.Name == "off" {
+			s.recorder.stop()
+			return cmd.Reply(api.DoneEvent, s.recorder.String())
+		}
+		if err := s.recorder.start(cmd.Name, int(cmd.Value), cmd.Delay); err != nil {
+			return cmd.Error("%v", err)
+		}
+		return cmd.Reply(api.DoneEvent, s.recorder.String()+" to "+filepath.Join(s.recorder.root, "recordings", s.model.Name()))
+	case api.FrameCommand:
+		i := s.history.viewed() + int(cmd.Value)
+		if i < 0 {
+			i = 0
+		}
+		if i >= len(s.history.frames)-1 {
+			i = -1
+		}
+		if err := s.show(i); err != nil {
+			return cmd.Error("%v", err)
+		}
+		return cmd.Reply(api.DoneEvent, s.frameString())
+	case api.LiveCommand:
+		if err := s.live(); err != nil {
+			return cmd.Error("%v", err)
+		}
+		return cmd.Reply(api.DoneEvent, s.frameString())
+	case api.BranchCommand:
+		step, err := s.branch()
+		if err != nil {
+			s.setState(previous)
+			return cmd.Error("%v", err)
+		}
+		return cmd.Reply(api.DoneEvent, fmt.Sprintf("branched at step %d", step))
+	case api.HistoryCommand:
+		if err := s.history.resize(int(cmd.Value), cmd.Spill); err != nil {
+			return cmd.Error("%v", err)
+		}
+		return cmd.Reply(api.DoneEvent, fmt.Sprintf("history: %d frames in memory, %d on disk", s.history.memory, s.history.disk))
+	case api.AdjustCommand, api.MouseCommand, api.ModelCommand:
+		err := s.model.SendEvent(cmd.ModelEvent())
+		s.runJobs()
+		if err != nil {
+			return cmd.Error("%v", err)
+		}
+		return cmd.Reply(api.DoneEvent, "")
+	}
+
+	return cmd.Error("unknown command: %v", cmd.Kind)
 }
 
-func (s *Simulation) savePng() {
-	fn := fmt.Sprintf("/media/RAMDisk/netron/%s%d.png", s.model.Name(), s.discNameId)
-	f, err := os.Create(fn)
+// status describes the state, the step and, while running, the rate.
+func (s *Simulation) status() string {
+	status := fmt.Sprintf("%v, step %d", s.state, s.steps)
+	if s.state == Running {
+		status += fmt.Sprintf(", %.1f steps/s", s.pace.measured(time.Now()))
+	}
+	if s.history.view >= 0 {
+		status += ", viewing " + s.frameString()
+	}
+	if s.recorder.recording() {
+		status += ", " + s.recorder.String()
+	}
+	return status + fmt.Sprintf(" (target %s steps/s, render every %d)", s.pace.targetString(), s.renderEvery)
+}
 
-	if err != nil {
-		log.Fatalln(err)
+// frameString describes the frame shown.
+func (s *Simulation) frameString() string {
+	i := s.history.viewed()
+	if s.history.view < 0 {
+		return fmt.Sprintf("live step %d", s.history.frames[i].step)
 	}
+	return fmt.Sprintf("step %d (frame %d of %d)", s.history.frames[i].step, i+1, len(s.history.frames))
+}
 
-	err = png.Encode(f, s.raster.Pixels())
+func (s *Simulation) Configure(model api.IModel) {
+	s.model = model //NewSISCityModel()
+	s.model.Configure(s.raster)
+	s.model.Reset()
+	s.history.clear()
+	s.keep()
+	s.surface.Update(true)
+}
 
-	if err != nil {
-		log.Fatalln(err)
-	}
-	s.discNameId++
+func (s *Simulation) reset() {
+	s.steps = 0
+	s.rendered = 0
+	s.recorder.finish()
+
+	s.model.Reset()
+	s.history.clear()
+	s.keep()
+	s.recorder.add(s.raster.Pixels(), s.steps, s.model)
 }
@@ -0,0 +1,450 @@
+package simulation
+
+import (
+	"Netron1-Go/api"
+	"Netron1-Go/raster"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSurface is a headless ISurface.
+type testSurface struct {
+	raster  api.IRasterBuffer
+	updates int
+}
+
+func (t *testSurface) Open(api.IModel)                         {}
+func (t *testSurface) Close()                                  {}
+func (t *testSurface) Run(context.Context, chan<- api.Command) {}
+func (t *testSurface) Quit()                                   {}
+func (t *testSurface) SetFont(string, int) error               { return nil }
+func (t *testSurface) Raster() api.IRasterBuffer               { return t.raster }
+
+func (t *testSurface) Update(bool) {
+	t.updates++
+	t.raster.Swap()
+}
+
+// startSimulation starts a simulation of model on a headless surface.
+// done is closed when Start returns.
+func startSimulation(ctx context.Context, model api.IModel) (sim *Simulation, in chan api.Command, out chan api.Event, done chan struct{}) {
+	surface := &testSurface{raster: raster.NewRasterBuffer(300, 300)}
+	sim = NewSimulation().(*Simulation)
+	sim.Initialize(surface.Raster(), surface)
+	sim.Configure(model)
+
+	in = make(chan api.Command)
+	out = make(chan api.Event)
+	done = make(chan struct{})
+	go func() {
+		sim.Start(ctx, in, out)
+		close(done)
+	}()
+	return sim, in, out, done
+}
+
+// exited fails the test unless done closes soon.
+func exited(t *testing.T, done <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start didn't return")
+	}
+}
+
+// send sends cmd and returns its reply, skipping unsolicited events.
+func send(t *testing.T, in chan<- api.Command, out <-chan api.Event, cmd api.Command) api.Event {
+	t.Helper()
+	in <- cmd
+	for ev := range out {
+		if ev.ID == cmd.ID {
+			return ev
+		}
+		if ev.ID != 0 {
+			t.Fatalf("%v: got reply to command %d", cmd.Kind, ev.ID)
+		}
+	}
+	t.Fatalf("%v: no reply", cmd.Kind)
+	return api.Event{}
+}
+
+func TestProtocolReplies(t *testing.T) {
+	_, in, out, done := startSimulation(context.Background(), NewSISDynCorrModel())
+
+	for _, c := range []struct {
+		cmd  api.Command
+		want api.EventKind
+	}{
+		{api.NewCommand(api.PauseCommand), api.ErrorEvent},
+		{api.NewCommand(api.ResumeCommand), api.ErrorEvent},
+		{api.NewCommand(api.StepCommand), api.SteppedEvent},
+		{api.NewSetCommand("drop", 0.2), api.DoneEvent},
+		{api.NewSetCommand("drop", 2), api.ErrorEvent},
+		{api.NewSetCommand("nothing", 1), api.ErrorEvent},
+		{api.NewAdjustCommand("size", 1), api.DoneEvent},
+		{api.NewMouseCommand("down", 1, 10, 10), api.DoneEvent},
+		{api.NewModelCommand([]string{"city", "list"}), api.DoneEvent},
+		{api.NewModelCommand([]string{"probe", "add", "0", "0", "0", "0"}), api.ErrorEvent},
+		{api.NewModelCommand([]string{"city", "nothing"}), api.ErrorEvent},
+		{api.NewCommand(api.StatusCommand), api.StatusEvent},
+		{api.NewCommand(api.ResetCommand), api.ResetEvent},
+		{api.NewCommand(api.ExitCommand), api.ExitedEvent},
+	} {
+		if ev := send(t, in, out, c.cmd); ev.Kind != c.want {
+			t.Errorf("%v: got %v, want %v", c.cmd.Kind, ev, c.want)
+		}
+	}
+	exited(t, done)
+}
+
+// TestProtocolModelErrors checks a model without commands of its own
+// rejects them and unknown parameters, and ignores the mouse.
+func TestProtocolModelErrors(t *testing.T) {
+	_, in, out, done := startSimulation(context.Background(), NewSIRModel())
+
+	for _, c := range []struct {
+		cmd  api.Command
+		want api.EventKind
+	}{
+		{api.NewSetCommand("transmission", 0.3), api.DoneEvent},
+		{api.NewSetCommand("drop", 0.2), api.ErrorEvent},
+		{api.NewAdjustCommand("accept", 1), api.ErrorEvent},
+		{api.NewMouseCommand("down", 1, 10, 10), api.DoneEvent},
+		{api.NewModelCommand([]string{"city", "list"}), api.ErrorEvent},
+	} {
+		if ev := send(t, in, out, c.cmd); ev.Kind != c.want {
+			t.Errorf("%s: got %v, want %v", c.cmd.ModelEvent(), ev, c.want)
+		}
+	}
+	send(t, in, out, api.NewCommand(api.ExitCommand))
+	exited(t, done)
+}
+
+// TestLifecycle runs scripted command sequences and checks the reply
+// and the state after each command.
+func TestLifecycle(t *testing.T) {
+	type step struct {
+		kind  api.CommandKind
+		reply api.EventKind
+		state State
+	}
+	for name, script := range map[string][]step{
+		"run pause resume stop": {
+			{api.RunCommand, api.StartedEvent, Running},
+			{api.RunCommand, api.ErrorEvent, Running},
+			{api.PauseCommand, api.PausedEvent, Paused},
+			{api.PauseCommand, api.ErrorEvent, Paused},
+			{api.RunCommand, api.ErrorEvent, Paused},
+			{api.ResumeCommand, api.ResumedEvent, Running},
+			{api.StopCommand, api.StoppedEvent, Stopped},
+			{api.ResumeCommand, api.ErrorEvent, Stopped},
+			{api.RunCommand, api.StartedEvent, Running},
+			{api.ExitCommand, api.TerminatedEvent, Exited},
+		},
+		"idle": {
+			{api.PauseCommand, api.ErrorEvent, Idle},
+			{api.StopCommand, api.ErrorEvent, Idle},
+			{api.StepCommand, api.SteppedEvent, Idle},
+			{api.StatusCommand, api.StatusEvent, Idle},
+			{api.ExitCommand, api.ExitedEvent, Exited},
+		},
+		"reset": {
+			{api.RunCommand, api.StartedEvent, Running},
+			{api.PauseCommand, api.PausedEvent, Paused},
+			{api.ResetCommand, api.ResetEvent, Idle},
+			{api.ResumeCommand, api.ErrorEvent, Idle},
+			{api.RunCommand, api.StartedEvent, Running},
+			{api.ResetCommand, api.ResetEvent, Idle},
+			{api.ExitCommand, api.ExitedEvent, Exited},
+		},
+	} {
+		sim, in, out, done := startSimulation(context.Background(), NewSISModel())
+		for _, s := range script {
+			ev := send(t, in, out, api.NewCommand(s.kind))
+			if ev.Kind != s.reply {
+				t.Errorf("%s: %v replied %v, want %v", name, s.kind, ev, s.reply)
+			}
+			if s.kind == api.ExitCommand {
+				exited(t, done)
+			}
+			if got := sim.State(); got != s.state {
+				t.Errorf("%s: state after %v is %v, want %v", name, s.kind, got, s.state)
+			}
+		}
+	}
+}
+
+// finiteModel finishes after n steps.
+type finiteModel struct {
+	api.IModel
+	steps, n int
+}
+
+func (f *finiteModel) Reset() {
+	f.steps = 0
+	f.IModel.Reset()
+}
+
+func (f *finiteModel) Step() bool {
+	f.steps++
+	f.IModel.Step()
+	return f.steps < f.n
+}
+
+// TestLifecycleCompletes runs a model until it finishes.
+func TestLifecycleCompletes(t *testing.T) {
+	sim, in, out, done := startSimulation(context.Background(), &finiteModel{IModel: NewSISModel(), n: 20})
+
+	send(t, in, out, api.NewCommand(api.RunCommand))
+	if ev := <-out; ev.Kind != api.CompletedEvent || ev.ID != 0 {
+		t.Fatalf("got %v, want an unsolicited completed event", ev)
+	}
+	if got := sim.State(); got != Completed {
+		t.Errorf("state %v, want completed", got)
+	}
+	if ev := send(t, in, out, api.NewCommand(api.StopCommand)); ev.Kind != api.StoppedEvent {
+		t.Errorf("stop after completion: got %v", ev)
+	}
+	send(t, in, out, api.NewCommand(api.ExitCommand))
+	exited(t, done)
+}
+
+// TestLifecycleCancel cancels the context while the model runs and
+// while Start is blocked sending an event nobody reads.
+func TestLifecycleCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sim, in, out, done := startSimulation(ctx, NewSISModel())
+	send(t, in, out, api.NewCommand(api.RunCommand))
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	exited(t, done)
+	if got := sim.State(); got != Exited {
+		t.Errorf("state %v, want exited", got)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	_, in, _, done = startSimulation(ctx, NewSISModel())
+	in <- api.NewCommand(api.StatusCommand)
+	cancel()
+	exited(t, done)
+}
+
+// TestLifecycleConcurrentClients sends commands from several
+// goroutines, as the console and the GUI do, and checks every command
+// is answered exactly once.
+func TestLifecycleConcurrentClients(t *testing.T) {
+	const clients, commands = 4, 20
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sim, in, out, done := startSimulation(ctx, NewSISModel())
+
+	kinds := []api.CommandKind{api.RunCommand, api.PauseCommand, api.ResumeCommand, api.StepCommand, api.StatusCommand, api.StopCommand, api.ResetCommand}
+	var wg sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < commands; i++ {
+				in <- api.NewCommand(kinds[(c+i)%len(kinds)])
+				// Readers on other goroutines may watch the state
+				sim.State()
+			}
+		}(c)
+	}
+
+	replies := map[int64]int{}
+	for len(replies) < clients*commands {
+		if ev := <-out; ev.ID != 0 {
+			replies[ev.ID]++
+		}
+	}
+	wg.Wait()
+	for id, n := range replies {
+		if n != 1 {
+			t.Errorf("command %d answered %d times", id, n)
+		}
+	}
+
+	cancel()
+	exited(t, done)
+}
+
+func TestModelEvent(t *testing.T) {
+	for _, c := range []struct {
+		cmd  api.Command
+		want string
+	}{
+		{api.NewSetCommand("drop", 0.25), "drop 0.25"},
+		{api.NewAdjustCommand("accept", 1), "inc accept"},
+		{api.NewAdjustCommand("accept", -1), "dec accept"},
+		{api.NewMouseCommand("down", 1, 3, 4), "mouse down 1 3 4"},
+		{api.NewMouseCommand("drag", 0, 3, 4), "mouse drag 3 4"},
+		{api.NewModelCommand([]string{"kc", "add", "100", "100", "2"}), "kc add 100 100 2"},
+	} {
+		if got := c.cmd.ModelEvent(); got != c.want {
+			t.Errorf("%v: got %q, want %q", c.cmd.Kind, got, c.want)
+		}
+	}
+}
+
+// rampModel's prevalence rises from 0 to 1 over n steps and then drops
+// to 0.
+type rampModel struct {
+	finiteModel
+}
+
+func (r *rampModel) Step() bool {
+	r.finiteModel.Step()
+	return true
+}
+
+func (r *rampModel) Prevalence() float64 {
+	if r.steps > r.n {
+		return 0
+	}
+	return float64(r.steps) / float64(r.n)
+}
+
+// runUntil starts a run and returns the event completing it.
+func runUntil(t *testing.T, in chan<- api.Command, out <-chan api.Event, until api.Until) api.Event {
+	t.Helper()
+	if ev := send(t, in, out, api.NewRunCommand(until)); ev.Kind != api.StartedEvent {
+		t.Fatalf("run until %v: got %v", until, ev)
+	}
+	ev := <-out
+	if ev.Kind != api.CompletedEvent {
+		t.Fatalf("run until %v: got %v, want completed", until, ev)
+	}
+	return ev
+}
+
+func TestRunUntil(t *testing.T) {
+	_, in, out, done := startSimulation(context.Background(), &rampModel{finiteModel{IModel: NewSISModel(), n: 20}})
+
+	for _, c := range []struct {
+		until api.Until
+		step  string
+	}{
+		{api.Until{Steps: 7}, "step 7"},
+		{api.Until{Prevalence: 0.5}, "step 10"},
+		{api.Until{Extinct: true}, "step 21"},
+		{api.Until{Steps: 30, Prevalence: 0.25}, "step 5"},
+	} {
+		ev := runUntil(t, in, out, c.until)
+		status := send(t, in, out, api.NewCommand(api.StatusCommand)).Message
+		if !strings.HasPrefix(status, "completed, "+c.step+" ") {
+			t.Errorf("until %v: %q, status %q, want %s", c.until, ev.Message, status, c.step)
+		}
+	}
+
+	send(t, in, out, api.NewCommand(api.ExitCommand))
+	exited(t, done)
+}
+
+func TestRunUntilWithoutPrevalence(t *testing.T) {
+	sim, in, out, done := startSimulation(context.Background(), NewPercolationModel())
+
+	if ev := send(t, in, out, api.NewRunCommand(api.Until{Extinct: true})); ev.Kind != api.ErrorEvent {
+		t.Errorf("run until extinct: got %v", ev)
+	}
+	if got := sim.State(); got != Idle {
+		t.Errorf("state %v, want idle", got)
+	}
+	send(t, in, out, api.NewCommand(api.ExitCommand))
+	exited(t, done)
+}
+
+func TestSpeed(t *testing.T) {
+	_, in, out, done := startSimulation(context.Background(), NewSISModel())
+
+	speed := api.NewCommand(api.SpeedCommand)
+	speed.Value = 100
+	send(t, in, out, speed)
+
+	start := time.Now()
+	runUntil(t, in, out, api.Until{Steps: 20})
+	// The first step is due at once, the rest every 10 ms
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Errorf("20 steps at 100 steps/s took %v", d)
+	}
+
+	speed = api.NewCommand(api.SpeedCommand)
+	speed.Value = -1
+	if ev := send(t, in, out, speed); ev.Kind != api.ErrorEvent {
+		t.Errorf("negative speed: got %v", ev)
+	}
+	send(t, in, out, api.NewCommand(api.ExitCommand))
+	exited(t, done)
+}
+
+func TestRenderEvery(t *testing.T) {
+	sim, in, out, done := startSimulation(context.Background(), NewSISModel())
+	surface := sim.surface.(*testSurface)
+
+	render := api.NewCommand(api.RenderCommand)
+	render.Value = 10
+	send(t, in, out, render)
+	runUntil(t, in, out, api.Until{Steps: 35})
+	send(t, in, out, api.NewCommand(api.ExitCommand))
+	exited(t, done)
+
+	// Configure, run, steps 10, 20 and 30 and the final step 35
+	if surface.updates != 6 {
+		t.Errorf("%d updates, want 6", surface.updates)
+	}
+}
+
+// report waits for the report of a background job.
+func report(t *testing.T, out <-chan api.Event) api.Event {
+	t.Helper()
+	for {
+		select {
+		case ev := <-out:
+			if ev.Kind == api.ReportEvent || ev.Kind == api.ErrorEvent {
+				if ev.ID != 0 {
+					t.Fatalf("got %v with ID %d, want an unsolicited event", ev, ev.ID)
+				}
+				return ev
+			}
+		case <-time.After(30 * time.Second):
+			t.Fatal("no report")
+		}
+	}
+}
+
+// TestJobs runs sweeps in the background and checks they leave the
+// simulation's model alone. A long sweep doesn't hold up commands and
+// is cancelled on exit.
+func TestJobs(t *testing.T) {
+	for _, c := range []struct {
+		new     func() api.IModel
+		command string
+		lines   int
+	}{
+		{NewBootstrapModel, "bootstrap sweep 0.2 0.25 0.05 1", 3},
+		{NewPercolationModel, "perc sweep 0.5 0.7 0.1 2", 5},
+		{NewOpinionModel, "opinion consensus 2 3", 1},
+		{NewSISAwareModel, "aware sweep 0.1 0.2 0.1 2 5", 3},
+	} {
+		_, in, out, done := startSimulation(context.Background(), c.new())
+		send(t, in, out, api.NewModelCommand(strings.Fields(c.command)))
+		if ev := report(t, out); ev.Kind != api.ReportEvent || len(strings.Split(ev.Message, "\n")) != c.lines {
+			t.Errorf("%s: got %v, want %d lines", c.command, ev, c.lines)
+		}
+		if ev := send(t, in, out, api.NewCommand(api.StatusCommand)); !strings.HasPrefix(ev.Message, "idle, step 0") {
+			t.Errorf("%s stepped the simulation: %v", c.command, ev)
+		}
+		send(t, in, out, api.NewCommand(api.ExitCommand))
+		exited(t, done)
+	}
+
+	_, in, out, done := startSimulation(context.Background(), NewBootstrapModel())
+	send(t, in, out, api.NewModelCommand(strings.Fields("bootstrap sweep 0 1 0.001 100")))
+	runUntil(t, in, out, api.Until{Steps: 3})
+	send(t, in, out, api.NewCommand(api.ExitCommand))
+	exited(t, done)
+}
@@ -0,0 +1,226 @@
+package simulation
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Model snapshots are sequences of varints, so cell states take a
+// byte each. Floats are written as their bits. Per step series only
+// grow, so snapshots keep their lengths and a restore cuts them back.
+
+var errBadSnapshot = errors.New("snapshot doesn't match the model")
+
+// stateWriter builds a model snapshot.
+type stateWriter struct {
+	buf []byte
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (w *stateWriter) int(v int) {
+	n := binary.PutVarint(w.tmp[:], int64(v))
+	w.buf = append(w.buf, w.tmp[:n]...)
+}
+
+// ints writes the length of vs and its values.
+func (w *stateWriter) ints(vs []int) {
+	w.int(len(vs))
+	for _, v := range vs {
+		w.int(v)
+	}
+}
+
+func (w *stateWriter) bool(v bool) {
+	if v {
+		w.int(1)
+	} else {
+		w.int(0)
+	}
+}
+
+func (w *stateWriter) float(v float64) {
+	w.int(int(math.Float64bits(v)))
+}
+
+// floats writes the length of vs and its values.
+func (w *stateWriter) floats(vs []float64) {
+	w.int(len(vs))
+	for _, v := range vs {
+		w.float(v)
+	}
+}
+
+// bits writes the words of g.
+func (w *stateWriter) bits(g *BitGrid) {
+	w.int(len(g.bits))
+	for _, b := range g.bits {
+		w.int(int(b))
+	}
+}
+
+// cells writes every field of the cells of g.
+func (w *stateWriter) cells(g *Grid) {
+	w.int(len(g.cells))
+	for _, c := range g.cells {
+		w.int(c.degree)
+		w.int(c.state)
+		w.int(c.nextState)
+		w.int(c.timer)
+		w.float(c.threshold)
+	}
+}
+
+// cities writes where the cities of m are and how they move and grow.
+func (w *stateWriter) cities(m *cityMap) {
+	w.int(len(m.cities))
+	for _, c := range m.cities {
+		for _, v := range []float64{c.x, c.y, c.size, c.vx, c.vy, c.growth, c.minSize, c.maxSize} {
+			w.float(v)
+		}
+	}
+}
+
+// stateReader reads a snapshot written by stateWriter. The first error
+// is kept and later reads return zeros.
+type stateReader struct {
+	buf []byte
+	err error
+}
+
+func (r *stateReader) int() int {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = errBadSnapshot
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return int(v)
+}
+
+// count reads a count of the values that follow. Each value takes at
+// least a byte.
+func (r *stateReader) count() int {
+	n := r.int()
+	if n < 0 || n > len(r.buf) {
+		r.err = errBadSnapshot
+		return 0
+	}
+	return n
+}
+
+// ints reads values written by stateWriter.ints, which must number n.
+func (r *stateReader) ints(n int) []int {
+	if r.int() != n {
+		r.err = errBadSnapshot
+		return nil
+	}
+	vs := make([]int, n)
+	for i := range vs {
+		vs[i] = r.int()
+	}
+	return vs
+}
+
+func (r *stateReader) bool() bool {
+	return r.int() != 0
+}
+
+func (r *stateReader) float() float64 {
+	return math.Float64frombits(uint64(r.int()))
+}
+
+// floats reads values written by stateWriter.floats, which must number
+// n.
+func (r *stateReader) floats(n int) []float64 {
+	if r.int() != n {
+		r.err = errBadSnapshot
+		return nil
+	}
+	vs := make([]float64, n)
+	for i := range vs {
+		vs[i] = r.float()
+	}
+	return vs
+}
+
+// length reads the length of a series, which must be at most max, the
+// length it has grown to since.
+func (r *stateReader) length(max int) int {
+	n := r.int()
+	if n < 0 || n > max {
+		r.err = errBadSnapshot
+		return 0
+	}
+	return n
+}
+
+// bits reads the words written by stateWriter.bits for a grid like g.
+func (r *stateReader) bits(g *BitGrid) []uint64 {
+	if r.int() != len(g.bits) {
+		r.err = errBadSnapshot
+		return nil
+	}
+	bits := make([]uint64, len(g.bits))
+	for i := range bits {
+		bits[i] = uint64(r.int())
+	}
+	return bits
+}
+
+// cells reads the cells written by stateWriter.cells for a grid like g.
+func (r *stateReader) cells(g *Grid) []Cell {
+	if r.int() != len(g.cells) {
+		r.err = errBadSnapshot
+		return nil
+	}
+	cells := make([]Cell, len(g.cells))
+	for i := range cells {
+		c := &cells[i]
+		c.degree = r.int()
+		c.state = r.int()
+		c.nextState = r.int()
+		c.timer = r.int()
+		c.threshold = r.float()
+	}
+	return cells
+}
+
+// cities reads the cities written by stateWriter.cities for a map with
+// the cities of m, as copies to be set with setCities.
+func (r *stateReader) cities(m *cityMap) []City {
+	if r.int() != len(m.cities) {
+		r.err = errBadSnapshot
+		return nil
+	}
+	cities := make([]City, len(m.cities))
+	for i := range cities {
+		c := &cities[i]
+		for _, v := range []*float64{&c.x, &c.y, &c.size, &c.vx, &c.vy, &c.growth, &c.minSize, &c.maxSize} {
+			*v = r.float()
+		}
+	}
+	return cities
+}
+
+// setCities moves and sizes the cities of m as read by
+// stateReader.cities.
+func setCities(m *cityMap, cities []City) {
+	for i, c := range m.cities {
+		c.x, c.y, c.size = cities[i].x, cities[i].y, cities[i].size
+		c.vx, c.vy, c.growth = cities[i].vx, cities[i].vy, cities[i].growth
+		c.minSize, c.maxSize = cities[i].minSize, cities[i].maxSize
+	}
+}
+
+// done returns the first error, or an error if the snapshot has more
+// in it than was read.
+func (r *stateReader) done() error {
+	if r.err == nil && len(r.buf) > 0 {
+		return errBadSnapshot
+	}
+	return r.err
+}
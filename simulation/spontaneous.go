@@ -0,0 +1,229 @@
+package simulation
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Spontaneous introductions are configured with:
+//   spont rate <per cell rate>
+//   spont uniform
+//   spont hub <col> <row> <sigma> <strength>   adds a gaussian hotspot
+//   spont map <file.png>                       brighter = more intense
+//   spont stats                                introduced vs transmitted cases
+
+// SpontaneousProcess introduces infections independently of any
+// neighbors. Each cell is infected at a Poisson rate scaled by a
+// spatial intensity map, for example to concentrate introductions
+// near hubs.
+type SpontaneousProcess struct {
+	w, h int
+
+	// Expected introductions per cell per step
+	rate float64
+
+	// Per cell intensity indexed col*h+row. nil = uniform
+	intensity []float64
+	// Cumulative intensity used to sample introduction sites
+	cumulative []float64
+}
+
+func NewSpontaneousProcess(w, h int, rate float64) *SpontaneousProcess {
+	o := new(SpontaneousProcess)
+	o.w = w
+	o.h = h
+	o.rate = rate
+	return o
+}
+
+// introduce draws this step's introductions and calls infect for each
+// site. infect returns false if the site can't be infected. Returns
+// the number of cells infected.
+func (p *SpontaneousProcess) introduce(infect func(col, row int) bool) int {
+	total := float64(p.w * p.h)
+	if p.intensity != nil {
+		total = p.cumulative[len(p.cumulative)-1]
+	}
+
+	introduced := 0
+	for k := poisson(p.rate * total); k > 0; k-- {
+		i := rand.Intn(p.w * p.h)
+		if p.intensity != nil {
+			i = sort.SearchFloat64s(p.cumulative, rand.Float64()*total)
+			if i >= len(p.cumulative) {
+				i = len(p.cumulative) - 1
+			}
+		}
+		if infect(i/p.h, i%p.h) {
+			introduced++
+		}
+	}
+
+	return introduced
+}
+
+// addHub adds a gaussian hotspot to the intensity map. A uniform
+// map has an intensity of 1 everywhere.
+func (p *SpontaneousProcess) addHub(col, row int, sigma, strength float64) {
+	if p.intensity == nil {
+		p.intensity = make([]float64, p.w*p.h)
+		for i := range p.intensity {
+			p.intensity[i] = 1
+		}
+	}
+
+	for c := 0; c < p.w; c++ {
+		for r := 0; r < p.h; r++ {
+			d2 := float64((c-col)*(c-col) + (r-row)*(r-row))
+			p.intensity[c*p.h+r] += strength * math.Exp(-d2/(2*sigma*sigma))
+		}
+	}
+
+	p.accumulate()
+}
+
+// loadMap sets the intensity map from an image scaled to the grid.
+// Intensity is the pixel's brightness from 0 to 1.
+func (p *SpontaneousProcess) loadMap(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return err
+	}
+
+	b := img.Bounds()
+	p.intensity = make([]float64, p.w*p.h)
+	for c := 0; c < p.w; c++ {
+		for r := 0; r < p.h; r++ {
+			gray := color.GrayModel.Convert(img.At(b.Min.X+c*b.Dx()/p.w, b.Min.Y+r*b.Dy()/p.h)).(color.Gray)
+			p.intensity[c*p.h+r] = float64(gray.Y) / 255
+		}
+	}
+
+	p.accumulate()
+	if p.cumulative[len(p.cumulative)-1] == 0 {
+		p.intensity = nil
+		return fmt.Errorf("intensity map is black")
+	}
+
+	return nil
+}
+
+func (p *SpontaneousProcess) accumulate() {
+	p.cumulative = make([]float64, len(p.intensity))
+	sum := 0.0
+	for i, v := range p.intensity {
+		sum += v
+		p.cumulative[i] = sum
+	}
+}
+
+// event handles the "spont" commands. Returns false if the event
+// isn't one, and an error if it's a bad one.
+func (p *SpontaneousProcess) event(fields []string) (bool, error) {
+	if len(fields) < 2 || fields[0] != "spont" {
+		return false, nil
+	}
+
+	switch fields[1] {
+	case "rate":
+		args, err := parseFloats(fields[2:])
+		if err != nil || len(args) != 1 || args[0] < 0 {
+			return true, fmt.Errorf("usage: spont rate <per cell rate>")
+		}
+		p.rate = args[0]
+		fmt.Println("spontaneous rate: ", p.rate)
+	case "uniform":
+		p.intensity = nil
+		fmt.Println("spontaneous intensity: uniform")
+	case "hub":
+		args, err := parseFloats(fields[2:])
+		if err != nil || len(args) != 4 || args[2] <= 0 || args[3] < 0 {
+			return true, fmt.Errorf("usage: spont hub <col> <row> <sigma> <strength>")
+		}
+		p.addHub(int(args[0]), int(args[1]), args[2], args[3])
+		fmt.Println("spontaneous hub added")
+	case "map":
+		if len(fields) != 3 {
+			return true, fmt.Errorf("usage: spont map <file.png>")
+		}
+		if err := p.loadMap(dataPath(fields[2])); err != nil {
+			return true, fmt.Errorf("spontaneous map: %v", err)
+		}
+		fmt.Println("spontaneous intensity map: " + dataPath(fields[2]))
+	case "stats":
+		// Reported by the model
+		return false, nil
+	default:
+		return true, fmt.Errorf("unknown spont command: %s", strings.Join(fields, " "))
+	}
+
+	return true, nil
+}
+
+// poisson draws a Poisson distributed count. Large means use the
+// normal approximation.
+func poisson(mean float64) int {
+	if mean <= 0 {
+		return 0
+	}
+
+	if mean > 30 {
+		k := int(math.Round(mean + math.Sqrt(mean)*rand.NormFloat64()))
+		if k < 0 {
+			return 0
+		}
+		return k
+	}
+
+	l := math.Exp(-mean)
+	k := 0
+	for p := rand.Float64(); p > l; p *= rand.Float64() {
+		k++
+	}
+	return k
+}
+
+// caseCounts keeps introduced cases apart from locally transmitted
+// ones, per step.
+type caseCounts struct {
+	introduced  []float64
+	transmitted []float64
+}
+
+func (c *caseCounts) reset() {
+	c.introduced = []float64{}
+	c.transmitted = []float64{}
+}
+
+func (c *caseCounts) record(introduced, transmitted int) {
+	c.introduced = append(c.introduced, float64(introduced))
+	c.transmitted = append(c.transmitted, float64(transmitted))
+}
+
+func (c *caseCounts) toString() string {
+	ti, tt := 0.0, 0.0
+	for i := range c.introduced {
+		ti += c.introduced[i]
+		tt += c.transmitted[i]
+	}
+
+	n := len(c.introduced)
+	if n == 0 || ti+tt == 0 {
+		return "no cases"
+	}
+
+	return fmt.Sprintf("introduced: %g (%.2f/step), transmitted: %g (%.2f/step), introduced fraction: %.4f",
+		ti, ti/float64(n), tt, tt/float64(n), ti/(ti+tt))
+}
@@ -0,0 +1,220 @@
+package simulation
+
+import "fmt"
+
+// frontier lists the active cells of a grid, so a sparse step can
+// visit them and the cells they reach instead of scanning the grid.
+// Far below the threshold almost every cell is inactive so a step
+// costs next to nothing.
+type frontier struct {
+	// Indices of the active cells
+	active []int
+	// Indices of the other cells visited this step
+	touched []int
+	// Indices of the cells that changed in the last update
+	changed []int
+}
+
+// reset empties the frontier.
+func (f *frontier) reset() {
+	f.active = f.active[:0]
+	f.touched = f.touched[:0]
+	f.changed = f.changed[:0]
+}
+
+// rebuild sets the frontier to the indices below n that are active.
+func (f *frontier) rebuild(n int, active func(i int) bool) {
+	f.reset()
+	for i := 0; i < n; i++ {
+		if active(i) {
+			f.active = append(f.active, i)
+		}
+	}
+}
+
+// update calls apply for the active and the touched cells and makes
+// the frontier the ones it reports active. apply also reports if the
+// cell changed.
+func (f *frontier) update(apply func(i int) (active, changed bool)) {
+	f.changed = f.changed[:0]
+
+	// The frontier is compacted in place
+	next := f.active[:0]
+	for _, list := range [][]int{f.active, f.touched} {
+		for _, i := range list {
+			active, changed := apply(i)
+			if active {
+				next = append(next, i)
+			}
+			if changed {
+				f.changed = append(f.changed, i)
+			}
+		}
+	}
+	f.active = next
+	f.touched = f.touched[:0]
+}
+
+// clone returns a copy of the frontier.
+func (f *frontier) clone() frontier {
+	return frontier{
+		active:  append([]int(nil), f.active...),
+		touched: append([]int(nil), f.touched...),
+		changed: append([]int(nil), f.changed...),
+	}
+}
+
+// gridStepper steps the cells of a Grid in concurrent tiles. Each cell
+// works out its own next state, pulling infections from the neighbors
+// that reach it, so a tile never writes the cells of another.
+//
+// Sparse mode only visits the active cells and the cells they reach,
+// on the random stream of the first tile. Which cells are active is up
+// to the model: they must include every cell that can change without
+// a neighbor and every cell that can change a neighbor.
+type gridStepper struct {
+	cells *Grid
+	tiles *TileGrid
+	// Per tile counts added by the step function, e.g. infections
+	counts []int
+
+	active   func(c *Cell) bool
+	sparse   bool
+	frontier frontier
+	// Cells visited this step in sparse mode
+	visited *BitGrid
+}
+
+func newGridStepper(cells *Grid, active func(c *Cell) bool) *gridStepper {
+	o := new(gridStepper)
+	o.cells = cells
+	o.tiles = NewTileGrid(cells.w, cells.h, tileSize)
+	o.counts = make([]int, len(o.tiles.tiles))
+	o.active = active
+	o.visited = NewBitGrid(cells.w, cells.h)
+	return o
+}
+
+// seed restarts the tiles' random streams from seed.
+func (g *gridStepper) seed(seed int64) {
+	g.tiles.seed(seed)
+}
+
+// setSparse switches between scanning the grid and visiting only the
+// active cells.
+func (g *gridStepper) setSparse(sparse bool) {
+	g.sparse = sparse
+	g.rebuild()
+}
+
+// rebuild finds the active cells again after the cells were set, e.g.
+// by a reset or a restore.
+func (g *gridStepper) rebuild() {
+	g.visited.clear()
+	if !g.sparse {
+		g.frontier.reset()
+		return
+	}
+	g.frontier.rebuild(len(g.cells.cells), func(i int) bool {
+		return g.active(&g.cells.cells[i])
+	})
+}
+
+// touch adds col,row to the cells updated this step, for a cell set
+// outside of the step function such as a spontaneous infection.
+func (g *gridStepper) touch(col, row int) {
+	if !g.sparse || !g.cells.in(col, row) || g.visited.get(col, row) {
+		return
+	}
+	g.visited.set(col, row, true)
+	g.frontier.touched = append(g.frontier.touched, g.cells.index(col, row))
+}
+
+// step calls fn for every cell with the tile it's in and returns the
+// sum of the counts fn added. fn may only write its own cell and the
+// count of its tile.
+func (g *gridStepper) step(fn func(t *Tile, col, row int)) int {
+	if g.sparse {
+		g.stepSparse(fn)
+	} else {
+		g.tiles.run(func(t *Tile) {
+			g.counts[t.index] = 0
+			for col := t.x0; col < t.x1; col += 1 {
+				for row := t.y0; row < t.y1; row += 1 {
+					fn(t, col, row)
+				}
+			}
+		})
+	}
+
+	n := 0
+	for _, c := range g.counts {
+		n += c
+	}
+	return n
+}
+
+// stepSparse calls fn for the active cells and the cells they reach.
+func (g *gridStepper) stepSparse(fn func(t *Tile, col, row int)) {
+	for i := range g.counts {
+		g.counts[i] = 0
+	}
+
+	h := g.cells.h
+	for _, i := range g.frontier.active {
+		g.visited.set(i/h, i%h, true)
+	}
+	for _, i := range g.frontier.active {
+		for _, n := range neighbors(g.cells.cells[i].degree) {
+			g.touch(i/h+n[0], i%h+n[1])
+		}
+	}
+
+	t := g.tiles.tiles[0]
+	for _, list := range [][]int{g.frontier.active, g.frontier.touched} {
+		for _, i := range list {
+			fn(t, i/h, i%h)
+		}
+	}
+}
+
+// update copies the next states to the states and calls fn for every
+// cell with the state it had before. In sparse mode that's only the
+// cells visited this step, the others can't have changed.
+func (g *gridStepper) update(fn func(col, row, was int)) {
+	if g.sparse {
+		h := g.cells.h
+		g.frontier.update(func(i int) (bool, bool) {
+			c := &g.cells.cells[i]
+			g.visited.set(i/h, i%h, false)
+			was := c.state
+			c.state = c.nextState
+			fn(i/h, i%h, was)
+			return g.active(c), c.state != was
+		})
+		return
+	}
+
+	for col := 0; col < g.cells.w; col += 1 {
+		for row := 0; row < g.cells.h; row += 1 {
+			c := g.cells.at(col, row)
+			was := c.state
+			c.state = c.nextState
+			fn(col, row, was)
+		}
+	}
+}
+
+// event handles "sparse <on|off>". Returns false if the event isn't
+// one, and an error if it's a bad one.
+func (g *gridStepper) event(fields []string) (bool, error) {
+	if len(fields) == 0 || fields[0] != "sparse" {
+		return false, nil
+	}
+	if len(fields) != 2 || (fields[1] != "on" && fields[1] != "off") {
+		return true, fmt.Errorf("usage: sparse <on|off>")
+	}
+	g.setSparse(fields[1] == "on")
+	fmt.Println("sparse stepping: ", fields[1])
+	return true, nil
+}
@@ -0,0 +1,104 @@
+package simulation
+
+import (
+	"fmt"
+	"image/color"
+)
+
+// maxStrains is limited by the bits of a strain mask.
+const maxStrains = 8
+
+// Interaction between strains when a cell is already infected.
+const (
+	// An infected cell can't be infected by another strain
+	exclusiveInfection = iota
+	// A more transmissible strain can replace the current one
+	superInfection
+	// A cell can carry several strains at once
+	coInfection
+)
+
+var infectionModes = []string{"exclusive", "superinfection", "coinfection"}
+
+var strainColors = []color.RGBA{
+	{R: 220, G: 0, B: 0, A: 255},
+	{R: 0, G: 0, B: 255, A: 255},
+	{R: 0, G: 170, B: 0, A: 255},
+	{R: 255, G: 140, B: 0, A: 255},
+	{R: 140, G: 0, B: 200, A: 255},
+	{R: 0, G: 190, B: 190, A: 255},
+	{R: 230, G: 0, B: 180, A: 255},
+	{R: 200, G: 200, B: 0, A: 255},
+}
+
+// Strain is one variant of the infection with its own transmissibility
+// and recovery rate.
+type Strain struct {
+	color color.RGBA
+
+	// The chance of infecting a susceptible neighbor per step
+	transmit float64
+	// The chance of recovering per step
+	recover float64
+}
+
+func NewStrain(index int, transmit, recover float64) *Strain {
+	o := new(Strain)
+	o.color = strainColors[index%len(strainColors)]
+	o.transmit = transmit
+	o.recover = recover
+	return o
+}
+
+func (s *Strain) toString() string {
+	return fmt.Sprintf("transmit: %.3f, recover: %.3f", s.transmit, s.recover)
+}
+
+// StrainCell holds the strains infecting a cell and the strains it has
+// recovered from as bit masks.
+type StrainCell struct {
+	strains     uint8
+	nextStrains uint8
+	memory      uint8
+
+	// Strains that tried to infect the cell this step. Used to pick
+	// one at random in exclusive mode.
+	offers int
+}
+
+// mixColors averages the colors of the strains in mask.
+func mixColors(strains []*Strain, mask uint8) color.RGBA {
+	r, g, b, n := 0, 0, 0, 0
+	for i, s := range strains {
+		if mask&(1<<i) != 0 {
+			r += int(s.color.R)
+			g += int(s.color.G)
+			b += int(s.color.B)
+			n++
+		}
+	}
+	return color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: 255}
+}
+
+// strainCount returns the number of strains in mask.
+func strainCount(mask uint8) int {
+	n := 0
+	for ; mask != 0; mask &= mask - 1 {
+		n++
+	}
+	return n
+}
+
+// StrainGrid is a grid of StrainCells.
+type StrainGrid struct {
+	Dims
+	cells []StrainCell
+}
+
+func NewStrainGrid(w, h int) *StrainGrid {
+	return &StrainGrid{Dims: Dims{w: w, h: h}, cells: make([]StrainCell, w*h)}
+}
+
+func (g *StrainGrid) at(col, row int) *StrainCell {
+	return &g.cells[g.index(col, row)]
+}
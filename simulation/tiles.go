@@ -0,0 +1,84 @@
+package simulation
+
+import (
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// tileSize is the default width and height of a tile in cells.
+const tileSize = 64
+
+// Tile is a rectangle of cells [x0,x1) x [y0,y1) stepped by a single
+// goroutine with its own random stream.
+type Tile struct {
+	index  int
+	x0, y0 int
+	x1, y1 int
+	rng    *rand.Rand
+}
+
+// TileGrid splits a grid into tiles that are stepped concurrently.
+// A tile may only write the next-state of its own cells. Because each
+// tile draws from its own stream in a fixed order, the results don't
+// depend on the number of goroutines (GOMAXPROCS).
+//
+// The SIS, SIR, SISa, immunity, SIS city and dynamic correlation
+// models step in tiles. The other grid models draw from the global
+// random stream in scan order, so they step on one goroutine.
+type TileGrid struct {
+	tiles []*Tile
+}
+
+func NewTileGrid(w, h, size int) *TileGrid {
+	o := new(TileGrid)
+	for x := 0; x < w; x += size {
+		for y := 0; y < h; y += size {
+			o.tiles = append(o.tiles, &Tile{index: len(o.tiles), x0: x, y0: y, x1: minInt(x+size, w), y1: minInt(y+size, h)})
+		}
+	}
+	o.seed(0)
+	return o
+}
+
+// seed restarts every tile's random stream from seed.
+func (g *TileGrid) seed(seed int64) {
+	for i, t := range g.tiles {
+		t.rng = rand.New(rand.NewSource(int64(splitMix64(uint64(seed) + uint64(i)))))
+	}
+}
+
+// run calls fn for every tile using up to GOMAXPROCS goroutines and
+// returns when all tiles are done.
+func (g *TileGrid) run(fn func(t *Tile)) {
+	workers := minInt(runtime.GOMAXPROCS(0), len(g.tiles))
+	if workers <= 1 {
+		for _, t := range g.tiles {
+			fn(t)
+		}
+		return
+	}
+
+	var next int64 = -1
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := atomic.AddInt64(&next, 1); j < int64(len(g.tiles)); j = atomic.AddInt64(&next, 1) {
+				fn(g.tiles[j])
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// splitMix64 scrambles x so that consecutive tile indexes seed
+// unrelated streams.
+func splitMix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
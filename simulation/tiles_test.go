@@ -0,0 +1,102 @@
+package simulation
+
+import (
+	"Netron1-Go/api"
+	"Netron1-Go/raster"
+	"bytes"
+	"runtime"
+	"testing"
+)
+
+// runTiled steps a fresh model, after sending it events, and returns
+// its snapshot.
+func runTiled(new func() api.IModel, procs, steps int, events []string) []byte {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+
+	m := new()
+	mp := m.Properties()
+	m.Configure(raster.NewRasterBuffer(mp.Width(), mp.Height()))
+	for _, event := range events {
+		m.SendEvent(event)
+	}
+	m.Reset()
+	for i := 0; i < steps; i++ {
+		m.Step()
+	}
+	return m.(api.ISnapshot).Snapshot()
+}
+
+func TestTilesDeterministic(t *testing.T) {
+	for _, c := range []struct {
+		new    func() api.IModel
+		events []string
+	}{
+		{NewSISDynCorrModel, []string{"flow trail"}},
+		{NewSISDynCorrModel, []string{"flow bidirectional"}},
+		{NewSISCityModel, nil},
+		{NewSISModel, nil},
+		{NewSIRModel, nil},
+		{NewSISaModel, nil},
+		{NewSISimmuModel, nil},
+		{NewSISimmuModel, []string{"immu dist gamma 20 0.5"}},
+	} {
+		want := runTiled(c.new, 1, 20, c.events)
+		got := runTiled(c.new, 4, 20, c.events)
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s %v: state with 4 procs differs from 1", c.new().Name(), c.events)
+		}
+	}
+}
+
+func TestTileGridCoversGrid(t *testing.T) {
+	g := NewTileGrid(130, 70, 64)
+	covered := make([][]int, 130)
+	for i := range covered {
+		covered[i] = make([]int, 70)
+	}
+
+	g.run(func(tile *Tile) {
+		for col := tile.x0; col < tile.x1; col++ {
+			for row := tile.y0; row < tile.y1; row++ {
+				covered[col][row]++
+			}
+		}
+	})
+
+	for col := range covered {
+		for row := range covered[col] {
+			if covered[col][row] != 1 {
+				t.Fatalf("cell [%d,%d] stepped %d times", col, row, covered[col][row])
+			}
+		}
+	}
+}
+
+// Run with -cpu 1,2,4 to compare the speedup.
+func BenchmarkSISDynCorrStep(b *testing.B) {
+	m := NewSISDynCorrModel()
+	mp := m.Properties()
+	m.Configure(raster.NewRasterBuffer(mp.Width(), mp.Height()))
+	m.Reset()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !m.Step() {
+			m.Reset()
+		}
+	}
+}
+
+func BenchmarkSISCityStep(b *testing.B) {
+	m := NewSISCityModel()
+	mp := m.Properties()
+	m.Configure(raster.NewRasterBuffer(mp.Width(), mp.Height()))
+	m.Reset()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !m.Step() {
+			m.Reset()
+		}
+	}
+}